@@ -0,0 +1,164 @@
+package latvis
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ======================================
+// =========== ADMIN HANDLERS ===========
+// ======================================
+
+// Admin requests must carry the token given to Environment.EnableAdmin, as
+// "Authorization: Bearer <token>".  Without one, the admin pages don't exist.
+func checkAdmin(env *Environment, response http.ResponseWriter, request *http.Request) bool {
+	if env.adminToken == "" {
+		http.NotFound(response, request)
+		return false
+	}
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(env.adminToken)) != 1 {
+		response.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(response, "Not authorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Manages the stored images:
+//   - GET /admin/blobs lists them (as JSON BlobInfos, newest first).
+//   - DELETE /admin/blobs/<handle>.json deletes one.
+func AdminBlobsHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+	if !checkAdmin(env, response, request) {
+		return
+	}
+
+	if request.URL.Path == "/admin/blobs" || request.URL.Path == "/admin/blobs/" {
+		if request.Method != "GET" {
+			http.Error(response, "Listing blobs needs a GET", http.StatusMethodNotAllowed)
+			return
+		}
+		infos, err := env.blobStore.List()
+		if err != nil {
+			serveErrorWithLabel(response, "AdminBlobsHandler/List error", err)
+			return
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Created.After(infos[j].Created) })
+		serveJson(response, infos)
+		return
+	}
+
+	if request.Method != "DELETE" {
+		http.Error(response, "Deleting a blob needs a DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	handle, err := parseHandleFromUrl(strings.TrimPrefix(request.URL.Path, "/admin"))
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := env.blobStore.Delete(handle); err != nil {
+		serveErrorWithLabel(response, "AdminBlobsHandler/Delete error", err)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// Sweeps the BlobStore now, in response to a POST to /admin/sweep, and
+// responds with the SweepResult as JSON.
+func AdminSweepHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+	if !checkAdmin(env, response, request) {
+		return
+	}
+	if request.Method != "POST" {
+		http.Error(response, "Sweeping needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if env.blobSweeper == nil {
+		http.Error(response, "No blob sweeper is configured", http.StatusNotFound)
+		return
+	}
+
+	result, err := env.blobSweeper.Sweep()
+	if err != nil {
+		serveErrorWithLabel(response, "AdminSweepHandler/Sweep error", err)
+		return
+	}
+	serveJson(response, result)
+}
+
+// Manages the render tasks, if they're queued in a DurableUrlTaskQueue:
+//   - GET /admin/tasks lists them (as JSON TaskInfos, oldest first).
+//   - POST /admin/tasks/<id> requeues a dead one.
+//   - DELETE /admin/tasks/<id> discards one which isn't running.
+func AdminTasksHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+	if !checkAdmin(env, response, request) {
+		return
+	}
+	queue, ok := env.taskQueue.(*DurableUrlTaskQueue)
+	if !ok {
+		http.Error(response, "The task queue can't be managed", http.StatusNotFound)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(request.URL.Path, "/admin/tasks"), "/")
+	if id == "" {
+		if request.Method != "GET" {
+			http.Error(response, "Listing tasks needs a GET", http.StatusMethodNotAllowed)
+			return
+		}
+		serveJson(response, queue.Tasks())
+		return
+	}
+
+	var err error
+	switch request.Method {
+	case "POST":
+		err = queue.Requeue(id)
+	case "DELETE":
+		err = queue.Discard(id)
+	default:
+		http.Error(response, "Requeueing a task needs a POST, and discarding one a DELETE",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, ErrNoSuchTask) {
+		http.NotFound(response, request)
+		return
+	}
+	if errors.Is(err, ErrTaskNotDead) || errors.Is(err, ErrTaskIsLeased) {
+		http.Error(response, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		serveErrorWithLabel(response, "AdminTasksHandler error", err)
+		return
+	}
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// Serves counters for monitoring, as JSON, in response to a GET to
+// /admin/stats.  For now, that's just "blob_cache" (BlobCacheStats), if the
+// BlobStore is an LRUBlobStore.
+func AdminStatsHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+	if !checkAdmin(env, response, request) {
+		return
+	}
+	if request.Method != "GET" {
+		http.Error(response, "Stats need a GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := map[string]interface{}{}
+	if cache, ok := env.blobStore.(*LRUBlobStore); ok {
+		stats["blob_cache"] = cache.Stats()
+	}
+	serveJson(response, stats)
+}
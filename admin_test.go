@@ -0,0 +1,188 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, handler http.HandlerFunc, method, url, token string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest(method, url, nil)
+	gt.AssertNil(t, err)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response := httptest.NewRecorder()
+	handler(response, request)
+	return response
+}
+
+func TestAdminNeedsToken(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	env := NewEnvironment(blobStore, nil, nil, nil, nil)
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(env))
+
+	gt.AssertEqualM(t, http.StatusNotFound,
+		adminRequest(t, AdminBlobsHandler, "GET", "http://myhost.com/admin/blobs", "").Code,
+		"Admin pages are off by default")
+
+	env.EnableAdmin("sesame")
+	gt.AssertEqual(t, http.StatusUnauthorized,
+		adminRequest(t, AdminBlobsHandler, "GET", "http://myhost.com/admin/blobs", "").Code)
+	gt.AssertEqual(t, http.StatusUnauthorized,
+		adminRequest(t, AdminBlobsHandler, "GET", "http://myhost.com/admin/blobs", "sesam").Code)
+	gt.AssertEqual(t, http.StatusUnauthorized,
+		adminRequest(t, AdminSweepHandler, "POST", "http://myhost.com/admin/sweep", "").Code)
+	gt.AssertEqual(t, http.StatusOK,
+		adminRequest(t, AdminBlobsHandler, "GET", "http://myhost.com/admin/blobs", "sesame").Code)
+}
+
+func TestAdminBlobs(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	env := NewEnvironment(blobStore, nil, nil, nil, nil)
+	env.EnableAdmin("sesame")
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(env))
+
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	gt.AssertNil(t, blobStore.Store(h, &Blob{Data: []byte("png")}))
+
+	res := adminRequest(t, AdminBlobsHandler, "GET", "http://myhost.com/admin/blobs", "sesame")
+	gt.AssertEqual(t, http.StatusOK, res.Code)
+	infos := []*BlobInfo{}
+	gt.AssertNil(t, json.Unmarshal(res.Body.Bytes(), &infos))
+	gt.AssertEqual(t, 1, len(infos))
+	gt.AssertEqual(t, *h, *infos[0].Handle)
+	gt.AssertEqual(t, int64(3), infos[0].Size)
+
+	blobUrl := "http://myhost.com/admin" + serializeHandleToUrl(h, "json", "blobs")
+	gt.AssertEqual(t, http.StatusMethodNotAllowed,
+		adminRequest(t, AdminBlobsHandler, "GET", blobUrl, "sesame").Code)
+	gt.AssertEqual(t, http.StatusBadRequest,
+		adminRequest(t, AdminBlobsHandler, "DELETE", "http://myhost.com/admin/blobs/100-1-2-3.json", "sesame").Code)
+	gt.AssertEqual(t, http.StatusNoContent,
+		adminRequest(t, AdminBlobsHandler, "DELETE", blobUrl, "sesame").Code)
+	_, err := blobStore.Fetch(h)
+	gt.AssertNotNil(t, err)
+}
+
+func TestAdminSweep(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	env := NewEnvironment(blobStore, nil, nil, nil, nil)
+	env.EnableAdmin("sesame")
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(env))
+
+	gt.AssertEqualM(t, http.StatusNotFound,
+		adminRequest(t, AdminSweepHandler, "POST", "http://myhost.com/admin/sweep", "sesame").Code,
+		"No sweeper")
+
+	gt.AssertNil(t, blobStore.Store(&Handle{timestamp: 100, n1: 1}, &Blob{Data: []byte("old")}))
+	sweeper := StartBlobSweeper(blobStore, BlobSweeperOptions{DefaultTTL: time.Hour, Interval: time.Hour})
+	defer sweeper.Close()
+	env.UseBlobSweeper(sweeper)
+
+	gt.AssertEqual(t, http.StatusMethodNotAllowed,
+		adminRequest(t, AdminSweepHandler, "GET", "http://myhost.com/admin/sweep", "sesame").Code)
+	res := adminRequest(t, AdminSweepHandler, "POST", "http://myhost.com/admin/sweep", "sesame")
+	gt.AssertEqual(t, http.StatusOK, res.Code)
+	result := &SweepResult{}
+	gt.AssertNil(t, json.Unmarshal(res.Body.Bytes(), result))
+	gt.AssertEqual(t, 0, result.Remaining)
+}
+
+func TestAdminStats(t *testing.T) {
+	cache := NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 1000})
+	env := NewEnvironment(cache, nil, nil, nil, nil)
+	env.EnableAdmin("sesame")
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(env))
+
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	gt.AssertNil(t, cache.Store(h, &Blob{Data: []byte("png")}))
+	_, err := cache.Fetch(h)
+	gt.AssertNil(t, err)
+
+	gt.AssertEqual(t, http.StatusUnauthorized,
+		adminRequest(t, AdminStatsHandler, "GET", "http://myhost.com/admin/stats", "").Code)
+	res := adminRequest(t, AdminStatsHandler, "GET", "http://myhost.com/admin/stats", "sesame")
+	gt.AssertEqual(t, http.StatusOK, res.Code)
+	stats := map[string]BlobCacheStats{}
+	gt.AssertNil(t, json.Unmarshal(res.Body.Bytes(), &stats))
+	gt.AssertEqual(t, BlobCacheStats{Hits: 1, Blobs: 1, Bytes: 3, MaxBytes: 1000}, stats["blob_cache"])
+}
+
+func TestAdminTasks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	options := fastTaskQueueOptions()
+	options.MaxAttempts = 1
+	queue := newTestDurableUrlTaskQueue(t, dir, options)
+	defer queue.Close(time.Second)
+	fail := true
+	var mutex sync.Mutex
+	queue.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if fail {
+			http.Error(response, "broken", http.StatusInternalServerError)
+		}
+	})
+	gt.AssertNil(t, queue.Enqueue("/work", &url.Values{"k": []string{"v"}}))
+	waitForTasks(t, queue, func(tasks []TaskInfo) bool { return len(tasks) == 1 && tasks[0].State == TASK_DEAD })
+
+	env := NewEnvironment(nil, nil, queue, nil, nil)
+	env.EnableAdmin("sesame")
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(env))
+
+	gt.AssertEqual(t, http.StatusUnauthorized,
+		adminRequest(t, AdminTasksHandler, "GET", "http://myhost.com/admin/tasks", "").Code)
+	res := adminRequest(t, AdminTasksHandler, "GET", "http://myhost.com/admin/tasks", "sesame")
+	gt.AssertEqual(t, http.StatusOK, res.Code)
+	gt.AssertTrueM(t, strings.Contains(res.Body.String(), `"last_error":"Status 500`), res.Body.String())
+	tasks := []TaskInfo{}
+	gt.AssertNil(t, json.Unmarshal(res.Body.Bytes(), &tasks))
+	gt.AssertEqual(t, 1, len(tasks))
+	gt.AssertEqual(t, "v", tasks[0].Params.Get("k"))
+	taskUrl := "http://myhost.com/admin/tasks/" + tasks[0].Id
+
+	gt.AssertEqual(t, http.StatusNotFound,
+		adminRequest(t, AdminTasksHandler, "POST", "http://myhost.com/admin/tasks/nonesuch", "sesame").Code)
+	gt.AssertEqual(t, http.StatusMethodNotAllowed,
+		adminRequest(t, AdminTasksHandler, "PUT", taskUrl, "sesame").Code)
+
+	mutex.Lock()
+	fail = false
+	mutex.Unlock()
+	gt.AssertEqual(t, http.StatusNoContent, adminRequest(t, AdminTasksHandler, "POST", taskUrl, "sesame").Code)
+	waitForTasks(t, queue, func(tasks []TaskInfo) bool { return len(tasks) == 0 })
+	gt.AssertEqualM(t, http.StatusNotFound,
+		adminRequest(t, AdminTasksHandler, "DELETE", taskUrl, "sesame").Code, "Already done")
+
+	mutex.Lock()
+	fail = true
+	mutex.Unlock()
+	gt.AssertNil(t, queue.Enqueue("/work", &url.Values{}))
+	tasks = waitForTasks(t, queue, func(tasks []TaskInfo) bool { return len(tasks) == 1 && tasks[0].State == TASK_DEAD })
+	gt.AssertEqual(t, http.StatusNoContent,
+		adminRequest(t, AdminTasksHandler, "DELETE", "http://myhost.com/admin/tasks/"+tasks[0].Id, "sesame").Code)
+	gt.AssertEqual(t, 0, len(queue.Tasks()))
+
+	other := NewEnvironment(nil, nil, &MockTaskQueue{}, nil, nil)
+	other.EnableAdmin("sesame")
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(other))
+	gt.AssertEqualM(t, http.StatusNotFound,
+		adminRequest(t, AdminTasksHandler, "GET", "http://myhost.com/admin/tasks", "sesame").Code,
+		"Only durable queues can be managed")
+}
@@ -1,11 +1,19 @@
 package latvis
 
 import (
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -14,41 +22,281 @@ import (
 // ======================================
 
 type Blob struct {
-	Data []byte
+	Data []byte `json:"-"`
+
+	// e.g. "image/png".  Empty means DEFAULT_BLOB_CONTENT_TYPE.
+	ContentType string `json:"content_type,omitempty"`
+
+	// When the blob was made.  BlobStores fill it in if it's zero.
+	Created time.Time `json:"created"`
+
+	// The request the blob was rendered for, if any.
+	Request *RenderRequest `json:"request,omitempty"`
+
+	// Anything else worth keeping with the blob.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// When the blob may be deleted (see SweepBlobs).  Zero means it lasts as
+	// long as the sweeper's DefaultTTL.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Blobs were all PNGs before they had a ContentType.
+const DEFAULT_BLOB_CONTENT_TYPE = "image/png"
+
+func (b *Blob) contentType() string {
+	if b.ContentType == "" {
+		return DEFAULT_BLOB_CONTENT_TYPE
+	}
+	return b.ContentType
 }
 
+// A handle is all it takes to fetch the image it names, so the three random
+// numbers have to be unguessable (see GenerateHandle).
 type Handle struct {
 	timestamp  int64
 	n1, n2, n3 int64
 }
 
+// The number of bytes in a handle (as encoded by String).
+const HANDLE_BYTES = 32
+
+// Handles are written as the URL-safe base64 of their four numbers, e.g. in
+// URLs (see serializeHandleToUrl).
 func (h *Handle) String() string {
-	return fmt.Sprintf("%d-%d%d%d", h.timestamp, h.n1, h.n2, h.n3)
+	return base64.RawURLEncoding.EncodeToString(h.bytes())
+}
+
+func (h *Handle) bytes() []byte {
+	b := make([]byte, HANDLE_BYTES)
+	for i, n := range []int64{h.timestamp, h.n1, h.n2, h.n3} {
+		binary.BigEndian.PutUint64(b[8*i:], uint64(n))
+	}
+	return b
+}
+
+func (h *Handle) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// Also accepts the "<timestamp>-<n1>-<n2>-<n3>" form handles used to be
+// written in, so that metadata stored back then can still be read.
+func (h *Handle) UnmarshalText(text []byte) error {
+	parsed, err := parseHandleString(string(text))
+	if err != nil {
+		var legacyErr error
+		if parsed, legacyErr = parseStorageKey(string(text)); legacyErr != nil {
+			return err
+		}
+	}
+	*h = *parsed
+	return nil
+}
+
+// How BlobStores which are keyed by strings (e.g. BoltBlobStore) name the
+// handle.  This is the handles' original text format, which stays the same so
+// that blobs stored under it can still be found.
+func (h *Handle) storageKey() string {
+	return fmt.Sprintf("%d-%d-%d-%d", h.timestamp, h.n1, h.n2, h.n3)
+}
+
+func parseStorageKey(key string) (*Handle, error) {
+	pieces := strings.Split(key, "-")
+	if len(pieces) != 4 {
+		return nil, errors.New("Invalid handle: " + key)
+	}
+	var n [4]int64
+	for i, piece := range pieces {
+		var err error
+		if n[i], err = strconv.ParseInt(piece, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return &Handle{timestamp: n[0], n1: n[1], n2: n[2], n3: n[3]}, nil
+}
+
+// The handle the image rendered for 'h' is stored under.  It can be worked out
+// from 'h', but not the other way round, so sharing the image (see
+// SharedImageHandler) doesn't give away 'h', with which its owner can fetch
+// it forever.
+func (h *Handle) imageHandle() *Handle {
+	sum := sha256.Sum256(append([]byte("latvis image:"), h.bytes()...))
+	return &Handle{
+		timestamp: h.timestamp,
+		n1:        randomInt63(sum[0:8]),
+		n2:        randomInt63(sum[8:16]),
+		n3:        randomInt63(sum[16:24]),
+	}
+}
+
+// When the handle was generated.
+func (h *Handle) Time() time.Time {
+	return time.Unix(h.timestamp, 0)
 }
 
 type BlobStore interface {
-	// Stores a blob, identified by the Handle, to the BlobStore.
-	// Storing a second blob with the same handle will overwrite the first one.
+	// Stores a blob, and everything about it, identified by the Handle, to
+	// the BlobStore.  Storing a second blob with the same handle will
+	// overwrite the first one.  Errors are *BlobErrors.
 	Store(handle *Handle, blob *Blob) error
 
-	// Fetches the blob with the given handle.
-	// TODO(mrjones): distinguish true error from missing blob?
+	// Fetches the blob (and everything about it) with the given handle.  If
+	// it can't, the error is a *BlobError, and tells a blob which isn't there
+	// (yet) apart from one which can't be read (see ErrNoSuchBlob, etc.).
 	Fetch(handle *Handle) (*Blob, error)
+
+	// Deletes the blob with the given handle.  Deleting a blob which doesn't
+	// exist isn't an error, and other errors are *BlobErrors.
+	Delete(handle *Handle) error
+
+	// Describes every blob in the store, in no particular order.
+	List() ([]*BlobInfo, error)
 }
 
+// Implemented by BlobStores whose blobs can be fetched straight from
+// somewhere else, so that RenderHandler can send clients there instead of
+// passing the data through.
+type BlobURLStore interface {
+	BlobStore
+
+	// Returns a URL which the blob can be fetched from, or "" if there isn't
+	// one (in which case the blob should be fetched as usual).
+	BlobURL(handle *Handle) (string, error)
+}
+
+// Implemented by BlobStores which can describe a blob much more cheaply than
+// fetching it (e.g. without reading, or downloading, its data), for finding
+// out whether it's there.  Use statBlob to describe blobs in any BlobStore.
+type BlobStatStore interface {
+	BlobStore
+
+	// Describes the blob, as List would, or fails with ErrNoSuchBlob.  Unlike
+	// Fetch, this doesn't count as using the blob (see BlobInfo.LastUsed), or
+	// check that its data is intact.
+	Stat(handle *Handle) (*BlobInfo, error)
+}
+
+// Describes a blob, by fetching it if the store can't Stat it.
+func statBlob(store BlobStore, handle *Handle) (*BlobInfo, error) {
+	if statStore, ok := store.(BlobStatStore); ok {
+		return statStore.Stat(handle)
+	}
+	blob, err := store.Fetch(handle)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{
+		Handle:      handle,
+		Size:        int64(len(blob.Data)),
+		ContentType: blob.ContentType,
+		Created:     blob.Created,
+		Expires:     blob.Expires,
+	}, nil
+}
+
+// The kinds of BlobError.  Check for them with errors.Is, e.g.
+// errors.Is(err, ErrNoSuchBlob).
+var (
+	// Nothing has been stored with the handle, or it's been deleted.
+	ErrNoSuchBlob = errors.New("No such blob")
+
+	// Something is stored, but it isn't a whole, readable blob.
+	ErrBlobCorrupted = errors.New("Blob is corrupted")
+
+	// The store isn't allowed to read (or write) the blob.
+	ErrBlobPermission = errors.New("Permission denied for blob")
+)
+
+// Why a BlobStore operation failed.
+type BlobError struct {
+	Op     string
+	Handle *Handle
+
+	// One of ErrNoSuchBlob, ErrBlobCorrupted or ErrBlobPermission, or nil
+	// for any other failure (e.g. the disk or network being down).
+	Kind error
+
+	// What went wrong underneath, if anything more than Kind.
+	Err error
+}
+
+func (e *BlobError) Error() string {
+	msg := e.Op + " blob " + e.Handle.String()
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *BlobError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+func (e *BlobError) Unwrap() error {
+	return e.Err
+}
+
+// Wraps 'err' in a BlobError, working out its Kind from the os errors it
+// wraps.  Nil stays nil, and BlobErrors are left alone.
+func newBlobError(op string, handle *Handle, err error) error {
+	if err == nil {
+		return nil
+	}
+	if blobErr, ok := err.(*BlobError); ok {
+		return blobErr
+	}
+	blobErr := &BlobError{Op: op, Handle: handle, Err: err}
+	switch {
+	case os.IsNotExist(err):
+		blobErr.Kind = ErrNoSuchBlob
+	case os.IsPermission(err):
+		blobErr.Kind = ErrBlobPermission
+	}
+	return blobErr
+}
+
+// What BlobStore.List says about a blob, without fetching its data.
+type BlobInfo struct {
+	Handle      *Handle   `json:"handle"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type,omitempty"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires,omitempty"`
+
+	// When the blob was last stored or fetched.
+	LastUsed time.Time `json:"last_used"`
+}
+
+// The random numbers come from crypto/rand, so that nobody can work out the
+// handles other people were given.
 func GenerateHandle() *Handle {
+	random := make([]byte, 24)
+	if _, err := cryptorand.Read(random); err != nil {
+		// Without randomness, there's no safe handle to give out.
+		panic(fmt.Sprintf("Couldn't generate handle: %s", err))
+	}
 	return &Handle{
 		timestamp: time.Now().Unix(),
-		n1:        rand.Int63(),
-		n2:        rand.Int63(),
-		n3:        rand.Int63(),
+		n1:        randomInt63(random[0:8]),
+		n2:        randomInt63(random[8:16]),
+		n3:        randomInt63(random[16:24]),
 	}
 }
 
+// A non-negative int64 from 8 random bytes.
+func randomInt63(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) >> 1)
+}
+
 // ======================================
 // ==== SIMPLE FLAT FILE BLOB STORE =====
 // ======================================
 
+const LOCALFS_METADATA_SUFFIX = ".meta.json"
+
 type LocalFSBlobStore struct {
 	location string
 }
@@ -70,19 +318,264 @@ func NewLocalFSBlobStore(location string) *LocalFSBlobStore {
 	return &LocalFSBlobStore{location: location}
 }
 
+// Each blob is kept as two files: its data, named after the handle with an
+// extension for its content type, and a ".meta.json" file with everything
+// else.  The metadata is written last, so a blob only exists once it's
+// complete, and its modification time records when the blob was last used.
+//
+// Blobs stored before there was any metadata are just a ".png".  They can
+// still be fetched and deleted, and are listed (by the file's modification
+// time) under a handle which names the same file: their real handles can't
+// be recovered from their filenames, but that's enough to delete them.
 func (s *LocalFSBlobStore) Store(handle *Handle, blob *Blob) error {
-	filename := s.filename(handle)
+	stored := *blob
+	if stored.Created.IsZero() {
+		stored.Created = time.Now()
+	}
+	metadata, err := json.Marshal(&localFSBlobMetadata{Handle: handle, Blob: &stored})
+	if err != nil {
+		return newBlobError("store", handle, err)
+	}
+	// If the blob is being replaced with one of another type, its old data
+	// (under another extension) has to go too.
+	oldDataFilename := ""
+	if old, err := s.readMetadata(handle); err == nil {
+		oldDataFilename = s.dataFilename(handle, old.contentType())
+	}
 
-	return ioutil.WriteFile(filename, blob.Data, 0600)
+	dataFilename := s.dataFilename(handle, stored.contentType())
+	if err := writeFileAtomically(dataFilename, blob.Data); err != nil {
+		return newBlobError("store", handle, err)
+	}
+	if err := writeFileAtomically(s.metadataFilename(handle), metadata); err != nil {
+		return newBlobError("store", handle, err)
+	}
+	if oldDataFilename != "" && oldDataFilename != dataFilename {
+		if err := os.Remove(oldDataFilename); err != nil && !os.IsNotExist(err) {
+			log.Printf("Couldn't delete the old data for blob %s: %s\n", handle, err)
+		}
+	}
+	return nil
+}
+
+type localFSBlobMetadata struct {
+	Handle *Handle `json:"handle"`
+	*Blob
 }
 
 func (s *LocalFSBlobStore) Fetch(handle *Handle) (*Blob, error) {
-	filename := s.filename(handle)
+	// Blobs from before there was metadata (see legacyLocalFSBlobInfo) aren't
+	// served: they were stored under guessable handles.
+	blob, err := s.readMetadata(handle)
+	if err != nil {
+		return nil, newBlobError("fetch", handle, err)
+	}
+
+	blob.Data, err = ioutil.ReadFile(s.dataFilename(handle, blob.contentType()))
+	if os.IsNotExist(err) {
+		// The data is written before the metadata, so it should be there.
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+	}
+	if err != nil {
+		return nil, newBlobError("fetch", handle, err)
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(s.metadataFilename(handle), now, now); err != nil {
+		log.Printf("Couldn't record use of blob %s: %s\n", handle, err)
+	}
+	return blob, nil
+}
+
+func (s *LocalFSBlobStore) Stat(handle *Handle) (*BlobInfo, error) {
+	blob, err := s.readMetadata(handle)
+	if err != nil {
+		return nil, newBlobError("stat", handle, err)
+	}
+	metadataInfo, err := os.Stat(s.metadataFilename(handle))
+	if err != nil {
+		return nil, newBlobError("stat", handle, err)
+	}
+	dataInfo, err := os.Stat(s.dataFilename(handle, blob.contentType()))
+	if os.IsNotExist(err) {
+		return nil, &BlobError{Op: "stat", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+	}
+	if err != nil {
+		return nil, newBlobError("stat", handle, err)
+	}
+	return &BlobInfo{
+		Handle:      handle,
+		Size:        dataInfo.Size(),
+		ContentType: blob.ContentType,
+		Created:     blob.Created,
+		Expires:     blob.Expires,
+		LastUsed:    metadataInfo.ModTime(),
+	}, nil
+}
+
+func (s *LocalFSBlobStore) Delete(handle *Handle) error {
+	contentType := DEFAULT_BLOB_CONTENT_TYPE
+	blob, err := s.readMetadata(handle)
+	if err == nil {
+		contentType = blob.contentType()
+	} else if !os.IsNotExist(err) && !errors.Is(err, ErrBlobCorrupted) {
+		// (Corrupted metadata is deleted, along with any PNG data.)
+		return newBlobError("delete", handle, err)
+	}
+
+	// Metadata first, so that the blob disappears all at once.
+	for _, filename := range []string{s.metadataFilename(handle), s.dataFilename(handle, contentType)} {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return newBlobError("delete", handle, err)
+		}
+	}
+	return nil
+}
+
+func (s *LocalFSBlobStore) List() ([]*BlobInfo, error) {
+	entries, err := ioutil.ReadDir(s.location)
+	if err != nil {
+		return nil, err
+	}
+
+	withMetadata := make(map[string]bool)
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), LOCALFS_METADATA_SUFFIX) {
+			withMetadata[strings.TrimSuffix(entry.Name(), LOCALFS_METADATA_SUFFIX)] = true
+		}
+	}
+
+	infos := []*BlobInfo{}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".png") &&
+			!withMetadata[strings.TrimSuffix(entry.Name(), ".png")] {
+			if info := legacyLocalFSBlobInfo(entry); info != nil {
+				infos = append(infos, info)
+			}
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), LOCALFS_METADATA_SUFFIX) {
+			continue
+		}
+		metadata := &localFSBlobMetadata{Blob: &Blob{}}
+		data, err := ioutil.ReadFile(filepath.Join(s.location, entry.Name()))
+		if err == nil {
+			err = json.Unmarshal(data, metadata)
+		}
+		if os.IsNotExist(err) {
+			// Deleted since ReadDir.
+			continue
+		}
+		if err != nil || metadata.Handle == nil {
+			// One bad blob shouldn't stop the rest being managed.
+			log.Printf("Skipping blob %s: %v\n", entry.Name(), err)
+			continue
+		}
+
+		info := &BlobInfo{
+			Handle:      metadata.Handle,
+			ContentType: metadata.ContentType,
+			Created:     metadata.Created,
+			Expires:     metadata.Expires,
+			LastUsed:    entry.ModTime(),
+		}
+		if dataInfo, err := os.Stat(s.dataFilename(metadata.Handle, metadata.contentType())); err == nil {
+			info.Size = dataInfo.Size()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Describes a blob from before there was metadata, or returns nil if 'entry'
+// isn't one.  These are listed (and can be deleted) so that the sweeper
+// cleans them up, but can't be fetched.
+func legacyLocalFSBlobInfo(entry os.FileInfo) *BlobInfo {
+	handle := legacyLocalFSHandle(strings.TrimSuffix(entry.Name(), ".png"))
+	if handle == nil {
+		log.Printf("Skipping blob %s: not named after a handle\n", entry.Name())
+		return nil
+	}
+	return &BlobInfo{
+		Handle:      handle,
+		Size:        entry.Size(),
+		ContentType: DEFAULT_BLOB_CONTENT_TYPE,
+		Created:     entry.ModTime(),
+		LastUsed:    entry.ModTime(),
+	}
+}
+
+// Filenames run the handle's random numbers together ("<timestamp>-<n1><n2><n3>"),
+// so the original handle can't be recovered.  Returns a handle with the same
+// filename, i.e. one which splits the digits into three numbers with no
+// leading zeros, or nil if there isn't one.
+func legacyLocalFSHandle(name string) *Handle {
+	parts := strings.SplitN(name, "-", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	timestamp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || strconv.FormatInt(timestamp, 10) != parts[0] {
+		return nil
+	}
+	digits := parts[1]
+	number := func(s string) (int64, bool) {
+		n, err := strconv.ParseInt(s, 10, 64)
+		return n, err == nil && n >= 0 && strconv.FormatInt(n, 10) == s
+	}
+	for i := 1; i < len(digits); i++ {
+		for j := i + 1; j < len(digits); j++ {
+			n1, ok1 := number(digits[:i])
+			n2, ok2 := number(digits[i:j])
+			n3, ok3 := number(digits[j:])
+			if ok1 && ok2 && ok3 {
+				return &Handle{timestamp: timestamp, n1: n1, n2: n2, n3: n3}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *LocalFSBlobStore) readMetadata(handle *Handle) (*Blob, error) {
+	filename := s.metadataFilename(handle)
 	data, err := ioutil.ReadFile(filename)
-	blob := &Blob{Data: data}
-	return blob, err
+	if err != nil {
+		return nil, err
+	}
+	metadata := &localFSBlobMetadata{Blob: &Blob{}}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted,
+			Err: fmt.Errorf("Bad metadata in %s: %s", filename, err)}
+	}
+	return metadata.Blob, nil
+}
+
+func (s *LocalFSBlobStore) dataFilename(h *Handle, contentType string) string {
+	return fmt.Sprintf(s.location+"/%d-%d%d%d.%s", h.timestamp, h.n1, h.n2, h.n3,
+		extensionForContentType(contentType))
 }
 
-func (s *LocalFSBlobStore) filename(h *Handle) string {
-	return fmt.Sprintf(s.location+"/%d-%d%d%d.png", h.timestamp, h.n1, h.n2, h.n3)
+func (s *LocalFSBlobStore) metadataFilename(h *Handle) string {
+	return fmt.Sprintf(s.location+"/%d-%d%d%d"+LOCALFS_METADATA_SUFFIX, h.timestamp, h.n1, h.n2, h.n3)
+}
+
+// Writes to a temporary file (in the same directory, so it can be renamed
+// into place) first, so that readers never see half a file.  Each write gets
+// its own temporary file, so concurrent writes can't clobber each other's.
+func writeFileAtomically(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
@@ -3,8 +3,15 @@ package latvis
 import (
 	"github.com/mrjones/gt"
 
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"testing"
+	"time"
 )
 
 func simpleHandle() *Handle {
@@ -17,21 +24,58 @@ func simpleHandle() *Handle {
 
 }
 
-func TestHandleDebugString(t *testing.T) {
+const SIMPLE_HANDLE_STRING = "AAAAAAAAAAAAAAAAAAAAAQAAAAAAAAACAAAAAAAAAAM"
+
+func TestHandleString(t *testing.T) {
 	h := simpleHandle()
 
-	gt.AssertEqualM(t, "0-123", h.String(), "Unexpected handle")
+	gt.AssertEqualM(t, SIMPLE_HANDLE_STRING, h.String(), "Unexpected handle")
 }
 
 func TestHandleUrlString(t *testing.T) {
 	h := simpleHandle()
 
 	gt.AssertEqualM(t,
-		"/page/0-1-2-3.xyz",
+		"/page/"+SIMPLE_HANDLE_STRING+".xyz",
 		serializeHandleToUrl(h, "xyz", "page"),
 		"Unexpected serialization")
 }
 
+func TestParseHandleString(t *testing.T) {
+	h, err := parseHandleString(SIMPLE_HANDLE_STRING)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, simpleHandle(), h)
+
+	for _, bad := range []string{"", "0-1-2-3", SIMPLE_HANDLE_STRING[1:], SIMPLE_HANDLE_STRING + "A", "!" + SIMPLE_HANDLE_STRING[1:]} {
+		_, err := parseHandleString(bad)
+		gt.AssertNotNilM(t, err, bad)
+	}
+}
+
+func TestGenerateHandle(t *testing.T) {
+	seen := make(map[Handle]bool)
+	for i := 0; i < 100; i++ {
+		h := GenerateHandle()
+		gt.AssertFalseM(t, seen[*h], "Handles should be unique")
+		seen[*h] = true
+		gt.AssertTrueM(t, h.n1 >= 0 && h.n2 >= 0 && h.n3 >= 0, h.String())
+
+		parsed, err := parseHandleString(h.String())
+		gt.AssertNil(t, err)
+		gt.AssertEqual(t, h, parsed)
+	}
+}
+
+func TestImageHandle(t *testing.T) {
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	image := h.imageHandle()
+	gt.AssertEqual(t, image, h.imageHandle())
+	gt.AssertEqual(t, int64(100), image.timestamp)
+	gt.AssertFalseM(t, *h == *image, "The image handle should differ")
+	gt.AssertFalseM(t, *image == *(&Handle{timestamp: 100, n1: 1, n2: 2, n3: 4}).imageHandle(),
+		"Every handle should have its own image handle")
+}
+
 func TestSuccessfulParamsSerializeAndDeserialize(t *testing.T) {
 	h := simpleHandle()
 
@@ -60,21 +104,37 @@ func TestParamsDeserializeWithMissingParams(t *testing.T) {
 	_, err := parseHandleFromParams(p)
 	gt.AssertNil(t, err)
 
+	p.Del("h")
+	_, err = parseHandleFromParams(p)
+	gt.AssertNotNil(t, err)
+}
+
+// Tasks queued before handles were serialized as one parameter.
+func legacyParams() *url.Values {
+	return &url.Values{"hStamp": {"0"}, "h1": {"1"}, "h2": {"2"}, "h3": {"3"}}
+}
+
+func TestLegacyParamsDeserialize(t *testing.T) {
+	h, err := parseHandleFromParams(legacyParams())
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, simpleHandle(), h)
+
+	p := legacyParams()
 	p.Del("hStamp")
 	_, err = parseHandleFromParams(p)
 	gt.AssertNotNil(t, err)
 
-	p = necessaryParams()
+	p = legacyParams()
 	p.Del("h1")
 	_, err = parseHandleFromParams(p)
 	gt.AssertNotNil(t, err)
 
-	p = necessaryParams()
+	p = legacyParams()
 	p.Del("h2")
 	_, err = parseHandleFromParams(p)
 	gt.AssertNotNil(t, err)
 
-	p = necessaryParams()
+	p = legacyParams()
 	p.Del("h3")
 	_, err = parseHandleFromParams(p)
 	gt.AssertNotNil(t, err)
@@ -89,3 +149,322 @@ func TestSuccessfulUrlSerializesAndDeserialize(t *testing.T) {
 	gt.AssertNil(t, err)
 	gt.AssertEqualM(t, h, h2, "Expected serialize/deserialize to return the same result.")
 }
+
+// What every BlobStore must do.  'store' should start out empty.
+func testBlobStore(t *testing.T, store BlobStore) {
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	other := &Handle{timestamp: 200, n1: 4, n2: 5, n3: 6}
+
+	_, err := store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrNoSuchBlob), "Nothing stored yet")
+	_, ok := err.(*BlobError)
+	gt.AssertTrueM(t, ok, "Errors should be BlobErrors")
+	infos, err := store.List()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 0, len(infos))
+
+	bounds, err := NewBoundingBox(Coordinate{Lat: 1, Lng: 2}, Coordinate{Lat: 3, Lng: 4})
+	gt.AssertNil(t, err)
+	blob := &Blob{
+		Data:        []byte("<svg/>"),
+		ContentType: "image/svg+xml",
+		Created:     time.Unix(1000, 0).UTC(),
+		Request: &RenderRequest{
+			Bounds:  bounds,
+			Start:   time.Unix(5, 0).UTC(),
+			End:     time.Unix(6, 0).UTC(),
+			Style:   "svg",
+			Options: VisualizerOptions{"marker": "square"},
+		},
+		Metadata: map[string]string{"points": "12"},
+		Expires:  time.Unix(5000, 0).UTC(),
+	}
+	gt.AssertNil(t, store.Store(h, blob))
+	fetched, err := store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, blob, fetched)
+
+	data := []byte("png")
+	gt.AssertNil(t, store.Store(other, &Blob{Data: data}))
+	data[0] = 'x'
+	fetched, err = store.Fetch(other)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, "png", string(fetched.Data), "The store should keep its own copy")
+	gt.AssertEqual(t, DEFAULT_BLOB_CONTENT_TYPE, fetched.contentType())
+	gt.AssertFalseM(t, fetched.Created.IsZero(), "The store should fill in the creation time")
+
+	info, err := statBlob(store, h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, *h, *info.Handle)
+	gt.AssertEqual(t, int64(6), info.Size)
+	gt.AssertEqual(t, "image/svg+xml", info.ContentType)
+	gt.AssertTrue(t, blob.Created.Equal(info.Created))
+	gt.AssertTrue(t, blob.Expires.Equal(info.Expires))
+	_, err = statBlob(store, &Handle{timestamp: 300})
+	gt.AssertTrueM(t, errors.Is(err, ErrNoSuchBlob), "Stat of a missing blob")
+
+	infos, err = store.List()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 2, len(infos))
+	for _, info := range infos {
+		if *info.Handle == *h {
+			gt.AssertEqual(t, int64(6), info.Size)
+			gt.AssertEqual(t, "image/svg+xml", info.ContentType)
+			gt.AssertTrue(t, blob.Created.Equal(info.Created))
+			gt.AssertTrue(t, blob.Expires.Equal(info.Expires))
+			gt.AssertFalse(t, info.LastUsed.IsZero())
+		} else {
+			gt.AssertEqual(t, *other, *info.Handle)
+			gt.AssertEqual(t, int64(3), info.Size)
+			gt.AssertTrue(t, info.Expires.IsZero())
+		}
+	}
+
+	// Overwriting replaces everything.
+	gt.AssertNil(t, store.Store(h, &Blob{}))
+	fetched, err = store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 0, len(fetched.Data))
+	gt.AssertEqual(t, DEFAULT_BLOB_CONTENT_TYPE, fetched.contentType())
+	gt.AssertTrue(t, fetched.Request == nil)
+
+	gt.AssertNil(t, store.Delete(h))
+	_, err = store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrNoSuchBlob), "Deleted")
+	gt.AssertNilM(t, store.Delete(h), "Deleting twice is fine")
+	infos, err = store.List()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 1, len(infos))
+	gt.AssertEqual(t, *other, *infos[0].Handle)
+
+	// Readers only ever see whole blobs, even while they're being replaced.
+	sizes := map[byte]int{'a': 1000, 'b': 100000}
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			for c, size := range sizes {
+				if err := store.Store(other, &Blob{Data: bytes.Repeat([]byte{c}, size)}); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+		done <- nil
+	}()
+	for reading := true; reading; {
+		select {
+		case err := <-done:
+			gt.AssertNil(t, err)
+			reading = false
+		default:
+		}
+		fetched, err := store.Fetch(other)
+		gt.AssertNil(t, err)
+		if len(fetched.Data) > 3 {
+			gt.AssertEqualM(t, sizes[fetched.Data[0]], len(fetched.Data), "Half-written blob")
+			gt.AssertTrue(t, bytes.Count(fetched.Data, fetched.Data[:1]) == len(fetched.Data))
+		}
+	}
+}
+
+func TestLocalFSBlobStore(t *testing.T) {
+	dir, store := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	testBlobStore(t, store)
+}
+
+func TestLocalFSBlobStoreKeepsMetadata(t *testing.T) {
+	dir, store := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	bounds, err := NewBoundingBox(Coordinate{Lat: 1, Lng: 2}, Coordinate{Lat: 3, Lng: 4})
+	gt.AssertNil(t, err)
+	blob := &Blob{
+		Data:        []byte("<svg/>"),
+		ContentType: "image/svg+xml",
+		Created:     time.Unix(1000, 0).UTC(),
+		Request: &RenderRequest{
+			Bounds:  bounds,
+			Start:   time.Unix(5, 0).UTC(),
+			End:     time.Unix(6, 0).UTC(),
+			Style:   "svg",
+			Options: VisualizerOptions{"marker": "square"},
+		},
+		Metadata: map[string]string{"points": "12"},
+	}
+	h := simpleHandle()
+	gt.AssertNil(t, store.Store(h, blob))
+
+	fetched, err := store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, blob, fetched)
+	_, err = os.Stat(dir + "/0-123.svg")
+	gt.AssertNilM(t, err, "Files should get the right extension")
+
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte("png")}))
+	fetched, err = store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "png", string(fetched.Data))
+	gt.AssertEqualM(t, DEFAULT_BLOB_CONTENT_TYPE, fetched.contentType(), "Default content type")
+	gt.AssertFalseM(t, fetched.Created.IsZero(), "The store should fill in the creation time")
+	_, err = os.Stat(dir + "/0-123.svg")
+	gt.AssertTrueM(t, os.IsNotExist(err), "The old data should go when the content type changes")
+
+	files, err := ioutil.ReadDir(dir)
+	gt.AssertNil(t, err)
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	gt.AssertEqualM(t, []string{"0-123.meta.json", "0-123.png"}, names, "No temporary files should be left")
+}
+
+func TestLocalFSBlobStoreDoesNotServeLegacyBlobs(t *testing.T) {
+	dir, store := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	// From before blobs had metadata, when handles were guessable.
+	gt.AssertNil(t, ioutil.WriteFile(dir+"/0-123.png", []byte("old"), 0600))
+
+	_, err := store.Fetch(simpleHandle())
+	gt.AssertTrue(t, errors.Is(err, ErrNoSuchBlob))
+	_, err = statBlob(store, simpleHandle())
+	gt.AssertTrue(t, errors.Is(err, ErrNoSuchBlob))
+}
+
+func TestLocalFSBlobStoreErrors(t *testing.T) {
+	dir, store := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	h := simpleHandle()
+
+	_, err := store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrNoSuchBlob), "Missing: "+err.Error())
+	_, ok := err.(*BlobError)
+	gt.AssertTrue(t, ok)
+
+	// Metadata without its data.
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte("data")}))
+	gt.AssertNil(t, os.Remove(dir+"/0-123.png"))
+	_, err = store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrBlobCorrupted), "No data: "+err.Error())
+	gt.AssertFalse(t, errors.Is(err, ErrNoSuchBlob))
+
+	// Unreadable metadata.
+	gt.AssertNil(t, ioutil.WriteFile(dir+"/0-123.meta.json", []byte("{not json"), 0600))
+	blob, err := store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrBlobCorrupted), "Bad metadata: "+err.Error())
+	gt.AssertTrue(t, blob == nil)
+
+	// Corrupted blobs can still be deleted.
+	gt.AssertNil(t, store.Delete(h))
+	_, err = store.Fetch(h)
+	gt.AssertTrue(t, errors.Is(err, ErrNoSuchBlob))
+}
+
+func TestNewBlobError(t *testing.T) {
+	h := simpleHandle()
+	gt.AssertNil(t, newBlobError("fetch", h, nil))
+
+	err := newBlobError("fetch", h, &os.PathError{Op: "open", Path: "x", Err: os.ErrPermission})
+	gt.AssertTrue(t, errors.Is(err, ErrBlobPermission))
+	gt.AssertTrueM(t, errors.Is(err, os.ErrPermission), "Should unwrap to the cause")
+	gt.AssertEqual(t, "fetch blob "+SIMPLE_HANDLE_STRING+": Permission denied for blob: open x: permission denied", err.Error())
+
+	err = newBlobError("fetch", h, &os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist})
+	gt.AssertTrue(t, errors.Is(err, ErrNoSuchBlob))
+
+	err = newBlobError("store", h, errors.New("disk on fire"))
+	gt.AssertFalse(t, errors.Is(err, ErrNoSuchBlob))
+	gt.AssertFalse(t, errors.Is(err, ErrBlobCorrupted))
+	gt.AssertFalse(t, errors.Is(err, ErrBlobPermission))
+
+	corrupted := &BlobError{Op: "fetch", Handle: h, Kind: ErrBlobCorrupted}
+	gt.AssertTrueM(t, newBlobError("delete", h, corrupted) == error(corrupted), "Should be left alone")
+}
+
+func TestLocalFSBlobStoreDeleteAndList(t *testing.T) {
+	dir, store := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	infos, err := store.List()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 0, len(infos))
+
+	h := simpleHandle()
+	other := &Handle{timestamp: 100, n1: 4, n2: 5, n3: 6}
+	expires := time.Unix(5000, 0).UTC()
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte("<svg/>"), ContentType: "image/svg+xml", Expires: expires}))
+	gt.AssertNil(t, store.Store(other, &Blob{Data: []byte("png")}))
+	// Legacy blobs are listed (under a handle with the same filename), but
+	// files which aren't blobs aren't.
+	gt.AssertNil(t, ioutil.WriteFile(dir+"/7-1023.png", []byte("old"), 0600))
+	lastUsed := time.Unix(3000, 0)
+	gt.AssertNil(t, os.Chtimes(dir+"/7-1023.png", lastUsed, lastUsed))
+	gt.AssertNil(t, os.Mkdir(dir+"/jobs", 0700))
+	gt.AssertNil(t, ioutil.WriteFile(dir+"/notes.png", []byte("not a blob"), 0600))
+
+	infos, err = store.List()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 3, len(infos))
+	var legacy *Handle
+	for _, info := range infos {
+		if *info.Handle == *h {
+			gt.AssertEqual(t, int64(6), info.Size)
+			gt.AssertEqual(t, "image/svg+xml", info.ContentType)
+			gt.AssertTrue(t, expires.Equal(info.Expires))
+			gt.AssertFalse(t, info.LastUsed.IsZero())
+		} else if *info.Handle == *other {
+			gt.AssertEqual(t, int64(3), info.Size)
+		} else {
+			legacy = info.Handle
+			gt.AssertEqual(t, int64(7), legacy.timestamp)
+			gt.AssertEqual(t, int64(3), info.Size)
+			gt.AssertTrue(t, lastUsed.Equal(info.LastUsed))
+			gt.AssertTrue(t, lastUsed.Equal(info.Created))
+		}
+	}
+	gt.AssertTrueM(t, legacy != nil, "The legacy blob should be listed")
+
+	gt.AssertNil(t, store.Delete(h))
+	_, err = store.Fetch(h)
+	gt.AssertNotNil(t, err)
+	_, err = os.Stat(dir + "/0-123.svg")
+	gt.AssertTrueM(t, os.IsNotExist(err), "The data should be deleted too")
+	gt.AssertNilM(t, store.Delete(h), "Deleting twice is fine")
+
+	gt.AssertNil(t, store.Delete(legacy))
+	_, err = os.Stat(dir + "/7-1023.png")
+	gt.AssertTrueM(t, os.IsNotExist(err), "Legacy blobs can be deleted by their listed handle")
+
+	infos, err = store.List()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 1, len(infos))
+}
+
+func TestLegacyLocalFSHandle(t *testing.T) {
+	for _, name := range []string{"7-123", "7-1023", "100-9000000000000000000123", "0-000"} {
+		h := legacyLocalFSHandle(name)
+		gt.AssertTrueM(t, h != nil, name)
+		gt.AssertEqual(t, name, fmt.Sprintf("%d-%d%d%d", h.timestamp, h.n1, h.n2, h.n3))
+	}
+	for _, name := range []string{"notes", "7-12", "x-123", "07-123", "7-12a"} {
+		gt.AssertTrueM(t, legacyLocalFSHandle(name) == nil, name)
+	}
+}
+
+func TestHandleJson(t *testing.T) {
+	data, err := json.Marshal(&Handle{timestamp: 100, n1: 1, n2: 22, n3: 3})
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, `"AAAAAAAAAGQAAAAAAAAAAQAAAAAAAAAWAAAAAAAAAAM"`, string(data))
+
+	h := &Handle{}
+	gt.AssertNil(t, json.Unmarshal(data, h))
+	gt.AssertEqual(t, Handle{timestamp: 100, n1: 1, n2: 22, n3: 3}, *h)
+
+	// As written before handles were base64.
+	h = &Handle{}
+	gt.AssertNil(t, json.Unmarshal([]byte(`"100-1-22-3"`), h))
+	gt.AssertEqual(t, Handle{timestamp: 100, n1: 1, n2: 22, n3: 3}, *h)
+
+	gt.AssertNotNil(t, json.Unmarshal([]byte(`"100-1-22"`), h))
+}
@@ -0,0 +1,186 @@
+package latvis
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ======================================
+// ============ BLOB SWEEPER ============
+// ======================================
+
+const (
+	DEFAULT_BLOB_SWEEP_INTERVAL = time.Hour
+
+	// How long cached map tiles are kept.  They can always be rendered again.
+	TILE_CACHE_TTL = 24 * time.Hour
+
+	// How long job records are kept when there's no DefaultTTL.
+	DEFAULT_JOB_TTL = 7 * 24 * time.Hour
+)
+
+// Zero values mean "no limit".
+type BlobSweeperOptions struct {
+	// Blobs without their own Blob.Expires are deleted once they're this
+	// old, going by the timestamp in their Handle.
+	DefaultTTL time.Duration
+
+	// Once the blobs take up more than this many bytes, the least recently
+	// used ones are deleted until they fit.
+	MaxTotalBytes int64
+
+	// How often StartBlobSweeper sweeps.  Defaults to
+	// DEFAULT_BLOB_SWEEP_INTERVAL.
+	Interval time.Duration
+
+	// If set, the records of jobs which haven't been updated for DefaultTTL
+	// (or DEFAULT_JOB_TTL, if there's no DefaultTTL) are deleted too.  Their
+	// images needn't have gone: images without a job record still count as
+	// JOB_STORED (see RenderEngineInterface.FetchJob).
+	Jobs JobStore
+}
+
+// What a sweep did.
+type SweepResult struct {
+	Expired    int   `json:"expired"`
+	Evicted    int   `json:"evicted"`
+	BytesFreed int64 `json:"bytes_freed"`
+
+	Remaining      int   `json:"remaining"`
+	RemainingBytes int64 `json:"remaining_bytes"`
+
+	JobsPruned int `json:"jobs_pruned"`
+}
+
+// Deletes the blobs which have expired by 'now', and then, if the rest are
+// still too big, the least recently used ones.  Then prunes options.Jobs.
+//
+// Blobs which can't be deleted are logged and skipped, so that one bad blob
+// can't fill up the store.  Errors are only returned if the store can't be
+// listed.
+func SweepBlobs(store BlobStore, options BlobSweeperOptions, now time.Time) (*SweepResult, error) {
+	infos, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SweepResult{}
+	remaining := []*BlobInfo{}
+	for _, info := range infos {
+		if blobExpired(info, options, now) && deleteBlob(store, info, result) {
+			result.Expired++
+			continue
+		}
+		remaining = append(remaining, info)
+		result.RemainingBytes += info.Size
+	}
+
+	if options.MaxTotalBytes > 0 && result.RemainingBytes > options.MaxTotalBytes {
+		sort.Slice(remaining, func(i, j int) bool {
+			return remaining[i].LastUsed.Before(remaining[j].LastUsed)
+		})
+		kept := []*BlobInfo{}
+		for _, info := range remaining {
+			if result.RemainingBytes > options.MaxTotalBytes && deleteBlob(store, info, result) {
+				result.Evicted++
+				result.RemainingBytes -= info.Size
+				continue
+			}
+			kept = append(kept, info)
+		}
+		remaining = kept
+	}
+
+	result.Remaining = len(remaining)
+
+	if options.Jobs != nil {
+		jobTtl := options.DefaultTTL
+		if jobTtl <= 0 {
+			jobTtl = DEFAULT_JOB_TTL
+		}
+		// Like blobs which can't be deleted, this shouldn't stop the sweep.
+		if result.JobsPruned, err = options.Jobs.Prune(now.Add(-jobTtl)); err != nil {
+			log.Printf("Couldn't prune jobs: %s\n", err)
+		}
+	}
+	return result, nil
+}
+
+func blobExpired(info *BlobInfo, options BlobSweeperOptions, now time.Time) bool {
+	if !info.Expires.IsZero() {
+		return now.After(info.Expires)
+	}
+	return options.DefaultTTL > 0 && now.Sub(info.Handle.Time()) > options.DefaultTTL
+}
+
+func deleteBlob(store BlobStore, info *BlobInfo, result *SweepResult) bool {
+	if err := store.Delete(info.Handle); err != nil {
+		log.Printf("Couldn't delete blob %s: %s\n", info.Handle, err)
+		return false
+	}
+	result.BytesFreed += info.Size
+	return true
+}
+
+// Sweeps a BlobStore (see SweepBlobs) in the background.
+type BlobSweeper struct {
+	store   BlobStore
+	options BlobSweeperOptions
+
+	// Only one sweep at a time.
+	mutex sync.Mutex
+
+	stop chan bool
+	done chan bool
+}
+
+// Sweeps straight away, and then every options.Interval until Close is
+// called.
+func StartBlobSweeper(store BlobStore, options BlobSweeperOptions) *BlobSweeper {
+	if options.Interval <= 0 {
+		options.Interval = DEFAULT_BLOB_SWEEP_INTERVAL
+	}
+	s := &BlobSweeper{
+		store:   store,
+		options: options,
+		stop:    make(chan bool),
+		done:    make(chan bool),
+	}
+	go s.run()
+	return s
+}
+
+func (s *BlobSweeper) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.options.Interval)
+	defer ticker.Stop()
+	for {
+		if result, err := s.Sweep(); err != nil {
+			log.Printf("Sweeping blobs: %s\n", err)
+		} else if result.Expired > 0 || result.Evicted > 0 || result.JobsPruned > 0 {
+			log.Printf("Swept blobs: %d expired, %d evicted, %d bytes freed, %d jobs pruned\n",
+				result.Expired, result.Evicted, result.BytesFreed, result.JobsPruned)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Sweeps now, rather than waiting for the next one.
+func (s *BlobSweeper) Sweep() (*SweepResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return SweepBlobs(s.store, s.options, time.Now())
+}
+
+// Stops sweeping, waiting for any sweep in progress to finish.
+func (s *BlobSweeper) Close() {
+	close(s.stop)
+	<-s.done
+}
@@ -0,0 +1,120 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Stores a blob of 'size' bytes, last used at 'lastUsed'.
+func storeSizedBlob(t *testing.T, store BlobStore, h *Handle, size int, lastUsed time.Time, expires time.Time) {
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte(strings.Repeat("x", size)), Expires: expires}))
+	gt.AssertNil(t, os.Chtimes(store.(*LocalFSBlobStore).metadataFilename(h), lastUsed, lastUsed))
+}
+
+func blobExists(store BlobStore, h *Handle) bool {
+	_, err := store.Fetch(h)
+	return err == nil
+}
+
+func TestSweepBlobsExpiry(t *testing.T) {
+	dir, store := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(100000, 0)
+	old := &Handle{timestamp: 100000 - 7200, n1: 1}
+	recent := &Handle{timestamp: 100000 - 60, n1: 2}
+	shortLived := &Handle{timestamp: 100000 - 60, n1: 3}
+	longLived := &Handle{timestamp: 100000 - 7200, n1: 4}
+	storeSizedBlob(t, store, old, 10, now, time.Time{})
+	storeSizedBlob(t, store, recent, 10, now, time.Time{})
+	storeSizedBlob(t, store, shortLived, 10, now, now.Add(-time.Second))
+	storeSizedBlob(t, store, longLived, 10, now, now.Add(time.Hour))
+
+	result, err := SweepBlobs(store, BlobSweeperOptions{DefaultTTL: time.Hour}, now)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 2, result.Expired)
+	gt.AssertEqual(t, int64(20), result.BytesFreed)
+	gt.AssertEqual(t, 2, result.Remaining)
+
+	gt.AssertFalseM(t, blobExists(store, old), "Older than the TTL")
+	gt.AssertTrueM(t, blobExists(store, recent), "Younger than the TTL")
+	gt.AssertFalseM(t, blobExists(store, shortLived), "Past its own expiry")
+	gt.AssertTrueM(t, blobExists(store, longLived), "Its own expiry overrides the TTL")
+
+	result, err = SweepBlobs(store, BlobSweeperOptions{}, now.Add(365*24*time.Hour))
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, 1, result.Expired, "Without a TTL, only blobs with their own expiry go")
+}
+
+func TestSweepBlobsPrunesJobs(t *testing.T) {
+	dir, store := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(100000, 0)
+	jobs := NewInMemoryJobStore()
+	old := &Handle{timestamp: 1}
+	recent := &Handle{timestamp: 2}
+	ancient := &Handle{timestamp: 3}
+	gt.AssertNil(t, jobs.Store(old, &Job{State: JOB_STORED, Updated: now.Add(-2 * time.Hour)}))
+	gt.AssertNil(t, jobs.Store(recent, &Job{State: JOB_STORED, Updated: now.Add(-time.Minute)}))
+	gt.AssertNil(t, jobs.Store(ancient, &Job{State: JOB_FAILED, Updated: now.Add(-DEFAULT_JOB_TTL - time.Hour)}))
+
+	result, err := SweepBlobs(store, BlobSweeperOptions{DefaultTTL: time.Hour, Jobs: jobs}, now)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 2, result.JobsPruned)
+	_, err = jobs.Fetch(recent)
+	gt.AssertNil(t, err)
+
+	result, err = SweepBlobs(store, BlobSweeperOptions{Jobs: jobs}, now.Add(DEFAULT_JOB_TTL))
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, 1, result.JobsPruned, "Without a TTL, jobs are kept for DEFAULT_JOB_TTL")
+}
+
+func TestSweepBlobsEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, store := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	handles := []*Handle{}
+	for i := 0; i < 4; i++ {
+		h := &Handle{timestamp: now.Unix(), n1: int64(i)}
+		handles = append(handles, h)
+	}
+	storeSizedBlob(t, store, handles[0], 100, now.Add(-1*time.Minute), time.Time{})
+	storeSizedBlob(t, store, handles[1], 100, now.Add(-4*time.Minute), time.Time{})
+	storeSizedBlob(t, store, handles[2], 100, now.Add(-2*time.Minute), time.Time{})
+	storeSizedBlob(t, store, handles[3], 100, now.Add(-3*time.Minute), time.Time{})
+
+	result, err := SweepBlobs(store, BlobSweeperOptions{MaxTotalBytes: 250}, now)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 2, result.Evicted)
+	gt.AssertEqual(t, 2, result.Remaining)
+	gt.AssertEqual(t, int64(200), result.RemainingBytes)
+
+	gt.AssertTrue(t, blobExists(store, handles[0]))
+	gt.AssertFalse(t, blobExists(store, handles[1]))
+	gt.AssertTrue(t, blobExists(store, handles[2]))
+	gt.AssertFalse(t, blobExists(store, handles[3]))
+}
+
+func TestBlobSweeperRunsInBackground(t *testing.T) {
+	dir, store := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	h := &Handle{timestamp: 1, n1: 1}
+	storeSizedBlob(t, store, h, 10, time.Now(), time.Time{})
+
+	sweeper := StartBlobSweeper(store, BlobSweeperOptions{DefaultTTL: time.Hour, Interval: time.Millisecond})
+	for blobExists(store, h) {
+		time.Sleep(time.Millisecond)
+	}
+	sweeper.Close()
+
+	result, err := sweeper.Sweep()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 0, result.Remaining)
+}
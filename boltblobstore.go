@@ -0,0 +1,219 @@
+package latvis
+
+import (
+	bolt "go.etcd.io/bbolt"
+
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ======================================
+// ===== EMBEDDED (BOLT) BLOB STORE =====
+// ======================================
+
+var (
+	BOLT_DATA_BUCKET     = []byte("blobs")
+	BOLT_METADATA_BUCKET = []byte("blob_metadata")
+)
+
+// Keeps every blob in a single bolt database file.  Each Store is one
+// transaction, so a blob is either all there (data and metadata) or not there
+// at all, and readers never see half of one.
+type BoltBlobStore struct {
+	db *bolt.DB
+}
+
+type boltBlobMetadata struct {
+	*Blob
+
+	// When the blob was last stored or fetched.
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Opens (or creates) the database in 'filename'.  Only one process can have it
+// open at a time, so this gives up if another one doesn't let go of it soon.
+func NewBoltBlobStore(filename string) (*BoltBlobStore, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't open blob database %s: %s", filename, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{BOLT_DATA_BUCKET, BOLT_METADATA_BUCKET} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBlobStore{db: db}, nil
+}
+
+func (s *BoltBlobStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltBlobStore) Store(handle *Handle, blob *Blob) error {
+	key := []byte(handle.storageKey())
+	stored := *blob
+	if stored.Created.IsZero() {
+		stored.Created = time.Now()
+	}
+	metadata, err := json.Marshal(&boltBlobMetadata{Blob: &stored, LastUsed: time.Now()})
+	if err != nil {
+		return newBlobError("store", handle, err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		data := blob.Data
+		if data == nil {
+			// Bolt can't tell a nil value from a missing one.
+			data = []byte{}
+		}
+		if err := tx.Bucket(BOLT_DATA_BUCKET).Put(key, data); err != nil {
+			return err
+		}
+		return tx.Bucket(BOLT_METADATA_BUCKET).Put(key, metadata)
+	})
+	return newBlobError("store", handle, err)
+}
+
+func (s *BoltBlobStore) Fetch(handle *Handle) (*Blob, error) {
+	key := []byte(handle.storageKey())
+
+	var blob *Blob
+	err := s.db.View(func(tx *bolt.Tx) error {
+		rawMetadata := tx.Bucket(BOLT_METADATA_BUCKET).Get(key)
+		if rawMetadata == nil {
+			return &BlobError{Op: "fetch", Handle: handle, Kind: ErrNoSuchBlob}
+		}
+		metadata := &boltBlobMetadata{Blob: &Blob{}}
+		if err := json.Unmarshal(rawMetadata, metadata); err != nil {
+			return &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+		}
+		data := tx.Bucket(BOLT_DATA_BUCKET).Get(key)
+		if data == nil {
+			return &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted,
+				Err: fmt.Errorf("Metadata without data")}
+		}
+		// Bolt's slices are only good until the transaction ends.
+		metadata.Data = append([]byte{}, data...)
+		blob = metadata.Blob
+		return nil
+	})
+	if err != nil {
+		return nil, newBlobError("fetch", handle, err)
+	}
+
+	if err := s.touch(key); err != nil {
+		log.Printf("Couldn't record use of blob %s: %s\n", handle, err)
+	}
+	return blob, nil
+}
+
+func (s *BoltBlobStore) Stat(handle *Handle) (*BlobInfo, error) {
+	key := []byte(handle.storageKey())
+
+	var info *BlobInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		rawMetadata := tx.Bucket(BOLT_METADATA_BUCKET).Get(key)
+		if rawMetadata == nil {
+			return &BlobError{Op: "stat", Handle: handle, Kind: ErrNoSuchBlob}
+		}
+		metadata := &boltBlobMetadata{Blob: &Blob{}}
+		if err := json.Unmarshal(rawMetadata, metadata); err != nil {
+			return &BlobError{Op: "stat", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+		}
+		data := tx.Bucket(BOLT_DATA_BUCKET).Get(key)
+		if data == nil {
+			return &BlobError{Op: "stat", Handle: handle, Kind: ErrBlobCorrupted,
+				Err: fmt.Errorf("Metadata without data")}
+		}
+		info = &BlobInfo{
+			Handle:      handle,
+			Size:        int64(len(data)),
+			ContentType: metadata.ContentType,
+			Created:     metadata.Created,
+			Expires:     metadata.Expires,
+			LastUsed:    metadata.LastUsed,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, newBlobError("stat", handle, err)
+	}
+	return info, nil
+}
+
+// Records that the blob was just used, for the sweeper (see
+// BlobInfo.LastUsed).  Fetches are batched up, so they don't each have to wait
+// for their own write to the disk.
+func (s *BoltBlobStore) touch(key []byte) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(BOLT_METADATA_BUCKET)
+		rawMetadata := bucket.Get(key)
+		if rawMetadata == nil {
+			// Deleted since it was fetched.
+			return nil
+		}
+		metadata := &boltBlobMetadata{Blob: &Blob{}}
+		if err := json.Unmarshal(rawMetadata, metadata); err != nil {
+			return err
+		}
+		metadata.LastUsed = time.Now()
+		updated, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, updated)
+	})
+}
+
+func (s *BoltBlobStore) Delete(handle *Handle) error {
+	key := []byte(handle.storageKey())
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(BOLT_METADATA_BUCKET).Delete(key); err != nil {
+			return err
+		}
+		return tx.Bucket(BOLT_DATA_BUCKET).Delete(key)
+	})
+	return newBlobError("delete", handle, err)
+}
+
+func (s *BoltBlobStore) List() ([]*BlobInfo, error) {
+	infos := []*BlobInfo{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(BOLT_DATA_BUCKET)
+		return tx.Bucket(BOLT_METADATA_BUCKET).ForEach(func(key, rawMetadata []byte) error {
+			handle := &Handle{}
+			metadata := &boltBlobMetadata{Blob: &Blob{}}
+			if err := handle.UnmarshalText(key); err != nil {
+				log.Printf("Skipping blob %s: %s\n", key, err)
+				return nil
+			}
+			if err := json.Unmarshal(rawMetadata, metadata); err != nil {
+				// One bad blob shouldn't stop the rest being managed.
+				log.Printf("Skipping blob %s: %s\n", key, err)
+				return nil
+			}
+			infos = append(infos, &BlobInfo{
+				Handle:      handle,
+				Size:        int64(len(data.Get(key))),
+				ContentType: metadata.ContentType,
+				Created:     metadata.Created,
+				Expires:     metadata.Expires,
+				LastUsed:    metadata.LastUsed,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
@@ -0,0 +1,66 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func setUpBoltBlobStore(t *testing.T) (string, *BoltBlobStore) {
+	dir, err := ioutil.TempDir("", "latvis-bolt")
+	gt.AssertNil(t, err)
+	store, err := NewBoltBlobStore(dir + "/blobs.db")
+	gt.AssertNil(t, err)
+	return dir, store
+}
+
+func TestBoltBlobStore(t *testing.T) {
+	dir, store := setUpBoltBlobStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+	testBlobStore(t, store)
+}
+
+func TestBoltBlobStoreKeepsBlobsWhenReopened(t *testing.T) {
+	dir, store := setUpBoltBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	h := simpleHandle()
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte("png")}))
+	gt.AssertNil(t, store.Close())
+
+	store, err := NewBoltBlobStore(dir + "/blobs.db")
+	gt.AssertNil(t, err)
+	defer store.Close()
+	blob, err := store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "png", string(blob.Data))
+}
+
+func TestBoltBlobStoreCorruption(t *testing.T) {
+	dir, store := setUpBoltBlobStore(t)
+	defer os.RemoveAll(dir)
+	defer store.Close()
+
+	h := simpleHandle()
+	key := []byte(h.storageKey())
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte("png")}))
+	gt.AssertNil(t, store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BOLT_METADATA_BUCKET).Put(key, []byte("{not json"))
+	}))
+	_, err := store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrBlobCorrupted), "Bad metadata")
+
+	infos, err := store.List()
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, 0, len(infos), "Corrupted blobs are skipped")
+
+	gt.AssertNil(t, store.Delete(h))
+	_, err = store.Fetch(h)
+	gt.AssertTrue(t, errors.Is(err, ErrNoSuchBlob))
+}
@@ -3,6 +3,7 @@ package latvis
 import (
 	"github.com/mrjones/gt"
 
+	"context"
 	"fmt"
 	"image"
 	"image/color"
@@ -24,14 +25,14 @@ func TestBwPngVisualizer2By2(t *testing.T) {
 	h = append(h, &Coordinate{Lat: .5, Lng: .5})
 
 	visualizer := &BwPngVisualizer{}
-	img := visualizer.makeImage(&h, bounds, 2, 2)
+	img := visualizer.makeImage(context.Background(), &h, bounds, 2, 2)
 	assertImage(t, [][]color.Color{
 		[]color.Color{W, W},
 		[]color.Color{B, W}}, img)
 
 	h = append(h, &Coordinate{Lat: 1.5, Lng: 1.5})
 
-	img = visualizer.makeImage(&h, bounds, 2, 2)
+	img = visualizer.makeImage(context.Background(), &h, bounds, 2, 2)
 	assertImage(t, [][]color.Color{
 		[]color.Color{W, B},
 		[]color.Color{B, W}}, img)
@@ -52,7 +53,7 @@ func TestBwPngVisualizerNotSquare(t *testing.T) {
 
 	visualizer := &BwPngVisualizer{}
 
-	img := visualizer.makeImage(&h, bounds, 5, 3)
+	img := visualizer.makeImage(context.Background(), &h, bounds, 5, 3)
 	assertImage(t, [][]color.Color{
 		[]color.Color{W, W, B, W, W},
 		[]color.Color{W, B, W, B, W},
@@ -75,7 +76,7 @@ func TestBwPngVisualizerSmushed(t *testing.T) {
 
 	visualizer := &BwPngVisualizer{}
 
-	img := visualizer.makeImage(&h, bounds, 2, 2)
+	img := visualizer.makeImage(context.Background(), &h, bounds, 2, 2)
 	assertImage(t, [][]color.Color{
 		[]color.Color{W, W},
 		[]color.Color{B, W}}, img)
@@ -0,0 +1,218 @@
+// Command latvis renders a location history from local files, without going
+// through the web server (so no OAuth, BlobStore or task queue).
+//
+// Usage:
+//
+//	latvis [flags] <history files or directories...>
+//
+// Inputs may be GPX files or Google Takeout exports (Records.json, or the
+// "Semantic Location History" directory), and are told apart automatically.
+//
+// For example, to draw last year's walks around Manhattan as a KDE:
+//
+//	latvis -bounds=40.70,-74.02,40.80,-73.93 -start=2013-01-01 \
+//	    -end=2014-01-01 -style=kde -option=palette=magma -o=manhattan.png Takeout/
+package main
+
+import (
+	"github.com/mrjones/latvis"
+
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	boundsFlag = flag.String("bounds", "",
+		"lllat,lllng,urlat,urlng of the area to draw.  Defaults to fitting the whole history.")
+	startFlag = flag.String("start", "",
+		"Only draw points at or after this time (RFC3339, YYYY-MM-DD, or Unix seconds).")
+	endFlag = flag.String("end", "",
+		"Only draw points at or before this time (RFC3339, YYYY-MM-DD, or Unix seconds).")
+	sizeFlag = flag.Int("size", latvis.DEFAULT_IMAGE_SIZE_PX,
+		"Maximum width and height of the image, in pixels.")
+	styleFlag = flag.String("style", latvis.DEFAULT_STYLE,
+		"Visualization style: "+strings.Join(latvis.VisualizerStyleNames(), ", ")+".")
+	projectionFlag = flag.String("projection", latvis.DEFAULT_PROJECTION,
+		"Map projection: "+strings.Join(latvis.ProjectionNames(), ", ")+".")
+	outputFlag = flag.String("o", "",
+		"Where to write the image.  Use - for stdout.")
+	stylesFlag = flag.Bool("styles", false,
+		"List the styles, and their options, then exit.")
+
+	optionFlags = optionList{}
+)
+
+// Collects repeated -option=name=value flags.
+type optionList map[string]string
+
+func (o optionList) String() string {
+	return fmt.Sprint(map[string]string(o))
+}
+
+func (o optionList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected name=value, got: %s", value)
+	}
+	o[parts[0]] = parts[1]
+	return nil
+}
+
+func init() {
+	flag.Var(optionFlags, "option",
+		"A style option, as name=value (e.g. palette=magma).  May be repeated.  See -styles.")
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <history files or directories...>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *stylesFlag {
+		listStyles()
+		return
+	}
+
+	if flag.NArg() == 0 || *outputFlag == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The first interrupt gives up on loading or rendering the history, and
+	// any after that kill the process as usual.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	go func() {
+		<-interrupts
+		signal.Stop(interrupts)
+		cancel()
+	}()
+
+	if err := run(ctx, flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(ctx context.Context, inputs []string) error {
+	start, err := parseTime(*startFlag)
+	if err != nil {
+		return fmt.Errorf("Invalid -start: %s", err)
+	}
+	end, err := parseTime(*endFlag)
+	if err != nil {
+		return fmt.Errorf("Invalid -end: %s", err)
+	}
+	options := map[string]string{}
+	for name, value := range optionFlags {
+		options[name] = value
+	}
+	if _, ok := options["size"]; !ok {
+		options["size"] = strconv.Itoa(*sizeFlag)
+	}
+	style, err := latvis.LookupVisualizerStyle(*styleFlag)
+	if err != nil {
+		return err
+	}
+	// Check the options before spending time loading the history.
+	parsedOptions, err := style.ParseOptions(options)
+	if err != nil {
+		return err
+	}
+
+	source, err := latvis.NewFileSource(inputs...)
+	if err != nil {
+		return err
+	}
+	history, err := source.FetchRange(ctx, start, end)
+	if err != nil {
+		return err
+	}
+	if history.Len() == 0 {
+		return fmt.Errorf("No points found in %s", strings.Join(inputs, ", "))
+	}
+
+	var bounds *latvis.BoundingBox
+	if *boundsFlag == "" {
+		bounds, err = history.Bounds(0.02)
+	} else {
+		bounds, err = parseBounds(*boundsFlag)
+	}
+	if err != nil {
+		return err
+	}
+
+	blob, err := latvis.RenderHistory(ctx, history, &latvis.RenderRequest{
+		Bounds:     bounds,
+		Start:      start,
+		End:        end,
+		Style:      style.Name,
+		Options:    parsedOptions,
+		Projection: *projectionFlag,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *outputFlag == "-" {
+		_, err = os.Stdout.Write(blob.Data)
+		return err
+	}
+	return ioutil.WriteFile(*outputFlag, blob.Data, 0644)
+}
+
+func listStyles() {
+	for _, style := range latvis.VisualizerStyles() {
+		fmt.Printf("%s (%s): %s\n", style.Name, style.ContentType, style.Description)
+		for _, option := range style.Options {
+			fmt.Printf("  %s (%s, default %s): %s\n",
+				option.Name, option.Type, option.Default, option.Description)
+		}
+	}
+}
+
+func parseBounds(s string) (*latvis.BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("Invalid -bounds '%s': expected lllat,lllng,urlat,urlng", s)
+	}
+	values := make([]float64, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -bounds '%s': %s", s, err)
+		}
+		values[i] = v
+	}
+	return latvis.NewBoundingBox(
+		latvis.Coordinate{Lat: values[0], Lng: values[1]},
+		latvis.Coordinate{Lat: values[2], Lng: values[3]})
+}
+
+// An empty string is the zero time, which leaves that end of the range open.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("Unrecognized time '%s'", s)
+}
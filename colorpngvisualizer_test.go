@@ -0,0 +1,75 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"context"
+	"image/color"
+	"testing"
+)
+
+func TestColorPngVisualizerUsesPalette(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 2, Lng: 2})
+	gt.AssertNil(t, err)
+
+	palette, err := ParsePalette("0=#0000ff,1=#ff0000")
+	gt.AssertNil(t, err)
+
+	h := make(History, 0)
+	// 16 points in the lower left, 1 in the upper right.
+	for i := 0; i < 16; i++ {
+		h = append(h, &Coordinate{Lat: .5, Lng: .5})
+	}
+	h = append(h, &Coordinate{Lat: 1.5, Lng: 1.5})
+
+	visualizer := &ColorPngVisualizer{Palette: palette}
+	img := visualizer.makeImage(context.Background(), &h, bounds, 2, 2)
+
+	blue := color.NRGBA{0, 0, 255, 255}
+	red := color.NRGBA{255, 0, 0, 255}
+	// Intensity scales with the fourth root of the count, so the single point
+	// is half as intense as the sixteen.
+	purple := color.NRGBA{128, 0, 128, 255}
+	assertImage(t, [][]color.Color{
+		[]color.Color{blue, purple},
+		[]color.Color{red, blue}}, img)
+}
+
+func TestColorPngVisualizerTransparentBackground(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 2, Lng: 2})
+	gt.AssertNil(t, err)
+
+	palette, err := ParsePalette("grayscale")
+	gt.AssertNil(t, err)
+
+	h := make(History, 0)
+	h = append(h, &Coordinate{Lat: .5, Lng: .5})
+
+	visualizer := &ColorPngVisualizer{Palette: palette, Transparent: true}
+	img := visualizer.makeImage(context.Background(), &h, bounds, 2, 2)
+
+	T := color.NRGBA{}
+	assertImage(t, [][]color.Color{
+		[]color.Color{T, T},
+		[]color.Color{color.NRGBA{0, 0, 0, 255}, T}}, img)
+}
+
+func TestColorPngVisualizerEmptyHistory(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 2, Lng: 2})
+	gt.AssertNil(t, err)
+
+	palette, err := ParsePalette("grayscale")
+	gt.AssertNil(t, err)
+
+	h := make(History, 0)
+	visualizer := &ColorPngVisualizer{Palette: palette}
+	img := visualizer.makeImage(context.Background(), &h, bounds, 1, 1)
+
+	assertImage(t, [][]color.Color{[]color.Color{color.NRGBA{255, 255, 255, 255}}}, img)
+}
@@ -1,6 +1,7 @@
 package latvis
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -53,8 +54,14 @@ func GetAuthorizer(callbackUrl string, httpTransport http.RoundTripper) Authoriz
 	}
 }
 
+// Both methods give up, returning ctx.Err(), once ctx is cancelled (or its
+// deadline passes).
 type DataStream interface {
-	FetchRange(start, end time.Time) (*History, error)
+	FetchRange(ctx context.Context, start, end time.Time) (*History, error)
+
+	// Like FetchRange, but reports a PROGRESS_FETCHING event to 'progress'
+	// after each page of results.
+	FetchRangeWithProgress(ctx context.Context, start, end time.Time, progress ProgressFunc) (*History, error)
 }
 
 // ======================================
@@ -88,10 +95,22 @@ func wrapError(wrapMsg string, cause error) error {
 	return errors.New(wrapMsg + ": " + cause.Error())
 }
 
+var (
+	oauthClientId     = CLIENT_ID
+	oauthClientSecret = CLIENT_SECRET
+)
+
+// Replaces the built-in OAuth client credentials (CLIENT_ID and
+// CLIENT_SECRET), e.g. with ones registered for your own server.
+func UseOauthClient(clientId, clientSecret string) {
+	oauthClientId = clientId
+	oauthClientSecret = clientSecret
+}
+
 func NewOauthConfig(callbackUrl string) *oauth.Config {
 	return &oauth.Config{
-		ClientId:     CLIENT_ID,
-		ClientSecret: CLIENT_SECRET,
+		ClientId:     oauthClientId,
+		ClientSecret: oauthClientSecret,
 		Scope:        "https://www.googleapis.com/auth/latitude.all.best",
 		AuthURL:      "https://accounts.google.com/o/oauth2/auth",
 		TokenURL:     "https://accounts.google.com/o/oauth2/token",
@@ -122,9 +141,39 @@ type JsonItem struct {
 	Latitude    float64
 	Longitude   float64
 	TimestampMs string
+
+	// Optional fields, which are omitted if the API doesn't know them.
+	Accuracy *float64 `json:",omitempty"`
+	Altitude *float64 `json:",omitempty"`
+	Speed    *float64 `json:",omitempty"`
+	Heading  *float64 `json:",omitempty"`
+}
+
+func (item *JsonItem) toCoordinate() *Coordinate {
+	c := &Coordinate{
+		Lat:    item.Latitude,
+		Lng:    item.Longitude,
+		Source: "latitude",
+	}
+	if item.Accuracy != nil {
+		c.Accuracy = *item.Accuracy
+	}
+	if item.Altitude != nil {
+		c.Altitude = *item.Altitude
+		c.Known |= FIELD_ALTITUDE
+	}
+	if item.Speed != nil {
+		c.Velocity = *item.Speed
+		c.Known |= FIELD_VELOCITY
+	}
+	if item.Heading != nil {
+		c.Heading = *item.Heading
+		c.Known |= FIELD_HEADING
+	}
+	return c
 }
 
-func (stream *DataStreamImpl) fetchJsonForRange(startMs int64, endMs int64) (*JsonRoot, error) {
+func (stream *DataStreamImpl) fetchJsonForRange(ctx context.Context, startMs int64, endMs int64) (*JsonRoot, error) {
 	fmt.Printf("fetchJsonForRange: %d - %d\n", startMs, endMs)
 	params := make(url.Values)
 	params.Set("granularity", "best")
@@ -132,7 +181,7 @@ func (stream *DataStreamImpl) fetchJsonForRange(startMs int64, endMs int64) (*Js
 	params.Set("min-time", strconv.FormatInt(startMs, 10))
 	params.Set("max-time", strconv.FormatInt(endMs, 10))
 
-	body, err := stream.client.FetchUrl(LOCATION_HISTORY_URL, params)
+	body, err := stream.client.FetchUrl(ctx, LOCATION_HISTORY_URL, params)
 	if err != nil {
 		return nil, wrapError("fetchJsonForRange error / "+LOCATION_HISTORY_URL, err)
 	}
@@ -151,36 +200,41 @@ func (stream *DataStreamImpl) parseJson(jsonObject *JsonRoot, out *History) (sta
 	maxTs := int64(-1)
 
 	for i := 0; i < len(jsonObject.Data.Items); i++ {
-		point := &Coordinate{
-			Lat: jsonObject.Data.Items[i].Latitude,
-			Lng: jsonObject.Data.Items[i].Longitude}
-		out.Add(point)
-		if jsonObject.Data.Items[i].TimestampMs == "" {
-			data, err := json.Marshal(jsonObject.Data.Items[i])
+		item := &jsonObject.Data.Items[i]
+		point := item.toCoordinate()
+		if item.TimestampMs == "" {
+			data, err := json.Marshal(item)
 			if err != nil {
 				fmt.Println("Can't even error properly: " + err.Error())
 			}
 			fmt.Println("Bad history item: " + string(data))
 		} else {
-			ts, err := strconv.ParseInt(jsonObject.Data.Items[i].TimestampMs, 10, 64)
+			ts, err := strconv.ParseInt(item.TimestampMs, 10, 64)
+			if err != nil {
+				return -1, -1, -1, wrapError(
+					"Atoi Error / "+item.TimestampMs, err)
+			}
 			if minTs == -1 || ts < minTs {
 				minTs = ts
 			}
 			if maxTs == -1 || ts > maxTs {
 				maxTs = ts
 			}
-			if err != nil {
-				return -1, -1, -1, wrapError(
-					"Atoi Error / "+jsonObject.Data.Items[i].TimestampMs, err)
-			}
+			point.Timestamp = time.Unix(0, ts*int64(time.Millisecond)).UTC()
 		}
+		out.Add(point)
 	}
 
 	return minTs, maxTs, len(jsonObject.Data.Items), nil
 }
 
-func (stream *DataStreamImpl) FetchRange(start, end time.Time) (*History, error) {
+func (stream *DataStreamImpl) FetchRange(ctx context.Context, start, end time.Time) (*History, error) {
+	return stream.FetchRangeWithProgress(ctx, start, end, nil)
+}
+
+func (stream *DataStreamImpl) FetchRangeWithProgress(ctx context.Context, start, end time.Time, progress ProgressFunc) (*History, error) {
 	history := &History{}
+	pages := 0
 
 	startTs := 1000 * start.Unix()
 	endTs := 1000 * end.Unix()
@@ -190,7 +244,10 @@ func (stream *DataStreamImpl) FetchRange(start, end time.Time) (*History, error)
 	// So we iteratively shrink our window, excluding the time range covered by
 	// the data recieved so far, until we no longer get any new data.
 	for keepGoing {
-		json, err := stream.fetchJsonForRange(startTs, endTs)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		json, err := stream.fetchJsonForRange(ctx, startTs, endTs)
 		if err != nil {
 			return nil, err
 		}
@@ -202,7 +259,11 @@ func (stream *DataStreamImpl) FetchRange(start, end time.Time) (*History, error)
 		if err != nil {
 			return nil, err
 		}
-		keepGoing = (itemsReturned > 0)
+		// Stop if the window isn't shrinking (e.g. because none of the points
+		// had timestamps), rather than asking for the same page forever.
+		keepGoing = (itemsReturned > 0) && minTs != -1 && minTs-1 < endTs
+		pages++
+		progress.report(ProgressEvent{Stage: PROGRESS_FETCHING, Pages: pages, Points: history.Len()})
 		// Make sure we exclude everything we've seen: ask for the min, minus 1ms
 		endTs = minTs - 1
 	}
@@ -213,10 +274,14 @@ type ApiClient struct {
 	httpClient *http.Client
 }
 
-func (conn *ApiClient) FetchUrl(url string, params url.Values) (responseBody string, err error) {
+func (conn *ApiClient) FetchUrl(ctx context.Context, url string, params url.Values) (responseBody string, err error) {
 	params.Set("key", API_KEY)
 
-	response, err := conn.httpClient.Get(url + "?" + params.Encode())
+	request, err := http.NewRequest("GET", url+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := conn.httpClient.Do(request.WithContext(ctx))
 
 	if err != nil {
 		return "", err
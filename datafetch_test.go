@@ -0,0 +1,57 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseJsonKeepsMetadata(t *testing.T) {
+	var root JsonRoot
+	err := json.Unmarshal([]byte(`{"data": {"kind": "latitude#locationFeed", "items": [
+		{"kind": "latitude#location", "timestampMs": "1300000000500",
+		 "latitude": 40.5, "longitude": -73.5, "accuracy": 25, "altitude": 0,
+		 "speed": 3.5, "heading": 90},
+		{"kind": "latitude#location", "timestampMs": "1300000000000",
+		 "latitude": 41.5, "longitude": -74.5}]}}`), &root)
+	gt.AssertNil(t, err)
+
+	stream := &DataStreamImpl{}
+	history := &History{}
+	minTs, maxTs, count, err := stream.parseJson(&root, history)
+	gt.AssertNil(t, err)
+
+	gt.AssertEqualM(t, int64(1300000000000), minTs, "min timestamp")
+	gt.AssertEqualM(t, int64(1300000000500), maxTs, "max timestamp")
+	gt.AssertEqualM(t, 2, count, "count")
+	gt.AssertEqualM(t, 2, history.Len(), "history length")
+
+	full := history.At(0)
+	gt.AssertEqualM(t, 40.5, full.Lat, "lat")
+	gt.AssertEqualM(t, -73.5, full.Lng, "lng")
+	gt.AssertEqualM(t, time.Unix(1300000000, 500*1000*1000).UTC(), full.Timestamp, "timestamp")
+	gt.AssertEqualM(t, 25.0, full.Accuracy, "accuracy")
+	gt.AssertTrueM(t, full.Has(FIELD_ALTITUDE), "altitude of 0 should still be known")
+	gt.AssertEqualM(t, 3.5, full.Velocity, "velocity")
+	gt.AssertEqualM(t, 90.0, full.Heading, "heading")
+	gt.AssertEqualM(t, "latitude", full.Source, "source")
+
+	sparse := history.At(1)
+	gt.AssertTrueM(t, sparse.HasTimestamp(), "timestamp")
+	gt.AssertFalseM(t, sparse.HasAccuracy(), "accuracy")
+	gt.AssertFalseM(t, sparse.Has(FIELD_ALTITUDE), "altitude")
+	gt.AssertFalseM(t, sparse.Has(FIELD_VELOCITY), "velocity")
+	gt.AssertFalseM(t, sparse.Has(FIELD_HEADING), "heading")
+}
+
+func TestParseJsonBadTimestamp(t *testing.T) {
+	root := &JsonRoot{Data: JsonData{Items: []JsonItem{
+		JsonItem{Latitude: 1, Longitude: 1, TimestampMs: "yesterday"},
+	}}}
+
+	stream := &DataStreamImpl{}
+	_, _, _, err := stream.parseJson(root, &History{})
+	gt.AssertNotNil(t, err)
+}
@@ -0,0 +1,688 @@
+package latvis
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ======================================
+// ======= DURABLE URL TASK QUEUE =======
+// ======================================
+
+const (
+	TASK_PENDING = "pending"
+	TASK_LEASED  = "leased"
+	TASK_DEAD    = "dead"
+
+	TASK_LOG_FILENAME = "tasks.log"
+
+	// The longest a worker sleeps before looking for tasks again (e.g. ones
+	// whose retry time or lease has come up).
+	MAX_TASK_POLL_INTERVAL = time.Second
+)
+
+// The log is compacted (rewritten with one record per task) once this many
+// records have been appended to it (checked whenever a worker looks for a
+// task), so that it doesn't grow forever.
+const TASK_LOG_COMPACTION_THRESHOLD = 1000
+
+// Leases last this fraction of TaskQueueOptions.Timeout longer than the
+// Timeout itself, so that a worker which has just given up on a task gets
+// to report back before anyone else is given the task.
+const TASK_LEASE_MARGIN = 0.5
+
+var (
+	ErrNoSuchTask   = errors.New("No such task")
+	ErrTaskNotDead  = errors.New("Only dead tasks can be requeued")
+	ErrTaskIsLeased = errors.New("Running tasks can't be discarded")
+)
+
+// The state of a task in a DurableUrlTaskQueue.
+type TaskInfo struct {
+	Id     string     `json:"id"`
+	Url    string     `json:"url"`
+	Params url.Values `json:"params"`
+
+	// TASK_PENDING, TASK_LEASED (i.e. running) or TASK_DEAD (failed
+	// MaxAttempts times, and won't be retried unless Requeue'd).
+	State    string    `json:"state"`
+	Attempts int       `json:"attempts"`
+	Enqueued time.Time `json:"enqueued"`
+
+	// Pending tasks aren't run before this time (because they're waiting to
+	// be retried).  Leased tasks become pending again at this time, in case
+	// whoever was running them has gone away (e.g. the server crashed).
+	NotBefore time.Time `json:"not_before"`
+
+	// Identifies the current lease of a leased task, so that results from
+	// earlier leases (which ran out before their attempts finished) can be
+	// ignored.
+	Lease string `json:"lease,omitempty"`
+
+	LastError string `json:"last_error,omitempty"`
+}
+
+// DurableUrlTaskQueue is a UrlTaskQueue which keeps its tasks on disk, so that
+// they survive the server restarting.  Like the InProcessUrlTaskQueue, tasks
+// are run by calling the handler registered for their URL.
+//
+// Tasks are delivered at least once: a task is leased to a worker for a
+// little longer than TaskQueueOptions.Timeout, and if the worker doesn't
+// report back before the lease expires, the task is run again (and whatever
+// the first worker eventually reports is ignored).  Tasks which fail
+// MaxAttempts times are kept as TASK_DEAD, for inspection with Tasks().
+//
+// Every change is appended to a log file (one JSON object per line), which is
+// replayed, and compacted, by NewDurableUrlTaskQueue, and compacted again
+// every TASK_LOG_COMPACTION_THRESHOLD records.  With TaskQueueOptions.Keyring
+// set, the tasks' Params are encrypted in the log (everything else is left
+// readable).  Compacting encrypts them all with the current key, so after
+// turning encryption on, or making a new key current, restart the queue
+// before removing the old key.
+type DurableUrlTaskQueue struct {
+	baseUrl string
+	options TaskQueueOptions
+
+	mutex    sync.Mutex
+	handlers map[string]func(http.ResponseWriter, *http.Request)
+	tasks    map[string]*TaskInfo
+	order    []string // Ids, in the order they were enqueued.
+	closed   bool
+
+	logPath      string
+	logFile      *os.File
+	logRecords   int // Appended since the log was last compacted.
+	compactAfter int
+
+	wake    chan bool
+	stop    chan bool
+	running sync.WaitGroup
+}
+
+// One line of the log.
+type taskLogRecord struct {
+	// "task" records the whole state of a task (which is all that's needed
+	// for an Enqueue, or after compaction).  "lease", "retry", "dead" and
+	// "requeue" update its State, Attempts, NotBefore and LastError.  "done"
+	// and "discard" remove it.
+	Op   string    `json:"op"`
+	Id   string    `json:"id"`
+	Task *TaskInfo `json:"task,omitempty"`
+
+	// A "task" record's Task.Params, encrypted (see sealTaskRecord) with
+	// the key with this ID, if the queue has a keyring.
+	KeyId        string `json:"key_id,omitempty"`
+	SealedParams []byte `json:"sealed_params,omitempty"`
+
+	State     string    `json:"state,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	Lease     string    `json:"lease,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Opens (or creates) the queue kept in 'dir', and starts running its tasks.
+// Register handlers straight away, since tasks left over from last time may
+// start running at any moment.  Tasks which were leased when the queue was
+// last open are run again straight away, rather than once their leases run
+// out, since nobody else can be running them: the queue isn't meant to be
+// opened twice at once.
+func NewDurableUrlTaskQueue(dir, baseUrl string, options TaskQueueOptions) (*DurableUrlTaskQueue, error) {
+	options.fillInDefaults()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, TASK_LOG_FILENAME)
+	tasks, order, err := readTaskLog(path, options.Keyring)
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		if task.State == TASK_LEASED {
+			task.State = TASK_PENDING
+			task.NotBefore = time.Time{}
+			task.Lease = ""
+		}
+	}
+	logFile, err := compactTaskLog(path, tasks, order, options.Keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &DurableUrlTaskQueue{
+		baseUrl:      strings.TrimSuffix(baseUrl, "/"),
+		options:      options,
+		handlers:     make(map[string]func(http.ResponseWriter, *http.Request)),
+		tasks:        tasks,
+		order:        order,
+		logPath:      path,
+		logFile:      logFile,
+		compactAfter: TASK_LOG_COMPACTION_THRESHOLD,
+		wake:         make(chan bool, 1),
+		stop:         make(chan bool),
+	}
+	for i := 0; i < options.Concurrency; i++ {
+		q.running.Add(1)
+		go q.work()
+	}
+	return q, nil
+}
+
+// Returns the tasks in the queue kept in 'dir', without opening it (so it's
+// safe to call while a server is using the queue).  'keyring' decrypts the
+// tasks' params, and may be nil if they aren't encrypted.
+func ReadDurableUrlTaskQueue(dir string, keyring *BlobKeyring) ([]TaskInfo, error) {
+	tasks, order, err := readTaskLog(filepath.Join(dir, TASK_LOG_FILENAME), keyring)
+	if err != nil {
+		return nil, err
+	}
+	result := []TaskInfo{}
+	for _, id := range order {
+		result = append(result, *tasks[id])
+	}
+	return result, nil
+}
+
+// Runs tasks for 'path' with the given handler.
+func (q *DurableUrlTaskQueue) Register(path string, handler func(http.ResponseWriter, *http.Request)) {
+	q.mutex.Lock()
+	q.handlers[path] = handler
+	q.mutex.Unlock()
+	q.signal()
+}
+
+func (q *DurableUrlTaskQueue) Enqueue(path string, params *url.Values) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return errors.New("Task queue is closed")
+	}
+	if _, ok := q.handlers[path]; !ok {
+		return fmt.Errorf("No handler registered for task %s", path)
+	}
+	live := 0
+	for _, task := range q.tasks {
+		if task.State != TASK_DEAD {
+			live++
+		}
+	}
+	if live >= q.options.MaxQueueDepth {
+		return ErrTaskQueueFull
+	}
+
+	id, err := newTaskId()
+	if err != nil {
+		return err
+	}
+	task := &TaskInfo{
+		Id:       id,
+		Url:      path,
+		Params:   url.Values{},
+		State:    TASK_PENDING,
+		Enqueued: time.Now(),
+	}
+	for key, values := range *params {
+		task.Params[key] = append([]string{}, values...)
+	}
+
+	record, err := sealTaskRecord(id, task, q.options.Keyring)
+	if err != nil {
+		return err
+	}
+	if err := q.appendRecord(record); err != nil {
+		return err
+	}
+	q.tasks[id] = task
+	q.order = append(q.order, id)
+	q.signal()
+	return nil
+}
+
+// Returns a copy of every task in the queue, in the order they were
+// enqueued.
+func (q *DurableUrlTaskQueue) Tasks() []TaskInfo {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	result := []TaskInfo{}
+	for _, id := range q.order {
+		result = append(result, *q.tasks[id])
+	}
+	return result
+}
+
+// Gives a dead task another MaxAttempts attempts.
+func (q *DurableUrlTaskQueue) Requeue(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	task, ok := q.tasks[id]
+	if !ok {
+		return ErrNoSuchTask
+	}
+	if task.State != TASK_DEAD {
+		return ErrTaskNotDead
+	}
+	record := &taskLogRecord{Op: "requeue", Id: id, State: TASK_PENDING, LastError: task.LastError}
+	if err := q.appendRecord(record); err != nil {
+		return err
+	}
+	applyTaskRecord(task, record)
+	q.signal()
+	return nil
+}
+
+// Removes a task which isn't running.
+func (q *DurableUrlTaskQueue) Discard(id string) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	task, ok := q.tasks[id]
+	if !ok {
+		return ErrNoSuchTask
+	}
+	if task.State == TASK_LEASED {
+		return ErrTaskIsLeased
+	}
+	if err := q.appendRecord(&taskLogRecord{Op: "discard", Id: id}); err != nil {
+		return err
+	}
+	q.remove(id)
+	return nil
+}
+
+// Stops starting new tasks, and waits up to 'timeout' for the running ones
+// to finish.  Anything not finished stays in the log, for next time.
+func (q *DurableUrlTaskQueue) Close(timeout time.Duration) error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mutex.Unlock()
+	close(q.stop)
+
+	done := make(chan bool)
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("Tasks still running after %s", timeout)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if closeErr := q.logFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (q *DurableUrlTaskQueue) work() {
+	defer q.running.Done()
+	for {
+		task, handler, wait := q.lease()
+		if task != nil {
+			q.attempt(task, handler)
+			continue
+		}
+
+		select {
+		case <-q.wake:
+		case <-time.After(wait):
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// Finds a task which is ready to run, and leases it.  If there isn't one,
+// returns how long to wait before looking again.
+func (q *DurableUrlTaskQueue) lease() (*TaskInfo, func(http.ResponseWriter, *http.Request), time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	wait := MAX_TASK_POLL_INTERVAL
+	if q.closed {
+		return nil, nil, wait
+	}
+	q.compactIfNeeded()
+
+	now := time.Now()
+	for _, id := range q.order {
+		task := q.tasks[id]
+		handler, ok := q.handlers[task.Url]
+		if task.State == TASK_DEAD || !ok {
+			continue
+		}
+		if task.NotBefore.After(now) {
+			if task.NotBefore.Sub(now) < wait {
+				wait = task.NotBefore.Sub(now)
+			}
+			continue
+		}
+
+		lease, err := newTaskId()
+		if err != nil {
+			log.Printf("Couldn't lease task %s: %s\n", id, err)
+			return nil, nil, wait
+		}
+		record := &taskLogRecord{
+			Op:        "lease",
+			Id:        id,
+			State:     TASK_LEASED,
+			Attempts:  task.Attempts + 1,
+			NotBefore: now.Add(q.leaseDuration()),
+			Lease:     lease,
+			LastError: task.LastError,
+		}
+		if err := q.appendRecord(record); err != nil {
+			log.Printf("Couldn't lease task %s: %s\n", id, err)
+			return nil, nil, wait
+		}
+		applyTaskRecord(task, record)
+		copy := *task
+		return &copy, handler, 0
+	}
+	return nil, nil, wait
+}
+
+func (q *DurableUrlTaskQueue) leaseDuration() time.Duration {
+	return q.options.Timeout + time.Duration(float64(q.options.Timeout)*TASK_LEASE_MARGIN)
+}
+
+func (q *DurableUrlTaskQueue) attempt(task *TaskInfo, handler func(http.ResponseWriter, *http.Request)) {
+	err := runTask(handler, q.baseUrl, task.Url, task.Params, task.Attempts, &q.options)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if current, ok := q.tasks[task.Id]; !ok || current.State != TASK_LEASED || current.Lease != task.Lease {
+		// The lease ran out, and the task has since been leased again (or
+		// finished, or been discarded), so this result is out of date.
+		log.Printf("Ignoring the result of task %s (%s) from an expired lease\n", task.Id, task.Url)
+		return
+	}
+
+	var record *taskLogRecord
+	if err == nil {
+		record = &taskLogRecord{Op: "done", Id: task.Id}
+	} else if task.Attempts >= q.options.MaxAttempts {
+		log.Printf("Task %s (%s) failed for good after %d attempts: %s\n", task.Id, task.Url, task.Attempts, err)
+		record = &taskLogRecord{
+			Op:        "dead",
+			Id:        task.Id,
+			State:     TASK_DEAD,
+			Attempts:  task.Attempts,
+			LastError: err.Error(),
+		}
+	} else {
+		backoff := q.options.backoff(task.Attempts)
+		log.Printf("Task %s (%s) failed (attempt %d), retrying in %s: %s\n", task.Id, task.Url, task.Attempts, backoff, err)
+		record = &taskLogRecord{
+			Op:        "retry",
+			Id:        task.Id,
+			State:     TASK_PENDING,
+			Attempts:  task.Attempts,
+			NotBefore: time.Now().Add(backoff),
+			LastError: err.Error(),
+		}
+	}
+
+	// If this fails, the lease will eventually run out, and the task will be
+	// run again.
+	if err := q.appendRecord(record); err != nil {
+		log.Printf("Couldn't record the result of task %s: %s\n", task.Id, err)
+		return
+	}
+	if record.Op == "done" {
+		q.remove(task.Id)
+	} else if current, ok := q.tasks[task.Id]; ok {
+		applyTaskRecord(current, record)
+	}
+	q.signal()
+}
+
+// Must be called with the mutex held.
+func (q *DurableUrlTaskQueue) remove(id string) {
+	delete(q.tasks, id)
+	for i, other := range q.order {
+		if other == id {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Wakes up a sleeping worker.
+func (q *DurableUrlTaskQueue) signal() {
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+// Must be called with the mutex held.  Only returns once the record is
+// safely on disk.
+func (q *DurableUrlTaskQueue) appendRecord(record *taskLogRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := q.logFile.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := q.logFile.Sync(); err != nil {
+		return err
+	}
+	q.logRecords++
+	return nil
+}
+
+// Must be called with the mutex held, and not between appending a record
+// and applying it to q.tasks (or the record would be lost).  If compacting
+// fails, the log is left as it was, and compacting is tried again next time.
+func (q *DurableUrlTaskQueue) compactIfNeeded() {
+	if q.logRecords < q.compactAfter {
+		return
+	}
+	logFile, err := compactTaskLog(q.logPath, q.tasks, q.order, q.options.Keyring)
+	q.logRecords = 0
+	if err != nil {
+		log.Printf("Couldn't compact the task log: %s\n", err)
+		return
+	}
+	if err := q.logFile.Close(); err != nil {
+		log.Printf("Couldn't close the old task log: %s\n", err)
+	}
+	q.logFile = logFile
+}
+
+func applyTaskRecord(task *TaskInfo, record *taskLogRecord) {
+	task.State = record.State
+	if record.Attempts > 0 || record.Op == "requeue" {
+		task.Attempts = record.Attempts
+	}
+	task.NotBefore = record.NotBefore
+	task.Lease = record.Lease
+	task.LastError = record.LastError
+}
+
+// The "task" record for 'task', with its Params encrypted with the current
+// key if there's a keyring.  Params are tied to the task's ID, so they can't
+// be swapped between tasks without it being noticed.
+func sealTaskRecord(id string, task *TaskInfo, keyring *BlobKeyring) (*taskLogRecord, error) {
+	record := &taskLogRecord{Op: "task", Id: id, Task: task}
+	if keyring == nil {
+		return record, nil
+	}
+	params, err := json.Marshal(task.Params)
+	if err != nil {
+		return nil, err
+	}
+	keyId := keyring.currentId
+	record.SealedParams, err = sealBlobPart(keyring.keys[keyId], params, taskAdditionalData(id, keyId))
+	if err != nil {
+		return nil, err
+	}
+	unsealed := *task
+	unsealed.Params = nil
+	record.Task = &unsealed
+	record.KeyId = keyId
+	return record, nil
+}
+
+// Decrypts the Params of a "task" record written by sealTaskRecord.  Records
+// written without a keyring are left alone.
+func openTaskRecord(record *taskLogRecord, keyring *BlobKeyring) error {
+	if record.SealedParams == nil {
+		return nil
+	}
+	if keyring == nil {
+		return fmt.Errorf("task %s is encrypted, and there's no keyring", record.Id)
+	}
+	key := keyring.keys[record.KeyId]
+	if key == nil {
+		return fmt.Errorf("task %s is encrypted with key '%s', which isn't in the keyring", record.Id, record.KeyId)
+	}
+	params, err := openBlobPart(key, record.SealedParams, taskAdditionalData(record.Id, record.KeyId))
+	if err != nil {
+		return fmt.Errorf("task %s: %s", record.Id, err)
+	}
+	return json.Unmarshal(params, &record.Task.Params)
+}
+
+func taskAdditionalData(id string, keyId string) []byte {
+	return []byte(fmt.Sprintf("latvis task params\n%s\n%s", id, keyId))
+}
+
+func newTaskId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Replays the log at 'path' (which needn't exist yet).  A half-written last
+// line, from crashing in the middle of an append, is ignored.
+func readTaskLog(path string, keyring *BlobKeyring) (map[string]*TaskInfo, []string, error) {
+	tasks := make(map[string]*TaskInfo)
+	order := []string{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return tasks, order, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything after the last newline was never completely written.
+			return tasks, order, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		record := &taskLogRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %s", path, lineNumber, err)
+		}
+
+		task, known := tasks[record.Id]
+		switch record.Op {
+		case "task":
+			if record.Task == nil {
+				return nil, nil, fmt.Errorf("%s:%d: task record without a task", path, lineNumber)
+			}
+			if err := openTaskRecord(record, keyring); err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %s", path, lineNumber, err)
+			}
+			if !known {
+				order = append(order, record.Id)
+			}
+			tasks[record.Id] = record.Task
+		case "lease", "retry", "dead", "requeue":
+			if known {
+				applyTaskRecord(task, record)
+			}
+		case "done", "discard":
+			if known {
+				delete(tasks, record.Id)
+				for i, id := range order {
+					if id == record.Id {
+						order = append(order[:i], order[i+1:]...)
+						break
+					}
+				}
+			}
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: unknown op '%s'", path, lineNumber, record.Op)
+		}
+	}
+}
+
+// Rewrites the log with a single record per remaining task, and returns it
+// opened for appending more records.  The new log replaces the old one
+// atomically, so if this fails, the old one is still there.
+func compactTaskLog(path string, tasks map[string]*TaskInfo, order []string, keyring *BlobKeyring) (*os.File, error) {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	writer := bufio.NewWriter(f)
+	encoder := json.NewEncoder(writer)
+	for _, id := range order {
+		var record *taskLogRecord
+		if record, err = sealTaskRecord(id, tasks[id], keyring); err != nil {
+			break
+		}
+		if err = encoder.Encode(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,401 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDurableUrlTaskQueue(t *testing.T, dir string, options TaskQueueOptions) *DurableUrlTaskQueue {
+	q, err := NewDurableUrlTaskQueue(dir, "http://localhost", options)
+	gt.AssertNil(t, err)
+	return q
+}
+
+// Polls until 'done' is true of the queue's tasks.
+func waitForTasks(t *testing.T, q *DurableUrlTaskQueue, done func([]TaskInfo) bool) []TaskInfo {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tasks := q.Tasks()
+		if done(tasks) {
+			return tasks
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Gave up waiting for tasks: %v", tasks)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func writeTaskLog(t *testing.T, dir string, records []taskLogRecord, trailer string) {
+	var lines []string
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		gt.AssertNil(t, err)
+		lines = append(lines, string(data)+"\n")
+	}
+	gt.AssertNil(t, ioutil.WriteFile(
+		filepath.Join(dir, TASK_LOG_FILENAME), []byte(strings.Join(lines, "")+trailer), 0600))
+}
+
+func TestDurableUrlTaskQueueRunsTasks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	requests := make(chan *http.Request, 1)
+	q := newTestDurableUrlTaskQueue(t, dir, fastTaskQueueOptions())
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		request.ParseForm()
+		requests <- request
+	})
+
+	params := url.Values{"a": []string{"1"}}
+	gt.AssertNil(t, q.Enqueue("/work", &params))
+	gt.AssertEqualM(t, "1", (<-requests).Form.Get("a"), "Params should be passed along")
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 0 })
+
+	gt.AssertNotNilM(t, q.Enqueue("/unknown", &params), "Tasks need a handler")
+	gt.AssertNil(t, q.Close(time.Second))
+	gt.AssertNotNilM(t, q.Enqueue("/work", &params), "Closed queues shouldn't take tasks")
+}
+
+func TestDurableUrlTaskQueueRetries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	options := fastTaskQueueOptions()
+	options.MaxAttempts = 2
+	attempts := make(chan bool, 3)
+	q := newTestDurableUrlTaskQueue(t, dir, options)
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		attempts <- isFinalTaskAttempt(request)
+		if len(attempts) < 2 {
+			http.Error(response, "try again", http.StatusServiceUnavailable)
+		}
+	})
+
+	params := url.Values{}
+	gt.AssertNil(t, q.Enqueue("/work", &params))
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 0 })
+	gt.AssertEqualM(t, 2, len(attempts), "Should succeed on the second attempt")
+	gt.AssertFalse(t, <-attempts)
+	gt.AssertTrueM(t, <-attempts, "Handlers should know when they're the last attempt")
+	gt.AssertNil(t, q.Close(time.Second))
+}
+
+func TestDurableUrlTaskQueueDeadLettersAndRequeuesAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	options := fastTaskQueueOptions()
+	options.MaxAttempts = 2
+	q := newTestDurableUrlTaskQueue(t, dir, options)
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		http.Error(response, "broken", http.StatusInternalServerError)
+	})
+
+	params := url.Values{"a": []string{"1"}}
+	gt.AssertNil(t, q.Enqueue("/work", &params))
+	tasks := waitForTasks(t, q, func(tasks []TaskInfo) bool {
+		return len(tasks) == 1 && tasks[0].State == TASK_DEAD
+	})
+	gt.AssertEqual(t, 2, tasks[0].Attempts)
+	gt.AssertTrueM(t, strings.Contains(tasks[0].LastError, "broken"), tasks[0].LastError)
+
+	gt.AssertNil(t, q.Close(time.Second))
+
+	tasks, err = ReadDurableUrlTaskQueue(dir, nil)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, 1, len(tasks), "Dead tasks should be kept on disk")
+	gt.AssertEqual(t, TASK_DEAD, tasks[0].State)
+	id := tasks[0].Id
+
+	done := make(chan string, 1)
+	q = newTestDurableUrlTaskQueue(t, dir, options)
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		request.ParseForm()
+		done <- request.Form.Get("a")
+	})
+	gt.AssertNotNilM(t, q.Requeue("no-such-task"), "Unknown task")
+	gt.AssertNil(t, q.Requeue(id))
+	gt.AssertEqual(t, "1", <-done)
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 0 })
+	gt.AssertNil(t, q.Close(time.Second))
+}
+
+func TestDurableUrlTaskQueueRecoversAfterCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	enqueued := time.Now().Add(-time.Hour)
+	task := func(id string) taskLogRecord {
+		return taskLogRecord{Op: "task", Id: id, Task: &TaskInfo{
+			Id:       id,
+			Url:      "/work",
+			Params:   url.Values{"id": []string{id}},
+			State:    TASK_PENDING,
+			Enqueued: enqueued,
+		}}
+	}
+	// "leased" was running when the server went away, and its lease has since
+	// run out.  "finished" ran to completion, and "waiting" never started.  The
+	// crash happened in the middle of writing the last line.
+	writeTaskLog(t, dir, []taskLogRecord{
+		task("leased"),
+		task("finished"),
+		task("waiting"),
+		{Op: "lease", Id: "leased", State: TASK_LEASED, Attempts: 1, NotBefore: time.Now().Add(-time.Minute)},
+		{Op: "lease", Id: "finished", State: TASK_LEASED, Attempts: 1, NotBefore: time.Now().Add(time.Hour)},
+		{Op: "done", Id: "finished"},
+	}, `{"op":"lease","id":"wai`)
+
+	tasks, err := ReadDurableUrlTaskQueue(dir, nil)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 2, len(tasks))
+	gt.AssertEqual(t, "leased", tasks[0].Id)
+	gt.AssertEqual(t, TASK_LEASED, tasks[0].State)
+	gt.AssertEqual(t, "waiting", tasks[1].Id)
+	gt.AssertEqual(t, TASK_PENDING, tasks[1].State)
+
+	ran := make(chan string, 2)
+	q := newTestDurableUrlTaskQueue(t, dir, fastTaskQueueOptions())
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		request.ParseForm()
+		ran <- request.Form.Get("id")
+	})
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 0 })
+	gt.AssertNil(t, q.Close(time.Second))
+
+	seen := map[string]bool{<-ran: true, <-ran: true}
+	gt.AssertTrueM(t, seen["leased"], "Expired leases should be redelivered")
+	gt.AssertTrueM(t, seen["waiting"], "Pending tasks should survive the crash")
+
+	// Reopening compacts away the records of finished tasks.
+	q = newTestDurableUrlTaskQueue(t, dir, fastTaskQueueOptions())
+	gt.AssertNil(t, q.Close(time.Second))
+	data, err := ioutil.ReadFile(filepath.Join(dir, TASK_LOG_FILENAME))
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, "", string(data), "Log should be empty once every task is done")
+}
+
+func TestDurableUrlTaskQueueRestartEndsLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The server was stopped in the middle of running the task, long before
+	// its lease would have run out.
+	writeTaskLog(t, dir, []taskLogRecord{
+		{Op: "task", Id: "running", Task: &TaskInfo{Id: "running", Url: "/work", State: TASK_PENDING}},
+		{Op: "lease", Id: "running", State: TASK_LEASED, Attempts: 1, NotBefore: time.Now().Add(time.Hour),
+			Lease: "old-lease"},
+	}, "")
+
+	options := fastTaskQueueOptions()
+	options.MaxAttempts = 5
+	q := newTestDurableUrlTaskQueue(t, dir, options)
+	tasks := q.Tasks()
+	gt.AssertEqual(t, 1, len(tasks))
+	gt.AssertEqual(t, TASK_PENDING, tasks[0].State)
+	gt.AssertTrue(t, tasks[0].NotBefore.IsZero())
+	gt.AssertEqualM(t, 1, tasks[0].Attempts, "The interrupted attempt still counts")
+	gt.AssertNil(t, q.Close(time.Second))
+
+	// The compacted log says so too.
+	tasks, err = ReadDurableUrlTaskQueue(dir, nil)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, TASK_PENDING, tasks[0].State)
+
+	ran := make(chan string, 1)
+	q = newTestDurableUrlTaskQueue(t, dir, options)
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		ran <- request.Header.Get(TASK_ATTEMPT_HEADER)
+	})
+	select {
+	case attempt := <-ran:
+		gt.AssertEqual(t, "2", attempt)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The interrupted task should run again straight away")
+	}
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 0 })
+	gt.AssertNil(t, q.Close(time.Second))
+}
+
+func TestDurableUrlTaskQueueCompactsAsItGoes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	q := newTestDurableUrlTaskQueue(t, dir, fastTaskQueueOptions())
+	q.mutex.Lock()
+	q.compactAfter = 10
+	q.mutex.Unlock()
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {})
+
+	// Each task takes three records: "task", "lease" and "done".
+	for i := 0; i < 20; i++ {
+		gt.AssertNil(t, q.Enqueue("/work", &url.Values{"i": []string{strconv.Itoa(i)}}))
+	}
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 0 })
+	gt.AssertNil(t, q.Close(time.Second))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, TASK_LOG_FILENAME))
+	gt.AssertNil(t, err)
+	lines := strings.Count(string(data), "\n")
+	gt.AssertTrueM(t, lines < 30, fmt.Sprintf("%d lines in the log, rather than 60 uncompacted", lines))
+
+	tasks, err := ReadDurableUrlTaskQueue(dir, nil)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 0, len(tasks))
+}
+
+func TestDurableUrlTaskQueueIgnoresExpiredLeases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	options := fastTaskQueueOptions()
+	options.Concurrency = 2
+	options.Timeout = 50 * time.Millisecond
+	q := newTestDurableUrlTaskQueue(t, dir, options)
+
+	attempts := make(chan bool, 3)
+	secondStarted := make(chan bool)
+	firstDone := make(chan bool)
+	release := make(chan bool)
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		attempts <- true
+		switch len(attempts) {
+		case 1:
+			// Runs on until its lease is up, and the task has been leased
+			// again.
+			<-secondStarted
+			http.Error(response, "too late", http.StatusInternalServerError)
+			close(firstDone)
+		case 2:
+			close(secondStarted)
+			<-release
+		}
+	})
+
+	gt.AssertNil(t, q.Enqueue("/work", &url.Values{}))
+	<-firstDone
+	time.Sleep(10 * time.Millisecond)
+	tasks := q.Tasks()
+	gt.AssertEqual(t, 1, len(tasks))
+	gt.AssertEqualM(t, TASK_LEASED, tasks[0].State, "The first attempt's failure shouldn't end the second's lease")
+	gt.AssertEqual(t, 2, tasks[0].Attempts)
+	gt.AssertEqual(t, "", tasks[0].LastError)
+	gt.AssertNotNilM(t, q.Discard(tasks[0].Id), "Leased tasks can't be discarded")
+
+	close(release)
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 0 })
+	gt.AssertNil(t, q.Close(time.Second))
+}
+
+func TestDurableUrlTaskQueueRejectsWhenFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	options := fastTaskQueueOptions()
+	options.MaxQueueDepth = 2
+	options.MaxAttempts = 1
+	q := newTestDurableUrlTaskQueue(t, dir, options)
+
+	release := make(chan bool)
+	q.Register("/fail", func(response http.ResponseWriter, request *http.Request) {
+		http.Error(response, "broken", http.StatusInternalServerError)
+	})
+	q.Register("/block", func(response http.ResponseWriter, request *http.Request) {
+		<-release
+	})
+
+	params := url.Values{}
+	gt.AssertNil(t, q.Enqueue("/fail", &params))
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 1 && tasks[0].State == TASK_DEAD })
+
+	gt.AssertNil(t, q.Enqueue("/block", &params))
+	gt.AssertNilM(t, q.Enqueue("/block", &params), "Dead tasks shouldn't count towards the depth")
+	gt.AssertEqual(t, ErrTaskQueueFull, q.Enqueue("/block", &params))
+
+	dead := q.Tasks()[0]
+	gt.AssertEqual(t, TASK_DEAD, dead.State)
+	gt.AssertNil(t, q.Discard(dead.Id))
+	gt.AssertEqual(t, 2, len(q.Tasks()))
+
+	close(release)
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 0 })
+	gt.AssertNil(t, q.Close(time.Second))
+}
+
+func TestDurableUrlTaskQueueEncryptsParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-taskqueue")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Queued before encryption was turned on.  Nothing runs "/later" tasks.
+	writeTaskLog(t, dir, []taskLogRecord{{Op: "task", Id: "old", Task: &TaskInfo{
+		Id:       "old",
+		Url:      "/later",
+		Params:   url.Values{"verification_code": []string{"old-secret"}},
+		State:    TASK_PENDING,
+		Enqueued: time.Now(),
+	}}}, "")
+
+	keyring := testBlobKeyring(t, "a", "a")
+	options := fastTaskQueueOptions()
+	options.MaxAttempts = 1
+	options.Keyring = keyring
+	q := newTestDurableUrlTaskQueue(t, dir, options)
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		response.WriteHeader(http.StatusInternalServerError)
+	})
+	gt.AssertNil(t, q.Enqueue("/work", &url.Values{"verification_code": []string{"new-secret"}}))
+	// Dead tasks stay in the log.
+	waitForTasks(t, q, func(tasks []TaskInfo) bool { return len(tasks) == 2 && tasks[1].State == TASK_DEAD })
+	gt.AssertNil(t, q.Close(time.Second))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, TASK_LOG_FILENAME))
+	gt.AssertNil(t, err)
+	gt.AssertFalseM(t, strings.Contains(string(data), "secret"), "Params should be encrypted: "+string(data))
+	gt.AssertTrueM(t, strings.Contains(string(data), "/later"), "Everything else should be readable")
+
+	tasks, err := ReadDurableUrlTaskQueue(dir, keyring)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 2, len(tasks))
+	gt.AssertEqual(t, "old-secret", tasks[0].Params.Get("verification_code"))
+	gt.AssertEqual(t, "new-secret", tasks[1].Params.Get("verification_code"))
+
+	_, err = ReadDurableUrlTaskQueue(dir, nil)
+	gt.AssertNotNilM(t, err, "Can't read encrypted params without a keyring")
+	_, err = ReadDurableUrlTaskQueue(dir, testBlobKeyring(t, "b", "b"))
+	gt.AssertNotNilM(t, err, "Can't read encrypted params without their key")
+	_, err = NewDurableUrlTaskQueue(dir, "http://localhost", fastTaskQueueOptions())
+	gt.AssertNotNil(t, err)
+
+	// Params can't be moved to another task.
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	records := make([]taskLogRecord, len(lines))
+	for i, line := range lines {
+		gt.AssertNil(t, json.Unmarshal([]byte(line), &records[i]))
+	}
+	records[0].SealedParams, records[1].SealedParams = records[1].SealedParams, records[0].SealedParams
+	writeTaskLog(t, dir, records, "")
+	_, err = ReadDurableUrlTaskQueue(dir, keyring)
+	gt.AssertNotNil(t, err)
+}
@@ -0,0 +1,317 @@
+package latvis
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// ======================================
+// ======= ENCRYPTING BLOB STORE ========
+// ======================================
+
+const (
+	// Blob keys are for AES-256.
+	BLOB_KEY_BYTES = 32
+
+	// Where an encrypted blob's Metadata (in the backing store) keeps the ID
+	// of the key it's encrypted with, and the encrypted Request and Metadata.
+	ENCRYPTED_BLOB_KEY_ID_METADATA = "latvis_key_id"
+	ENCRYPTED_BLOB_SEALED_METADATA = "latvis_sealed"
+
+	// What encrypting adds to each blob's Data: a version byte, the GCM
+	// nonce, and the GCM tag.
+	ENCRYPTED_BLOB_VERSION  = 1
+	ENCRYPTED_BLOB_OVERHEAD = 1 + 12 + 16
+)
+
+// The keys an EncryptedBlobStore can decrypt blobs with, and the one it
+// encrypts them with.
+type BlobKeyring struct {
+	currentId string
+	keys      map[string]cipher.AEAD
+}
+
+// Key files are JSON, with base64 keys of BLOB_KEY_BYTES bytes (e.g. from
+// "head -c 32 /dev/urandom | base64"):
+//
+//	{
+//	  "current": "2024-06",
+//	  "keys": {"2024-01": "...", "2024-06": "..."}
+//	}
+//
+// To rotate keys, add a new one, make it current, and then re-encrypt the
+// blobs (see EncryptedBlobStore.Reencrypt) before removing the old one.
+type blobKeyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+func LoadBlobKeyring(filename string) (*BlobKeyring, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	keyFile := &blobKeyFile{}
+	if err := json.Unmarshal(data, keyFile); err != nil {
+		return nil, fmt.Errorf("Invalid key file %s: %s", filename, err)
+	}
+	keys := make(map[string][]byte)
+	for id, encoded := range keyFile.Keys {
+		if keys[id], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("Invalid key '%s' in %s: %s", id, filename, err)
+		}
+	}
+	keyring, err := NewBlobKeyring(keyFile.Current, keys)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key file %s: %s", filename, err)
+	}
+	return keyring, nil
+}
+
+// 'current' must be one of 'keys', which are keyed by ID.
+func NewBlobKeyring(current string, keys map[string][]byte) (*BlobKeyring, error) {
+	keyring := &BlobKeyring{currentId: current, keys: make(map[string]cipher.AEAD)}
+	for id, key := range keys {
+		if len(key) != BLOB_KEY_BYTES {
+			return nil, fmt.Errorf("Key '%s' has %d bytes, rather than %d", id, len(key), BLOB_KEY_BYTES)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if keyring.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if keyring.keys[current] == nil {
+		return nil, fmt.Errorf("No current key '%s'", current)
+	}
+	return keyring, nil
+}
+
+// Encrypts blobs before handing them to another BlobStore, so that what it
+// stores (wherever that is) doesn't give away anyone's location.  Everything
+// but the ContentType, Created and Expires (which the BlobSweeper needs) is
+// encrypted, with AES-GCM.  Blobs are tied to their handles and content
+// types, so they can't be swapped around without it being noticed.
+//
+// It deliberately isn't a BlobURLStore, even if the backing store is, since
+// what that would serve is encrypted.
+type EncryptedBlobStore struct {
+	backing BlobStore
+	keyring *BlobKeyring
+}
+
+// The parts of a Blob which are encrypted along with it.
+type sealedBlobMetadata struct {
+	Request  *RenderRequest    `json:"request,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func NewEncryptedBlobStore(backing BlobStore, keyring *BlobKeyring) *EncryptedBlobStore {
+	return &EncryptedBlobStore{backing: backing, keyring: keyring}
+}
+
+func (s *EncryptedBlobStore) Store(handle *Handle, blob *Blob) error {
+	sealed, err := s.seal(handle, blob)
+	if err != nil {
+		return newBlobError("store", handle, err)
+	}
+	return s.backing.Store(handle, sealed)
+}
+
+func (s *EncryptedBlobStore) Fetch(handle *Handle) (*Blob, error) {
+	sealed, err := s.backing.Fetch(handle)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(handle, sealed)
+}
+
+func (s *EncryptedBlobStore) Delete(handle *Handle) error {
+	return s.backing.Delete(handle)
+}
+
+// Describes the blob without decrypting it, so it doesn't notice tampering
+// (Fetch does).
+func (s *EncryptedBlobStore) Stat(handle *Handle) (*BlobInfo, error) {
+	info, err := statBlob(s.backing, handle)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size >= ENCRYPTED_BLOB_OVERHEAD {
+		info.Size -= ENCRYPTED_BLOB_OVERHEAD
+	}
+	return info, nil
+}
+
+// Sizes are of the decrypted data, as long as the blobs have been encrypted.
+func (s *EncryptedBlobStore) List() ([]*BlobInfo, error) {
+	infos, err := s.backing.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Size >= ENCRYPTED_BLOB_OVERHEAD {
+			info.Size -= ENCRYPTED_BLOB_OVERHEAD
+		}
+	}
+	return infos, nil
+}
+
+// What Reencrypt did.
+type ReencryptResult struct {
+	Reencrypted int `json:"reencrypted"`
+	// Already encrypted with the current key.
+	Current int `json:"current"`
+	Failed  int `json:"failed"`
+}
+
+// Encrypts every blob which isn't already encrypted with the current key,
+// including ones which were stored before they were encrypted at all.  Blobs
+// which can't be re-encrypted are logged and skipped.  Blobs never change once
+// they've been stored, so this can run while the store is in use, although
+// the blobs it re-encrypts count as just used (see BlobInfo.LastUsed).
+func (s *EncryptedBlobStore) Reencrypt() (*ReencryptResult, error) {
+	infos, err := s.backing.List()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReencryptResult{}
+	for _, info := range infos {
+		stored, err := s.backing.Fetch(info.Handle)
+		if errors.Is(err, ErrNoSuchBlob) {
+			// Deleted since it was listed.
+			continue
+		}
+		if err != nil {
+			log.Printf("Couldn't re-encrypt blob %s: %s\n", info.Handle, err)
+			result.Failed++
+			continue
+		}
+
+		keyId, encrypted := stored.Metadata[ENCRYPTED_BLOB_KEY_ID_METADATA]
+		if encrypted && keyId == s.keyring.currentId {
+			result.Current++
+			continue
+		}
+		blob := stored
+		if encrypted {
+			blob, err = s.open(info.Handle, stored)
+		}
+		if err == nil {
+			err = s.Store(info.Handle, blob)
+		}
+		if err != nil {
+			log.Printf("Couldn't re-encrypt blob %s: %s\n", info.Handle, err)
+			result.Failed++
+			continue
+		}
+		result.Reencrypted++
+	}
+	log.Printf("Re-encrypted blobs: %d re-encrypted, %d already current, %d failed\n",
+		result.Reencrypted, result.Current, result.Failed)
+	return result, nil
+}
+
+func (s *EncryptedBlobStore) seal(handle *Handle, blob *Blob) (*Blob, error) {
+	metadata, err := json.Marshal(&sealedBlobMetadata{Request: blob.Request, Metadata: blob.Metadata})
+	if err != nil {
+		return nil, err
+	}
+	keyId := s.keyring.currentId
+	key := s.keyring.keys[keyId]
+	sealedData, err := sealBlobPart(key, blob.Data, blobAdditionalData("data", handle, keyId, blob))
+	if err != nil {
+		return nil, err
+	}
+	sealedMetadata, err := sealBlobPart(key, metadata, blobAdditionalData("metadata", handle, keyId, blob))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Blob{
+		Data:        sealedData,
+		ContentType: blob.ContentType,
+		Created:     blob.Created,
+		Expires:     blob.Expires,
+		Metadata: map[string]string{
+			ENCRYPTED_BLOB_KEY_ID_METADATA: keyId,
+			ENCRYPTED_BLOB_SEALED_METADATA: base64.StdEncoding.EncodeToString(sealedMetadata),
+		},
+	}, nil
+}
+
+func (s *EncryptedBlobStore) open(handle *Handle, sealed *Blob) (*Blob, error) {
+	keyId, ok := sealed.Metadata[ENCRYPTED_BLOB_KEY_ID_METADATA]
+	if !ok {
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted,
+			Err: fmt.Errorf("Not encrypted")}
+	}
+	key := s.keyring.keys[keyId]
+	if key == nil {
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobPermission,
+			Err: fmt.Errorf("No key '%s'", keyId)}
+	}
+
+	data, err := openBlobPart(key, sealed.Data, blobAdditionalData("data", handle, keyId, sealed))
+	if err != nil {
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+	}
+	sealedMetadata, err := base64.StdEncoding.DecodeString(sealed.Metadata[ENCRYPTED_BLOB_SEALED_METADATA])
+	if err != nil {
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+	}
+	rawMetadata, err := openBlobPart(key, sealedMetadata, blobAdditionalData("metadata", handle, keyId, sealed))
+	if err != nil {
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+	}
+	metadata := &sealedBlobMetadata{}
+	if err := json.Unmarshal(rawMetadata, metadata); err != nil {
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+	}
+
+	return &Blob{
+		Data:        data,
+		ContentType: sealed.ContentType,
+		Created:     sealed.Created,
+		Request:     metadata.Request,
+		Metadata:    metadata.Metadata,
+		Expires:     sealed.Expires,
+	}, nil
+}
+
+// What each encrypted part of a blob is tied to, besides its key.
+func blobAdditionalData(part string, handle *Handle, keyId string, blob *Blob) []byte {
+	return []byte(fmt.Sprintf("latvis blob %s\n%s\n%s\n%s", part, handle, keyId, blob.contentType()))
+}
+
+// The version byte, then the nonce, then the encrypted 'plaintext'.
+func sealBlobPart(key cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, key.NonceSize())
+	if _, err := cryptorand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append([]byte{ENCRYPTED_BLOB_VERSION}, nonce...)
+	return key.Seal(sealed, nonce, plaintext, additionalData), nil
+}
+
+func openBlobPart(key cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < 1+key.NonceSize() || sealed[0] != ENCRYPTED_BLOB_VERSION {
+		return nil, fmt.Errorf("Not an encrypted blob")
+	}
+	nonce := sealed[1 : 1+key.NonceSize()]
+	plaintext, err := key.Open(nil, nonce, sealed[1+key.NonceSize():], additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decrypt: %s", err)
+	}
+	return plaintext, nil
+}
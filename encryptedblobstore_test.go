@@ -0,0 +1,187 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testBlobKey(c string) []byte {
+	return []byte(strings.Repeat(c, BLOB_KEY_BYTES))
+}
+
+func setUpEncryptedBlobStore(t *testing.T, keyring *BlobKeyring) (string, BlobStore, *EncryptedBlobStore) {
+	dir, backing := setUpFakeBlobStore(t)
+	return dir, backing, NewEncryptedBlobStore(backing, keyring)
+}
+
+func testBlobKeyring(t *testing.T, current string, ids ...string) *BlobKeyring {
+	keys := make(map[string][]byte)
+	for _, id := range ids {
+		keys[id] = testBlobKey(id)
+	}
+	keyring, err := NewBlobKeyring(current, keys)
+	gt.AssertNil(t, err)
+	return keyring
+}
+
+func TestEncryptedBlobStore(t *testing.T) {
+	dir, _, store := setUpEncryptedBlobStore(t, testBlobKeyring(t, "a", "a"))
+	defer os.RemoveAll(dir)
+	testBlobStore(t, store)
+}
+
+func TestEncryptedBlobStoreHidesEverything(t *testing.T) {
+	dir, backing, store := setUpEncryptedBlobStore(t, testBlobKeyring(t, "a", "a"))
+	defer os.RemoveAll(dir)
+
+	h := simpleHandle()
+	request := &RenderRequest{Start: time.Unix(1700000000, 0).UTC(), Style: "secret-style"}
+	gt.AssertNil(t, store.Store(h, &Blob{
+		Data:     []byte("<svg>secret-data</svg>"),
+		Request:  request,
+		Metadata: map[string]string{"secret-key": "secret-value"},
+	}))
+
+	sealed, err := backing.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertNil(t, sealed.Request)
+	gt.AssertEqual(t, "a", sealed.Metadata[ENCRYPTED_BLOB_KEY_ID_METADATA])
+	gt.AssertEqual(t, 2, len(sealed.Metadata))
+	gt.AssertEqual(t, len("<svg>secret-data</svg>")+ENCRYPTED_BLOB_OVERHEAD, len(sealed.Data))
+
+	files, err := ioutil.ReadDir(dir)
+	gt.AssertNil(t, err)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		gt.AssertNil(t, err)
+		gt.AssertFalseM(t, bytes.Contains(data, []byte("secret")), file.Name()+": "+string(data))
+	}
+
+	blob, err := store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "<svg>secret-data</svg>", string(blob.Data))
+	gt.AssertEqual(t, request, blob.Request)
+	gt.AssertEqual(t, "secret-value", blob.Metadata["secret-key"])
+}
+
+func TestEncryptedBlobStoreNoticesTampering(t *testing.T) {
+	dir, backing, store := setUpEncryptedBlobStore(t, testBlobKeyring(t, "a", "a"))
+	defer os.RemoveAll(dir)
+
+	h := simpleHandle()
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte("png")}))
+	sealed, err := backing.Fetch(h)
+	gt.AssertNil(t, err)
+	assertCorrupted := func(blob *Blob, message string) {
+		other := &Handle{timestamp: 1}
+		gt.AssertNil(t, backing.Store(other, blob))
+		_, err := store.Fetch(other)
+		gt.AssertTrueM(t, errors.Is(err, ErrBlobCorrupted), message)
+	}
+
+	assertCorrupted(sealed, "Moved to another handle")
+
+	gt.AssertNil(t, backing.Store(h, &Blob{Data: sealed.Data, Metadata: sealed.Metadata, ContentType: "image/svg+xml"}))
+	_, err = store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrBlobCorrupted), "Changed content type")
+
+	flipped := append([]byte{}, sealed.Data...)
+	flipped[len(flipped)-1] ^= 1
+	gt.AssertNil(t, backing.Store(h, &Blob{Data: flipped, Metadata: sealed.Metadata}))
+	_, err = store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrBlobCorrupted), "Changed data")
+
+	gt.AssertNil(t, backing.Store(h, &Blob{Data: sealed.Data, Metadata: map[string]string{
+		ENCRYPTED_BLOB_KEY_ID_METADATA: "a",
+		ENCRYPTED_BLOB_SEALED_METADATA: base64.StdEncoding.EncodeToString([]byte("garbage")),
+	}}))
+	_, err = store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrBlobCorrupted), "Changed metadata")
+
+	gt.AssertNil(t, backing.Store(h, &Blob{Data: []byte("png")}))
+	_, err = store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrBlobCorrupted), "Not encrypted")
+
+	gt.AssertNil(t, backing.Store(h, &Blob{Data: sealed.Data, Metadata: map[string]string{
+		ENCRYPTED_BLOB_KEY_ID_METADATA: "b",
+		ENCRYPTED_BLOB_SEALED_METADATA: sealed.Metadata[ENCRYPTED_BLOB_SEALED_METADATA],
+	}}))
+	_, err = store.Fetch(h)
+	gt.AssertTrueM(t, errors.Is(err, ErrBlobPermission), "Unknown key")
+}
+
+func TestEncryptedBlobStoreKeyRotation(t *testing.T) {
+	dir, backing, oldStore := setUpEncryptedBlobStore(t, testBlobKeyring(t, "a", "a"))
+	defer os.RemoveAll(dir)
+
+	encrypted := &Handle{timestamp: 100, n1: 1}
+	plain := &Handle{timestamp: 100, n1: 2}
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+	gt.AssertNil(t, oldStore.Store(encrypted, &Blob{Data: []byte("old"), Expires: expires}))
+	gt.AssertNil(t, backing.Store(plain, &Blob{Data: []byte("plain"), Metadata: map[string]string{"k": "v"}}))
+
+	store := NewEncryptedBlobStore(backing, testBlobKeyring(t, "b", "a", "b"))
+	blob, err := store.Fetch(encrypted)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, "old", string(blob.Data), "Old keys still work")
+
+	result, err := store.Reencrypt()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, ReencryptResult{Reencrypted: 2}, *result)
+	result, err = store.Reencrypt()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, ReencryptResult{Current: 2}, *result)
+
+	newStore := NewEncryptedBlobStore(backing, testBlobKeyring(t, "b", "b"))
+	blob, err = newStore.Fetch(encrypted)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "old", string(blob.Data))
+	gt.AssertTrueM(t, expires.Equal(blob.Expires), "Expiry is kept")
+	blob, err = newStore.Fetch(plain)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "plain", string(blob.Data))
+	gt.AssertEqual(t, "v", blob.Metadata["k"])
+
+	sealed, err := backing.Fetch(plain)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "b", sealed.Metadata[ENCRYPTED_BLOB_KEY_ID_METADATA])
+}
+
+func TestLoadBlobKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-keys")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "keys.json")
+	key := func(c string) string { return base64.StdEncoding.EncodeToString(testBlobKey(c)) }
+
+	gt.AssertNil(t, ioutil.WriteFile(filename,
+		[]byte(`{"current": "b", "keys": {"a": "`+key("a")+`", "b": "`+key("b")+`"}}`), 0600))
+	keyring, err := LoadBlobKeyring(filename)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "b", keyring.currentId)
+	gt.AssertEqual(t, 2, len(keyring.keys))
+
+	for _, bad := range []string{
+		`{"current": "c", "keys": {"a": "` + key("a") + `"}}`,
+		`{"current": "a", "keys": {"a": "not base64!"}}`,
+		`{"current": "a", "keys": {"a": "` + base64.StdEncoding.EncodeToString([]byte("short")) + `"}}`,
+		`{"current": "a"}`,
+		`not json`,
+	} {
+		gt.AssertNil(t, ioutil.WriteFile(filename, []byte(bad), 0600))
+		_, err := LoadBlobKeyring(filename)
+		gt.AssertNotNilM(t, err, bad)
+	}
+
+	_, err = LoadBlobKeyring(filepath.Join(dir, "missing.json"))
+	gt.AssertNotNil(t, err)
+}
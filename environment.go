@@ -17,15 +17,22 @@ import (
 // both unit-testing, and also portability (e.g. to the Google Appengine sandbox).
 type Environment struct {
 	blobStore        BlobStore
+	jobStore         JobStore
+	progress         *ProgressBroker
+	running          *runningJobs
 	taskQueue        UrlTaskQueue
 	mockRenderEngine RenderEngineInterface
 	logger           Logger
 	httpTransport    http.RoundTripper
+	tileLayers       map[string]*TileLayer
+	adminToken       string
+	blobSweeper      *BlobSweeper
+	shareLinkKey     []byte
 }
 
 func (env *Environment) Errorf(format string, args ...interface{}) {
 	if env.logger != nil {
-		env.logger.Errorf(format, args)
+		env.logger.Errorf(format, args...)
 	}
 }
 
@@ -33,18 +40,56 @@ func (env *Environment) RenderEngineForRequest(request *http.Request) RenderEngi
 	if env.mockRenderEngine != nil {
 		return env.mockRenderEngine
 	}
-	return NewRenderEngine(env.blobStore, env.httpTransport)
+	return NewRenderEngine(env.blobStore, env.jobStore, env.progress, env.httpTransport)
+}
+
+// Makes the layer available from the TileHandler, replacing any existing
+// layer with the same name.  Layers should be added before serving starts.
+func (env *Environment) AddTileLayer(layer *TileLayer) {
+	if env.tileLayers == nil {
+		env.tileLayers = make(map[string]*TileLayer)
+	}
+	env.tileLayers[layer.Name] = layer
+}
+
+// Returns the named layer, or nil if there isn't one.
+func (env *Environment) TileLayer(name string) *TileLayer {
+	return env.tileLayers[name]
+}
+
+// Turns on the admin pages (see AdminBlobsHandler), for requests bearing
+// the given token.
+func (env *Environment) EnableAdmin(token string) {
+	env.adminToken = token
+}
+
+// Lets admins trigger sweeps of the BlobStore (see AdminSweepHandler).
+func (env *Environment) UseBlobSweeper(sweeper *BlobSweeper) {
+	env.blobSweeper = sweeper
+}
+
+// Turns on share links (see ShareHandler), which are signed with the given
+// key (of at least SHARE_LINK_MIN_KEY_BYTES).  Changing the key breaks the
+// links made with the old one.
+func (env *Environment) EnableShareLinks(key []byte) {
+	env.shareLinkKey = key
 }
 
 // Use this instead of &Environment{...} directly to get compile-timer
 // errors when new dependencies are introduced.
+//
+// jobStore may be nil, in which case render jobs' progress isn't tracked.
 func NewEnvironment(blobStore BlobStore,
+	jobStore JobStore,
 	taskQueue UrlTaskQueue,
 	logger Logger,
 	httpTransport http.RoundTripper) *Environment {
 
 	return &Environment{
 		blobStore:     blobStore,
+		jobStore:      jobStore,
+		progress:      NewProgressBroker(),
+		running:       newRunningJobs(),
 		taskQueue:     taskQueue,
 		logger:        logger,
 		httpTransport: httpTransport,
@@ -103,7 +148,7 @@ func (q *SyncUrlTaskQueue) Enqueue(url string, params *url.Values) error {
 type DefaultLogger struct{}
 
 func (l DefaultLogger) Errorf(format string, args ...interface{}) {
-	log.Printf(format, args)
+	log.Printf(format, args...)
 }
 
 type StaticEnvironmentFactory struct {
@@ -0,0 +1,113 @@
+package latvis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ======================================
+// ========= LOCAL FILE SOURCES =========
+// ======================================
+
+// Returns a HistorySource which reads all of the given files, working out
+// for each one whether it's GPX or a Google Takeout export.
+//
+// Directories are treated as Takeout exports (see NewTakeoutSource).  Files
+// ending in .gpx or .json are trusted to be what they say, and anything else
+// is sniffed: GPX is XML, so starts with a '<', and Takeout starts with a '{'.
+func NewFileSource(paths ...string) (HistorySource, error) {
+	gpxPaths := []string{}
+	takeoutPaths := []string{}
+
+	for _, path := range paths {
+		format, err := detectFileFormat(path)
+		if err != nil {
+			return nil, err
+		}
+		switch format {
+		case "gpx":
+			gpxPaths = append(gpxPaths, path)
+		case "takeout":
+			takeoutPaths = append(takeoutPaths, path)
+		}
+	}
+
+	sources := multiSource{}
+	if len(takeoutPaths) > 0 {
+		sources = append(sources, NewTakeoutSource(takeoutPaths...))
+	}
+	if len(gpxPaths) > 0 {
+		sources = append(sources, NewGpxSource(gpxPaths...))
+	}
+	return sources, nil
+}
+
+func detectFileFormat(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "takeout", nil
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpx":
+		return "gpx", nil
+	case ".json":
+		return "takeout", nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("Couldn't recognize the format of %s: %s", path, err)
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n', 0xef, 0xbb, 0xbf: // Whitespace, or a UTF-8 BOM.
+			continue
+		case '<':
+			return "gpx", nil
+		case '{':
+			return "takeout", nil
+		}
+		return "", fmt.Errorf("Couldn't recognize the format of %s (expected GPX or Takeout JSON)", path)
+	}
+}
+
+// Combines the histories from several sources.  Segments are renumbered so
+// that points from different sources never share one.
+type multiSource []HistorySource
+
+func (s multiSource) FetchRange(ctx context.Context, start, end time.Time) (*History, error) {
+	history := &History{}
+	offset := 0
+	for _, source := range s {
+		h, err := source.FetchRange(ctx, start, end)
+		if err != nil {
+			return nil, err
+		}
+		nextOffset := offset
+		for _, c := range *h {
+			c.Segment += offset
+			if c.Segment >= nextOffset {
+				nextOffset = c.Segment + 1
+			}
+			history.Add(c)
+		}
+		offset = nextOffset
+	}
+	return history, nil
+}
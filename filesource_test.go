@@ -0,0 +1,68 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDetectFileFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-filesource")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		gt.AssertNil(t, ioutil.WriteFile(path, []byte(contents), 0600))
+		return path
+	}
+
+	for path, expected := range map[string]string{
+		dir:                                      "takeout",
+		"testdata/sample-1.1.gpx":                "gpx",
+		write("export.json", "not even json"):    "takeout",
+		write("track.xml", "\n  <?xml ?><gpx/>"): "gpx",
+		write("records", "\xef\xbb\xbf{\"locations\": []}"): "takeout",
+	} {
+		format, err := detectFileFormat(path)
+		gt.AssertNil(t, err)
+		gt.AssertEqualM(t, expected, format, path)
+	}
+
+	_, err = detectFileFormat(write("notes.txt", "hello"))
+	gt.AssertNotNil(t, err)
+	_, err = detectFileFormat(write("empty", ""))
+	gt.AssertNotNil(t, err)
+	_, err = detectFileFormat(filepath.Join(dir, "missing.gpx"))
+	gt.AssertNotNil(t, err)
+}
+
+func TestFileSourceCombinesFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-filesource")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	takeout := filepath.Join(dir, "Records")
+	gt.AssertNil(t, ioutil.WriteFile(takeout, []byte(`{"locations": [
+		{"timestampMs": "1000", "latitudeE7": 100000000, "longitudeE7": 200000000}
+	]}`), 0600))
+
+	source, err := NewFileSource("testdata/sample-1.1.gpx", takeout)
+	gt.AssertNil(t, err)
+	history, err := source.FetchRange(context.Background(), time.Time{}, time.Time{})
+	gt.AssertNil(t, err)
+
+	gpxOnly, err := NewGpxSource("testdata/sample-1.1.gpx").FetchRange(context.Background(), time.Time{}, time.Time{})
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, gpxOnly.Len()+1, history.Len(), "Should read both files")
+
+	takeoutSegment := history.At(0).Segment
+	for _, c := range (*history)[1:] {
+		gt.AssertTrueM(t, c.Segment != takeoutSegment, "Sources shouldn't share segments")
+	}
+}
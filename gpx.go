@@ -0,0 +1,230 @@
+package latvis
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ======================================
+// ============= GPX READER =============
+// ======================================
+
+// Plenty of loggers leave the timezone off their <time>s, which GPX doesn't
+// allow.  Those times are taken to be UTC, as GPX times are meant to be.
+const GPX_LOCAL_TIME_FORMAT = "2006-01-02T15:04:05.999999999"
+
+// GpxSource is a HistorySource which reads GPX 1.0 and 1.1 files.
+//
+// Tracks, routes and waypoints are all turned into points.  Every track
+// segment and every route gets its own Coordinate.Segment, as does each
+// waypoint, so that breaks in the recording survive a round trip through
+// WriteGpx.
+type GpxSource struct {
+	paths []string
+}
+
+func NewGpxSource(paths ...string) *GpxSource {
+	return &GpxSource{paths: paths}
+}
+
+func (s *GpxSource) FetchRange(ctx context.Context, start, end time.Time) (*History, error) {
+	history := &History{}
+	for _, path := range s.paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = readGpx(ctx, f, start, end, history)
+		f.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, wrapError("GPX error / "+path, err)
+		}
+	}
+	return history, nil
+}
+
+// GPX 1.0 and 1.1 use different namespaces, but the elements we care about
+// have the same local names, which is all encoding/xml matches on.
+type gpxPoint struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  *float64 `xml:"ele"`
+	Time string   `xml:"time"`
+	Src  string   `xml:"src"`
+
+	// Only present in GPX 1.0.
+	Speed  *float64 `xml:"speed"`
+	Course *float64 `xml:"course"`
+}
+
+func readGpx(ctx context.Context, r io.Reader, start, end time.Time, out *History) error {
+	decoder := xml.NewDecoder(r)
+
+	segment := 0
+	if out.Len() > 0 {
+		segment = out.At(out.Len()-1).Segment + 1
+	}
+	first := true
+	nextSegment := func() {
+		if !first {
+			segment++
+		}
+		first = false
+	}
+
+	sawGpx := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch element.Name.Local {
+		case "gpx":
+			sawGpx = true
+		case "trkseg", "rte":
+			nextSegment()
+		case "wpt":
+			nextSegment()
+			fallthrough
+		case "trkpt", "rtept":
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var p gpxPoint
+			if err := decoder.DecodeElement(&p, &element); err != nil {
+				return err
+			}
+			c, err := p.toCoordinate(segment)
+			if err != nil {
+				return err
+			}
+			if inTimeRange(c.Timestamp, start, end) {
+				out.Add(c)
+			}
+		}
+	}
+
+	if !sawGpx {
+		return fmt.Errorf("No <gpx> element found")
+	}
+	return nil
+}
+
+func (p *gpxPoint) toCoordinate(segment int) (*Coordinate, error) {
+	c := &Coordinate{
+		Lat:     p.Lat,
+		Lng:     p.Lon,
+		Source:  "gpx",
+		Segment: segment,
+	}
+	if p.Src != "" {
+		c.Source = p.Src
+	}
+	if p.Time != "" {
+		t, err := time.Parse(time.RFC3339Nano, p.Time)
+		if err != nil {
+			t, err = time.Parse(GPX_LOCAL_TIME_FORMAT, p.Time)
+		}
+		if err != nil {
+			return nil, wrapError("Bad <time> / "+p.Time, err)
+		}
+		c.Timestamp = t.UTC()
+	}
+	if p.Ele != nil {
+		c.Altitude = *p.Ele
+		c.Known |= FIELD_ALTITUDE
+	}
+	if p.Speed != nil {
+		c.Velocity = *p.Speed
+		c.Known |= FIELD_VELOCITY
+	}
+	if p.Course != nil {
+		c.Heading = *p.Course
+		c.Known |= FIELD_HEADING
+	}
+	return c, nil
+}
+
+// ======================================
+// ============= GPX WRITER =============
+// ======================================
+
+// Writes a history as a single-track GPX 1.1 document, with one <trkseg> per
+// Coordinate.Segment.
+//
+// If bounds is non-nil, points outside of it are dropped, and a zero start or
+// end leaves that side of the time range open.  Wherever points are dropped
+// from the middle of a segment, the segment is split so that the output never
+// claims continuous movement across the gap.
+//
+// GPX 1.1 has no standard place for velocity or heading, so those are lost.
+func WriteGpx(w io.Writer, history *History, bounds *BoundingBox, start, end time.Time) error {
+	out := bufio.NewWriter(w)
+
+	out.WriteString(xml.Header)
+	out.WriteString(`<gpx version="1.1" creator="latvis" xmlns="http://www.topografix.com/GPX/1/1">` + "\n")
+	out.WriteString(" <trk>\n")
+
+	inSegment := false
+	lastSegment := 0
+	for i := 0; i < history.Len(); i++ {
+		c := history.At(i)
+		if (bounds != nil && !bounds.Contains(c)) || !inTimeRange(c.Timestamp, start, end) {
+			if inSegment {
+				out.WriteString("  </trkseg>\n")
+				inSegment = false
+			}
+			continue
+		}
+
+		if inSegment && c.Segment != lastSegment {
+			out.WriteString("  </trkseg>\n")
+			inSegment = false
+		}
+		if !inSegment {
+			out.WriteString("  <trkseg>\n")
+			inSegment = true
+		}
+		lastSegment = c.Segment
+
+		writeGpxPoint(out, c)
+	}
+	if inSegment {
+		out.WriteString("  </trkseg>\n")
+	}
+
+	out.WriteString(" </trk>\n")
+	out.WriteString("</gpx>\n")
+	return out.Flush()
+}
+
+func writeGpxPoint(out *bufio.Writer, c *Coordinate) {
+	fmt.Fprintf(out, "   <trkpt lat=\"%s\" lon=\"%s\">",
+		strconv.FormatFloat(c.Lat, 'f', -1, 64),
+		strconv.FormatFloat(c.Lng, 'f', -1, 64))
+	if c.Has(FIELD_ALTITUDE) {
+		fmt.Fprintf(out, "<ele>%s</ele>", strconv.FormatFloat(c.Altitude, 'f', -1, 64))
+	}
+	if c.HasTimestamp() {
+		fmt.Fprintf(out, "<time>%s</time>", c.Timestamp.UTC().Format(time.RFC3339Nano))
+	}
+	out.WriteString("</trkpt>\n")
+}
@@ -0,0 +1,143 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadGpx10(t *testing.T) {
+	h, err := NewGpxSource("testdata/sample-1.0.gpx").FetchRange(context.Background(), time.Time{}, time.Time{})
+	gt.AssertNil(t, err)
+
+	// 1 waypoint, 2 track segments (3 + 2 points) and a 2 point route.
+	gt.AssertEqualM(t, 8, h.Len(), "Unexpected number of points")
+	gt.AssertEqualM(t, []int{1, 3, 2, 2}, segmentLengths(h), "Unexpected segments")
+
+	wpt := h.At(0)
+	gt.AssertEqualM(t, 40.7484, wpt.Lat, "waypoint lat")
+	gt.AssertEqualM(t, 443.0, wpt.Altitude, "waypoint elevation")
+
+	trkpt := h.At(1)
+	gt.AssertEqualM(t, time.Date(2012, 6, 1, 12, 0, 0, 0, time.UTC), trkpt.Timestamp, "time")
+	gt.AssertTrueM(t, trkpt.Has(FIELD_VELOCITY), "GPX 1.0 has speed")
+	gt.AssertEqualM(t, 1.4, trkpt.Velocity, "speed")
+	gt.AssertTrueM(t, trkpt.Has(FIELD_HEADING), "GPX 1.0 has course")
+	gt.AssertEqualM(t, 90.0, trkpt.Heading, "course")
+	gt.AssertEqualM(t, "gpx", trkpt.Source, "source")
+
+	rtept := h.At(7)
+	gt.AssertFalseM(t, rtept.Has(FIELD_ALTITUDE), "route points have no elevation")
+}
+
+func TestReadGpx11(t *testing.T) {
+	h, err := NewGpxSource("testdata/sample-1.1.gpx").FetchRange(context.Background(), time.Time{}, time.Time{})
+	gt.AssertNil(t, err)
+
+	gt.AssertEqualM(t, []int{3, 2}, segmentLengths(h), "Unexpected segments")
+	gt.AssertEqualM(t, time.Date(2013, 9, 14, 7, 0, 0, 250*1000*1000, time.UTC),
+		h.At(0).Timestamp, "fractional seconds")
+	gt.AssertEqualM(t, -179.98, h.At(2).Lng, "lng")
+}
+
+func TestReadGpxHonorsRange(t *testing.T) {
+	h, err := NewGpxSource("testdata/sample-1.0.gpx").FetchRange(context.Background(),
+		time.Date(2012, 6, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2012, 6, 1, 13, 0, 0, 0, time.UTC))
+	gt.AssertNil(t, err)
+
+	gt.AssertEqualM(t, []int{3, 2}, segmentLengths(h), "Only the track is in range")
+}
+
+func TestReadGpxGivesUpWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewGpxSource("testdata/sample-1.0.gpx").FetchRange(ctx, time.Time{}, time.Time{})
+	gt.AssertEqual(t, context.Canceled, err)
+}
+
+func TestReadGpxRejectsOtherXml(t *testing.T) {
+	err := readGpx(context.Background(), strings.NewReader("<kml><Placemark/></kml>"), time.Time{}, time.Time{}, &History{})
+	gt.AssertNotNil(t, err)
+
+	err = readGpx(context.Background(), strings.NewReader("<gpx><trk><trkseg><trkpt lat=\"1\" lon=\"2\"><time>noon</time></trkpt>"),
+		time.Time{}, time.Time{}, &History{})
+	gt.AssertNotNil(t, err)
+}
+
+func TestReadGpxTimesWithoutTimezone(t *testing.T) {
+	history := &History{}
+	err := readGpx(context.Background(), strings.NewReader("<gpx><trk><trkseg>"+
+		"<trkpt lat=\"1\" lon=\"2\"><time>2013-05-01T12:00:00</time></trkpt>"+
+		"<trkpt lat=\"3\" lon=\"4\"><time>2013-05-01T12:00:01.5</time></trkpt>"+
+		"</trkseg></trk></gpx>"), time.Time{}, time.Time{}, history)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 2, history.Len())
+	gt.AssertEqualM(t, time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC), history.At(0).Timestamp, "Taken to be UTC")
+	gt.AssertEqual(t, time.Date(2013, 5, 1, 12, 0, 1, 500000000, time.UTC), history.At(1).Timestamp)
+}
+
+func TestGpxRoundTrip(t *testing.T) {
+	for _, filename := range []string{"testdata/sample-1.0.gpx", "testdata/sample-1.1.gpx"} {
+		original, err := NewGpxSource(filename).FetchRange(context.Background(), time.Time{}, time.Time{})
+		gt.AssertNil(t, err)
+
+		var buf bytes.Buffer
+		gt.AssertNil(t, WriteGpx(&buf, original, nil, time.Time{}, time.Time{}))
+
+		roundTripped := &History{}
+		gt.AssertNil(t, readGpx(context.Background(), &buf, time.Time{}, time.Time{}, roundTripped))
+
+		gt.AssertEqualM(t, segmentLengths(original), segmentLengths(roundTripped),
+			filename+": segments should be preserved")
+		for i := 0; i < original.Len(); i++ {
+			expected, actual := original.At(i), roundTripped.At(i)
+			msg := fmt.Sprintf("%s: point %d", filename, i)
+			gt.AssertEqualM(t, expected.Lat, actual.Lat, msg)
+			gt.AssertEqualM(t, expected.Lng, actual.Lng, msg)
+			gt.AssertEqualM(t, expected.Timestamp, actual.Timestamp, msg)
+			gt.AssertEqualM(t, expected.Has(FIELD_ALTITUDE), actual.Has(FIELD_ALTITUDE), msg)
+			gt.AssertEqualM(t, expected.Altitude, actual.Altitude, msg)
+		}
+	}
+}
+
+func TestWriteGpxClipsAndSplitsSegments(t *testing.T) {
+	h := &History{}
+	for i := 0; i < 5; i++ {
+		h.Add(&Coordinate{Lat: 1, Lng: float64(i), Timestamp: time.Unix(int64(100*i), 0)})
+	}
+	h.At(2).Lat = 50 // Outside of the box, in the middle of the segment.
+
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: -1},
+		Coordinate{Lat: 2, Lng: 10})
+	gt.AssertNil(t, err)
+
+	var buf bytes.Buffer
+	gt.AssertNil(t, WriteGpx(&buf, h, bounds, time.Unix(100, 0), time.Time{}))
+
+	clipped := &History{}
+	gt.AssertNil(t, readGpx(context.Background(), &buf, time.Time{}, time.Time{}, clipped))
+
+	// Point 0 is before the start time, and point 2 is outside the box.
+	gt.AssertEqualM(t, []int{1, 2}, segmentLengths(clipped), "Unexpected segments")
+	gt.AssertEqualM(t, 1.0, clipped.At(0).Lng, "first point")
+	gt.AssertEqualM(t, 3.0, clipped.At(1).Lng, "second point")
+}
+
+func segmentLengths(h *History) []int {
+	lengths := []int{}
+	for i := 0; i < h.Len(); i++ {
+		if i == 0 || h.At(i).Segment != h.At(i-1).Segment {
+			lengths = append(lengths, 0)
+		}
+		lengths[len(lengths)-1]++
+	}
+	return lengths
+}
@@ -1,6 +1,8 @@
 package latvis
 
 import (
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net/url"
@@ -13,6 +15,10 @@ import (
 // =========== RENDER REQUEST ===========
 // ======================================
 
+// Visualizer options are sent as "<prefix><option name>" parameters, so that
+// they can't collide with the rest of the RenderRequest.
+const OPTION_PARAM_PREFIX = "opt_"
+
 // Serializes a RenderRequest to a url.Values so that it can be
 // communicated to another URL endpoint.
 func serializeRenderRequest(r *RenderRequest, m *url.Values) {
@@ -29,6 +35,16 @@ func serializeRenderRequest(r *RenderRequest, m *url.Values) {
 	m2.Add("urlat", strconv.FormatFloat(r.Bounds.UpperRight().Lat, 'f', 16, 64))
 	m2.Add("urlng", strconv.FormatFloat(r.Bounds.UpperRight().Lng, 'f', 16, 64))
 
+	if r.Style != "" {
+		m2.Add("style", r.Style)
+	}
+	for name, value := range r.Options {
+		m2.Add(OPTION_PARAM_PREFIX+name, value)
+	}
+	if r.Projection != "" {
+		m2.Add("projection", r.Projection)
+	}
+
 	m.Add("state", m2.Encode())
 }
 
@@ -76,10 +92,31 @@ func deserializeRenderRequest(rawParams *url.Values) (*RenderRequest, error) {
 		return nil, err
 	}
 
+	// Reject unknown projections now, rather than once rendering starts.
+	projection := params.Get("projection")
+	if _, err := NewProjection(projection, bounds); err != nil {
+		return nil, err
+	}
+
+	// Likewise for styles, and their options.
+	rawOptions := make(map[string]string)
+	for key, _ := range params {
+		if strings.HasPrefix(key, OPTION_PARAM_PREFIX) {
+			rawOptions[strings.TrimPrefix(key, OPTION_PARAM_PREFIX)] = params.Get(key)
+		}
+	}
+	_, options, err := parseStyle(params.Get("style"), rawOptions)
+	if err != nil {
+		return nil, err
+	}
+
 	return &RenderRequest{
-		Bounds: bounds,
-		Start:  start,
-		End:    end,
+		Bounds:     bounds,
+		Start:      start,
+		End:        end,
+		Style:      params.Get("style"),
+		Options:    options,
+		Projection: projection,
 	}, nil
 }
 
@@ -132,13 +169,19 @@ func extractStringFromUrl(params *url.Values, param string) (string, error) {
 // ======================================
 
 func serializeHandleToParams(h *Handle, p *url.Values) {
-	p.Add("hStamp", strconv.FormatInt(h.timestamp, 10))
-	p.Add("h1", strconv.FormatInt(h.n1, 10))
-	p.Add("h2", strconv.FormatInt(h.n2, 10))
-	p.Add("h3", strconv.FormatInt(h.n3, 10))
+	p.Add("h", h.String())
 }
 
 func parseHandleFromParams(p *url.Values) (*Handle, error) {
+	if p.Get("h") != "" {
+		return parseHandleString(p.Get("h"))
+	}
+	return parseLegacyHandleFromParams(p)
+}
+
+// Tasks queued before handles were encoded by Handle.String carry their four
+// numbers separately.
+func parseLegacyHandleFromParams(p *url.Values) (*Handle, error) {
 	timestamp, err := strconv.ParseInt(p.Get("hStamp"), 10, 64)
 	if err != nil {
 		return nil, errors.New("[hStamp=" + p.Get("hStamp") + "]" + err.Error())
@@ -163,7 +206,7 @@ func parseHandleFromParams(p *url.Values) (*Handle, error) {
 }
 
 func serializeHandleToUrl(h *Handle, suffix string, page string) string {
-	return fmt.Sprintf("/%s/%d-%d-%d-%d.%s", page, h.timestamp, h.n1, h.n2, h.n3, suffix)
+	return fmt.Sprintf("/%s/%s.%s", page, h, suffix)
 }
 
 func parseHandleFromUrl(fullpath string) (*Handle, error) {
@@ -182,26 +225,18 @@ func parseHandleFromUrl(fullpath string) (*Handle, error) {
 		return nil, errors.New("Invalid filename [3]: " + fullpath)
 	}
 
-	pieces := strings.Split(fileparts[0], "-")
-	if len(pieces) != 4 {
-		return nil, errors.New("Invalid filename [4]: " + fullpath)
-	}
+	return parseHandleString(fileparts[0])
+}
 
-	s, err := strconv.ParseInt(pieces[0], 10, 64)
-	if err != nil {
-		return nil, err
-	}
-	n1, err := strconv.ParseInt(pieces[1], 10, 64)
-	if err != nil {
-		return nil, err
+// Parses a handle written by Handle.String.
+func parseHandleString(text string) (*Handle, error) {
+	b, err := base64.RawURLEncoding.DecodeString(text)
+	if err != nil || len(b) != HANDLE_BYTES {
+		return nil, errors.New("Invalid handle: " + text)
 	}
-	n2, err := strconv.ParseInt(pieces[2], 10, 64)
-	if err != nil {
-		return nil, err
-	}
-	n3, err := strconv.ParseInt(pieces[3], 10, 64)
-	if err != nil {
-		return nil, err
+	var n [4]int64
+	for i := range n {
+		n[i] = int64(binary.BigEndian.Uint64(b[8*i:]))
 	}
-	return &Handle{timestamp: s, n1: n1, n2: n2, n3: n3}, nil
+	return &Handle{timestamp: n[0], n1: n[1], n2: n[2], n3: n[3]}, nil
 }
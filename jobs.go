@@ -0,0 +1,455 @@
+package latvis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ======================================
+// ========== JOB STATUS API ============
+// ======================================
+
+// The stages a render job goes through.  A job ends up either JOB_STORED (its
+// image can be fetched with the same Handle), JOB_FAILED or JOB_CANCELLED.
+// Jobs which fail, but will be tried again, are JOB_RETRYING until then.
+// Stored jobs whose images have since been deleted (e.g. by the BlobSweeper)
+// are reported as JOB_EXPIRED, although that's never stored.
+const (
+	JOB_QUEUED    = "queued"
+	JOB_FETCHING  = "fetching"
+	JOB_RENDERING = "rendering"
+	JOB_RETRYING  = "retrying"
+	JOB_STORED    = "stored"
+	JOB_FAILED    = "failed"
+	JOB_CANCELLED = "cancelled"
+	JOB_EXPIRED   = "expired"
+)
+
+// Rough progress, in percent, when each stage starts.  Jobs which fail or are
+// cancelled keep the progress they'd made.
+var jobStateProgress = map[string]int{
+	JOB_QUEUED:    0,
+	JOB_FETCHING:  10,
+	JOB_RENDERING: 60,
+	JOB_STORED:    100,
+}
+
+var (
+	ErrNoSuchJob    = errors.New("No such job")
+	ErrJobCancelled = errors.New("Job was cancelled")
+	ErrJobFinished  = errors.New("Job has already finished")
+	ErrJobExpired   = errors.New("The image has expired, and been deleted")
+
+	// Retrying won't help, e.g. because the request is malformed, or the
+	// (single-use) verification code has already been used.
+	ErrJobPermanentFailure = errors.New("Job can't be retried")
+)
+
+// Marks 'err' as one which retrying won't fix, so that it Is
+// ErrJobPermanentFailure (while keeping its message).
+func permanentJobError(err error) error {
+	return &permanentError{err: err}
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Is(target error) bool {
+	return target == ErrJobPermanentFailure
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// The status of the job rendering the image for a Handle.
+type Job struct {
+	State string `json:"state"`
+
+	// Percent complete.
+	Progress int `json:"progress"`
+
+	// Why the job failed (only set for JOB_FAILED and JOB_CANCELLED), or why
+	// its last attempt did (for JOB_RETRYING).
+	Error string `json:"error,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+func (j *Job) Finished() bool {
+	return j.State == JOB_STORED || j.State == JOB_FAILED || j.State == JOB_CANCELLED || j.State == JOB_EXPIRED
+}
+
+type JobStore interface {
+	// Stores a job, replacing any earlier one with the same handle.
+	Store(handle *Handle, job *Job) error
+
+	// Replaces the job with the given handle with what 'update' makes of it
+	// (it's given nil if there's no job yet), without anyone else changing
+	// the job in between.  If 'update' returns an error, the job is left
+	// alone, and the error is returned.
+	Update(handle *Handle, update func(job *Job) (*Job, error)) error
+
+	// Fetches the job with the given handle, or returns ErrNoSuchJob.
+	Fetch(handle *Handle) (*Job, error)
+
+	// Deletes the job with the given handle.  Deleting a job which isn't
+	// there is fine.
+	Delete(handle *Handle) error
+
+	// Deletes the jobs which were last updated before 'updatedBefore', and
+	// returns how many there were.
+	Prune(updatedBefore time.Time) (int, error)
+}
+
+// Moves the job for 'handle' to a new state, creating it if necessary.
+// 'failure' should be set for JOB_FAILED, JOB_RETRYING and JOB_CANCELLED, to
+// say why.
+//
+// Cancelled jobs stay cancelled: moving one to any other state returns
+// ErrJobCancelled, and leaves it alone.  Otherwise, job statuses are only
+// informational, so failing to record one is logged rather than returned: it
+// shouldn't stop the image from being rendered.
+func updateJob(store JobStore, handle *Handle, state string, failure error) error {
+	if store == nil {
+		return nil
+	}
+
+	err := store.Update(handle, func(job *Job) (*Job, error) {
+		now := time.Now()
+		if job == nil {
+			job = &Job{Created: now}
+		}
+		if job.State == JOB_CANCELLED && state != JOB_CANCELLED {
+			return nil, ErrJobCancelled
+		}
+
+		job.Updated = now
+		job.State = state
+		job.Error = ""
+		if failure != nil {
+			job.Error = failure.Error()
+		}
+		if progress, ok := jobStateProgress[state]; ok {
+			job.Progress = progress
+		}
+		return job, nil
+	})
+	if err == ErrJobCancelled {
+		return err
+	}
+	if err != nil {
+		log.Printf("Updating job %s: %s\n", handle, err)
+	}
+	return nil
+}
+
+// Serves the status of a render job as JSON, at /jobs/<handle>.json.
+func JobHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+	handle, err := parseHandleFromUrl(request.URL.Path)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := env.RenderEngineForRequest(request).FetchJob(handle)
+	if err == ErrNoSuchJob {
+		http.Error(response, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serveErrorWithLabel(response, "JobHandler/FetchJob error", err)
+		return
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		serveErrorWithLabel(response, "JobHandler/Marshal error", err)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Write(data)
+}
+
+// Cancels a render job, in response to a POST to /cancel/<handle>.json.
+// Responds with the cancelled job, as JSON.
+func CancelHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+	if request.Method != "POST" {
+		http.Error(response, "Cancelling a job needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	handle, err := parseHandleFromUrl(request.URL.Path)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := env.RenderEngineForRequest(request).CancelJob(handle)
+	// Stop the job straight away if it's running here.  (Otherwise it'll
+	// notice the next time it checks its JobStore.)
+	running := env.running.cancel(handle)
+	switch {
+	case err == ErrNoSuchJob && running:
+		job = &Job{State: JOB_CANCELLED, Error: ErrJobCancelled.Error()}
+	case err == ErrNoSuchJob:
+		http.Error(response, err.Error(), http.StatusNotFound)
+		return
+	case err == ErrJobFinished:
+		http.Error(response, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		serveErrorWithLabel(response, "CancelHandler/CancelJob error", err)
+		return
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		serveErrorWithLabel(response, "CancelHandler/Marshal error", err)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(data)
+}
+
+// ======================================
+// ========= RUNNING JOB TRACKER ========
+// ======================================
+
+// Keeps track of the jobs running in this process, so that they can be
+// cancelled.  A nil runningJobs tracks nothing.
+type runningJobs struct {
+	mutex   sync.Mutex
+	cancels map[Handle]context.CancelFunc
+}
+
+func newRunningJobs() *runningJobs {
+	return &runningJobs{cancels: make(map[Handle]context.CancelFunc)}
+}
+
+// Returns a context for running the job in, which is cancelled by 'cancel'.
+// Call 'done' once the job has finished.
+func (r *runningJobs) start(parent context.Context, handle *Handle) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(parent)
+	if r == nil {
+		return ctx, cancel
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cancels[*handle] = cancel
+	key := *handle
+	return ctx, func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		delete(r.cancels, key)
+		cancel()
+	}
+}
+
+// Cancels the job, returning whether it was running.
+func (r *runningJobs) cancel(handle *Handle) bool {
+	if r == nil {
+		return false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	cancel, ok := r.cancels[*handle]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// ======================================
+// ======== IN-MEMORY JOB STORE =========
+// ======================================
+
+// Keeps jobs for as long as the process runs.
+type InMemoryJobStore struct {
+	mutex sync.Mutex
+	jobs  map[Handle]Job
+}
+
+func NewInMemoryJobStore() *InMemoryJobStore {
+	return &InMemoryJobStore{jobs: make(map[Handle]Job)}
+}
+
+func (s *InMemoryJobStore) Store(handle *Handle, job *Job) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.jobs[*handle] = *job
+	return nil
+}
+
+func (s *InMemoryJobStore) Update(handle *Handle, update func(job *Job) (*Job, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var current *Job
+	if job, ok := s.jobs[*handle]; ok {
+		current = &job
+	}
+	job, err := update(current)
+	if err != nil {
+		return err
+	}
+	s.jobs[*handle] = *job
+	return nil
+}
+
+func (s *InMemoryJobStore) Fetch(handle *Handle) (*Job, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	job, ok := s.jobs[*handle]
+	if !ok {
+		return nil, ErrNoSuchJob
+	}
+	return &job, nil
+}
+
+func (s *InMemoryJobStore) Delete(handle *Handle) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.jobs, *handle)
+	return nil
+}
+
+func (s *InMemoryJobStore) Prune(updatedBefore time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pruned := 0
+	for handle, job := range s.jobs {
+		if job.Updated.Before(updatedBefore) {
+			delete(s.jobs, handle)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// ======================================
+// ===== SIMPLE FLAT FILE JOB STORE =====
+// ======================================
+
+// Keeps each job as a JSON file in a directory.  Updates are only atomic
+// with respect to each other within a process, so processes shouldn't share
+// a directory.
+type LocalFSJobStore struct {
+	location string
+
+	// Held by Update, and by Store so that it can't sneak in during one.
+	mutex sync.Mutex
+}
+
+// Creates 'location' if it doesn't exist yet.
+func NewLocalFSJobStore(location string) (*LocalFSJobStore, error) {
+	if err := os.MkdirAll(location, 0700); err != nil {
+		return nil, err
+	}
+	return &LocalFSJobStore{location: location}, nil
+}
+
+func (s *LocalFSJobStore) Store(handle *Handle, job *Job) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.store(handle, job)
+}
+
+func (s *LocalFSJobStore) Update(handle *Handle, update func(job *Job) (*Job, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, err := s.Fetch(handle)
+	if err == ErrNoSuchJob {
+		current, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	job, err := update(current)
+	if err != nil {
+		return err
+	}
+	return s.store(handle, job)
+}
+
+func (s *LocalFSJobStore) store(handle *Handle, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	// Written in one go, so that Fetch never sees half a job.
+	return writeFileAtomically(s.filename(handle), data)
+}
+
+func (s *LocalFSJobStore) Fetch(handle *Handle) (*Job, error) {
+	data, err := ioutil.ReadFile(s.filename(handle))
+	if os.IsNotExist(err) {
+		return nil, ErrNoSuchJob
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{}
+	if err := json.Unmarshal(data, job); err != nil {
+		return nil, fmt.Errorf("Corrupt job %s: %s", handle, err)
+	}
+	return job, nil
+}
+
+func (s *LocalFSJobStore) Delete(handle *Handle) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := os.Remove(s.filename(handle))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Goes by the files' modification times, which are when the jobs were last
+// stored, so that the jobs needn't all be read.  Jobs which can't be deleted
+// are logged and skipped.
+func (s *LocalFSJobStore) Prune(updatedBefore time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries, err := ioutil.ReadDir(s.location)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, entry := range entries {
+		// Skips the temporary files of writes in progress, too.
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" || !entry.ModTime().Before(updatedBefore) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.location, entry.Name())); err != nil && !os.IsNotExist(err) {
+			log.Printf("Couldn't delete job %s: %s\n", entry.Name(), err)
+			continue
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+func (s *LocalFSJobStore) filename(h *Handle) string {
+	return filepath.Join(s.location, fmt.Sprintf("%d-%d%d%d.json", h.timestamp, h.n1, h.n2, h.n3))
+}
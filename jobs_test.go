@@ -0,0 +1,255 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testJobStore(t *testing.T, store JobStore) {
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	_, err := store.Fetch(h)
+	gt.AssertEqualM(t, ErrNoSuchJob, err, "Nothing stored yet")
+
+	updateJob(store, h, JOB_QUEUED, nil)
+	job, err := store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, JOB_QUEUED, job.State)
+	gt.AssertEqual(t, 0, job.Progress)
+	gt.AssertFalse(t, job.Created.IsZero())
+	created := job.Created
+
+	updateJob(store, h, JOB_RENDERING, nil)
+	updateJob(store, h, JOB_FAILED, errors.New("out of ink"))
+	job, err = store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, JOB_FAILED, job.State)
+	gt.AssertEqual(t, "out of ink", job.Error)
+	gt.AssertEqualM(t, jobStateProgress[JOB_RENDERING], job.Progress, "Failures keep their progress")
+	gt.AssertTrueM(t, created.Equal(job.Created), "Updates keep the creation time")
+	gt.AssertTrue(t, job.Finished())
+
+	updateJob(store, h, JOB_STORED, nil)
+	job, err = store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, JOB_STORED, job.State)
+	gt.AssertEqualM(t, "", job.Error, "A later success clears the error")
+	gt.AssertEqual(t, 100, job.Progress)
+
+	_, err = store.Fetch(&Handle{timestamp: 100, n1: 1, n2: 2, n3: 4})
+	gt.AssertEqual(t, ErrNoSuchJob, err)
+
+	other := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 5}
+	gt.AssertNil(t, updateJob(store, other, JOB_FETCHING, nil))
+	gt.AssertNil(t, updateJob(store, other, JOB_CANCELLED, ErrJobCancelled))
+	gt.AssertEqual(t, ErrJobCancelled, updateJob(store, other, JOB_RENDERING, nil))
+	gt.AssertEqual(t, ErrJobCancelled, updateJob(store, other, JOB_STORED, nil))
+	job, err = store.Fetch(other)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, JOB_CANCELLED, job.State, "Cancelled jobs stay cancelled")
+
+	refused := errors.New("no thanks")
+	gt.AssertEqual(t, refused, store.Update(other, func(job *Job) (*Job, error) {
+		gt.AssertEqual(t, JOB_CANCELLED, job.State)
+		return nil, refused
+	}))
+	gt.AssertNil(t, store.Update(&Handle{timestamp: 100, n1: 1, n2: 2, n3: 6}, func(job *Job) (*Job, error) {
+		gt.AssertTrueM(t, job == nil, "No job yet")
+		return &Job{State: JOB_QUEUED, Updated: time.Now()}, nil
+	}))
+
+	pruned, err := store.Prune(time.Now().Add(-time.Hour))
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, 0, pruned, "Every job is recent")
+	gt.AssertNil(t, store.Delete(h))
+	_, err = store.Fetch(h)
+	gt.AssertEqual(t, ErrNoSuchJob, err)
+	gt.AssertNilM(t, store.Delete(h), "Deleting twice is fine")
+	pruned, err = store.Prune(time.Now().Add(time.Hour))
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 2, pruned)
+	_, err = store.Fetch(other)
+	gt.AssertEqual(t, ErrNoSuchJob, err)
+}
+
+// Many concurrent updates, none of which should be lost.
+func TestJobStoreUpdatesAreAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-jobs")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+	fsStore, err := NewLocalFSJobStore(dir)
+	gt.AssertNil(t, err)
+
+	for _, store := range []JobStore{NewInMemoryJobStore(), fsStore} {
+		h := simpleHandle()
+		var wait sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				gt.AssertNil(t, store.Update(h, func(job *Job) (*Job, error) {
+					if job == nil {
+						job = &Job{}
+					}
+					job.Progress++
+					return job, nil
+				}))
+			}()
+		}
+		wait.Wait()
+		job, err := store.Fetch(h)
+		gt.AssertNil(t, err)
+		gt.AssertEqual(t, 20, job.Progress)
+	}
+}
+
+func TestInMemoryJobStore(t *testing.T) {
+	testJobStore(t, NewInMemoryJobStore())
+}
+
+func TestLocalFSJobStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-jobs")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := NewLocalFSJobStore(dir + "/jobs")
+	gt.AssertNil(t, err)
+	testJobStore(t, store)
+}
+
+func TestJobHandler(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	jobStore := NewInMemoryJobStore()
+	env := NewEnvironment(blobStore, jobStore, nil, nil, nil)
+
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	jobUrl := "http://myhost.com" + serializeHandleToUrl(h, "json", "jobs")
+	res := execute(t, jobUrl, JobHandler, env)
+	gt.AssertEqualM(t, http.StatusNotFound, res.StatusCode, "Unknown job")
+
+	res = execute(t, "http://myhost.com/jobs/100-1-2-3.json", JobHandler, env)
+	gt.AssertEqualM(t, http.StatusBadRequest, res.StatusCode, "Malformed handle")
+
+	updateJob(jobStore, h, JOB_FAILED, errors.New("no data"))
+	res = execute(t, jobUrl, JobHandler, env)
+	gt.AssertEqual(t, http.StatusOK, res.StatusCode)
+	gt.AssertEqual(t, "application/json", res.Headers.Get("Content-Type"))
+	job := &Job{}
+	gt.AssertNil(t, json.Unmarshal([]byte(res.Body), job))
+	gt.AssertEqual(t, JOB_FAILED, job.State)
+	gt.AssertEqual(t, "no data", job.Error)
+
+	// Without a record of the job, a stored image still counts.
+	other := &Handle{timestamp: 100, n1: 4, n2: 5, n3: 6}
+	otherUrl := "http://myhost.com" + serializeHandleToUrl(other, "json", "jobs")
+	gt.AssertNil(t, blobStore.Store(other.imageHandle(), &Blob{}))
+	res = execute(t, otherUrl, JobHandler, env)
+	gt.AssertEqual(t, http.StatusOK, res.StatusCode)
+	gt.AssertNil(t, json.Unmarshal([]byte(res.Body), job))
+	gt.AssertEqual(t, JOB_STORED, job.State)
+
+	// Stored jobs whose images have been swept have expired.
+	updateJob(jobStore, other, JOB_STORED, nil)
+	res = execute(t, otherUrl, JobHandler, env)
+	gt.AssertNil(t, json.Unmarshal([]byte(res.Body), job))
+	gt.AssertEqual(t, JOB_STORED, job.State)
+	gt.AssertNil(t, blobStore.Delete(other.imageHandle()))
+	res = execute(t, otherUrl, JobHandler, env)
+	gt.AssertEqual(t, http.StatusOK, res.StatusCode)
+	gt.AssertNil(t, json.Unmarshal([]byte(res.Body), job))
+	gt.AssertEqual(t, JOB_EXPIRED, job.State)
+	gt.AssertEqual(t, ErrJobExpired.Error(), job.Error)
+	gt.AssertTrue(t, job.Finished())
+
+	// A store which can't say whether the image is there isn't the same as
+	// one without it.
+	broken := &brokenBlobStore{err: &BlobError{Op: "fetch", Handle: other, Kind: ErrBlobPermission}}
+	res = execute(t, otherUrl, JobHandler,
+		NewEnvironment(broken, nil, nil, nil, nil))
+	gt.AssertEqual(t, http.StatusInternalServerError, res.StatusCode)
+}
+
+func TestAsyncTaskCreationRecordsJob(t *testing.T) {
+	jobStore := NewInMemoryJobStore()
+	q := &MockTaskQueue{}
+	env := &Environment{taskQueue: q, jobStore: jobStore}
+	s := "lllat=1.0&lllng=2.0&urlat=3.0&urlng=4.0&start=5&end=6"
+	u := "http://myhost.com/async_drawmap/?code=vercode&state=" + url.QueryEscape(s)
+
+	res := execute(t, u, AsyncDrawMapHandler, env)
+	gt.AssertEqual(t, http.StatusFound, res.StatusCode)
+
+	h, err := parseHandleFromParams(q.lastParams)
+	gt.AssertNil(t, err)
+	job, err := jobStore.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, JOB_QUEUED, job.State)
+}
+
+func TestCancelHandler(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	jobStore := NewInMemoryJobStore()
+	env := NewEnvironment(blobStore, jobStore, nil, nil, nil)
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(env))
+
+	cancel := func(method, url string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest(method, url, nil)
+		gt.AssertNil(t, err)
+		response := httptest.NewRecorder()
+		CancelHandler(response, request)
+		return response
+	}
+
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	cancelUrl := "http://myhost.com" + serializeHandleToUrl(h, "json", "cancel")
+	gt.AssertEqual(t, http.StatusNotFound, cancel("POST", cancelUrl).Code)
+	gt.AssertEqual(t, http.StatusBadRequest, cancel("POST", "http://myhost.com/cancel/100-1-2.json").Code)
+	gt.AssertEqual(t, http.StatusMethodNotAllowed, cancel("GET", cancelUrl).Code)
+
+	updateJob(jobStore, h, JOB_FETCHING, nil)
+	ctx, done := env.running.start(context.Background(), h)
+	defer done()
+
+	response := cancel("POST", cancelUrl)
+	gt.AssertEqual(t, http.StatusOK, response.Code)
+	job := &Job{}
+	gt.AssertNil(t, json.Unmarshal(response.Body.Bytes(), job))
+	gt.AssertEqual(t, JOB_CANCELLED, job.State)
+	gt.AssertEqual(t, ErrJobCancelled.Error(), job.Error)
+	gt.AssertEqualM(t, context.Canceled, ctx.Err(), "The running job should be stopped")
+
+	gt.AssertEqualM(t, http.StatusConflict, cancel("POST", cancelUrl).Code,
+		"Already cancelled")
+
+	updateJob(jobStore, h, JOB_STORED, nil)
+	gt.AssertEqual(t, http.StatusConflict, cancel("POST", cancelUrl).Code)
+}
+
+func TestRunningJobs(t *testing.T) {
+	r := newRunningJobs()
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+
+	ctx, done := r.start(context.Background(), h)
+	gt.AssertTrue(t, r.cancel(h))
+	gt.AssertEqual(t, context.Canceled, ctx.Err())
+	done()
+	gt.AssertFalseM(t, r.cancel(h), "Finished jobs are forgotten")
+
+	var nilJobs *runningJobs
+	ctx, done = nilJobs.start(context.Background(), h)
+	gt.AssertFalse(t, nilJobs.cancel(h))
+	done()
+	gt.AssertEqual(t, context.Canceled, ctx.Err())
+}
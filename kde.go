@@ -0,0 +1,266 @@
+package latvis
+
+import (
+	"context"
+	"image"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// ======================================
+// ============ KDE VISUALIZER ==========
+// ======================================
+
+const DEFAULT_KDE_BANDWIDTH_METERS = 100.0
+
+func init() {
+	RegisterVisualizer(&VisualizerStyle{
+		Name:        "kde",
+		Description: "A kernel density estimate: a heatmap with each point smoothed into a blob",
+		ContentType: "image/png",
+		Extension:   "png",
+		Options: []VisualizerOption{
+			sizeOption,
+			{
+				Name:        "bandwidth",
+				Type:        OPTION_FLOAT,
+				Description: "How far each point is spread, in meters",
+				Default:     formatOptionFloat(DEFAULT_KDE_BANDWIDTH_METERS),
+				Min:         1,
+				Max:         100000,
+			},
+			paletteOption(DEFAULT_PALETTE),
+			transparentOption,
+		},
+		New: func(options VisualizerOptions, projection Projection, progress ProgressFunc) (Visualizer, error) {
+			palette, err := options.Palette("palette")
+			if err != nil {
+				return nil, err
+			}
+			return &KdeVisualizer{
+				BandwidthMeters: options.Float("bandwidth"),
+				Palette:         palette,
+				Transparent:     options.Bool("transparent"),
+				Projection:      projection,
+				Progress:        progress,
+			}, nil
+		},
+	})
+}
+
+// Renders a kernel density estimate of the history: every point is replaced by
+// a Gaussian with a standard deviation of BandwidthMeters, so that sparse
+// areas show up as soft blobs rather than isolated pixels.
+//
+// The Gaussian is approximated by three successive box blurs in each
+// direction, which costs the same no matter how wide the kernel is.
+type KdeVisualizer struct {
+	BandwidthMeters float64
+	Palette         *Palette
+	Transparent     bool
+
+	// Defaults to equirectangular.
+	Projection Projection
+
+	// Told how many points have been drawn, and when encoding starts.  May
+	// be nil.
+	Progress ProgressFunc
+}
+
+func (r *KdeVisualizer) Visualize(ctx context.Context, history *History, bounds *BoundingBox, width int, height int) (*[]byte, error) {
+	img := r.makeImage(ctx, history, bounds, width, height)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.Progress.report(ProgressEvent{Stage: PROGRESS_ENCODING})
+	return imageToPNGBytes(img)
+}
+
+// Seam for testing
+func (r *KdeVisualizer) makeImage(ctx context.Context, history *History, bounds *BoundingBox, width int, height int) image.Image {
+	mapping := newProjectedPixelMapping(bounds, r.Projection, width, height)
+	density := kernelDensity(history, mapping, r.BandwidthMeters, newProgressCounter(ctx, r.Progress, history.Len()))
+	return intensityGridToColorImage(density.normalize(), r.Palette, r.Transparent)
+}
+
+// A width x height grid of densities, stored row by row.
+type densityGrid struct {
+	values        []float64
+	width, height int
+}
+
+func newDensityGrid(width, height int) *densityGrid {
+	return &densityGrid{
+		values: make([]float64, width*height),
+		width:  width,
+		height: height,
+	}
+}
+
+func (d *densityGrid) add(x, y int, v float64) {
+	if x >= 0 && x < d.width && y >= 0 && y < d.height {
+		d.values[y*d.width+x] += v
+	}
+}
+
+func (d *densityGrid) get(x, y int) float64 {
+	return d.values[y*d.width+x]
+}
+
+// Scales the densities into an IntensityGrid, so that the densest pixel has
+// an intensity of 1.
+func (d *densityGrid) normalize() *IntensityGrid {
+	max := 0.0
+	for _, v := range d.values {
+		if v > max {
+			max = v
+		}
+	}
+
+	intensityGrid := &IntensityGrid{Points: make([][]float64, d.width)}
+	for x := 0; x < d.width; x++ {
+		intensityGrid.Points[x] = make([]float64, d.height)
+		if max == 0 {
+			continue
+		}
+		for y := 0; y < d.height; y++ {
+			intensityGrid.Points[x][y] = d.get(x, y) / max
+		}
+	}
+	return intensityGrid
+}
+
+// Stops early (without blurring) if the counter says so.
+func kernelDensity(history *History, mapping *pixelMapping, bandwidthMeters float64, counter *progressCounter) *densityGrid {
+	density := newDensityGrid(mapping.width, mapping.height)
+
+	// Splat each point onto the four nearest pixel centers, so that the
+	// estimate doesn't jump around as points cross pixel boundaries.
+	for i := 0; i < history.Len() && counter.inc(); i++ {
+		c := history.At(i)
+		if !mapping.bounds.Contains(c) {
+			continue
+		}
+		x, y := mapping.position(c)
+		x, y = x-0.5, y-0.5
+		x0, y0 := math.Floor(x), math.Floor(y)
+		fx, fy := x-x0, y-y0
+		ix, iy := int(x0), int(y0)
+
+		density.add(ix, iy, (1-fx)*(1-fy))
+		density.add(ix+1, iy, fx*(1-fy))
+		density.add(ix, iy+1, (1-fx)*fy)
+		density.add(ix+1, iy+1, fx*fy)
+	}
+
+	if counter.err() != nil {
+		return density
+	}
+
+	metersPerPixelX, metersPerPixelY := mapping.metersPerPixel()
+	gaussianBlur(density, bandwidthMeters/metersPerPixelX, bandwidthMeters/metersPerPixelY)
+	return density
+}
+
+// Blurs the grid in place, with separate standard deviations (in pixels)
+// along each axis.
+func gaussianBlur(d *densityGrid, sigmaX, sigmaY float64) {
+	scratch := make([]float64, len(d.values))
+	for _, size := range boxSizesForGaussian(sigmaX, 3) {
+		boxBlurRows(d.values, scratch, d.width, d.height, size/2)
+		d.values, scratch = scratch, d.values
+	}
+	for _, size := range boxSizesForGaussian(sigmaY, 3) {
+		boxBlurColumns(d.values, scratch, d.width, d.height, size/2)
+		d.values, scratch = scratch, d.values
+	}
+}
+
+// Returns the (odd) widths of n box filters which, applied in sequence,
+// approximate a Gaussian with the given standard deviation.
+// See: http://www.peterkovesi.com/papers/FastGaussianSmoothing.pdf
+func boxSizesForGaussian(sigma float64, n int) []int {
+	if !(sigma > 0) {
+		sigma = 0
+	}
+	wIdeal := math.Sqrt(12*sigma*sigma/float64(n) + 1)
+	wl := int(math.Floor(wIdeal))
+	if wl%2 == 0 {
+		wl--
+	}
+	wu := wl + 2
+
+	mIdeal := (12*sigma*sigma - float64(n*wl*wl) - float64(4*n*wl) - float64(3*n)) /
+		float64(-4*wl-4)
+	m := int(math.Floor(mIdeal + 0.5))
+
+	sizes := make([]int, n)
+	for i := range sizes {
+		if i < m {
+			sizes[i] = wl
+		} else {
+			sizes[i] = wu
+		}
+	}
+	return sizes
+}
+
+func boxBlurRows(src, dst []float64, width, height, radius int) {
+	inParallel(height, func(y int) {
+		boxBlurLine(src, dst, y*width, 1, width, radius)
+	})
+}
+
+func boxBlurColumns(src, dst []float64, width, height, radius int) {
+	inParallel(width, func(x int) {
+		boxBlurLine(src, dst, x, width, height, radius)
+	})
+}
+
+// Averages each of the n values starting at src[offset] (spaced 'stride'
+// apart) with its neighbors within 'radius', treating anything past the ends
+// as zero.
+func boxBlurLine(src, dst []float64, offset, stride, n, radius int) {
+	if radius == 0 {
+		for i := 0; i < n; i++ {
+			dst[offset+i*stride] = src[offset+i*stride]
+		}
+		return
+	}
+
+	scale := 1 / float64(2*radius+1)
+	sum := 0.0
+	for i := 0; i < radius && i < n; i++ {
+		sum += src[offset+i*stride]
+	}
+	for i := 0; i < n; i++ {
+		if entering := i + radius; entering < n {
+			sum += src[offset+entering*stride]
+		}
+		if leaving := i - radius - 1; leaving >= 0 {
+			sum -= src[offset+leaving*stride]
+		}
+		dst[offset+i*stride] = sum * scale
+	}
+}
+
+// Calls f(0) ... f(n-1), spread across all CPUs.
+func inParallel(n int, f func(i int)) {
+	workers := runtime.NumCPU()
+	if workers > n {
+		workers = n
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < n; i += workers {
+				f(i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
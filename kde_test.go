@@ -0,0 +1,121 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// A box around the equator that's 1km on each side (give or take).
+func kilometerBox(t *testing.T) *BoundingBox {
+	d := 500 / METERS_PER_DEGREE
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: -d, Lng: -d},
+		Coordinate{Lat: d, Lng: d})
+	gt.AssertNil(t, err)
+	return bounds
+}
+
+func TestKernelDensityIsSymmetricAroundPoint(t *testing.T) {
+	h := History{}
+	h.Add(&Coordinate{Lat: 0, Lng: 0})
+
+	// ~10m per pixel, and a 50m (5 pixel) bandwidth.  An odd size puts the
+	// point right in the middle of pixel (50, 50).
+	d := kernelDensity(&h, newPixelMapping(kilometerBox(t), 101, 101), 50, nil)
+
+	peak := d.get(50, 50)
+	for x := 0; x < 101; x++ {
+		for y := 0; y < 101; y++ {
+			gt.AssertTrueM(t, d.get(x, y) <= peak, "The center should be densest")
+		}
+	}
+	assertClose(t, d.get(45, 50), d.get(55, 50), "Left/right symmetry")
+	assertClose(t, d.get(50, 45), d.get(50, 55), "Up/down symmetry")
+	assertClose(t, d.get(45, 50), d.get(50, 45), "The kernel should be round")
+
+	// One standard deviation out, a Gaussian is ~60% of its peak.
+	ratio := d.get(55, 50) / peak
+	gt.AssertTrueM(t, ratio > 0.5 && ratio < 0.7, "Falloff doesn't look Gaussian")
+
+	total := 0.0
+	for _, v := range d.values {
+		total += v
+	}
+	assertClose(t, 1.0, total, "Blurring shouldn't lose any mass")
+}
+
+func TestKernelDensityWiderBandwidthIsFlatter(t *testing.T) {
+	h := History{}
+	h.Add(&Coordinate{Lat: 0, Lng: 0})
+
+	narrow := kernelDensity(&h, newPixelMapping(kilometerBox(t), 100, 100), 20, nil)
+	wide := kernelDensity(&h, newPixelMapping(kilometerBox(t), 100, 100), 100, nil)
+
+	gt.AssertTrueM(t, narrow.get(50, 50) > wide.get(50, 50), "Wide kernels have lower peaks")
+	gt.AssertTrueM(t, narrow.get(30, 50) < wide.get(30, 50), "Wide kernels reach further")
+}
+
+func TestKdeVisualizerNormalizes(t *testing.T) {
+	h := History{}
+	h.Add(&Coordinate{Lat: 0, Lng: 0})
+	h.Add(&Coordinate{Lat: 0, Lng: 0})
+
+	d := kernelDensity(&h, newPixelMapping(kilometerBox(t), 20, 20), 30, nil)
+	intensity := d.normalize()
+
+	max := 0.0
+	for x := 0; x < 20; x++ {
+		for y := 0; y < 20; y++ {
+			max = math.Max(max, intensity.Points[x][y])
+		}
+	}
+	gt.AssertEqualM(t, 1.0, max, "Densest pixel should have intensity 1")
+
+	empty := newDensityGrid(3, 3).normalize()
+	gt.AssertEqualM(t, 0.0, empty.Points[1][1], "Empty grids stay empty")
+}
+
+func TestBoxSizesForGaussian(t *testing.T) {
+	gt.AssertEqualM(t, []int{1, 1, 1}, boxSizesForGaussian(0, 3), "No blur")
+
+	for _, sigma := range []float64{1, 2.5, 10, 40} {
+		// The variance of a box of width w is (w*w - 1) / 12, and variances add.
+		variance := 0.0
+		for _, w := range boxSizesForGaussian(sigma, 3) {
+			gt.AssertEqualM(t, 1, w%2, "Boxes should have odd widths")
+			variance += float64(w*w-1) / 12
+		}
+		gt.AssertTrueM(t, math.Abs(math.Sqrt(variance)-sigma) < 0.5, "Wrong standard deviation")
+	}
+}
+
+func assertClose(t *testing.T, expected, actual float64, msg string) {
+	if math.Abs(expected-actual) > 1e-9 {
+		t.Fatalf("%s: Expected %f, Actual: %f", msg, expected, actual)
+	}
+}
+
+func BenchmarkKdeVisualizer4096(b *testing.B) {
+	bounds, _ := NewBoundingBox(
+		Coordinate{Lat: 40.5, Lng: -74.3},
+		Coordinate{Lat: 41.0, Lng: -73.7})
+
+	h := make(History, 0, 1000000)
+	for i := 0; i < cap(h); i++ {
+		h = append(h, &Coordinate{
+			Lat: 40.75 + rand.NormFloat64()*0.05,
+			Lng: -74.0 + rand.NormFloat64()*0.05,
+		})
+	}
+
+	palette, _ := ParsePalette(DEFAULT_PALETTE)
+	visualizer := &KdeVisualizer{BandwidthMeters: 200, Palette: palette}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		visualizer.makeImage(context.Background(), &h, bounds, 4096, 4096)
+	}
+}
@@ -0,0 +1,512 @@
+// Command localserver runs latvis as an ordinary (non-AppEngine) HTTP server.
+//
+// Settings come from flags, or from a JSON config file named by -config,
+// whose keys match the flag names, e.g.:
+//
+//	{
+//	  "listen": ":443",
+//	  "base_url": "https://latvis.example.com",
+//	  "tls_cert": "/etc/latvis/cert.pem",
+//	  "tls_key": "/etc/latvis/key.pem",
+//	  "data_dir": "/var/lib/latvis",
+//	  "blob_store": "bolt",
+//	  "oauth_client_id": "...",
+//	  "oauth_client_secret": "...",
+//	  "tile_layers": {"home": ["/var/lib/latvis/Takeout"]},
+//	  "blob_ttl": "720h",
+//	  "max_blob_bytes": 1073741824,
+//	  "blob_cache_bytes": 104857600,
+//	  "blob_key_file": "/etc/latvis/blob_keys.json",
+//	  "admin_token": "...",
+//	  "share_link_key": "..."
+//	}
+//
+// Flags given on the command line take precedence over the config file.
+//
+// On SIGTERM (or SIGINT), the server stops accepting connections, and waits up
+// to -shutdown_timeout for in-flight requests and render jobs to finish.
+// Render jobs are queued on disk (in <data_dir>/queue), so any which don't
+// finish in time are picked up again when the server next starts.  Run with
+// -list_tasks to see what's queued, including jobs which have failed for good.
+// With -admin_token set, /admin/tasks lists them too, and lets admins retry
+// (POST /admin/tasks/<id>) or discard (DELETE /admin/tasks/<id>) them.
+//
+// Rendered images are stored in <data_dir>, either as files (-blob_store=files)
+// or in a single database file, blobs.db (-blob_store=bolt).  Files are
+// easier to look at; the database stores each image and its metadata in one
+// transaction, so they can't get out of step.  Servers which share their
+// images use -blob_store=s3, and an S3 (or compatible, e.g. MinIO) bucket:
+//
+//	{
+//	  "blob_store": "s3",
+//	  "s3_endpoint": "https://s3.eu-west-1.amazonaws.com",
+//	  "s3_region": "eu-west-1",
+//	  "s3_bucket": "latvis-renders",
+//	  "s3_presign_expiry": "1h"
+//	}
+//
+// The S3 credentials come from -s3_access_key_id and -s3_secret_access_key,
+// or else $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY.  With
+// -s3_presign_expiry set, images are served by redirecting to S3.
+//
+// Stored images are kept for -blob_ttl, and the least recently used ones are
+// deleted once they take up more than -max_blob_bytes.  Render jobs' records
+// (in <data_dir>/jobs) are kept for -blob_ttl too, or for a week if it isn't
+// set.  With -admin_token set, /admin/blobs and /admin/sweep let admins
+// manage them by hand.
+//
+// With -blob_cache_bytes set, the most recently used images are also kept in
+// memory.  /admin/stats says how well that's working.
+//
+// With -share_link_key set (to at least 32 random characters), the result
+// page can make links to just the image, which stop working after a while.
+// Changing the key breaks all the links made with the old one.
+//
+// With -blob_key_file set, images (and what they were rendered from) are
+// encrypted before they're stored (see latvis.LoadBlobKeyring for the file's
+// format), and so are the queued render jobs' requests.  Presigned S3 URLs
+// aren't used, since S3 only has the encrypted images.  After turning
+// encryption on, or making a new key current, run with -reencrypt_blobs to
+// encrypt the existing images with the current key, and restart the server
+// to do the same for the queue, before removing an old key.
+package main
+
+import (
+	"github.com/mrjones/latvis"
+
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type Config struct {
+	Listen            string `json:"listen"`
+	BaseUrl           string `json:"base_url"`
+	TlsCert           string `json:"tls_cert"`
+	TlsKey            string `json:"tls_key"`
+	DataDir           string `json:"data_dir"`
+	BlobStore         string `json:"blob_store"`
+	S3Endpoint        string `json:"s3_endpoint"`
+	S3Region          string `json:"s3_region"`
+	S3Bucket          string `json:"s3_bucket"`
+	S3Prefix          string `json:"s3_prefix"`
+	S3AccessKeyId     string `json:"s3_access_key_id"`
+	S3SecretAccessKey string `json:"s3_secret_access_key"`
+	S3PresignExpiry   string `json:"s3_presign_expiry"`
+	S3Timeout         string `json:"s3_timeout"`
+	BlobCacheBytes    int64  `json:"blob_cache_bytes"`
+	BlobKeyFile       string `json:"blob_key_file"`
+	OauthClientId     string `json:"oauth_client_id"`
+	OauthClientSecret string `json:"oauth_client_secret"`
+	ShutdownTimeout   string `json:"shutdown_timeout"`
+	RenderWorkers     int    `json:"render_workers"`
+	MaxQueuedRenders  int    `json:"max_queued_renders"`
+	BlobTtl           string `json:"blob_ttl"`
+	MaxBlobBytes      int64  `json:"max_blob_bytes"`
+	AdminToken        string `json:"admin_token"`
+	ShareLinkKey      string `json:"share_link_key"`
+
+	// Layer name to the history files (see latvis.NewFileSource) to serve
+	// as map tiles.
+	TileLayers map[string][]string `json:"tile_layers"`
+}
+
+var (
+	configFlag = flag.String("config", "", "JSON config file.  Flags override its settings.")
+
+	listenFlag  = flag.String("listen", ":8081", "Address to listen on.")
+	baseUrlFlag = flag.String("base_url", "",
+		"URL the server is reached at from outside.  Defaults to http(s)://localhost<listen>.")
+	tlsCertFlag = flag.String("tls_cert", "", "TLS certificate file.  Serves HTTPS if set (along with -tls_key).")
+	tlsKeyFlag  = flag.String("tls_key", "", "TLS private key file.")
+	dataDirFlag = flag.String("data_dir", "", "Directory to store rendered images in.  Defaults to a temporary directory.")
+
+	oauthClientIdFlag     = flag.String("oauth_client_id", "", "OAuth client ID.  Defaults to the built-in one.")
+	oauthClientSecretFlag = flag.String("oauth_client_secret", "", "OAuth client secret.")
+
+	shutdownTimeoutFlag = flag.String("shutdown_timeout", "30s",
+		"How long to wait for in-flight requests and render jobs when shutting down.")
+	renderWorkersFlag = flag.Int("render_workers", latvis.DEFAULT_TASK_CONCURRENCY,
+		"How many images to render at once.")
+	maxQueuedRendersFlag = flag.Int("max_queued_renders", latvis.DEFAULT_TASK_QUEUE_DEPTH,
+		"How many images may wait to be rendered before new requests are turned away.")
+	blobStoreFlag = flag.String("blob_store", "files",
+		"How to store rendered images: in -data_dir as \"files\" (one per image) or \"bolt\" (one database), or \"s3\".")
+	s3EndpointFlag        = flag.String("s3_endpoint", "", "S3 (or compatible) server for -blob_store=s3, e.g. https://s3.amazonaws.com.")
+	s3RegionFlag          = flag.String("s3_region", latvis.S3_DEFAULT_REGION, "Region of -s3_bucket.")
+	s3BucketFlag          = flag.String("s3_bucket", "", "Bucket to store rendered images in, for -blob_store=s3.")
+	s3PrefixFlag          = flag.String("s3_prefix", "", "Prefix for the keys of rendered images in -s3_bucket.")
+	s3AccessKeyIdFlag     = flag.String("s3_access_key_id", "", "S3 access key ID.  Defaults to $AWS_ACCESS_KEY_ID.")
+	s3SecretAccessKeyFlag = flag.String("s3_secret_access_key", "", "S3 secret access key.  Defaults to $AWS_SECRET_ACCESS_KEY.")
+	s3PresignExpiryFlag   = flag.String("s3_presign_expiry", "0",
+		"If set, images are served by redirecting to presigned S3 URLs which last this long.")
+	s3TimeoutFlag      = flag.String("s3_timeout", latvis.S3_DEFAULT_TIMEOUT.String(), "How long each request to S3 may take.")
+	blobCacheBytesFlag = flag.Int64("blob_cache_bytes", 0,
+		"How many bytes of the most recently used images to keep in memory.  0 turns the cache off.")
+	blobKeyFileFlag = flag.String("blob_key_file", "",
+		"JSON file of keys to encrypt stored images and queued render jobs with.  They aren't encrypted if this isn't set.")
+	blobTtlFlag = flag.String("blob_ttl", "0",
+		"How long to keep rendered images (e.g. 720h).  0 keeps them forever.")
+	maxBlobBytesFlag = flag.Int64("max_blob_bytes", 0,
+		"Once rendered images take up more than this, the least recently used ones are deleted.  0 means no limit.")
+	adminTokenFlag = flag.String("admin_token", "",
+		"Bearer token for the /admin/ pages.  They're turned off if this isn't set.")
+	shareLinkKeyFlag = flag.String("share_link_key", "",
+		"Secret key to sign share links with.  Sharing is turned off if this isn't set.")
+	tileLayerFlag = flag.String("tile_layer", "",
+		"name=path[,path...] of a history to serve at /tiles/name/{z}/{x}/{y}.png.")
+	listTasksFlag = flag.Bool("list_tasks", false,
+		"Print the render jobs queued in -data_dir as JSON, and exit.")
+	reencryptBlobsFlag = flag.Bool("reencrypt_blobs", false,
+		"Encrypt the stored images with the current key from -blob_key_file, and exit.")
+)
+
+func main() {
+	flag.Parse()
+
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *listTasksFlag {
+		err = listTasks(config)
+	} else if *reencryptBlobsFlag {
+		err = reencryptBlobs(config)
+	} else {
+		err = run(config)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Starts from the config file (if any), and then applies any flags which
+// were set explicitly.  Flags which weren't set only fill in blanks.
+func loadConfig() (*Config, error) {
+	config := &Config{}
+	if *configFlag != "" {
+		data, err := ioutil.ReadFile(*configFlag)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("Invalid config file %s: %s", *configFlag, err)
+		}
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	apply := func(name string, value string, setting *string) {
+		if explicit[name] || *setting == "" {
+			*setting = value
+		}
+	}
+	apply("listen", *listenFlag, &config.Listen)
+	apply("base_url", *baseUrlFlag, &config.BaseUrl)
+	apply("tls_cert", *tlsCertFlag, &config.TlsCert)
+	apply("tls_key", *tlsKeyFlag, &config.TlsKey)
+	apply("data_dir", *dataDirFlag, &config.DataDir)
+	apply("blob_store", *blobStoreFlag, &config.BlobStore)
+	apply("s3_endpoint", *s3EndpointFlag, &config.S3Endpoint)
+	apply("s3_region", *s3RegionFlag, &config.S3Region)
+	apply("s3_bucket", *s3BucketFlag, &config.S3Bucket)
+	apply("s3_prefix", *s3PrefixFlag, &config.S3Prefix)
+	apply("s3_access_key_id", *s3AccessKeyIdFlag, &config.S3AccessKeyId)
+	apply("s3_secret_access_key", *s3SecretAccessKeyFlag, &config.S3SecretAccessKey)
+	apply("s3_presign_expiry", *s3PresignExpiryFlag, &config.S3PresignExpiry)
+	apply("s3_timeout", *s3TimeoutFlag, &config.S3Timeout)
+	apply("blob_key_file", *blobKeyFileFlag, &config.BlobKeyFile)
+	if config.S3AccessKeyId == "" {
+		config.S3AccessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if config.S3SecretAccessKey == "" {
+		config.S3SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	apply("oauth_client_id", *oauthClientIdFlag, &config.OauthClientId)
+	apply("oauth_client_secret", *oauthClientSecretFlag, &config.OauthClientSecret)
+	apply("shutdown_timeout", *shutdownTimeoutFlag, &config.ShutdownTimeout)
+	apply("blob_ttl", *blobTtlFlag, &config.BlobTtl)
+	apply("admin_token", *adminTokenFlag, &config.AdminToken)
+	apply("share_link_key", *shareLinkKeyFlag, &config.ShareLinkKey)
+	if explicit["render_workers"] || config.RenderWorkers == 0 {
+		config.RenderWorkers = *renderWorkersFlag
+	}
+	if explicit["max_queued_renders"] || config.MaxQueuedRenders == 0 {
+		config.MaxQueuedRenders = *maxQueuedRendersFlag
+	}
+	if explicit["max_blob_bytes"] || config.MaxBlobBytes == 0 {
+		config.MaxBlobBytes = *maxBlobBytesFlag
+	}
+	if explicit["blob_cache_bytes"] || config.BlobCacheBytes == 0 {
+		config.BlobCacheBytes = *blobCacheBytesFlag
+	}
+
+	if *tileLayerFlag != "" {
+		parts := strings.SplitN(*tileLayerFlag, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid -tile_layer '%s': expected name=path[,path...]", *tileLayerFlag)
+		}
+		if config.TileLayers == nil {
+			config.TileLayers = make(map[string][]string)
+		}
+		config.TileLayers[parts[0]] = strings.Split(parts[1], ",")
+	}
+
+	if (config.TlsCert == "") != (config.TlsKey == "") {
+		return nil, fmt.Errorf("tls_cert and tls_key must be set together")
+	}
+	if config.BaseUrl == "" {
+		scheme := "http"
+		if config.TlsCert != "" {
+			scheme = "https"
+		}
+		if strings.HasPrefix(config.Listen, ":") {
+			config.BaseUrl = scheme + "://localhost" + config.Listen
+		} else {
+			config.BaseUrl = scheme + "://" + config.Listen
+		}
+	}
+	return config, nil
+}
+
+func run(config *Config) error {
+	shutdownTimeout, err := time.ParseDuration(config.ShutdownTimeout)
+	if err != nil {
+		return fmt.Errorf("Invalid shutdown_timeout: %s", err)
+	}
+	blobTtl, err := time.ParseDuration(config.BlobTtl)
+	if err != nil {
+		return fmt.Errorf("Invalid blob_ttl: %s", err)
+	}
+
+	if config.DataDir == "" {
+		config.DataDir, err = ioutil.TempDir("", "latvis")
+		if err != nil {
+			return err
+		}
+		log.Printf("Storing images in %s\n", config.DataDir)
+	}
+
+	if config.OauthClientId != "" {
+		latvis.UseOauthClient(config.OauthClientId, config.OauthClientSecret)
+	}
+
+	keyring, err := loadKeyring(config)
+	if err != nil {
+		return err
+	}
+	taskQueue, err := latvis.NewDurableUrlTaskQueue(queueDir(config), config.BaseUrl, latvis.TaskQueueOptions{
+		Concurrency:   config.RenderWorkers,
+		MaxQueueDepth: config.MaxQueuedRenders,
+		Keyring:       keyring,
+	})
+	if err != nil {
+		return err
+	}
+	taskQueue.Register("/drawmap_worker", latvis.DrawMapWorker)
+	jobStore, err := latvis.NewLocalFSJobStore(filepath.Join(config.DataDir, "jobs"))
+	if err != nil {
+		return err
+	}
+	blobStore, closeBlobStore, err := openBlobStore(config, keyring)
+	if err != nil {
+		return err
+	}
+	defer closeBlobStore()
+	if config.BlobCacheBytes > 0 {
+		blobStore = latvis.NewLRUBlobStore(latvis.LRUBlobStoreOptions{
+			MaxBytes:     config.BlobCacheBytes,
+			Backing:      blobStore,
+			WriteThrough: true,
+		})
+	}
+	env := latvis.NewEnvironment(
+		blobStore,
+		jobStore,
+		taskQueue,
+		&latvis.DefaultLogger{},
+		http.DefaultTransport)
+	if blobTtl > 0 || config.MaxBlobBytes > 0 {
+		sweeper := latvis.StartBlobSweeper(blobStore, latvis.BlobSweeperOptions{
+			DefaultTTL:    blobTtl,
+			MaxTotalBytes: config.MaxBlobBytes,
+			Jobs:          jobStore,
+		})
+		defer sweeper.Close()
+		env.UseBlobSweeper(sweeper)
+	}
+	if config.AdminToken != "" {
+		env.EnableAdmin(config.AdminToken)
+	}
+	if config.ShareLinkKey != "" {
+		if len(config.ShareLinkKey) < latvis.SHARE_LINK_MIN_KEY_BYTES {
+			return fmt.Errorf("-share_link_key must be at least %d characters", latvis.SHARE_LINK_MIN_KEY_BYTES)
+		}
+		env.EnableShareLinks([]byte(config.ShareLinkKey))
+	}
+
+	for name, paths := range config.TileLayers {
+		source, err := latvis.NewFileSource(paths...)
+		if err != nil {
+			return err
+		}
+		history, err := source.FetchRange(context.Background(), time.Time{}, time.Time{})
+		if err != nil {
+			return err
+		}
+		env.AddTileLayer(latvis.NewTileLayer(name, history, nil))
+		log.Printf("Serving %d points at /tiles/%s/\n", history.Len(), name)
+	}
+
+	latvis.Setup(latvis.NewStaticEnvironmentFactory(env))
+
+	server := &http.Server{Addr: config.Listen}
+	stopped := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		log.Printf("Shutting down (%s)\n", <-signals)
+
+		deadline := time.Now().Add(shutdownTimeout)
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		// Stop taking requests first, since they can enqueue more jobs.
+		err := server.Shutdown(ctx)
+		if queueErr := taskQueue.Close(deadline.Sub(time.Now())); err == nil {
+			err = queueErr
+		}
+		stopped <- err
+	}()
+
+	log.Printf("Serving on %s (%s)\n", config.Listen, config.BaseUrl)
+	if config.TlsCert != "" {
+		err = server.ListenAndServeTLS(config.TlsCert, config.TlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-stopped
+}
+
+// Returns nil if there's no -blob_key_file.
+func loadKeyring(config *Config) (*latvis.BlobKeyring, error) {
+	if config.BlobKeyFile == "" {
+		return nil, nil
+	}
+	return latvis.LoadBlobKeyring(config.BlobKeyFile)
+}
+
+// Returns the store (encrypted with 'keyring', if it isn't nil), and a
+// function to close it with.
+func openBlobStore(config *Config, keyring *latvis.BlobKeyring) (latvis.BlobStore, func() error, error) {
+	store, closeStore, err := openUnencryptedBlobStore(config)
+	if err != nil || keyring == nil {
+		return store, closeStore, err
+	}
+	return latvis.NewEncryptedBlobStore(store, keyring), closeStore, nil
+}
+
+func openUnencryptedBlobStore(config *Config) (latvis.BlobStore, func() error, error) {
+	switch config.BlobStore {
+	case "files":
+		return latvis.NewLocalFSBlobStore(config.DataDir), func() error { return nil }, nil
+	case "bolt":
+		store, err := latvis.NewBoltBlobStore(filepath.Join(config.DataDir, "blobs.db"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store.Close, nil
+	case "s3":
+		presignExpiry, err := time.ParseDuration(config.S3PresignExpiry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid s3_presign_expiry: %s", err)
+		}
+		timeout, err := time.ParseDuration(config.S3Timeout)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid s3_timeout: %s", err)
+		}
+		store, err := latvis.NewS3BlobStore(latvis.S3BlobStoreOptions{
+			Endpoint:        config.S3Endpoint,
+			Region:          config.S3Region,
+			Bucket:          config.S3Bucket,
+			Prefix:          config.S3Prefix,
+			AccessKeyId:     config.S3AccessKeyId,
+			SecretAccessKey: config.S3SecretAccessKey,
+			PresignExpiry:   presignExpiry,
+			Timeout:         timeout,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, func() error { return nil }, nil
+	}
+	return nil, nil, fmt.Errorf("Invalid blob_store '%s': expected files, bolt or s3", config.BlobStore)
+}
+
+func queueDir(config *Config) string {
+	return filepath.Join(config.DataDir, "queue")
+}
+
+func listTasks(config *Config) error {
+	if config.DataDir == "" {
+		return fmt.Errorf("-list_tasks needs -data_dir")
+	}
+	keyring, err := loadKeyring(config)
+	if err != nil {
+		return err
+	}
+	tasks, err := latvis.ReadDurableUrlTaskQueue(queueDir(config), keyring)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(tasks, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(data))
+	return err
+}
+
+func reencryptBlobs(config *Config) error {
+	if config.BlobKeyFile == "" {
+		return fmt.Errorf("-reencrypt_blobs needs -blob_key_file")
+	}
+	if config.DataDir == "" && config.BlobStore != "s3" {
+		return fmt.Errorf("-reencrypt_blobs needs -data_dir")
+	}
+	keyring, err := loadKeyring(config)
+	if err != nil {
+		return err
+	}
+	blobStore, closeBlobStore, err := openBlobStore(config, keyring)
+	if err != nil {
+		return err
+	}
+	defer closeBlobStore()
+
+	result, err := blobStore.(*latvis.EncryptedBlobStore).Reencrypt()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	if result.Failed > 0 {
+		return fmt.Errorf("%d images couldn't be re-encrypted", result.Failed)
+	}
+	return nil
+}
@@ -1,13 +1,84 @@
 package latvis
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"math"
 	"time"
 )
 
+// A single location observation.
+//
+// Only Lat and Lng are required.  The rest is optional metadata which a
+// HistorySource fills in when it knows it.  A zero Timestamp or Accuracy means
+// "unknown", but zero is a perfectly good altitude, velocity or heading, so
+// those are only meaningful when the corresponding bit is set in Known.
 type Coordinate struct {
 	Lat float64
 	Lng float64
+
+	// When the observation was made.
+	Timestamp time.Time
+
+	// Radius of horizontal uncertainty, in meters.
+	Accuracy float64
+
+	// Meters above sea level.
+	Altitude float64
+
+	// Ground speed, in meters per second.
+	Velocity float64
+
+	// Direction of travel, in degrees clockwise from true north.
+	Heading float64
+
+	// Where the observation came from (e.g. "latitude", "gps", "wifi").
+	Source string
+
+	// What the person was doing at the time (e.g. "WALKING", "IN_VEHICLE").
+	Activity string
+
+	// Consecutive points with the same Segment were recorded as one continuous
+	// track.  A change in Segment marks a break (e.g. the GPS was switched off).
+	Segment int
+
+	// Which of Altitude, Velocity and Heading have been populated.
+	Known CoordinateField
+}
+
+type CoordinateField uint
+
+const (
+	FIELD_ALTITUDE CoordinateField = 1 << iota
+	FIELD_VELOCITY
+	FIELD_HEADING
+)
+
+func (c *Coordinate) HasTimestamp() bool {
+	return !c.Timestamp.IsZero()
+}
+
+func (c *Coordinate) HasAccuracy() bool {
+	return c.Accuracy > 0
+}
+
+func (c *Coordinate) Has(field CoordinateField) bool {
+	return c.Known&field == field
+}
+
+const EARTH_RADIUS_METERS = 6371000.0
+
+// Great-circle distance to 'other', in meters.
+func (c *Coordinate) DistanceTo(other *Coordinate) float64 {
+	lat1 := c.Lat * math.Pi / 180
+	lat2 := other.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (other.Lng - c.Lng) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * EARTH_RADIUS_METERS * math.Asin(math.Min(1, math.Sqrt(a)))
 }
 
 type BoundingBox struct {
@@ -72,8 +143,65 @@ func (b *BoundingBox) Height() float64 {
 	return b.upperRight.Lat - b.lowerLeft.Lat
 }
 
+// Boxes are written as just their corners, using the same names as the URL
+// parameters (see serializeRenderRequest).
+type boundingBoxJson struct {
+	LowerLeftLat  float64 `json:"lllat"`
+	LowerLeftLng  float64 `json:"lllng"`
+	UpperRightLat float64 `json:"urlat"`
+	UpperRightLng float64 `json:"urlng"`
+}
+
+func (b *BoundingBox) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&boundingBoxJson{
+		LowerLeftLat:  b.lowerLeft.Lat,
+		LowerLeftLng:  b.lowerLeft.Lng,
+		UpperRightLat: b.upperRight.Lat,
+		UpperRightLng: b.upperRight.Lng,
+	})
+}
+
+func (b *BoundingBox) UnmarshalJSON(data []byte) error {
+	corners := &boundingBoxJson{}
+	if err := json.Unmarshal(data, corners); err != nil {
+		return err
+	}
+	box, err := NewBoundingBox(
+		Coordinate{Lat: corners.LowerLeftLat, Lng: corners.LowerLeftLng},
+		Coordinate{Lat: corners.UpperRightLat, Lng: corners.UpperRightLng})
+	if err != nil {
+		return err
+	}
+	*b = *box
+	return nil
+}
+
 type History []*Coordinate
 
+// Returns the smallest box containing every point in the history, plus a
+// margin of 'margin' times its size on every side (since BoundingBox.Contains
+// excludes points right on the edge).  Boxes are never less than 0.001
+// degrees across, so that a single point still gets some room.
+func (h *History) Bounds(margin float64) (*BoundingBox, error) {
+	if h.Len() == 0 {
+		return nil, errors.New("Can't find the bounds of an empty history")
+	}
+
+	ll := Coordinate{Lat: h.At(0).Lat, Lng: h.At(0).Lng}
+	ur := ll
+	for i := 1; i < h.Len(); i++ {
+		c := h.At(i)
+		ll.Lat, ll.Lng = math.Min(ll.Lat, c.Lat), math.Min(ll.Lng, c.Lng)
+		ur.Lat, ur.Lng = math.Max(ur.Lat, c.Lat), math.Max(ur.Lng, c.Lng)
+	}
+
+	padLat := math.Max((ur.Lat-ll.Lat)*margin, 0.0005)
+	padLng := math.Max((ur.Lng-ll.Lng)*margin, 0.0005)
+	ll.Lat, ur.Lat = math.Max(ll.Lat-padLat, -90), math.Min(ur.Lat+padLat, 90)
+	ll.Lng, ur.Lng = math.Max(ll.Lng-padLng, -180), math.Min(ur.Lng+padLng, 180)
+	return NewBoundingBox(ll, ur)
+}
+
 func (h *History) Len() int {
 	return len(*h)
 }
@@ -102,6 +230,50 @@ func (h *History) At(i int) *Coordinate {
 	return (*h)[i]
 }
 
+// History implements sort.Interface, ordering points by Timestamp.
+// Points without a timestamp sort first.
+func (h *History) Less(i, j int) bool {
+	return (*h)[i].Timestamp.Before((*h)[j].Timestamp)
+}
+
+func (h *History) Swap(i, j int) {
+	(*h)[i], (*h)[j] = (*h)[j], (*h)[i]
+}
+
+// Returns the earliest and latest timestamps in the history, ignoring points
+// without a timestamp.  Both are zero if no point has a timestamp.
+func (h *History) TimeRange() (start, end time.Time) {
+	for i := 0; i < h.Len(); i++ {
+		c := h.At(i)
+		if !c.HasTimestamp() {
+			continue
+		}
+		if start.IsZero() || c.Timestamp.Before(start) {
+			start = c.Timestamp
+		}
+		if end.IsZero() || c.Timestamp.After(end) {
+			end = c.Timestamp
+		}
+	}
+	return start, end
+}
+
+// Whether t falls within [start, end].  A zero start or end leaves that side
+// of the range open.  Points without a timestamp only match a fully open range.
+func inTimeRange(t, start, end time.Time) bool {
+	if t.IsZero() {
+		return start.IsZero() && end.IsZero()
+	}
+	if !start.IsZero() && t.Before(start) {
+		return false
+	}
+	if !end.IsZero() && t.After(end) {
+		return false
+	}
+	return true
+}
+
 type HistorySource interface {
-	FetchRange(start, end time.Time) (*History, error)
+	// Gives up, returning ctx.Err(), if ctx is cancelled.
+	FetchRange(ctx context.Context, start, end time.Time) (*History, error)
 }
@@ -3,7 +3,9 @@ package latvis
 import (
 	"github.com/mrjones/gt"
 
+	"sort"
 	"testing"
+	"time"
 )
 
 func TestContainsBoundaries(t *testing.T) {
@@ -156,3 +158,54 @@ func TestWidthAround180(t *testing.T) {
 		t.Fatalf("Wrong width fraction: Expected .75, Actual: %f", wf)
 	}
 }
+
+func TestHistorySortsByTimestamp(t *testing.T) {
+	h := &History{}
+	h.Add(&Coordinate{Lat: 3, Lng: 3, Timestamp: time.Unix(300, 0)})
+	h.Add(&Coordinate{Lat: 1, Lng: 1, Timestamp: time.Unix(100, 0)})
+	h.Add(&Coordinate{Lat: 2, Lng: 2, Timestamp: time.Unix(200, 0)})
+
+	sort.Sort(h)
+
+	gt.AssertEqualM(t, 1.0, h.At(0).Lat, "First point")
+	gt.AssertEqualM(t, 2.0, h.At(1).Lat, "Second point")
+	gt.AssertEqualM(t, 3.0, h.At(2).Lat, "Third point")
+}
+
+func TestHistoryTimeRange(t *testing.T) {
+	h := &History{}
+	start, end := h.TimeRange()
+	gt.AssertTrueM(t, start.IsZero(), "Empty history has no start")
+	gt.AssertTrueM(t, end.IsZero(), "Empty history has no end")
+
+	h.Add(&Coordinate{Lat: 1, Lng: 1, Timestamp: time.Unix(200, 0)})
+	h.Add(&Coordinate{Lat: 1, Lng: 1})
+	h.Add(&Coordinate{Lat: 1, Lng: 1, Timestamp: time.Unix(100, 0)})
+	h.Add(&Coordinate{Lat: 1, Lng: 1, Timestamp: time.Unix(300, 0)})
+
+	start, end = h.TimeRange()
+	gt.AssertEqualM(t, time.Unix(100, 0), start, "Start")
+	gt.AssertEqualM(t, time.Unix(300, 0), end, "End")
+}
+
+func TestHistoryBounds(t *testing.T) {
+	h := History{}
+	_, err := h.Bounds(0)
+	gt.AssertNotNil(t, err)
+
+	h.Add(&Coordinate{Lat: 10, Lng: 20})
+	h.Add(&Coordinate{Lat: 30, Lng: -20})
+	bounds, err := h.Bounds(0.1)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, Coordinate{Lat: 8, Lng: -24}, bounds.LowerLeft(), "Lower left")
+	gt.AssertEqualM(t, Coordinate{Lat: 32, Lng: 24}, bounds.UpperRight(), "Upper right")
+	for _, c := range h {
+		gt.AssertTrueM(t, bounds.Contains(c), "Every point should be inside")
+	}
+
+	single := History{&Coordinate{Lat: 89.9999, Lng: 0}}
+	bounds, err = single.Bounds(0)
+	gt.AssertNil(t, err)
+	gt.AssertTrueM(t, bounds.Contains(single[0]), "A single point still gets a box")
+	gt.AssertEqualM(t, 90.0, bounds.UpperRight().Lat, "Bounds shouldn't go past the pole")
+}
@@ -0,0 +1,254 @@
+package latvis
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ======================================
+// ====== IN-MEMORY (LRU) BLOB STORE ====
+// ======================================
+
+type LRUBlobStoreOptions struct {
+	// How many bytes of blob data to keep in memory.  Once there's more, the
+	// least recently used blobs are dropped.
+	MaxBytes int64
+
+	// The store to cache.  Without one, the LRUBlobStore is all there is, and
+	// dropped blobs are gone for good.
+	Backing BlobStore
+
+	// Whether storing a blob puts it in the cache too (as well as in
+	// Backing), or just waits for it to be fetched.
+	WriteThrough bool
+}
+
+// How well an LRUBlobStore is doing.
+type BlobCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+
+	Blobs    int   `json:"blobs"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// Keeps the most recently used blobs in memory, either on its own, or as a
+// cache in front of another BlobStore.  Changes always go to the Backing store
+// first, so the cache never has anything the Backing store doesn't.
+type LRUBlobStore struct {
+	options LRUBlobStoreOptions
+
+	mutex   sync.Mutex
+	entries map[Handle]*list.Element
+	// Most recently used at the front.
+	order *list.List
+	bytes int64
+	stats BlobCacheStats
+
+	// Bumped by every Store and Delete, so that Fetch can tell if what it
+	// read from the Backing store might already be out of date.
+	generation int64
+}
+
+type lruBlobEntry struct {
+	handle   Handle
+	blob     *Blob
+	lastUsed time.Time
+}
+
+func NewLRUBlobStore(options LRUBlobStoreOptions) *LRUBlobStore {
+	return &LRUBlobStore{
+		options: options,
+		entries: make(map[Handle]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (s *LRUBlobStore) Store(handle *Handle, blob *Blob) error {
+	stored := copyBlob(blob)
+	if stored.Created.IsZero() {
+		stored.Created = time.Now()
+	}
+
+	if s.options.Backing != nil {
+		if err := s.options.Backing.Store(handle, stored); err != nil {
+			return err
+		}
+	} else if int64(len(stored.Data)) > s.options.MaxBytes {
+		return &BlobError{Op: "store", Handle: handle,
+			Err: fmt.Errorf("%d bytes won't fit in a %d byte cache", len(stored.Data), s.options.MaxBytes)}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.generation++
+	if s.options.Backing == nil || s.options.WriteThrough {
+		s.put(handle, stored)
+	} else {
+		s.remove(handle)
+	}
+	return nil
+}
+
+func (s *LRUBlobStore) Fetch(handle *Handle) (*Blob, error) {
+	s.mutex.Lock()
+	if element, ok := s.entries[*handle]; ok {
+		entry := element.Value.(*lruBlobEntry)
+		entry.lastUsed = time.Now()
+		s.order.MoveToFront(element)
+		s.stats.Hits++
+		s.mutex.Unlock()
+		return copyBlob(entry.blob), nil
+	}
+	s.stats.Misses++
+	generation := s.generation
+	s.mutex.Unlock()
+
+	if s.options.Backing == nil {
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrNoSuchBlob}
+	}
+	blob, err := s.options.Backing.Fetch(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if generation == s.generation {
+		s.put(handle, copyBlob(blob))
+	}
+	return blob, nil
+}
+
+func (s *LRUBlobStore) Delete(handle *Handle) error {
+	if s.options.Backing != nil {
+		if err := s.options.Backing.Delete(handle); err != nil {
+			return err
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.generation++
+	s.remove(handle)
+	return nil
+}
+
+// Describes a cached blob without going to the Backing store (and without
+// counting as a hit or a miss).
+func (s *LRUBlobStore) Stat(handle *Handle) (*BlobInfo, error) {
+	s.mutex.Lock()
+	if element, ok := s.entries[*handle]; ok {
+		entry := element.Value.(*lruBlobEntry)
+		s.mutex.Unlock()
+		return &BlobInfo{
+			Handle:      handle,
+			Size:        int64(len(entry.blob.Data)),
+			ContentType: entry.blob.ContentType,
+			Created:     entry.blob.Created,
+			Expires:     entry.blob.Expires,
+			LastUsed:    entry.lastUsed,
+		}, nil
+	}
+	s.mutex.Unlock()
+
+	if s.options.Backing == nil {
+		return nil, &BlobError{Op: "stat", Handle: handle, Kind: ErrNoSuchBlob}
+	}
+	return statBlob(s.options.Backing, handle)
+}
+
+// Lists the Backing store, if there is one.  Blobs which have been fetched
+// from the cache have been used more recently than the Backing store knows.
+func (s *LRUBlobStore) List() ([]*BlobInfo, error) {
+	if s.options.Backing != nil {
+		infos, err := s.options.Backing.List()
+		if err != nil {
+			return nil, err
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for _, info := range infos {
+			if element, ok := s.entries[*info.Handle]; ok {
+				if lastUsed := element.Value.(*lruBlobEntry).lastUsed; lastUsed.After(info.LastUsed) {
+					info.LastUsed = lastUsed
+				}
+			}
+		}
+		return infos, nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	infos := []*BlobInfo{}
+	for element := s.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*lruBlobEntry)
+		handle := entry.handle
+		infos = append(infos, &BlobInfo{
+			Handle:      &handle,
+			Size:        int64(len(entry.blob.Data)),
+			ContentType: entry.blob.ContentType,
+			Created:     entry.blob.Created,
+			Expires:     entry.blob.Expires,
+			LastUsed:    entry.lastUsed,
+		})
+	}
+	return infos, nil
+}
+
+func (s *LRUBlobStore) Stats() BlobCacheStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	stats.Blobs = s.order.Len()
+	stats.Bytes = s.bytes
+	stats.MaxBytes = s.options.MaxBytes
+	return stats
+}
+
+// Caches 'blob' (which the caller mustn't change afterwards), and then makes
+// room for it.  Blobs too big for the cache aren't kept at all.  Must be
+// called with the mutex held.
+func (s *LRUBlobStore) put(handle *Handle, blob *Blob) {
+	s.remove(handle)
+	size := int64(len(blob.Data))
+	if size > s.options.MaxBytes {
+		return
+	}
+	s.entries[*handle] = s.order.PushFront(&lruBlobEntry{handle: *handle, blob: blob, lastUsed: time.Now()})
+	s.bytes += size
+
+	for s.bytes > s.options.MaxBytes {
+		oldest := s.order.Back()
+		s.remove(&oldest.Value.(*lruBlobEntry).handle)
+		s.stats.Evictions++
+	}
+}
+
+// Must be called with the mutex held.
+func (s *LRUBlobStore) remove(handle *Handle) {
+	element, ok := s.entries[*handle]
+	if !ok {
+		return
+	}
+	s.bytes -= int64(len(element.Value.(*lruBlobEntry).blob.Data))
+	s.order.Remove(element)
+	delete(s.entries, *handle)
+}
+
+// A copy of the blob which shares nothing changeable with it.
+func copyBlob(blob *Blob) *Blob {
+	copied := *blob
+	copied.Data = append([]byte{}, blob.Data...)
+	if blob.Metadata != nil {
+		copied.Metadata = make(map[string]string)
+		for key, value := range blob.Metadata {
+			copied.Metadata[key] = value
+		}
+	}
+	return &copied
+}
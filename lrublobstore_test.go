@@ -0,0 +1,109 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestLRUBlobStore(t *testing.T) {
+	testBlobStore(t, NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 1 << 20}))
+}
+
+func TestLRUBlobStoreWriteThrough(t *testing.T) {
+	dir, backing := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	testBlobStore(t, NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 1 << 20, Backing: backing, WriteThrough: true}))
+}
+
+func TestLRUBlobStoreWriteAround(t *testing.T) {
+	dir, backing := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	testBlobStore(t, NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 1 << 20, Backing: backing}))
+}
+
+func TestLRUBlobStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 10})
+	h1 := &Handle{timestamp: 1}
+	h2 := &Handle{timestamp: 2}
+	h3 := &Handle{timestamp: 3}
+
+	gt.AssertNil(t, store.Store(h1, &Blob{Data: []byte("1111")}))
+	gt.AssertNil(t, store.Store(h2, &Blob{Data: []byte("2222")}))
+	_, err := store.Fetch(h1)
+	gt.AssertNil(t, err)
+	gt.AssertNil(t, store.Store(h3, &Blob{Data: []byte("3333")}))
+
+	_, err = store.Fetch(h2)
+	gt.AssertTrueM(t, errors.Is(err, ErrNoSuchBlob), "h2 was the least recently used")
+	_, err = store.Fetch(h1)
+	gt.AssertNil(t, err)
+	_, err = store.Fetch(h3)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, BlobCacheStats{Hits: 3, Misses: 1, Evictions: 1, Blobs: 2, Bytes: 8, MaxBytes: 10}, store.Stats())
+
+	gt.AssertNotNilM(t, store.Store(h2, &Blob{Data: []byte("too big to fit")}), "Without a backing store")
+	gt.AssertEqual(t, 2, store.Stats().Blobs)
+}
+
+func TestLRUBlobStoreCachesBackingStore(t *testing.T) {
+	dir, backing := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	store := NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 10, Backing: backing})
+	h := &Handle{timestamp: 1}
+	big := &Handle{timestamp: 2}
+
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte("png")}))
+	gt.AssertEqualM(t, 0, store.Stats().Blobs, "Not write-through")
+	for i := 0; i < 3; i++ {
+		blob, err := store.Fetch(h)
+		gt.AssertNil(t, err)
+		gt.AssertEqual(t, "png", string(blob.Data))
+	}
+	gt.AssertEqual(t, BlobCacheStats{Hits: 2, Misses: 1, Blobs: 1, Bytes: 3, MaxBytes: 10}, store.Stats())
+
+	// Changes made through the cache show up straight away.
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte("svg")}))
+	blob, err := store.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "svg", string(blob.Data))
+	gt.AssertNil(t, store.Delete(h))
+	_, err = store.Fetch(h)
+	gt.AssertTrue(t, errors.Is(err, ErrNoSuchBlob))
+	_, err = backing.Fetch(h)
+	gt.AssertTrue(t, errors.Is(err, ErrNoSuchBlob))
+
+	// Blobs too big to cache are still stored.
+	gt.AssertNil(t, store.Store(big, &Blob{Data: []byte("too big to fit")}))
+	blob, err = store.Fetch(big)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "too big to fit", string(blob.Data))
+	gt.AssertEqual(t, 0, store.Stats().Blobs)
+
+	// Errors from the backing store aren't cached.
+	broken := NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 10, Backing: &brokenBlobStore{
+		err: &BlobError{Op: "fetch", Handle: h, Kind: ErrBlobPermission}}})
+	_, err = broken.Fetch(h)
+	gt.AssertTrue(t, errors.Is(err, ErrBlobPermission))
+	gt.AssertEqual(t, 0, broken.Stats().Blobs)
+}
+
+func TestLRUBlobStoreListsCacheUse(t *testing.T) {
+	dir, backing := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	store := NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 10, Backing: backing, WriteThrough: true})
+	h := &Handle{timestamp: 1}
+	gt.AssertNil(t, store.Store(h, &Blob{Data: []byte("png")}))
+	before, err := backing.List()
+	gt.AssertNil(t, err)
+
+	_, err = store.Fetch(h)
+	gt.AssertNil(t, err)
+	infos, err := store.List()
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 1, len(infos))
+	gt.AssertTrueM(t, infos[0].LastUsed.After(before[0].LastUsed),
+		"Fetches from the cache count as uses, even though the backing store doesn't see them")
+}
@@ -0,0 +1,180 @@
+package latvis
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ======================================
+// ============== PALETTES ==============
+// ======================================
+
+// A point on a color ramp.  Position is between 0 and 1.
+type GradientStop struct {
+	Position float64
+	Color    color.NRGBA
+}
+
+// Palette maps an intensity between 0 and 1 to a color, by interpolating
+// linearly between a set of gradient stops.
+type Palette struct {
+	Name  string
+	stops []GradientStop
+}
+
+// Builds a palette from user-supplied stops.  There must be at least two
+// stops, with positions between 0 and 1; they don't need to be sorted.
+func NewGradientPalette(name string, stops []GradientStop) (*Palette, error) {
+	if len(stops) < 2 {
+		return nil, errors.New("A gradient needs at least two stops")
+	}
+	sorted := make([]GradientStop, len(stops))
+	copy(sorted, stops)
+	sort.Sort(byPosition(sorted))
+
+	for _, stop := range sorted {
+		if stop.Position < 0 || stop.Position > 1 {
+			return nil, fmt.Errorf("Gradient stop position %f is not between 0 and 1", stop.Position)
+		}
+	}
+	return &Palette{Name: name, stops: sorted}, nil
+}
+
+// Returns the color for the given intensity, which is clamped to [0, 1].
+func (p *Palette) At(intensity float64) color.NRGBA {
+	if !(intensity > 0) { // Also catches NaN.
+		intensity = 0
+	}
+	if intensity > 1 {
+		intensity = 1
+	}
+
+	if intensity <= p.stops[0].Position {
+		return p.stops[0].Color
+	}
+	for i := 1; i < len(p.stops); i++ {
+		lo, hi := p.stops[i-1], p.stops[i]
+		if intensity <= hi.Position {
+			f := (intensity - lo.Position) / (hi.Position - lo.Position)
+			return color.NRGBA{
+				R: lerpChannel(lo.Color.R, hi.Color.R, f),
+				G: lerpChannel(lo.Color.G, hi.Color.G, f),
+				B: lerpChannel(lo.Color.B, hi.Color.B, f),
+				A: lerpChannel(lo.Color.A, hi.Color.A, f),
+			}
+		}
+	}
+	return p.stops[len(p.stops)-1].Color
+}
+
+func lerpChannel(a, b uint8, f float64) uint8 {
+	return uint8(math.Floor(float64(a) + (float64(b)-float64(a))*f + 0.5))
+}
+
+type byPosition []GradientStop
+
+func (s byPosition) Len() int           { return len(s) }
+func (s byPosition) Less(i, j int) bool { return s[i].Position < s[j].Position }
+func (s byPosition) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Evenly spaced samples of the matplotlib color maps, which is close enough
+// to the originals once interpolated.
+var namedPalettes = map[string][]string{
+	"viridis": []string{
+		"#440154", "#482475", "#414487", "#355f8d", "#2a788e", "#21918c",
+		"#22a884", "#44bf70", "#7ad151", "#bddf26", "#fde725"},
+	"magma": []string{
+		"#000004", "#140e36", "#3b0f70", "#641a80", "#8c2981", "#b73779",
+		"#de4968", "#f7705c", "#fe9f6d", "#fecf92", "#fcfdbf"},
+	"inferno": []string{
+		"#000004", "#160b39", "#420a68", "#6a176e", "#932667", "#bc3754",
+		"#dd513a", "#f37819", "#fca50a", "#f6d746", "#fcffa4"},
+	// Low intensities are white, to match the BwPngVisualizer.
+	"grayscale": []string{"#ffffff", "#000000"},
+}
+
+// "hot" isn't evenly spaced: red, then green, then blue saturate in turn.
+var hotStops = "0=#000000,0.365=#ff0000,0.746=#ffff00,1=#ffffff"
+
+const DEFAULT_PALETTE = "viridis"
+
+// Returns the names of all built-in palettes, in sorted order.
+func PaletteNames() []string {
+	names := []string{"hot"}
+	for name, _ := range namedPalettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parses either the name of a built-in palette (see PaletteNames), or a
+// custom gradient written as comma-separated "position=#rrggbb[aa]" stops,
+// e.g. "0=#000000,0.5=#ff000080,1=#ffffff".
+func ParsePalette(spec string) (*Palette, error) {
+	if spec == "hot" {
+		return parseGradientStops("hot", hotStops)
+	}
+	if colors, ok := namedPalettes[spec]; ok {
+		stops := make([]GradientStop, len(colors))
+		for i, hex := range colors {
+			c, err := parseHexColor(hex)
+			if err != nil {
+				return nil, err
+			}
+			stops[i] = GradientStop{Position: float64(i) / float64(len(colors)-1), Color: c}
+		}
+		return NewGradientPalette(spec, stops)
+	}
+	if strings.Contains(spec, "=") {
+		return parseGradientStops("custom", spec)
+	}
+	return nil, fmt.Errorf("Unknown palette '%s' (expected one of: %s)",
+		spec, strings.Join(PaletteNames(), ", "))
+}
+
+func parseGradientStops(name, spec string) (*Palette, error) {
+	stops := []GradientStop{}
+	for _, part := range strings.Split(spec, ",") {
+		pieces := strings.Split(part, "=")
+		if len(pieces) != 2 {
+			return nil, errors.New("Invalid gradient stop: " + part)
+		}
+		position, err := strconv.ParseFloat(strings.TrimSpace(pieces[0]), 64)
+		if err != nil {
+			return nil, wrapError("Invalid gradient stop position / "+part, err)
+		}
+		c, err := parseHexColor(strings.TrimSpace(pieces[1]))
+		if err != nil {
+			return nil, err
+		}
+		stops = append(stops, GradientStop{Position: position, Color: c})
+	}
+	return NewGradientPalette(name, stops)
+}
+
+// Parses "#rrggbb" or "#rrggbbaa" (the leading '#' is optional).
+func parseHexColor(hex string) (color.NRGBA, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 && len(hex) != 8 {
+		return color.NRGBA{}, errors.New("Invalid color: " + hex)
+	}
+	if len(hex) == 6 {
+		hex = hex + "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, wrapError("Invalid color / "+hex, err)
+	}
+	return color.NRGBA{
+		R: uint8(v >> 24),
+		G: uint8(v >> 16),
+		B: uint8(v >> 8),
+		A: uint8(v),
+	}, nil
+}
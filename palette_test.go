@@ -0,0 +1,56 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"image/color"
+	"testing"
+)
+
+func TestNamedPalettes(t *testing.T) {
+	gt.AssertEqualM(t,
+		[]string{"grayscale", "hot", "inferno", "magma", "viridis"},
+		PaletteNames(), "Unexpected palettes")
+
+	for _, name := range PaletteNames() {
+		p, err := ParsePalette(name)
+		gt.AssertNil(t, err)
+		gt.AssertEqualM(t, name, p.Name, "name")
+	}
+
+	viridis, err := ParsePalette("viridis")
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, color.NRGBA{0x44, 0x01, 0x54, 255}, viridis.At(0), "viridis low")
+	gt.AssertEqualM(t, color.NRGBA{0xfd, 0xe7, 0x25, 255}, viridis.At(1), "viridis high")
+
+	hot, err := ParsePalette("hot")
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, color.NRGBA{255, 255, 0, 255}, hot.At(0.746), "hot yellow")
+}
+
+func TestCustomGradient(t *testing.T) {
+	p, err := ParsePalette("1=#ffffff, 0=#000000 ,0.5=#ff000080")
+	gt.AssertNil(t, err)
+
+	gt.AssertEqualM(t, color.NRGBA{0, 0, 0, 255}, p.At(0), "low")
+	gt.AssertEqualM(t, color.NRGBA{255, 0, 0, 128}, p.At(0.5), "middle")
+	gt.AssertEqualM(t, color.NRGBA{255, 128, 128, 192}, p.At(0.75), "interpolated")
+	gt.AssertEqualM(t, color.NRGBA{255, 255, 255, 255}, p.At(1), "high")
+
+	gt.AssertEqualM(t, p.At(0), p.At(-5), "clamped low")
+	gt.AssertEqualM(t, p.At(1), p.At(5), "clamped high")
+}
+
+func TestInvalidPalettes(t *testing.T) {
+	for _, spec := range []string{
+		"rainbow",
+		"0=#000000",
+		"0=#000000,2=#ffffff",
+		"0=#000000,1=#fff",
+		"0=#000000,x=#ffffff",
+		"0=#000000,1=#gggggg",
+	} {
+		_, err := ParsePalette(spec)
+		gt.AssertNotNilM(t, err, spec)
+	}
+}
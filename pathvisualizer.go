@@ -0,0 +1,261 @@
+package latvis
+
+import (
+	"context"
+	"image"
+	"math"
+	"sort"
+	"time"
+)
+
+// ======================================
+// =========== PATH VISUALIZER ==========
+// ======================================
+
+const (
+	DEFAULT_PATH_LINE_WIDTH = 1.5
+	DEFAULT_PATH_OPACITY    = 0.5
+	DEFAULT_PATH_MAX_GAP    = 30 * time.Minute
+
+	// Meters per second.  Faster than this is probably a bad GPS fix (or a
+	// flight, which also doesn't make for a useful line on a map).
+	DEFAULT_PATH_MAX_SPEED = 100.0
+)
+
+func init() {
+	RegisterVisualizer(&VisualizerStyle{
+		Name:        "path",
+		Description: "Draws the routes travelled between points",
+		ContentType: "image/png",
+		Extension:   "png",
+		Options: []VisualizerOption{
+			sizeOption,
+			{
+				Name:        "line_width",
+				Type:        OPTION_FLOAT,
+				Description: "Width of each line, in pixels",
+				Default:     formatOptionFloat(DEFAULT_PATH_LINE_WIDTH),
+				Min:         0.1,
+				Max:         50,
+			},
+			{
+				Name:        "opacity",
+				Type:        OPTION_FLOAT,
+				Description: "How much each line adds to the brightness of the pixels it crosses",
+				Default:     formatOptionFloat(DEFAULT_PATH_OPACITY),
+				Min:         0.01,
+				Max:         1,
+			},
+			paletteOption("grayscale"),
+			transparentOption,
+		},
+		New: func(options VisualizerOptions, projection Projection, progress ProgressFunc) (Visualizer, error) {
+			palette, err := options.Palette("palette")
+			if err != nil {
+				return nil, err
+			}
+			visualizer := NewPathVisualizer(palette)
+			visualizer.LineWidth = options.Float("line_width")
+			visualizer.Opacity = options.Float("opacity")
+			visualizer.Transparent = options.Bool("transparent")
+			visualizer.Projection = projection
+			visualizer.Progress = progress
+			return visualizer, nil
+		},
+	})
+}
+
+// Draws the route between consecutive (by time) points as anti-aliased lines.
+//
+// The history is split into separate tracks wherever the recording broke off:
+// when Coordinate.Segment changes, when there's a gap of more than MaxGap
+// between points, or when getting from one point to the next would have meant
+// moving faster than MaxSpeed.
+//
+// Each track is drawn with the given Opacity, and where tracks overlap their
+// brightness accumulates, so often-travelled routes stand out.
+type PathVisualizer struct {
+	// In pixels.
+	LineWidth float64
+
+	// Between 0 and 1.
+	Opacity float64
+
+	MaxGap time.Duration
+
+	// In meters per second.
+	MaxSpeed float64
+
+	Palette     *Palette
+	Transparent bool
+
+	// Defaults to equirectangular.
+	Projection Projection
+
+	// Told how many points have been drawn, and when encoding starts.  May
+	// be nil.
+	Progress ProgressFunc
+}
+
+func NewPathVisualizer(palette *Palette) *PathVisualizer {
+	return &PathVisualizer{
+		LineWidth: DEFAULT_PATH_LINE_WIDTH,
+		Opacity:   DEFAULT_PATH_OPACITY,
+		MaxGap:    DEFAULT_PATH_MAX_GAP,
+		MaxSpeed:  DEFAULT_PATH_MAX_SPEED,
+		Palette:   palette,
+	}
+}
+
+func (r *PathVisualizer) Visualize(ctx context.Context, history *History, bounds *BoundingBox, width int, height int) (*[]byte, error) {
+	img := r.makeImage(ctx, history, bounds, width, height)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.Progress.report(ProgressEvent{Stage: PROGRESS_ENCODING})
+	return imageToPNGBytes(img)
+}
+
+// Seam for testing
+func (r *PathVisualizer) makeImage(ctx context.Context, history *History, bounds *BoundingBox, width int, height int) image.Image {
+	tracks := splitIntoTracks(history, r.MaxGap, r.MaxSpeed)
+	coverage := r.drawTracks(tracks, newProjectedPixelMapping(bounds, r.Projection, width, height),
+		newProgressCounter(ctx, r.Progress, history.Len()))
+	return intensityGridToColorImage(coverage.toIntensity(), r.Palette, r.Transparent)
+}
+
+// Sorts the points by time, and then breaks them up wherever there seems to
+// be a discontinuity.  Points without timestamps are kept in their original
+// order, and are only split up by Coordinate.Segment.
+func splitIntoTracks(history *History, maxGap time.Duration, maxSpeed float64) []History {
+	sorted := make(History, history.Len())
+	copy(sorted, *history)
+	sort.Stable(&sorted)
+
+	tracks := []History{}
+	var current History
+	for i, c := range sorted {
+		if i > 0 && isTrackBreak(sorted[i-1], c, maxGap, maxSpeed) {
+			tracks = append(tracks, current)
+			current = nil
+		}
+		current = append(current, c)
+	}
+	if len(current) > 0 {
+		tracks = append(tracks, current)
+	}
+	return tracks
+}
+
+func isTrackBreak(from, to *Coordinate, maxGap time.Duration, maxSpeed float64) bool {
+	if from.Segment != to.Segment {
+		return true
+	}
+	if !from.HasTimestamp() || !to.HasTimestamp() {
+		return false
+	}
+
+	elapsed := to.Timestamp.Sub(from.Timestamp)
+	if maxGap > 0 && elapsed > maxGap {
+		return true
+	}
+	if maxSpeed > 0 {
+		// Don't let a couple of fixes in the same second look infinitely fast.
+		seconds := math.Max(elapsed.Seconds(), 1)
+		if from.DistanceTo(to)/seconds > maxSpeed {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops early if the counter says so.
+func (r *PathVisualizer) drawTracks(tracks []History, mapping *pixelMapping, counter *progressCounter) *densityGrid {
+	grid := newDensityGrid(mapping.width, mapping.height)
+	// Chosen so that toIntensity turns one fully covered stroke into exactly
+	// r.Opacity, and n overlapping strokes into 1 - (1 - r.Opacity)^n.
+	strength := -math.Log(1 - math.Min(r.Opacity, 0.999))
+
+	for _, track := range tracks {
+		// Within a track, keep the maximum coverage of each pixel rather than
+		// the sum, so the joints between segments don't show up as beads.
+		coverage := make(map[int]float64)
+		if len(track) > 0 && !counter.inc() {
+			break
+		}
+		if len(track) == 1 {
+			x, y := mapping.position(track[0])
+			drawSegment(coverage, mapping, r.LineWidth, x, y, x, y)
+		}
+		for i := 1; i < len(track) && counter.inc(); i++ {
+			from, to := track[i-1], track[i]
+			x1, y1 := mapping.position(from)
+			x2, y2 := mapping.position(to)
+
+			// Take the short way around the globe.  If the map itself wraps
+			// somewhere in between, draw the segment leaving one side of the
+			// map, and again arriving at the other.
+			if dx, wraps := mapping.wrappedDx(from, to); wraps {
+				drawSegment(coverage, mapping, r.LineWidth, x1, y1, x1+dx, y2)
+				drawSegment(coverage, mapping, r.LineWidth, x2-dx, y1, x2, y2)
+			} else {
+				drawSegment(coverage, mapping, r.LineWidth, x1, y1, x2, y2)
+			}
+		}
+
+		for offset, c := range coverage {
+			grid.values[offset] += c * strength
+		}
+	}
+	return grid
+}
+
+// Records how much of each pixel is covered by a line of the given width
+// between (x1, y1) and (x2, y2), in pixel space.  Coverage is 1 for pixels
+// whose centers are within width/2 of the line, falling off linearly to 0
+// over the next pixel.
+func drawSegment(coverage map[int]float64, mapping *pixelMapping, width, x1, y1, x2, y2 float64) {
+	reach := width/2 + 1
+	minX := int(math.Max(0, math.Floor(math.Min(x1, x2)-reach)))
+	maxX := int(math.Min(float64(mapping.width-1), math.Ceil(math.Max(x1, x2)+reach)))
+	minY := int(math.Max(0, math.Floor(math.Min(y1, y2)-reach)))
+	maxY := int(math.Min(float64(mapping.height-1), math.Ceil(math.Max(y1, y2)+reach)))
+
+	for y := minY; y <= maxY; y++ {
+		for x := minX; x <= maxX; x++ {
+			d := distanceToSegment(float64(x)+0.5, float64(y)+0.5, x1, y1, x2, y2)
+			c := math.Min(1, width/2+0.5-d)
+			if c <= 0 {
+				continue
+			}
+			offset := y*mapping.width + x
+			if c > coverage[offset] {
+				coverage[offset] = c
+			}
+		}
+	}
+}
+
+func distanceToSegment(px, py, x1, y1, x2, y2 float64) float64 {
+	dx, dy := x2-x1, y2-y1
+	lengthSquared := dx*dx + dy*dy
+	t := 0.0
+	if lengthSquared > 0 {
+		t = ((px-x1)*dx + (py-y1)*dy) / lengthSquared
+		t = math.Max(0, math.Min(1, t))
+	}
+	return math.Hypot(px-(x1+t*dx), py-(y1+t*dy))
+}
+
+// Turns accumulated stroke strength (see drawTracks) into an intensity
+// between 0 and 1.
+func (d *densityGrid) toIntensity() *IntensityGrid {
+	intensityGrid := &IntensityGrid{Points: make([][]float64, d.width)}
+	for x := 0; x < d.width; x++ {
+		intensityGrid.Points[x] = make([]float64, d.height)
+		for y := 0; y < d.height; y++ {
+			intensityGrid.Points[x][y] = 1 - math.Exp(-d.get(x, y))
+		}
+	}
+	return intensityGrid
+}
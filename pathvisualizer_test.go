@@ -0,0 +1,135 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSplitIntoTracks(t *testing.T) {
+	h := History{}
+	at := func(seconds int64, lat float64, segment int) {
+		h.Add(&Coordinate{Lat: lat, Lng: 0, Timestamp: time.Unix(seconds, 0), Segment: segment})
+	}
+	// Out of order, to make sure the points get sorted.
+	at(60, 0.0010, 0)
+	at(0, 0.0000, 0)
+	at(120, 0.0020, 0)
+	// A two hour gap.
+	at(7320, 0.0030, 0)
+	at(7380, 0.0040, 0)
+	// A 1 degree (~111km) jump in a minute.
+	at(7440, 1.0040, 0)
+	// A new segment.
+	at(7500, 1.0041, 1)
+
+	tracks := splitIntoTracks(&h, 30*time.Minute, 100)
+	lengths := []int{}
+	for _, track := range tracks {
+		lengths = append(lengths, len(track))
+	}
+	gt.AssertEqualM(t, []int{3, 2, 1, 1}, lengths, "Unexpected tracks")
+	gt.AssertEqualM(t, 0.0, tracks[0][0].Lat, "Tracks should be sorted by time")
+}
+
+func TestSplitIntoTracksWithoutTimestamps(t *testing.T) {
+	h := History{}
+	h.Add(&Coordinate{Lat: 0, Lng: 0})
+	h.Add(&Coordinate{Lat: 50, Lng: 50})
+	h.Add(&Coordinate{Lat: 0, Lng: 0, Segment: 1})
+
+	tracks := splitIntoTracks(&h, time.Minute, 1)
+	gt.AssertEqualM(t, 2, len(tracks), "Only segments can split untimed points")
+	gt.AssertEqualM(t, 50.0, tracks[0][1].Lat, "Order should be preserved")
+}
+
+func TestPathVisualizerDrawsLine(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 5, Lng: 5})
+	gt.AssertNil(t, err)
+
+	h := History{}
+	h.Add(&Coordinate{Lat: 2.5, Lng: 0.5})
+	h.Add(&Coordinate{Lat: 2.5, Lng: 4.5})
+
+	v := &PathVisualizer{LineWidth: 1, Opacity: 1}
+	coverage := v.drawTracks(splitIntoTracks(&h, 0, 0), newPixelMapping(bounds, 5, 5), nil)
+	intensity := coverage.toIntensity()
+
+	for x := 0; x < 5; x++ {
+		for y := 0; y < 5; y++ {
+			msg := fmt.Sprintf("(%d, %d)", x, y)
+			if y == 2 {
+				gt.AssertTrueM(t, intensity.Points[x][y] > 0.99, msg+" should be on the line")
+			} else {
+				gt.AssertTrueM(t, intensity.Points[x][y] < 0.01, msg+" should be off the line")
+			}
+		}
+	}
+}
+
+func TestPathVisualizerAccumulatesOverlappingTracks(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 5, Lng: 5})
+	gt.AssertNil(t, err)
+
+	// The same route, twice, an hour apart.
+	h := History{}
+	for _, start := range []int64{0, 3600} {
+		h.Add(&Coordinate{Lat: 2.5, Lng: 0.5, Timestamp: time.Unix(start, 0)})
+		h.Add(&Coordinate{Lat: 2.5, Lng: 2.5, Timestamp: time.Unix(start+60, 0)})
+		h.Add(&Coordinate{Lat: 2.5, Lng: 4.5, Timestamp: time.Unix(start+120, 0)})
+	}
+
+	v := &PathVisualizer{LineWidth: 1, Opacity: 0.5, MaxGap: time.Minute * 10}
+	mapping := newPixelMapping(bounds, 5, 5)
+
+	once := v.drawTracks(splitIntoTracks(&h, 0, 0), mapping, nil).toIntensity()
+	assertClose(t, 0.5, once.Points[2][2], "One track, including the joint in the middle")
+
+	twice := v.drawTracks(splitIntoTracks(&h, v.MaxGap, 0), mapping, nil).toIntensity()
+	gt.AssertEqualM(t, 2, len(splitIntoTracks(&h, v.MaxGap, 0)), "Expected two tracks")
+	assertClose(t, 0.75, twice.Points[2][2], "Two overlapping tracks")
+}
+
+func TestPathVisualizerCrossesAntimeridian(t *testing.T) {
+	// The whole world, at 10 degrees per pixel.
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: -90, Lng: -180},
+		Coordinate{Lat: 90, Lng: 180})
+	gt.AssertNil(t, err)
+
+	h := History{}
+	h.Add(&Coordinate{Lat: -5, Lng: 175})
+	h.Add(&Coordinate{Lat: -5, Lng: -175})
+
+	v := &PathVisualizer{LineWidth: 1, Opacity: 1}
+	intensity := v.drawTracks(splitIntoTracks(&h, 0, 0), newPixelMapping(bounds, 36, 18), nil).toIntensity()
+
+	gt.AssertTrueM(t, intensity.Points[35][9] > 0.99, "Should leave the right edge")
+	gt.AssertTrueM(t, intensity.Points[0][9] > 0.99, "Should arrive at the left edge")
+	gt.AssertTrueM(t, intensity.Points[18][9] < 0.01, "Shouldn't go the long way around")
+}
+
+func TestPathVisualizerInReversedBox(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: -10, Lng: 170},
+		Coordinate{Lat: 10, Lng: -170})
+	gt.AssertNil(t, err)
+
+	h := History{}
+	// One degree per pixel.
+	h.Add(&Coordinate{Lat: -0.5, Lng: 175})
+	h.Add(&Coordinate{Lat: -0.5, Lng: -175})
+
+	v := &PathVisualizer{LineWidth: 1, Opacity: 1}
+	intensity := v.drawTracks(splitIntoTracks(&h, 0, 0), newPixelMapping(bounds, 20, 20), nil).toIntensity()
+
+	gt.AssertTrueM(t, intensity.Points[10][10] > 0.99, "Should cross the middle of the box")
+	gt.AssertTrueM(t, intensity.Points[1][10] < 0.01, "Shouldn't reach the left edge")
+	gt.AssertTrueM(t, intensity.Points[18][10] < 0.01, "Shouldn't reach the right edge")
+}
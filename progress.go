@@ -0,0 +1,284 @@
+package latvis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ======================================
+// =========== PROGRESS API =============
+// ======================================
+
+// The stages of a render, in the order they happen.  Every render ends with
+// a single PROGRESS_DONE or PROGRESS_ERROR event.  Attempts which fail, but
+// will be retried, end with PROGRESS_RETRYING instead, and the next attempt
+// starts from PROGRESS_FETCHING again.
+const (
+	PROGRESS_FETCHING    = "fetching"
+	PROGRESS_AGGREGATING = "aggregating"
+	PROGRESS_ENCODING    = "encoding"
+	PROGRESS_RETRYING    = "retrying"
+	PROGRESS_DONE        = "done"
+	PROGRESS_ERROR       = "error"
+
+	// How many events a slow listener may fall behind by, before it starts
+	// missing some.
+	PROGRESS_BUFFER = 16
+
+	// How often to send a comment to idle event streams, so that proxies
+	// don't give up on them.  Also how often the job is checked, in case it's
+	// running in another process (whose events we wouldn't see).
+	PROGRESS_KEEPALIVE = 15 * time.Second
+)
+
+type ProgressEvent struct {
+	Stage string `json:"stage"`
+
+	// While fetching: how many pages of history have been downloaded, and
+	// how many points they held.
+	Pages  int `json:"pages,omitempty"`
+	Points int `json:"points,omitempty"`
+
+	// While aggregating: how many of the Total points have been drawn.
+	Done  int `json:"done,omitempty"`
+	Total int `json:"total,omitempty"`
+
+	// Why the render failed (only for PROGRESS_ERROR and PROGRESS_RETRYING).
+	Error string `json:"error,omitempty"`
+}
+
+func (e *ProgressEvent) final() bool {
+	return e.Stage == PROGRESS_DONE || e.Stage == PROGRESS_ERROR
+}
+
+// Receives progress events from a long-running operation.  A nil ProgressFunc
+// ignores them.
+type ProgressFunc func(event ProgressEvent)
+
+func (p ProgressFunc) report(event ProgressEvent) {
+	if p != nil {
+		p(event)
+	}
+}
+
+// Reports PROGRESS_AGGREGATING events while working through 'total' points,
+// no more often than once per percent, and checks (just as often) whether
+// ctx has been cancelled.  A nil counter does neither.
+type progressCounter struct {
+	ctx         context.Context
+	progress    ProgressFunc
+	done, total int
+	step        int
+}
+
+func newProgressCounter(ctx context.Context, progress ProgressFunc, total int) *progressCounter {
+	c := &progressCounter{ctx: ctx, progress: progress, total: total, step: total / 100}
+	if c.step < 1 {
+		c.step = 1
+	}
+	c.progress.report(ProgressEvent{Stage: PROGRESS_AGGREGATING, Total: total})
+	return c
+}
+
+// Counts a point.  Returns false once it's time to give up.
+func (c *progressCounter) inc() bool {
+	if c == nil {
+		return true
+	}
+	c.done++
+	if c.done%c.step == 0 || c.done == c.total {
+		c.progress.report(ProgressEvent{Stage: PROGRESS_AGGREGATING, Done: c.done, Total: c.total})
+		return c.err() == nil
+	}
+	return true
+}
+
+func (c *progressCounter) err() error {
+	if c == nil {
+		return nil
+	}
+	return c.ctx.Err()
+}
+
+// ======================================
+// ========== PROGRESS BROKER ===========
+// ======================================
+
+// ProgressBroker passes progress events from render jobs to whoever is
+// listening for them (i.e. the ProgressHandler).  It only works within a
+// process: listeners don't see events from jobs run elsewhere.
+type ProgressBroker struct {
+	mutex     sync.Mutex
+	listeners map[Handle]map[chan ProgressEvent]bool
+
+	// The latest event for each unfinished job, for new listeners.
+	latest map[Handle]ProgressEvent
+}
+
+func NewProgressBroker() *ProgressBroker {
+	return &ProgressBroker{
+		listeners: make(map[Handle]map[chan ProgressEvent]bool),
+		latest:    make(map[Handle]ProgressEvent),
+	}
+}
+
+// Sends the event to everyone listening to 'handle'.  Listeners which have
+// fallen PROGRESS_BUFFER events behind lose their oldest event, so that a
+// stuck listener can't hold up the job.  A nil broker drops everything.
+func (b *ProgressBroker) Publish(handle *Handle, event ProgressEvent) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if event.final() {
+		delete(b.latest, *handle)
+	} else {
+		b.latest[*handle] = event
+	}
+
+	for events := range b.listeners[*handle] {
+		for sent := false; !sent; {
+			select {
+			case events <- event:
+				sent = true
+			default:
+				select {
+				case <-events:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Returns a channel of events for 'handle', starting with the latest one (if
+// the job has started).  Call 'cancel' once finished with it.
+func (b *ProgressBroker) Subscribe(handle *Handle) (events <-chan ProgressEvent, cancel func()) {
+	listener := make(chan ProgressEvent, PROGRESS_BUFFER)
+	if b == nil {
+		return listener, func() {}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.listeners[*handle] == nil {
+		b.listeners[*handle] = make(map[chan ProgressEvent]bool)
+	}
+	b.listeners[*handle][listener] = true
+	if latest, ok := b.latest[*handle]; ok {
+		listener <- latest
+	}
+
+	key := *handle
+	return listener, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.listeners[key], listener)
+		if len(b.listeners[key]) == 0 {
+			delete(b.listeners, key)
+		}
+	}
+}
+
+// ======================================
+// ====== SERVER-SENT EVENTS HANDLER ====
+// ======================================
+
+// Streams a render job's progress as Server-Sent Events, from
+// /progress/<handle>.events.  Each event's data is a JSON ProgressEvent, and
+// its type is "progress", PROGRESS_DONE or PROGRESS_ERROR.  The stream ends
+// after the PROGRESS_DONE or PROGRESS_ERROR event.
+//
+// Jobs with no record (see RenderEngineInterface.FetchJob) get a 404.
+func ProgressHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+	handle, err := parseHandleFromUrl(request.URL.Path)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		serveError(response, fmt.Errorf("Streaming isn't supported"))
+		return
+	}
+
+	// Subscribe before checking on the job, so that nothing can happen in
+	// between.
+	events, cancel := env.progress.Subscribe(handle)
+	defer cancel()
+
+	engine := env.RenderEngineForRequest(request)
+	job, err := engine.FetchJob(handle)
+	if err == ErrNoSuchJob {
+		http.Error(response, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		serveErrorWithLabel(response, "ProgressHandler/FetchJob error", err)
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/event-stream")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.WriteHeader(http.StatusOK)
+
+	if finished, ok := finishedJobEvent(job); ok {
+		writeProgressEvent(response, &finished)
+		flusher.Flush()
+		return
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(PROGRESS_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-events:
+			writeProgressEvent(response, &event)
+			flusher.Flush()
+			if event.final() {
+				return
+			}
+		case <-keepalive.C:
+			if job, err := engine.FetchJob(handle); err == nil {
+				if finished, ok := finishedJobEvent(job); ok {
+					writeProgressEvent(response, &finished)
+					flusher.Flush()
+					return
+				}
+			}
+			fmt.Fprint(response, ": keepalive\n\n")
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
+
+// Returns the final event for a job which has finished.
+func finishedJobEvent(job *Job) (ProgressEvent, bool) {
+	switch job.State {
+	case JOB_STORED:
+		return ProgressEvent{Stage: PROGRESS_DONE}, true
+	case JOB_FAILED, JOB_CANCELLED, JOB_EXPIRED:
+		return ProgressEvent{Stage: PROGRESS_ERROR, Error: job.Error}, true
+	}
+	return ProgressEvent{}, false
+}
+
+func writeProgressEvent(response http.ResponseWriter, event *ProgressEvent) {
+	eventType := "progress"
+	if event.final() {
+		eventType = event.Stage
+	}
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(response, "event: %s\ndata: %s\n\n", eventType, data)
+}
@@ -0,0 +1,182 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressBroker(t *testing.T) {
+	b := NewProgressBroker()
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	other := &Handle{timestamp: 100, n1: 4, n2: 5, n3: 6}
+
+	b.Publish(h, ProgressEvent{Stage: PROGRESS_FETCHING, Pages: 1})
+	events, cancel := b.Subscribe(h)
+	defer cancel()
+	gt.AssertEqualM(t, 1, (<-events).Pages, "New listeners should get the latest event")
+
+	b.Publish(other, ProgressEvent{Stage: PROGRESS_FETCHING})
+	gt.AssertEqualM(t, 0, len(events), "Listeners should only see their own job")
+
+	// Listeners which fall behind lose the oldest events, not the newest.
+	for i := 0; i < PROGRESS_BUFFER+5; i++ {
+		b.Publish(h, ProgressEvent{Stage: PROGRESS_AGGREGATING, Done: i})
+	}
+	b.Publish(h, ProgressEvent{Stage: PROGRESS_DONE})
+	gt.AssertEqual(t, PROGRESS_BUFFER, len(events))
+	var last ProgressEvent
+	for len(events) > 0 {
+		last = <-events
+	}
+	gt.AssertEqual(t, PROGRESS_DONE, last.Stage)
+
+	late, cancelLate := b.Subscribe(h)
+	defer cancelLate()
+	gt.AssertEqualM(t, 0, len(late), "Finished jobs have no latest event")
+
+	var nilBroker *ProgressBroker
+	nilBroker.Publish(h, ProgressEvent{Stage: PROGRESS_DONE})
+}
+
+func TestProgressCounter(t *testing.T) {
+	var events []ProgressEvent
+	progress := func(event ProgressEvent) { events = append(events, event) }
+
+	counter := newProgressCounter(context.Background(), progress, 1000)
+	for i := 0; i < 1000; i++ {
+		counter.inc()
+	}
+	gt.AssertEqualM(t, 101, len(events), "A start event, then one per percent")
+	gt.AssertEqual(t, 0, events[0].Done)
+	gt.AssertEqual(t, 1000, events[100].Done)
+	gt.AssertEqual(t, 1000, events[100].Total)
+
+	newProgressCounter(context.Background(), nil, 10).inc()
+}
+
+func TestVisualizerReportsProgress(t *testing.T) {
+	var stages []string
+	var last ProgressEvent
+	v, err := newVisualizer("heatmap", nil, nil, func(event ProgressEvent) {
+		if len(stages) == 0 || stages[len(stages)-1] != event.Stage {
+			stages = append(stages, event.Stage)
+		}
+		last = event
+	})
+	gt.AssertNil(t, err)
+
+	bounds, err := NewBoundingBox(Coordinate{Lat: 0, Lng: 0}, Coordinate{Lat: 10, Lng: 10})
+	gt.AssertNil(t, err)
+	h := History{}
+	for i := 0; i < 50; i++ {
+		h.Add(&Coordinate{Lat: float64(i) / 5, Lng: 5})
+	}
+	_, err = v.Visualize(context.Background(), &h, bounds, 10, 10)
+	gt.AssertNil(t, err)
+
+	gt.AssertEqual(t, 2, len(stages))
+	gt.AssertEqual(t, PROGRESS_AGGREGATING, stages[0])
+	gt.AssertEqual(t, PROGRESS_ENCODING, stages[1])
+	gt.AssertEqual(t, PROGRESS_ENCODING, last.Stage)
+}
+
+func TestVisualizerStopsWhenCancelled(t *testing.T) {
+	bounds, err := NewBoundingBox(Coordinate{Lat: 0, Lng: 0}, Coordinate{Lat: 10, Lng: 10})
+	gt.AssertNil(t, err)
+	h := History{}
+	for i := 0; i < 50; i++ {
+		h.Add(&Coordinate{Lat: float64(i) / 5, Lng: 5})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, style := range []string{"heatmap", "kde", "path", "svg"} {
+		v, err := newVisualizer(style, nil, nil, nil)
+		gt.AssertNil(t, err)
+		_, err = v.Visualize(ctx, &h, bounds, 10, 10)
+		gt.AssertEqualM(t, context.Canceled, err, style)
+	}
+}
+
+func TestProgressHandlerStreamsEvents(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	jobStore := NewInMemoryJobStore()
+	env := NewEnvironment(blobStore, jobStore, nil, nil, nil)
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(env))
+
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	updateJob(jobStore, h, JOB_FETCHING, nil)
+
+	request, err := http.NewRequest("GET", "http://myhost.com"+serializeHandleToUrl(h, "events", "progress"), nil)
+	gt.AssertNil(t, err)
+	response := httptest.NewRecorder()
+	finished := make(chan bool)
+	go func() {
+		ProgressHandler(response, request)
+		close(finished)
+	}()
+
+	// Wait for the handler to start listening.
+	for {
+		env.progress.mutex.Lock()
+		listening := len(env.progress.listeners[*h]) > 0
+		env.progress.mutex.Unlock()
+		if listening {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	env.progress.Publish(h, ProgressEvent{Stage: PROGRESS_FETCHING, Pages: 2, Points: 300})
+	env.progress.Publish(h, ProgressEvent{Stage: PROGRESS_DONE})
+	<-finished
+
+	gt.AssertEqual(t, "text/event-stream", response.Header().Get("Content-Type"))
+	gt.AssertEqual(t,
+		"event: progress\ndata: {\"stage\":\"fetching\",\"pages\":2,\"points\":300}\n\n"+
+			"event: done\ndata: {\"stage\":\"done\"}\n\n",
+		response.Body.String())
+	env.progress.mutex.Lock()
+	gt.AssertEqualM(t, 0, len(env.progress.listeners), "Listeners should be cleaned up")
+	env.progress.mutex.Unlock()
+}
+
+func TestProgressHandlerFinishedJobs(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	jobStore := NewInMemoryJobStore()
+	env := NewEnvironment(blobStore, jobStore, nil, nil, nil)
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(env))
+
+	get := func(url string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", url, nil)
+		gt.AssertNil(t, err)
+		response := httptest.NewRecorder()
+		ProgressHandler(response, request)
+		return response
+	}
+
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	progressUrl := "http://myhost.com" + serializeHandleToUrl(h, "events", "progress")
+	gt.AssertEqual(t, http.StatusNotFound, get(progressUrl).Code)
+	gt.AssertEqual(t, http.StatusBadRequest, get("http://myhost.com/progress/100-1-2-3.events").Code)
+
+	updateJob(jobStore, h, JOB_FAILED, errors.New("no data"))
+	response := get(progressUrl)
+	gt.AssertEqual(t, http.StatusOK, response.Code)
+	gt.AssertTrueM(t, strings.HasPrefix(response.Body.String(), "event: error\n"), response.Body.String())
+	gt.AssertTrueM(t, strings.Contains(response.Body.String(), "no data"), response.Body.String())
+
+	stored := &Handle{timestamp: 100, n1: 4, n2: 5, n3: 6}
+	gt.AssertNil(t, blobStore.Store(stored.imageHandle(), &Blob{}))
+	response = get("http://myhost.com" + serializeHandleToUrl(stored, "events", "progress"))
+	gt.AssertEqual(t, "event: done\ndata: {\"stage\":\"done\"}\n\n", response.Body.String())
+}
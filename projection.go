@@ -0,0 +1,258 @@
+package latvis
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// ======================================
+// ============ PROJECTIONS =============
+// ======================================
+
+// Projection flattens the globe onto a plane, so that it can be drawn.
+//
+// Projections are built for a particular BoundingBox (see NewProjection), so
+// that they can center themselves on it, and handle boxes which straddle the
+// antimeridian.
+type Projection interface {
+	Name() string
+
+	// Maps a coordinate onto the plane.  x grows eastwards, and y grows
+	// northwards.  The units are arbitrary, but must be the same on both axes.
+	Project(c *Coordinate) (x, y float64)
+
+	// For projections which repeat every 360 degrees of longitude, the
+	// distance in x covered by one full trip around the globe.  0 otherwise.
+	Period() float64
+}
+
+const DEFAULT_PROJECTION = "equirectangular"
+
+var projectionConstructors = map[string]func(bounds *BoundingBox) Projection{
+	"equirectangular": func(bounds *BoundingBox) Projection {
+		return &equirectangularProjection{reversed: bounds.isReversed()}
+	},
+	"mercator": func(bounds *BoundingBox) Projection {
+		return &webMercatorProjection{reversed: bounds.isReversed()}
+	},
+	"laea": func(bounds *BoundingBox) Projection {
+		center := boxCenter(bounds)
+		return &lambertAzimuthalProjection{
+			lat0: center.Lat * math.Pi / 180,
+			lng0: center.Lng * math.Pi / 180,
+		}
+	},
+	"utm": func(bounds *BoundingBox) Projection {
+		center := boxCenter(bounds)
+		return &utmProjection{
+			zone:  utmZone(center.Lng),
+			south: center.Lat < 0,
+		}
+	},
+}
+
+// Returns the names accepted by NewProjection, in sorted order.
+func ProjectionNames() []string {
+	names := []string{}
+	for name, _ := range projectionConstructors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builds the named projection (see ProjectionNames) for the given box.  An
+// empty name gets the DEFAULT_PROJECTION.
+//
+//   - "equirectangular" treats latitude and longitude as a flat grid.
+//   - "mercator" is Web Mercator, which lines up with most web basemaps.
+//   - "laea" is Lambert azimuthal equal-area, centered on the box.
+//   - "utm" is the Universal Transverse Mercator zone containing the center
+//     of the box.
+func NewProjection(name string, bounds *BoundingBox) (Projection, error) {
+	if name == "" {
+		name = DEFAULT_PROJECTION
+	}
+	constructor, ok := projectionConstructors[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown projection '%s' (expected one of: %s)",
+			name, strings.Join(ProjectionNames(), ", "))
+	}
+	return constructor(bounds), nil
+}
+
+func boxCenter(bounds *BoundingBox) *Coordinate {
+	lng := bounds.LowerLeft().Lng + bounds.Width()/2
+	if lng > 180 {
+		lng -= 360
+	}
+	return &Coordinate{
+		Lat: bounds.LowerLeft().Lat + bounds.Height()/2,
+		Lng: lng,
+	}
+}
+
+// Boxes which straddle the antimeridian (see BoundingBox.isReversed) continue
+// eastwards past 180 degrees, rather than jumping back to -180.
+func unwrappedLng(c *Coordinate, reversed bool) float64 {
+	if reversed && c.Lng < 0 {
+		return c.Lng + 360
+	}
+	return c.Lng
+}
+
+// ======================================
+// ========== EQUIRECTANGULAR ===========
+// ======================================
+
+type equirectangularProjection struct {
+	reversed bool
+}
+
+func (p *equirectangularProjection) Name() string {
+	return "equirectangular"
+}
+
+func (p *equirectangularProjection) Project(c *Coordinate) (x, y float64) {
+	return unwrappedLng(c, p.reversed), c.Lat
+}
+
+func (p *equirectangularProjection) Period() float64 {
+	return 360
+}
+
+// ======================================
+// ============ WEB MERCATOR ============
+// ======================================
+
+// Web Mercator can't show the poles, so (like everyone else) we cut it off
+// where the map becomes square.
+const MAX_MERCATOR_LATITUDE = 85.051128779806604
+
+type webMercatorProjection struct {
+	reversed bool
+}
+
+func (p *webMercatorProjection) Name() string {
+	return "mercator"
+}
+
+func (p *webMercatorProjection) Project(c *Coordinate) (x, y float64) {
+	lat := math.Max(-MAX_MERCATOR_LATITUDE, math.Min(MAX_MERCATOR_LATITUDE, c.Lat))
+	x = unwrappedLng(c, p.reversed) * math.Pi / 180
+	y = math.Log(math.Tan(math.Pi/4 + lat*math.Pi/360))
+	return x, y
+}
+
+func (p *webMercatorProjection) Period() float64 {
+	return 2 * math.Pi
+}
+
+// ======================================
+// ===== LAMBERT AZIMUTHAL EQUAL-AREA ===
+// ======================================
+
+// Spherical Lambert azimuthal equal-area, centered on (lat0, lng0), which are
+// in radians.
+type lambertAzimuthalProjection struct {
+	lat0, lng0 float64
+}
+
+func (p *lambertAzimuthalProjection) Name() string {
+	return "laea"
+}
+
+func (p *lambertAzimuthalProjection) Project(c *Coordinate) (x, y float64) {
+	lat := c.Lat * math.Pi / 180
+	dLng := c.Lng*math.Pi/180 - p.lng0
+
+	denominator := 1 + math.Sin(p.lat0)*math.Sin(lat) + math.Cos(p.lat0)*math.Cos(lat)*math.Cos(dLng)
+	// The antipode of the center is a circle at the edge of the map.
+	k := math.Sqrt(2 / math.Max(denominator, 1e-12))
+
+	x = k * math.Cos(lat) * math.Sin(dLng)
+	y = k * (math.Cos(p.lat0)*math.Sin(lat) - math.Sin(p.lat0)*math.Cos(lat)*math.Cos(dLng))
+	return x, y
+}
+
+func (p *lambertAzimuthalProjection) Period() float64 {
+	return 0
+}
+
+// ======================================
+// ================ UTM =================
+// ======================================
+
+// WGS84 ellipsoid.
+const (
+	WGS84_SEMI_MAJOR_AXIS = 6378137.0
+	WGS84_FLATTENING      = 1 / 298.257223563
+	UTM_SCALE_FACTOR      = 0.9996
+)
+
+type utmProjection struct {
+	zone  int
+	south bool
+}
+
+// Returns the (1-based) UTM zone containing the given longitude.
+func utmZone(lng float64) int {
+	zone := int(math.Floor((lng+180)/6)) + 1
+	if zone > 60 {
+		zone = 60
+	}
+	if zone < 1 {
+		zone = 1
+	}
+	return zone
+}
+
+func (p *utmProjection) Name() string {
+	if p.south {
+		return fmt.Sprintf("utm:%dS", p.zone)
+	}
+	return fmt.Sprintf("utm:%dN", p.zone)
+}
+
+func (p *utmProjection) Period() float64 {
+	return 0
+}
+
+// Returns meters of easting and northing, using the series expansion from
+// Snyder's "Map Projections: A Working Manual" (USGS Professional Paper 1395).
+func (p *utmProjection) Project(c *Coordinate) (x, y float64) {
+	a := WGS84_SEMI_MAJOR_AXIS
+	e2 := WGS84_FLATTENING * (2 - WGS84_FLATTENING)
+	e4 := e2 * e2
+	e6 := e4 * e2
+	ep2 := e2 / (1 - e2)
+	k0 := UTM_SCALE_FACTOR
+
+	centralMeridian := float64(-183+6*p.zone) * math.Pi / 180
+	lat := c.Lat * math.Pi / 180
+	dLng := math.Remainder(c.Lng*math.Pi/180-centralMeridian, 2*math.Pi)
+
+	sinLat, cosLat, tanLat := math.Sin(lat), math.Cos(lat), math.Tan(lat)
+	n := a / math.Sqrt(1-e2*sinLat*sinLat)
+	t := tanLat * tanLat
+	cc := ep2 * cosLat * cosLat
+	aa := cosLat * dLng
+
+	m := a * ((1-e2/4-3*e4/64-5*e6/256)*lat -
+		(3*e2/8+3*e4/32+45*e6/1024)*math.Sin(2*lat) +
+		(15*e4/256+45*e6/1024)*math.Sin(4*lat) -
+		(35*e6/3072)*math.Sin(6*lat))
+
+	x = k0*n*(aa+
+		(1-t+cc)*math.Pow(aa, 3)/6+
+		(5-18*t+t*t+72*cc-58*ep2)*math.Pow(aa, 5)/120) + 500000
+	y = k0 * (m + n*tanLat*(aa*aa/2+
+		(5-t+9*cc+4*cc*cc)*math.Pow(aa, 4)/24+
+		(61-58*t+t*t+600*cc-330*ep2)*math.Pow(aa, 6)/720))
+	if p.south {
+		y += 10000000
+	}
+	return x, y
+}
@@ -0,0 +1,137 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"math"
+	"testing"
+)
+
+func TestNewProjection(t *testing.T) {
+	box, err := NewBoundingBox(
+		Coordinate{Lat: 40, Lng: -75},
+		Coordinate{Lat: 41, Lng: -73})
+	gt.AssertNil(t, err)
+
+	p, err := NewProjection("", box)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, DEFAULT_PROJECTION, p.Name(), "Default projection")
+
+	p, err = NewProjection("utm", box)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, "utm:18N", p.Name(), "New York is in UTM zone 18")
+
+	_, err = NewProjection("dymaxion", box)
+	gt.AssertNotNil(t, err)
+
+	gt.AssertEqualM(t, []string{"equirectangular", "laea", "mercator", "utm"},
+		ProjectionNames(), "Projection names")
+}
+
+func TestWebMercatorProjection(t *testing.T) {
+	p := &webMercatorProjection{}
+
+	x, y := p.Project(&Coordinate{Lat: 0, Lng: 180})
+	assertClose(t, math.Pi, x, "The antimeridian")
+	assertClose(t, 0.0, y, "The equator")
+
+	// The cut-off latitude makes the world square.
+	_, y = p.Project(&Coordinate{Lat: 90, Lng: 0})
+	assertClose(t, math.Pi, y, "The top of the map")
+}
+
+func TestLambertAzimuthalProjection(t *testing.T) {
+	p := &lambertAzimuthalProjection{lat0: 50 * math.Pi / 180, lng0: 10 * math.Pi / 180}
+
+	x, y := p.Project(&Coordinate{Lat: 50, Lng: 10})
+	assertClose(t, 0.0, x, "The center x")
+	assertClose(t, 0.0, y, "The center y")
+
+	// Equal-area: a one degree square has the same area on the map as it does
+	// on the (unit) sphere.
+	ax, ay := p.Project(&Coordinate{Lat: 60, Lng: 30})
+	bx, by := p.Project(&Coordinate{Lat: 60, Lng: 30.001})
+	cx, cy := p.Project(&Coordinate{Lat: 60.001, Lng: 30})
+	mapArea := math.Abs((bx-ax)*(cy-ay) - (by-ay)*(cx-ax))
+	sphereArea := math.Pow(0.001*math.Pi/180, 2) * math.Cos(60*math.Pi/180)
+	gt.AssertTrueM(t, math.Abs(mapArea/sphereArea-1) < 0.001, "Area should be preserved")
+}
+
+func TestUtmProjection(t *testing.T) {
+	// Null Island is well known to be at 166021E 0N in zone 31.
+	x, y := (&utmProjection{zone: 31}).Project(&Coordinate{Lat: 0, Lng: 0})
+	gt.AssertTrueM(t, math.Abs(x-166021.44) < 0.1, "Easting")
+	gt.AssertTrueM(t, math.Abs(y) < 0.1, "Northing")
+
+	// The central meridian of each zone has an easting of 500km.
+	x, _ = (&utmProjection{zone: 18}).Project(&Coordinate{Lat: 40, Lng: -75})
+	gt.AssertTrueM(t, math.Abs(x-500000) < 0.001, "Central meridian")
+
+	// The southern hemisphere gets a false northing, to stay positive.
+	_, y = (&utmProjection{zone: 56, south: true}).Project(&Coordinate{Lat: -33.86, Lng: 151.21})
+	gt.AssertTrueM(t, y > 6200000 && y < 6300000, "Sydney's northing")
+
+	gt.AssertEqualM(t, 1, utmZone(-180), "First zone")
+	gt.AssertEqualM(t, 60, utmZone(180), "Last zone")
+}
+
+func TestMercatorStretchesHighLatitudes(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 80, Lng: 10})
+	gt.AssertNil(t, err)
+	c := &Coordinate{Lat: 40, Lng: 5}
+
+	_, flatY := newPixelMapping(bounds, 100, 100).position(c)
+	assertClose(t, 50.0, flatY, "Equirectangular puts 40N halfway up")
+
+	mercator, err := NewProjection("mercator", bounds)
+	gt.AssertNil(t, err)
+	_, mercatorY := newProjectedPixelMapping(bounds, mercator, 100, 100).position(c)
+	gt.AssertTrueM(t, mercatorY > 65, "Mercator puts 40N well below halfway")
+
+	// Degrees of longitude shrink towards the poles, but not on the map, so
+	// Mercator makes the box much taller than equirectangular does.
+	flatW, _ := projectedImgSize(bounds, nil, 500)
+	mercatorW, _ := projectedImgSize(bounds, mercator, 500)
+	gt.AssertTrueM(t, mercatorW < flatW, "Mercator box should be narrower")
+}
+
+func TestProjectedExtentIncludesBulgingEdges(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 40, Lng: -10},
+		Coordinate{Lat: 60, Lng: 10})
+	gt.AssertNil(t, err)
+
+	laea, err := NewProjection("laea", bounds)
+	gt.AssertNil(t, err)
+	_, minY, _, _ := projectedExtent(laea, bounds)
+
+	// Parallels curve around the pole, so the middle of the bottom edge sags
+	// below its corners.
+	_, cornerY := laea.Project(&Coordinate{Lat: 40, Lng: 10})
+	_, middleY := laea.Project(&Coordinate{Lat: 40, Lng: 0})
+	gt.AssertTrueM(t, middleY < cornerY, "Edge should bulge")
+	assertClose(t, middleY, minY, "Extent should include the middle of the edge")
+}
+
+func TestPathVisualizerProjectionWithoutWrapping(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: -10, Lng: 170},
+		Coordinate{Lat: 10, Lng: -170})
+	gt.AssertNil(t, err)
+	laea, err := NewProjection("laea", bounds)
+	gt.AssertNil(t, err)
+
+	h := History{}
+	h.Add(&Coordinate{Lat: 0, Lng: 175})
+	h.Add(&Coordinate{Lat: 0, Lng: -175})
+
+	v := &PathVisualizer{LineWidth: 1, Opacity: 1}
+	mapping := newProjectedPixelMapping(bounds, laea, 21, 21)
+	_, wraps := mapping.wrappedDx(h[0], h[1])
+	gt.AssertFalseM(t, wraps, "LAEA doesn't wrap around")
+
+	intensity := v.drawTracks(splitIntoTracks(&h, 0, 0), mapping, nil).toIntensity()
+	gt.AssertTrueM(t, intensity.Points[10][10] > 0.99, "Should cross the middle of the box")
+}
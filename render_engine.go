@@ -1,8 +1,12 @@
 package latvis
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -14,13 +18,23 @@ import (
 type RenderRequest struct {
 	// The geographic area, specified with a box of latitude/longitude
 	// coordinates, to consider when rendering.
-	Bounds *BoundingBox
+	Bounds *BoundingBox `json:"bounds"`
 
 	// The time period to consider when rendering.
-	Start, End time.Time
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
 
-	// TODO(mrjones): make this a better API
-	VisualizationStyle string
+	// The name of the VisualizerStyle to draw with (see
+	// VisualizerStyleNames).  Empty means DEFAULT_STYLE.
+	Style string `json:"style,omitempty"`
+
+	// Settings for the style, checked by VisualizerStyle.ParseOptions.
+	// Missing ones get their defaults.
+	Options VisualizerOptions `json:"options,omitempty"`
+
+	// The name of the map projection to draw with (see ProjectionNames).
+	// Empty means DEFAULT_PROJECTION.
+	Projection string `json:"projection,omitempty"`
 }
 
 // TODO(mrjones): I think I want to call this something like "LatvisController"
@@ -39,21 +53,52 @@ type RenderEngineInterface interface {
 	GetOAuthUrl(callbackUrl string, applicationState string) string
 
 	// Download and visualize a Latitude history.  The resulting visualization
-	// will be stored using the given handle, and can be retrieved using
-	// FecthImage with the same handle. Blocks until rendering is complete.
-	Execute(renderRequest *RenderRequest,
+	// will be stored using the given handle's imageHandle, and can be retrieved
+	// using FecthImage with the same handle. Blocks until rendering is complete.
+	//
+	// Returns ErrJobCancelled, without storing anything, if ctx is cancelled
+	// or CancelJob is called.  (CancelJob is noticed between stages, while
+	// cancelling ctx stops the current stage too.)
+	//
+	// Unless it's the 'finalAttempt', a failure (other than one which Is
+	// ErrJobPermanentFailure) leaves the job JOB_RETRYING rather than
+	// JOB_FAILED, since it'll be tried again.
+	Execute(ctx context.Context,
+		renderRequest *RenderRequest,
 		oauthVerificationCode string,
 		callbackUrl string, // TODO(mrjones): make better?
-		handle *Handle) error
+		handle *Handle,
+		finalAttempt bool) error
 
 	// Retrieve a visualization generated by 'Execute'.
-	// This will return an error if the image is not ready yet.
-	// TOOD(mrjones): distinguish between real error, and not-ready?
+	// This will return an error if the image is not ready yet (use FetchJob
+	// to tell whether it's still on its way, or has failed).
 	FetchImage(handle *Handle) (*Blob, error)
+
+	// Retrieve the status of the 'Execute' for the given handle.  Returns
+	// ErrNoSuchJob if there's no record of it.  Stored jobs whose images
+	// have since been deleted are JOB_EXPIRED.
+	FetchJob(handle *Handle) (*Job, error)
+
+	// Marks the job for the given handle as JOB_CANCELLED, so that Execute
+	// gives up on it.  Returns ErrNoSuchJob, or ErrJobFinished if it's too
+	// late.
+	CancelJob(handle *Handle) (*Job, error)
 }
 
-func NewRenderEngine(blobStore BlobStore, httpTransport http.RoundTripper) RenderEngineInterface {
-	return &RenderEngine{blobStore: blobStore, httpTransport: httpTransport}
+// jobStore may be nil, in which case job statuses aren't recorded, and
+// FetchJob can only tell whether the image has been stored.  Progress events
+// from Execute are published to 'progress' (which may also be nil).
+func NewRenderEngine(blobStore BlobStore,
+	jobStore JobStore,
+	progress *ProgressBroker,
+	httpTransport http.RoundTripper) RenderEngineInterface {
+	return &RenderEngine{
+		blobStore:     blobStore,
+		jobStore:      jobStore,
+		progress:      progress,
+		httpTransport: httpTransport,
+	}
 }
 
 // ======================================
@@ -62,6 +107,8 @@ func NewRenderEngine(blobStore BlobStore, httpTransport http.RoundTripper) Rende
 
 type RenderEngine struct {
 	blobStore     BlobStore
+	jobStore      JobStore
+	progress      *ProgressBroker
 	httpTransport http.RoundTripper
 }
 
@@ -70,75 +117,259 @@ func (r *RenderEngine) GetOAuthUrl(callbackUrl string, applicationState string)
 }
 
 func (r *RenderEngine) FetchImage(handle *Handle) (*Blob, error) {
-	return r.blobStore.Fetch(handle)
+	return r.blobStore.Fetch(handle.imageHandle())
+}
+
+func (r *RenderEngine) FetchJob(handle *Handle) (*Job, error) {
+	var job *Job
+	if r.jobStore != nil {
+		var err error
+		job, err = r.jobStore.Fetch(handle)
+		if err == ErrNoSuchJob {
+			job = nil
+		} else if err != nil {
+			return nil, err
+		} else if job.State != JOB_STORED {
+			return job, nil
+		}
+	}
+
+	// Images rendered without a JobStore (or before there was one) have no
+	// record, but are just as finished, and stored jobs' images may have
+	// been swept since.  (This is called on every poll, so it mustn't fetch
+	// the whole image.)
+	_, err := statBlob(r.blobStore, handle.imageHandle())
+	if errors.Is(err, ErrNoSuchBlob) {
+		if job == nil {
+			return nil, ErrNoSuchJob
+		}
+		job.State = JOB_EXPIRED
+		job.Error = ErrJobExpired.Error()
+		return job, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if job == nil {
+		job = &Job{State: JOB_STORED, Progress: jobStateProgress[JOB_STORED]}
+	}
+	return job, nil
 }
 
-func (r *RenderEngine) Execute(renderRequest *RenderRequest,
+func (r *RenderEngine) CancelJob(handle *Handle) (*Job, error) {
+	job, err := r.FetchJob(handle)
+	if err != nil {
+		return nil, err
+	}
+	if job.Finished() {
+		// Including every job FetchJob finds without a JobStore.
+		return job, ErrJobFinished
+	}
+
+	// Checked and changed in one go, so that a job can't finish in between
+	// (and then be marked as cancelled anyway).
+	var finished *Job
+	err = r.jobStore.Update(handle, func(job *Job) (*Job, error) {
+		if job == nil {
+			return nil, ErrNoSuchJob
+		}
+		if job.Finished() {
+			finished = job
+			return nil, ErrJobFinished
+		}
+		job.State = JOB_CANCELLED
+		job.Error = ErrJobCancelled.Error()
+		job.Updated = time.Now()
+		return job, nil
+	})
+	if err == ErrJobFinished {
+		return finished, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.FetchJob(handle)
+}
+
+func (r *RenderEngine) Execute(ctx context.Context,
+	renderRequest *RenderRequest,
 	verificationCode string,
 	callbackUrl string, // TODO(mrjones): make better?
+	handle *Handle,
+	finalAttempt bool) error {
+
+	err := r.execute(ctx, renderRequest, verificationCode, callbackUrl, handle)
+	if err == nil {
+		r.progress.Publish(handle, ProgressEvent{Stage: PROGRESS_DONE})
+		return nil
+	}
+	if err == ErrJobCancelled || ctx.Err() == context.Canceled {
+		err = ErrJobCancelled
+	}
+	r.recordFailure(handle, err, finalAttempt)
+	return err
+}
+
+// Records why an attempt at a job failed, and tells anyone watching.  Only
+// the last attempt's failure is final: until then, the job is JOB_RETRYING.
+func (r *RenderEngine) recordFailure(handle *Handle, err error, finalAttempt bool) {
+	state := JOB_RETRYING
+	switch {
+	case err == ErrJobCancelled:
+		state = JOB_CANCELLED
+	case finalAttempt || errors.Is(err, ErrJobPermanentFailure):
+		state = JOB_FAILED
+	}
+	if updateJob(r.jobStore, handle, state, err) == ErrJobCancelled {
+		// It was cancelled before it failed.
+		state, err = JOB_CANCELLED, ErrJobCancelled
+	}
+
+	stage := PROGRESS_ERROR
+	if state == JOB_RETRYING {
+		stage = PROGRESS_RETRYING
+	}
+	r.progress.Publish(handle, ProgressEvent{Stage: stage, Error: err.Error()})
+}
+
+func (r *RenderEngine) execute(ctx context.Context,
+	renderRequest *RenderRequest,
+	verificationCode string,
+	callbackUrl string,
 	handle *Handle) error {
 
+	progress := func(event ProgressEvent) { r.progress.Publish(handle, event) }
+
+	if err := updateJob(r.jobStore, handle, JOB_FETCHING, nil); err != nil {
+		return err
+	}
 	dataStream, err := GetAuthorizer(callbackUrl, r.httpTransport).FinishAuthorize(verificationCode)
 	if err != nil {
-		return fmt.Errorf("FinishAuthorize failed: %s", err)
+		// The verification code can only be used once, so this won't work
+		// any better next time.
+		return permanentJobError(fmt.Errorf("FinishAuthorize failed: %s", err))
 	}
 
-	history, err := dataStream.FetchRange(renderRequest.Start, renderRequest.End)
+	history, err := dataStream.FetchRangeWithProgress(ctx, renderRequest.Start, renderRequest.End, progress)
 	if err != nil {
 		return fmt.Errorf("FetchRange failed: %s", err)
 	}
 
-	blob, err := r.MakeVisualization(history, renderRequest.Bounds, renderRequest.VisualizationStyle)
+	if err := updateJob(r.jobStore, handle, JOB_RENDERING, nil); err != nil {
+		return err
+	}
+	blob, err := renderHistory(ctx, history, renderRequest, progress)
 	if err != nil {
-		return fmt.Errorf("MakeVisualization failed: %s", err)
+		return fmt.Errorf("Rendering failed: %s", err)
 	}
 
-	err = r.blobStore.Store(handle, blob)
+	if r.cancelled(handle) {
+		return ErrJobCancelled
+	}
+	err = r.blobStore.Store(handle.imageHandle(), blob)
 	if err != nil {
 		return fmt.Errorf("Store failed: %s", err)
 	}
 
+	// CancelJob may have been called while the image was being stored.
+	if err := updateJob(r.jobStore, handle, JOB_STORED, nil); err != nil {
+		if deleteErr := r.blobStore.Delete(handle.imageHandle()); deleteErr != nil {
+			log.Printf("Couldn't delete the image for cancelled job %s: %s\n", handle, deleteErr)
+		}
+		return err
+	}
 	return nil
 }
 
-const (
-	IMAGE_SIZE_PX = 512
-)
+// Whether CancelJob has been called for the handle (possibly by another
+// process sharing the JobStore).
+func (r *RenderEngine) cancelled(handle *Handle) bool {
+	if r.jobStore == nil {
+		return false
+	}
+	job, err := r.jobStore.Fetch(handle)
+	return err == nil && job.State == JOB_CANCELLED
+}
+
+// Renders an already-loaded history, without fetching or storing anything.
+//
+// Only renderRequest's Bounds, Style, Options and Projection are used: it's
+// up to the caller to have only loaded the points between Start and End.
+//
+// Gives up, returning ctx.Err(), if ctx is cancelled.
+func RenderHistory(ctx context.Context,
+	history *History, renderRequest *RenderRequest) (*Blob, error) {
+	return renderHistory(ctx, history, renderRequest, nil)
+}
 
-func (r *RenderEngine) MakeVisualization(
-	history *History, bounds *BoundingBox, style string) (*Blob, error) {
-	w, h := imgSize(bounds, IMAGE_SIZE_PX)
+func renderHistory(ctx context.Context,
+	history *History,
+	renderRequest *RenderRequest,
+	progress ProgressFunc) (*Blob, error) {
+	projection, err := NewProjection(renderRequest.Projection, renderRequest.Bounds)
+	if err != nil {
+		return nil, err
+	}
 
-	var visualizer Visualizer
-	if (style == "svg") {
-		visualizer = &SvgVisualizer{}
-	} else {
-		visualizer = &BwPngVisualizer{}
+	style, options, err := parseStyle(renderRequest.Style, renderRequest.Options)
+	if err != nil {
+		return nil, err
+	}
+	w, h := projectedImgSize(renderRequest.Bounds, projection, options.Int("size"))
+
+	visualizer, err := style.New(options, projection, progress)
+	if err != nil {
+		return nil, err
 	}
 
 	data, err := visualizer.Visualize(
+		ctx,
 		history,
-		bounds,
+		renderRequest.Bounds,
 		w,
 		h)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Blob{Data: *data}, nil
+	return &Blob{
+		Data:        *data,
+		ContentType: style.ContentType,
+		Created:     time.Now(),
+		Request:     renderRequest,
+		Metadata:    map[string]string{"points": strconv.Itoa(history.Len())},
+	}, nil
 }
 
 func imgSize(bounds *BoundingBox, max int) (w, h int) {
+	return projectedImgSize(bounds, nil, max)
+}
+
+// Picks the largest image size, no more than 'max' pixels in either
+// direction, with the same shape as the projected box.  A nil projection
+// means equirectangular.
+func projectedImgSize(bounds *BoundingBox, projection Projection, max int) (w, h int) {
+	if projection == nil {
+		projection = &equirectangularProjection{reversed: bounds.isReversed()}
+	}
+	minX, minY, maxX, maxY := projectedExtent(projection, bounds)
 	maxF := float64(max)
 
 	w = max
 	h = max
 
-	skew := bounds.Height() / bounds.Width()
+	skew := (maxY - minY) / (maxX - minX)
 	if skew > 1.0 {
 		w = int(maxF / skew)
 	} else {
 		h = int(maxF * skew)
 	}
+	// Very thin boxes would otherwise round down to nothing.
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
 	return w, h
 }
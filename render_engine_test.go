@@ -3,7 +3,10 @@ package latvis
 import (
 	"github.com/mrjones/gt"
 
+	"errors"
+	"net/url"
 	"testing"
+	"time"
 )
 
 func TestSquareBox(t *testing.T) {
@@ -41,3 +44,203 @@ func TestTallBox(t *testing.T) {
 	gt.AssertEqualM(t, 250, w, "Width should be narrow for a tall box")
 	gt.AssertEqualM(t, 500, h, "Height should be maxed for a tall box")
 }
+
+func TestSlimBox(t *testing.T) {
+	box, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 0.0001, Lng: 100})
+	gt.AssertNil(t, err)
+
+	w, h := imgSize(box, 500)
+
+	gt.AssertEqualM(t, 500, w, "Width should be maxed for a slim box")
+	gt.AssertEqualM(t, 1, h, "Height should be at least a pixel")
+}
+
+// Builds the visualizer for the named style (see LookupVisualizerStyle),
+// checking its options.  The visualizer draws using the given projection
+// (nil means equirectangular), and reports its progress to 'progress' (which
+// may be nil).
+func newVisualizer(styleName string,
+	options map[string]string,
+	projection Projection,
+	progress ProgressFunc) (Visualizer, error) {
+	style, parsed, err := parseStyle(styleName, options)
+	if err != nil {
+		return nil, err
+	}
+	return style.New(parsed, projection, progress)
+}
+
+func TestVisualizerForStyle(t *testing.T) {
+	v, err := newVisualizer("", nil, nil, nil)
+	gt.AssertNil(t, err)
+	_, ok := v.(*BwPngVisualizer)
+	gt.AssertTrueM(t, ok, "Default should be black & white")
+
+	v, err = newVisualizer("svg", nil, nil, nil)
+	gt.AssertNil(t, err)
+	svg, ok := v.(*SvgVisualizer)
+	gt.AssertTrueM(t, ok, "Expected SVG")
+	gt.AssertFalseM(t, svg.HideLegend, "Legend by default")
+
+	v, err = newVisualizer("svg", map[string]string{"marker": "diamond", "legend": "false"}, nil, nil)
+	gt.AssertNil(t, err)
+	svg = v.(*SvgVisualizer)
+	gt.AssertEqual(t, "diamond", svg.MarkerShape)
+	gt.AssertTrue(t, svg.HideLegend)
+
+	v, err = newVisualizer("heatmap", nil, nil, nil)
+	gt.AssertNil(t, err)
+	heatmap, ok := v.(*ColorPngVisualizer)
+	gt.AssertTrueM(t, ok, "Expected a heatmap")
+	gt.AssertEqualM(t, DEFAULT_PALETTE, heatmap.Palette.Name, "Default palette")
+	gt.AssertFalseM(t, heatmap.Transparent, "Opaque by default")
+
+	v, err = newVisualizer("heatmap", map[string]string{"palette": "magma", "transparent": "true"}, nil, nil)
+	gt.AssertNil(t, err)
+	heatmap = v.(*ColorPngVisualizer)
+	gt.AssertEqualM(t, "magma", heatmap.Palette.Name, "Palette")
+	gt.AssertTrueM(t, heatmap.Transparent, "Transparent")
+
+	_, err = newVisualizer("heatmap", map[string]string{"palette": "plaid"}, nil, nil)
+	gt.AssertNotNil(t, err)
+
+	v, err = newVisualizer("kde", map[string]string{"bandwidth": "250", "palette": "magma"}, nil, nil)
+	gt.AssertNil(t, err)
+	kde := v.(*KdeVisualizer)
+	gt.AssertEqualM(t, 250.0, kde.BandwidthMeters, "Bandwidth")
+	gt.AssertEqualM(t, "magma", kde.Palette.Name, "Palette")
+
+	_, err = newVisualizer("kde", map[string]string{"bandwidth": "-5"}, nil, nil)
+	gt.AssertNotNil(t, err)
+
+	v, err = newVisualizer("path", map[string]string{"line_width": "3", "opacity": "0.25", "palette": "hot"}, nil, nil)
+	gt.AssertNil(t, err)
+	path := v.(*PathVisualizer)
+	gt.AssertEqualM(t, 3.0, path.LineWidth, "Line width")
+	gt.AssertEqualM(t, 0.25, path.Opacity, "Opacity")
+	gt.AssertEqualM(t, "hot", path.Palette.Name, "Palette")
+
+	_, err = newVisualizer("path", map[string]string{"opacity": "2"}, nil, nil)
+	gt.AssertNotNil(t, err)
+
+	_, err = newVisualizer("plaid", nil, nil, nil)
+	gt.AssertNotNil(t, err)
+}
+
+// Every style has to draw in the requested projection, since the image is
+// sized for it (see projectedImgSize).
+func TestVisualizersUseProjection(t *testing.T) {
+	bounds, err := NewBoundingBox(Coordinate{Lat: 40, Lng: -75}, Coordinate{Lat: 41, Lng: -73})
+	gt.AssertNil(t, err)
+	projection, err := NewProjection("mercator", bounds)
+	gt.AssertNil(t, err)
+
+	for _, style := range []string{"", "svg", "heatmap", "kde", "path"} {
+		v, err := newVisualizer(style, nil, projection, nil)
+		gt.AssertNil(t, err)
+		var used Projection
+		switch v := v.(type) {
+		case *BwPngVisualizer:
+			used = v.Projection
+		case *SvgVisualizer:
+			used = v.Projection
+		case *ColorPngVisualizer:
+			used = v.Projection
+		case *KdeVisualizer:
+			used = v.Projection
+		case *PathVisualizer:
+			used = v.Projection
+		}
+		gt.AssertEqualM(t, projection, used, "Style '"+style+"'")
+	}
+}
+
+func TestRenderRequestStyleRoundTrip(t *testing.T) {
+	box, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 10, Lng: 5})
+	gt.AssertNil(t, err)
+
+	_, options, err := parseStyle("heatmap", map[string]string{"palette": "inferno"})
+	gt.AssertNil(t, err)
+	rr := &RenderRequest{
+		Bounds:     box,
+		Start:      time.Unix(100, 0).UTC(),
+		End:        time.Unix(200, 0).UTC(),
+		Style:      "heatmap",
+		Options:    options,
+		Projection: "mercator",
+	}
+
+	params := make(url.Values)
+	serializeRenderRequest(rr, &params)
+	rr2, err := deserializeRenderRequest(&params)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, rr, rr2, "Should survive serialization")
+
+	rr.Projection = "dymaxion"
+	params = make(url.Values)
+	serializeRenderRequest(rr, &params)
+	_, err = deserializeRenderRequest(&params)
+	gt.AssertNotNil(t, err)
+
+	rr.Projection = "mercator"
+	rr.Options = VisualizerOptions{"palette": "plaid"}
+	params = make(url.Values)
+	serializeRenderRequest(rr, &params)
+	_, err = deserializeRenderRequest(&params)
+	gt.AssertNotNil(t, err)
+}
+
+func TestRenderEngineOnlyFailsOnFinalAttempt(t *testing.T) {
+	jobStore := NewInMemoryJobStore()
+	progress := NewProgressBroker()
+	engine := &RenderEngine{jobStore: jobStore, progress: progress}
+	h := simpleHandle()
+	events, cancel := progress.Subscribe(h)
+	defer cancel()
+
+	updateJob(jobStore, h, JOB_RENDERING, nil)
+	engine.recordFailure(h, errors.New("out of ink"), false)
+	job, err := jobStore.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, JOB_RETRYING, job.State)
+	gt.AssertEqual(t, "out of ink", job.Error)
+	gt.AssertFalseM(t, job.Finished(), "Retrying jobs aren't finished")
+	event := <-events
+	gt.AssertEqual(t, PROGRESS_RETRYING, event.Stage)
+	gt.AssertFalseM(t, event.final(), "Listeners should keep listening")
+
+	engine.recordFailure(h, permanentJobError(errors.New("bad code")), false)
+	job, err = jobStore.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, JOB_FAILED, job.State, "Permanent failures aren't retried")
+	gt.AssertEqual(t, PROGRESS_ERROR, (<-events).Stage)
+
+	updateJob(jobStore, h, JOB_RENDERING, nil)
+	engine.recordFailure(h, errors.New("out of ink"), true)
+	job, err = jobStore.Fetch(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, JOB_FAILED, job.State)
+	event = <-events
+	gt.AssertEqual(t, PROGRESS_ERROR, event.Stage)
+	gt.AssertEqual(t, "out of ink", event.Error)
+}
+
+func TestRenderEngineFetchJobDoesNotFetchImage(t *testing.T) {
+	blobStore := NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 1000})
+	engine := &RenderEngine{blobStore: blobStore}
+	h := simpleHandle()
+
+	_, err := engine.FetchJob(h)
+	gt.AssertEqual(t, ErrNoSuchJob, err)
+
+	gt.AssertNil(t, blobStore.Store(h.imageHandle(), &Blob{Data: []byte("png")}))
+	job, err := engine.FetchJob(h)
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, JOB_STORED, job.State)
+	stats := blobStore.Stats()
+	gt.AssertEqualM(t, int64(0), stats.Hits+stats.Misses, "Polling shouldn't fetch the image")
+}
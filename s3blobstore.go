@@ -0,0 +1,562 @@
+package latvis
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ======================================
+// ===== S3-COMPATIBLE BLOB STORE =======
+// ======================================
+
+const (
+	S3_DEFAULT_REGION = "us-east-1"
+
+	// Long enough to move a big image, but a stalled server doesn't hang its
+	// callers for good.
+	S3_DEFAULT_TIMEOUT = time.Minute
+
+	// Object headers for the parts of a Blob other than its data (which is
+	// the object) and its content type (which is Content-Type).  Request and
+	// Metadata are base64url-encoded JSON, since headers must be ASCII.
+	S3_CREATED_HEADER  = "X-Amz-Meta-Created"
+	S3_EXPIRES_HEADER  = "X-Amz-Meta-Expires"
+	S3_REQUEST_HEADER  = "X-Amz-Meta-Request"
+	S3_METADATA_HEADER = "X-Amz-Meta-Metadata"
+
+	// Presigned URLs can't last any longer than this.
+	S3_MAX_PRESIGN_EXPIRY = 7 * 24 * time.Hour
+
+	S3_TIME_FORMAT          = "20060102T150405Z"
+	S3_EMPTY_PAYLOAD_SHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+type S3BlobStoreOptions struct {
+	// Where the S3 API is, e.g. "https://s3.eu-west-1.amazonaws.com", or
+	// "http://localhost:9000" for MinIO.  Buckets are addressed by path
+	// (<endpoint>/<bucket>/<key>), which every implementation supports.
+	Endpoint string
+	Bucket   string
+
+	// Defaults to S3_DEFAULT_REGION.
+	Region string
+
+	// Put in front of each handle to make its object's key, so that one
+	// bucket can hold several stores.
+	Prefix string
+
+	AccessKeyId     string
+	SecretAccessKey string
+
+	// If set, RenderHandler sends clients to presigned URLs which are good
+	// for this long, instead of passing the images through itself.
+	PresignExpiry time.Duration
+
+	// How long each request may take, including reading the response.
+	// Defaults to S3_DEFAULT_TIMEOUT.
+	Timeout time.Duration
+
+	// Defaults to http.DefaultTransport.
+	HttpTransport http.RoundTripper
+}
+
+// Keeps each blob as an object in an S3 bucket, so that several servers can
+// share them.  Each PUT replaces a whole object, so readers never see half of
+// one.
+//
+// S3 doesn't record when objects are read, so BlobInfo.LastUsed is when the
+// blob was stored.  Listings don't include objects' metadata either, so List
+// sends a HEAD for every blob to find out when it expires: sweeping N blobs
+// takes N+1 requests (plus one per extra 1000 blobs).
+type S3BlobStore struct {
+	options  S3BlobStoreOptions
+	endpoint *url.URL
+	signer   *s3Signer
+	client   *http.Client
+}
+
+func NewS3BlobStore(options S3BlobStoreOptions) (*S3BlobStore, error) {
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 endpoint '%s': %s", options.Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("Invalid S3 endpoint '%s': expected e.g. https://host", options.Endpoint)
+	}
+	if options.Bucket == "" {
+		return nil, fmt.Errorf("An S3 bucket is required")
+	}
+	if options.PresignExpiry > S3_MAX_PRESIGN_EXPIRY {
+		return nil, fmt.Errorf("S3 presigned URLs can't last longer than %s", S3_MAX_PRESIGN_EXPIRY)
+	}
+	if options.Region == "" {
+		options.Region = S3_DEFAULT_REGION
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = S3_DEFAULT_TIMEOUT
+	}
+	transport := options.HttpTransport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &S3BlobStore{
+		options:  options,
+		endpoint: endpoint,
+		signer: &s3Signer{
+			accessKeyId:     options.AccessKeyId,
+			secretAccessKey: options.SecretAccessKey,
+			region:          options.Region,
+		},
+		client: &http.Client{Transport: transport, Timeout: options.Timeout},
+	}, nil
+}
+
+func (s *S3BlobStore) Store(handle *Handle, blob *Blob) error {
+	header := http.Header{}
+	header.Set("Content-Type", blob.contentType())
+	created := blob.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	header.Set(S3_CREATED_HEADER, created.UTC().Format(time.RFC3339Nano))
+	if !blob.Expires.IsZero() {
+		header.Set(S3_EXPIRES_HEADER, blob.Expires.UTC().Format(time.RFC3339Nano))
+	}
+	if blob.Request != nil {
+		if err := setS3JsonHeader(header, S3_REQUEST_HEADER, blob.Request); err != nil {
+			return newBlobError("store", handle, err)
+		}
+	}
+	if len(blob.Metadata) > 0 {
+		if err := setS3JsonHeader(header, S3_METADATA_HEADER, blob.Metadata); err != nil {
+			return newBlobError("store", handle, err)
+		}
+	}
+
+	response, err := s.do("PUT", s.objectUrl(handle), header, blob.Data)
+	if err != nil {
+		return newBlobError("store", handle, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return s3BlobError("store", handle, response)
+	}
+	return nil
+}
+
+func (s *S3BlobStore) Fetch(handle *Handle) (*Blob, error) {
+	response, err := s.do("GET", s.objectUrl(handle), nil, nil)
+	if err != nil {
+		return nil, newBlobError("fetch", handle, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, s3BlobError("fetch", handle, response)
+	}
+
+	blob, err := blobFromS3Header(response.Header)
+	if err != nil {
+		return nil, &BlobError{Op: "fetch", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+	}
+	blob.Data, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, newBlobError("fetch", handle, err)
+	}
+	return blob, nil
+}
+
+func (s *S3BlobStore) Delete(handle *Handle) error {
+	response, err := s.do("DELETE", s.objectUrl(handle), nil, nil)
+	if err != nil {
+		return newBlobError("delete", handle, err)
+	}
+	defer response.Body.Close()
+	// S3 itself says 204 whether or not there was anything to delete, but
+	// not every implementation does.
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK &&
+		response.StatusCode != http.StatusNotFound {
+		return s3BlobError("delete", handle, response)
+	}
+	return nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3BlobStore) List() ([]*BlobInfo, error) {
+	infos := []*BlobInfo{}
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.options.Prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		u := s.bucketUrl()
+		u.RawQuery = s3CanonicalQuery(query)
+
+		result := &s3ListBucketResult{}
+		if err := s.getXml(u, result); err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			handle, err := parseStorageKey(strings.TrimPrefix(object.Key, s.options.Prefix))
+			if err != nil {
+				// Not one of ours.
+				continue
+			}
+			info, err := s.Stat(handle)
+			if errors.Is(err, ErrNoSuchBlob) {
+				// Deleted since it was listed.
+				continue
+			}
+			if errors.Is(err, ErrBlobCorrupted) {
+				// One bad blob shouldn't stop the rest being managed.
+				log.Printf("Skipping blob %s: %s\n", handle, err)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			info.Size = object.Size
+			info.LastUsed = object.LastModified
+			infos = append(infos, info)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return infos, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// Describes a blob, from its object's headers (with a HEAD, so the data isn't
+// downloaded).
+func (s *S3BlobStore) Stat(handle *Handle) (*BlobInfo, error) {
+	response, err := s.do("HEAD", s.objectUrl(handle), nil, nil)
+	if err != nil {
+		return nil, newBlobError("stat", handle, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, s3BlobError("stat", handle, response)
+	}
+	blob, err := blobFromS3Header(response.Header)
+	if err != nil {
+		return nil, &BlobError{Op: "stat", Handle: handle, Kind: ErrBlobCorrupted, Err: err}
+	}
+	info := &BlobInfo{
+		Handle:      handle,
+		Size:        response.ContentLength,
+		ContentType: blob.ContentType,
+		Created:     blob.Created,
+		Expires:     blob.Expires,
+	}
+	if lastModified, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+		info.LastUsed = lastModified
+	}
+	return info, nil
+}
+
+// A presigned URL for the blob's object, or "" if presigning isn't turned on
+// (see S3BlobStoreOptions.PresignExpiry).  The URL doesn't check whether
+// there is such a blob: S3 will answer that itself.
+func (s *S3BlobStore) BlobURL(handle *Handle) (string, error) {
+	if s.options.PresignExpiry <= 0 {
+		return "", nil
+	}
+	return s.signer.presign("GET", s.objectUrl(handle), s.options.PresignExpiry, time.Now()), nil
+}
+
+func (s *S3BlobStore) bucketUrl() *url.URL {
+	return s.url("/" + s.options.Bucket)
+}
+
+func (s *S3BlobStore) objectUrl(handle *Handle) *url.URL {
+	return s.url("/" + s.options.Bucket + "/" + s.options.Prefix + handle.storageKey())
+}
+
+func (s *S3BlobStore) url(path string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = s3UriEncode(u.Path, false)
+	u.RawQuery = ""
+	return &u
+}
+
+func (s *S3BlobStore) do(method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	payloadHash := S3_EMPTY_PAYLOAD_SHA256
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	s.signer.sign(request, payloadHash, time.Now())
+	return s.client.Do(request)
+}
+
+func (s *S3BlobStore) getXml(u *url.URL, result interface{}) error {
+	response, err := s.do("GET", u, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return s3Error(response)
+	}
+	return xml.NewDecoder(response.Body).Decode(result)
+}
+
+func setS3JsonHeader(header http.Header, name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	header.Set(name, base64.RawURLEncoding.EncodeToString(data))
+	return nil
+}
+
+func getS3JsonHeader(header http.Header, name string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(header.Get(name))
+	if err != nil {
+		return fmt.Errorf("Bad %s header: %s", name, err)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("Bad %s header: %s", name, err)
+	}
+	return nil
+}
+
+// Everything but the Data.
+func blobFromS3Header(header http.Header) (*Blob, error) {
+	blob := &Blob{ContentType: header.Get("Content-Type")}
+	var err error
+	if created := header.Get(S3_CREATED_HEADER); created != "" {
+		if blob.Created, err = time.Parse(time.RFC3339Nano, created); err != nil {
+			return nil, fmt.Errorf("Bad %s header: %s", S3_CREATED_HEADER, err)
+		}
+	} else {
+		// Not stored by an S3BlobStore, but this will do.
+		blob.Created, _ = http.ParseTime(header.Get("Last-Modified"))
+	}
+	if expires := header.Get(S3_EXPIRES_HEADER); expires != "" {
+		if blob.Expires, err = time.Parse(time.RFC3339Nano, expires); err != nil {
+			return nil, fmt.Errorf("Bad %s header: %s", S3_EXPIRES_HEADER, err)
+		}
+	}
+	if header.Get(S3_REQUEST_HEADER) != "" {
+		blob.Request = &RenderRequest{}
+		if err := getS3JsonHeader(header, S3_REQUEST_HEADER, blob.Request); err != nil {
+			return nil, err
+		}
+	}
+	if header.Get(S3_METADATA_HEADER) != "" {
+		if err := getS3JsonHeader(header, S3_METADATA_HEADER, &blob.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	return blob, nil
+}
+
+// What S3 says went wrong, in the body of an error response.
+type S3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 error %d", e.StatusCode)
+	}
+	return fmt.Sprintf("S3 error %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func s3Error(response *http.Response) *S3Error {
+	s3Err := &S3Error{}
+	// HEAD responses (at least) have no body.
+	xml.NewDecoder(io.LimitReader(response.Body, 64*1024)).Decode(s3Err)
+	s3Err.StatusCode = response.StatusCode
+	return s3Err
+}
+
+func s3BlobError(op string, handle *Handle, response *http.Response) error {
+	s3Err := s3Error(response)
+	blobErr := &BlobError{Op: op, Handle: handle, Err: s3Err}
+	switch {
+	case response.StatusCode == http.StatusNotFound && s3Err.Code != "NoSuchBucket":
+		blobErr.Kind = ErrNoSuchBlob
+	case response.StatusCode == http.StatusForbidden:
+		blobErr.Kind = ErrBlobPermission
+	}
+	return blobErr
+}
+
+// ======================================
+// ======== S3 REQUEST SIGNATURES =======
+// ======================================
+
+// Signs requests with AWS Signature Version 4, as S3 wants them:
+// http://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+type s3Signer struct {
+	accessKeyId     string
+	secretAccessKey string
+	region          string
+}
+
+// Signs every header the request has (as well as Host), and adds the
+// X-Amz-Date, X-Amz-Content-Sha256 and Authorization headers.  'payloadHash'
+// is the hex SHA-256 of the body.
+func (s *s3Signer) sign(request *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	request.Header.Set("X-Amz-Date", now.Format(S3_TIME_FORMAT))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	headers["host"] = request.Host
+	if headers["host"] == "" {
+		headers["host"] = request.URL.Host
+	}
+	signedHeaders := []string{}
+	for name, _ := range headers {
+		signedHeaders = append(signedHeaders, name)
+	}
+	sort.Strings(signedHeaders)
+
+	canonical := s3CanonicalRequest(request.Method, request.URL, request.URL.Query(),
+		headers, signedHeaders, payloadHash)
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyId, s.scope(now), strings.Join(signedHeaders, ";"), s.signature(now, canonical)))
+}
+
+// Returns 'u' with a signature in its query, good for 'expiry', so that it
+// can be fetched without any credentials.
+func (s *s3Signer) presign(method string, u *url.URL, expiry time.Duration, now time.Time) string {
+	now = now.UTC()
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.accessKeyId+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format(S3_TIME_FORMAT))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonical := s3CanonicalRequest(method, u, query,
+		map[string]string{"host": u.Host}, []string{"host"}, "UNSIGNED-PAYLOAD")
+	query.Set("X-Amz-Signature", s.signature(now, canonical))
+
+	presigned := *u
+	presigned.RawQuery = s3CanonicalQuery(query)
+	return presigned.String()
+}
+
+func (s *s3Signer) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+func (s *s3Signer) signature(now time.Time, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format(S3_TIME_FORMAT) + "\n" +
+		s.scope(now) + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretAccessKey)
+	for _, part := range []string{now.Format("20060102"), s.region, "s3", "aws4_request"} {
+		key = hmacSha256(key, part)
+	}
+	return hex.EncodeToString(hmacSha256(key, stringToSign))
+}
+
+func s3CanonicalRequest(method string, u *url.URL, query url.Values,
+	headers map[string]string, signedHeaders []string, payloadHash string) string {
+	canonicalHeaders := ""
+	for _, name := range signedHeaders {
+		canonicalHeaders += name + ":" + strings.TrimSpace(headers[name]) + "\n"
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	return strings.Join([]string{
+		method,
+		s3UriEncode(path, false),
+		s3CanonicalQuery(query),
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// The query, sorted and encoded the way signatures need it.
+func s3CanonicalQuery(query url.Values) string {
+	params := [][2]string{}
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{s3UriEncode(name, true), s3UriEncode(value, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := []string{}
+	for _, param := range params {
+		encoded = append(encoded, param[0]+"="+param[1])
+	}
+	return strings.Join(encoded, "&")
+}
+
+// Percent-encodes everything but the unreserved characters (and, unless
+// 'encodeSlash', slashes).
+func s3UriEncode(s string, encodeSlash bool) string {
+	encoded := ""
+	for _, b := range []byte(s) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			encoded += string(b)
+		default:
+			encoded += fmt.Sprintf("%%%02X", b)
+		}
+	}
+	return encoded
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
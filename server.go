@@ -1,11 +1,15 @@
 package latvis
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"text/template"
 )
@@ -31,19 +35,56 @@ func Setup(serverEnvFactory EnvironmentFactory) {
 	// Writes the result to storage, but doesn't return any data.
 	http.HandleFunc("/drawmap_worker", DrawMapWorker)
 
-	// Displays the requested image (as a raw image/png)
+	// Displays the requested image (as a raw image/png, or whatever type it
+	// was stored with)
 	// NOTE: also update static/js/image-loader.js.
 	http.HandleFunc("/rawimg/", RenderHandler)
 
+	// Makes expiring links to an image, which anyone can follow (on a POST),
+	// and serves the images they link to (see Environment.EnableShareLinks).
+	// NOTE: also update static/js/image-loader.js.
+	http.HandleFunc("/share/", ShareHandler)
+	http.HandleFunc("/shared/", SharedImageHandler)
+
 	// Polls, waiting for the requested image to be ready, and once it is
 	// displays that image. (This returns text/html, with an embedded <img>
 	// referenceing a "/render/" endpoint.)
 	http.HandleFunc("/display/", ResultPageHandler)
 
-	// Checks if the requested image is ready or not (used for polling on
-	// the "display" page.
+	// Checks if the requested image is ready or not.  (The "display" page
+	// polls "/jobs/" instead, which can also say why an image failed.)
 	http.HandleFunc("/is_ready/", IsReadyHandler)
 
+	// Reports the progress of a render job, as JSON (used for polling on the
+	// "display" page).
+	// NOTE: also update static/js/image-loader.js.
+	http.HandleFunc("/jobs/", JobHandler)
+
+	// Cancels a render job (on a POST).
+	// NOTE: also update static/js/image-loader.js.
+	http.HandleFunc("/cancel/", CancelHandler)
+
+	// Streams a render job's progress as Server-Sent Events.
+	// NOTE: also update static/js/image-loader.js.
+	http.HandleFunc("/progress/", ProgressHandler)
+
+	// Lets admins list and delete stored images, sweep away expired ones,
+	// retry or discard render tasks, and see how the image cache is doing
+	// (see Environment.EnableAdmin).
+	http.HandleFunc("/admin/blobs", AdminBlobsHandler)
+	http.HandleFunc("/admin/blobs/", AdminBlobsHandler)
+	http.HandleFunc("/admin/sweep", AdminSweepHandler)
+	http.HandleFunc("/admin/tasks", AdminTasksHandler)
+	http.HandleFunc("/admin/tasks/", AdminTasksHandler)
+	http.HandleFunc("/admin/stats", AdminStatsHandler)
+
+	// Lists the visualization styles, and their options, as JSON.
+	http.HandleFunc("/styles", StylesHandler)
+
+	// Serves Web Mercator map tiles (as /tiles/{layer}/{z}/{x}/{y}.png) for
+	// the layers added with Environment.AddTileLayer.
+	http.HandleFunc("/tiles/", TileHandler)
+
 	http.Handle("/", http.FileServer(http.Dir("static")))
 }
 
@@ -57,18 +98,23 @@ func IsReadyHandler(response http.ResponseWriter, request *http.Request) {
 	env := envFactory.ForRequest(request)
 	handle, err := parseHandleFromUrl(request.URL.Path)
 	if err != nil {
-		serveErrorWithLabel(response, "error parsing blob handle", err)
+		http.Error(response, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	blob, err := env.RenderEngineForRequest(request).FetchImage(handle)
-
-	if err != nil || blob == nil {
-		log.Println(err)
+	// Polled until the image is ready, so this mustn't fetch it.
+	_, err = statBlob(env.blobStore, handle.imageHandle())
+	if errors.Is(err, ErrNoSuchBlob) {
+		// Not rendered yet (or ever).
+		response.WriteHeader(http.StatusNotFound)
 		response.Write([]byte("fail"))
-	} else {
-		response.Write([]byte("ok"))
+		return
+	}
+	if err != nil {
+		serveErrorWithLabel(response, "IsReadyHandler/statBlob error", err)
+		return
 	}
+	response.Write([]byte("ok"))
 }
 
 type ResultPageInfo struct {
@@ -88,6 +134,8 @@ var resultPageSource = `
     <img src='/img/generating.png' id='generating' />
     <br />
     <img src='/img/spinner.gif' id='spinner' />
+    <br />
+    <a href='#' onclick="cancelJob('{{.Filename}}'); return false;">Cancel</a>
   </div>
   <br />
   <div id='debug'></div>
@@ -129,23 +177,53 @@ func RenderHandler(response http.ResponseWriter, request *http.Request) {
 	env := envFactory.ForRequest(request)
 	handle, err := parseHandleFromUrl(request.URL.Path)
 	if err != nil {
-		serveErrorWithLabel(response, "(Sync) parseHandleFromUrl error", err)
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if redirectToBlobURL(response, request, env, handle.imageHandle()) {
 		return
 	}
 
 	blob, err := env.RenderEngineForRequest(request).FetchImage(handle)
+	if errors.Is(err, ErrNoSuchBlob) {
+		http.NotFound(response, request)
+		return
+	}
 	if err != nil {
-		serveErrorWithLabel(response, "RenderHandler/OpenStore error", err)
+		serveErrorWithLabel(response, "RenderHandler/FetchImage error", err)
 		return
 	}
+	serveImage(response, request, blob)
+}
 
-	if blob == nil {
-		serveError(response, errors.New("blob is nil"))
-		return
+// Redirects to where the BlobStore serves the image itself, if it does (see
+// BlobURLStore).  Returns whether it responded (with a redirect, or an error).
+func redirectToBlobURL(response http.ResponseWriter, request *http.Request, env *Environment, imageHandle *Handle) bool {
+	urlStore, ok := env.blobStore.(BlobURLStore)
+	if !ok {
+		return false
+	}
+	blobUrl, err := urlStore.BlobURL(imageHandle)
+	if err != nil {
+		serveErrorWithLabel(response, "BlobURL error", err)
+		return true
 	}
+	if blobUrl == "" {
+		return false
+	}
+	// Not permanent, since the URL may only work for a while.
+	http.Redirect(response, request, blobUrl, http.StatusFound)
+	return true
+}
 
-	response.Header().Set("Content-Type", "image/png")
-	response.Write(blob.Data)
+func serveImage(response http.ResponseWriter, request *http.Request, blob *Blob) {
+	// Images never change once they've been stored, so the ETag only needs
+	// to tell different images apart.  (ServeContent takes care of
+	// conditional requests, ranges and Content-Length.)
+	response.Header().Set("Content-Type", blob.contentType())
+	response.Header().Set("ETag", fmt.Sprintf("\"%x\"", sha1.Sum(blob.Data)))
+	http.ServeContent(response, request, request.URL.Path, blob.Created, bytes.NewReader(blob.Data))
 }
 
 func propogateParameter(base string, params *url.Values, key string) string {
@@ -179,6 +257,18 @@ func AuthorizeHandler(response http.ResponseWriter, request *http.Request) {
 	state = propogateParameter(state, &request.Form, "urlng")
 	state = propogateParameter(state, &request.Form, "start")
 	state = propogateParameter(state, &request.Form, "end")
+	state = propogateParameter(state, &request.Form, "style")
+	state = propogateParameter(state, &request.Form, "projection")
+	optionParams := []string{}
+	for key, _ := range request.Form {
+		if strings.HasPrefix(key, OPTION_PARAM_PREFIX) {
+			optionParams = append(optionParams, key)
+		}
+	}
+	sort.Strings(optionParams)
+	for _, key := range optionParams {
+		state = propogateParameter(state, &request.Form, key)
+	}
 
 	callbackUrl := callbackUrlFor(request)
 	log.Printf("Callback URL: '%s' + '%s'\n", callbackUrl, state)
@@ -200,15 +290,31 @@ func AsyncDrawMapHandler(response http.ResponseWriter, request *http.Request) {
 	}
 
 	handle := GenerateHandle()
+	updateJob(env.jobStore, handle, JOB_QUEUED, nil)
 
 	var params = make(url.Values)
 	serializeRenderRequest(rr, &params)
 	serializeHandleToParams(handle, &params)
 	params.Set("verification_code", request.Form.Get("code"))
 
-	env.taskQueue.Enqueue("/drawmap_worker", &params)
+	if err := env.taskQueue.Enqueue("/drawmap_worker", &params); err != nil {
+		updateJob(env.jobStore, handle, JOB_FAILED, err)
+		if err == ErrTaskQueueFull {
+			http.Error(response, "Too many maps are being drawn right now, please try again later.",
+				http.StatusServiceUnavailable)
+			return
+		}
+		serveErrorWithLabel(response, "AsyncDrawMapHandler/enqueue", err)
+		return
+	}
 
-	displayImageUrl := serializeHandleToUrl(handle, "png", "display")
+	// Give the image's URL the right extension for its type.
+	style, err := LookupVisualizerStyle(rr.Style)
+	if err != nil {
+		serveErrorWithLabel(response, "AsyncDrawMapHandler/style", err)
+		return
+	}
+	displayImageUrl := serializeHandleToUrl(handle, style.Extension, "display")
 	http.Redirect(response, request, displayImageUrl, http.StatusFound)
 }
 
@@ -217,29 +323,49 @@ func DrawMapWorker(response http.ResponseWriter, request *http.Request) {
 	fmt.Println("--> DrawMapWorker: " + request.Host + " / " + request.RequestURI)
 	request.ParseForm()
 
-	rr, err := deserializeRenderRequest(&request.Form)
+	// Problems with the task itself are answered with a 4xx status, so that
+	// the queue doesn't retry them.
+	handle, err := parseHandleFromParams(&request.Form)
 	if err != nil {
-		env.Errorf("deserializeRenderRequest: %s", err)
-		serveErrorWithLabel(response, "deserializeRenderRequest() error", err)
+		env.Errorf("parseHandleFromParams: %s", err)
+		serveTaskFailure(response, "parseHandleFromParams error", err)
 		return
 	}
 
-	handle, err := parseHandleFromParams(&request.Form)
+	rr, err := deserializeRenderRequest(&request.Form)
 	if err != nil {
-		env.Errorf("parseHandleFromParams: %s", err)
-		serveErrorWithLabel(response, "parseHandleFromParams error", err)
+		env.Errorf("deserializeRenderRequest: %s", err)
+		updateJob(env.jobStore, handle, JOB_FAILED, err)
+		serveTaskFailure(response, "deserializeRenderRequest() error", err)
 		return
 	}
 
 	verificationCode := request.FormValue("verification_code")
 	if verificationCode == "" {
-		env.Errorf("verification_code query parameter missing")
-		serveErrorWithLabel(response, "get verificationcode", errors.New("verification_code query parameter missing"))
+		err := errors.New("verification_code query parameter missing")
+		env.Errorf("%s", err)
+		updateJob(env.jobStore, handle, JOB_FAILED, err)
+		serveTaskFailure(response, "get verificationcode", err)
+		return
 	}
 
 	callbackUrl := callbackUrlFor(request)
 	log.Printf("Callback URL: '%s'\n", callbackUrl)
-	err = env.RenderEngineForRequest(request).Execute(rr, verificationCode, callbackUrl, handle)
+	ctx, done := env.running.start(request.Context(), handle)
+	defer done()
+	err = env.RenderEngineForRequest(request).Execute(ctx, rr, verificationCode, callbackUrl, handle,
+		isFinalTaskAttempt(request))
+	if err == ErrJobCancelled {
+		// Nothing to retry.
+		log.Printf("Job %s was cancelled\n", handle)
+		response.WriteHeader(http.StatusOK)
+		return
+	}
+	if errors.Is(err, ErrJobPermanentFailure) {
+		env.Errorf("renderEngine error (not retrying): %s", err)
+		serveTaskFailure(response, "engine.Render error", err)
+		return
+	}
 	if err != nil {
 		env.Errorf("renderEngine error: %s", err)
 		serveErrorWithLabel(response, "engine.Render error", err)
@@ -249,6 +375,15 @@ func DrawMapWorker(response http.ResponseWriter, request *http.Request) {
 	response.WriteHeader(http.StatusOK)
 }
 
+// Answers a task which retrying won't help with a 4xx status, so that the
+// task queue gives up on it (unlike serveErrorWithLabel's 500).
+func serveTaskFailure(response http.ResponseWriter, message string, err error) {
+	fmt.Println("ERROR: " + message + ":" + err.Error())
+
+	response.WriteHeader(http.StatusUnprocessableEntity)
+	response.Write([]byte(message + ":" + err.Error()))
+}
+
 func serveErrorWithLabel(response http.ResponseWriter, message string, err error) {
 	serveErrorMessage(response, message+":"+err.Error())
 }
@@ -263,3 +398,14 @@ func serveErrorMessage(response http.ResponseWriter, message string) {
 	response.WriteHeader(http.StatusInternalServerError)
 	response.Write([]byte(message))
 }
+
+func serveJson(response http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		serveErrorWithLabel(response, "Marshal error", err)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Cache-Control", "no-cache")
+	response.Write(data)
+}
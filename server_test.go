@@ -3,8 +3,11 @@ package latvis
 import (
 	"github.com/mrjones/gt"
 
+	"context"
+	"errors"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strconv"
@@ -17,21 +20,43 @@ func TestObjectReady(t *testing.T) {
 	dir, blobStore := setUpFakeBlobStore(t)
 	defer os.RemoveAll(dir)
 
-	cfg := NewEnvironment(blobStore, nil, nil, nil)
+	cfg := NewEnvironment(blobStore, nil, nil, nil, nil)
+	h := &Handle{n1: 1, n2: 2, n3: 3, timestamp: 100}
+	u := "http://myhost.com" + serializeHandleToUrl(h, "png", "is_ready")
 
-	res1 := execute(t, "http://myhost.com/is_ready/100-1-2-3.png", IsReadyHandler, cfg)
-	gt.AssertEqualM(t, http.StatusOK, res1.StatusCode, "Request should have succeeded")
-	gt.AssertEqualM(t, "fail", res1.Body, "Should not have found the object")
+	res1 := execute(t, u, IsReadyHandler, cfg)
+	gt.AssertEqualM(t, http.StatusNotFound, res1.StatusCode, "Should not have found the object")
+	gt.AssertEqual(t, "fail", res1.Body)
 
-	h := &Handle{n1: 1, n2: 2, n3: 3, timestamp: 100}
-	err := blobStore.Store(h, &Blob{})
+	err := blobStore.Store(h.imageHandle(), &Blob{})
 	gt.AssertNil(t, err)
 
-	res2 := execute(t, "http://myhost.com/is_ready/100-1-2-3.png", IsReadyHandler, cfg)
+	res2 := execute(t, u, IsReadyHandler, cfg)
 	gt.AssertEqualM(t, http.StatusOK, res2.StatusCode, "Request should have succeeded")
 	gt.AssertEqualM(t, "ok", res2.Body, "Should have found the object this time.")
 }
 
+func TestObjectReadyDoesNotFetchImage(t *testing.T) {
+	blobStore := NewLRUBlobStore(LRUBlobStoreOptions{MaxBytes: 1000})
+	h := simpleHandle()
+	gt.AssertNil(t, blobStore.Store(h.imageHandle(), &Blob{Data: []byte("png")}))
+
+	res := execute(t, "http://myhost.com"+serializeHandleToUrl(h, "png", "is_ready"), IsReadyHandler,
+		NewEnvironment(blobStore, nil, nil, nil, nil))
+	gt.AssertEqual(t, http.StatusOK, res.StatusCode)
+	stats := blobStore.Stats()
+	gt.AssertEqualM(t, int64(0), stats.Hits+stats.Misses, "Polling shouldn't fetch the image")
+}
+
+func TestObjectReadyStorageError(t *testing.T) {
+	for _, kind := range []error{ErrBlobCorrupted, ErrBlobPermission, nil} {
+		store := &brokenBlobStore{err: &BlobError{Op: "fetch", Handle: simpleHandle(), Kind: kind}}
+		res := execute(t, "http://myhost.com"+serializeHandleToUrl(simpleHandle(), "png", "is_ready"), IsReadyHandler,
+			NewEnvironment(store, nil, nil, nil, nil))
+		gt.AssertEqualM(t, http.StatusInternalServerError, res.StatusCode, store.err.Error())
+	}
+}
+
 func TestObjectReadyMalformedUrl(t *testing.T) {
 	dir, blobStore := setUpFakeBlobStore(t)
 	defer os.RemoveAll(dir)
@@ -41,24 +66,24 @@ func TestObjectReadyMalformedUrl(t *testing.T) {
 	// TODO(mrjones): check error messages
 
 	// No ".png" extension
-	res := execute(t, "http://myhost.com/is_ready/100-1-2-3", IsReadyHandler, cfg)
-	gt.AssertEqualM(t, http.StatusInternalServerError, res.StatusCode, "Should have been an error")
+	res := execute(t, "http://myhost.com/is_ready/"+SIMPLE_HANDLE_STRING, IsReadyHandler, cfg)
+	gt.AssertEqualM(t, http.StatusBadRequest, res.StatusCode, "Should have been an error")
 
 	// No "is_ready" path
-	res = execute(t, "http://myhost.com/100-1-2-3.png", IsReadyHandler, cfg)
-	gt.AssertEqualM(t, http.StatusInternalServerError, res.StatusCode, "Should have been an error")
+	res = execute(t, "http://myhost.com/"+SIMPLE_HANDLE_STRING+".png", IsReadyHandler, cfg)
+	gt.AssertEqualM(t, http.StatusBadRequest, res.StatusCode, "Should have been an error")
 
 	// Extraneous path
-	res = execute(t, "http://myhost.com/random/is_ready/100-1-2-3.png", IsReadyHandler, cfg)
-	gt.AssertEqualM(t, http.StatusInternalServerError, res.StatusCode, "Should have been an error")
+	res = execute(t, "http://myhost.com/random/is_ready/"+SIMPLE_HANDLE_STRING+".png", IsReadyHandler, cfg)
+	gt.AssertEqualM(t, http.StatusBadRequest, res.StatusCode, "Should have been an error")
 
-	// Not enough parts in the handle
-	res = execute(t, "http://myhost.com/is_ready/100-1-2.png", IsReadyHandler, cfg)
-	gt.AssertEqualM(t, http.StatusInternalServerError, res.StatusCode, "Should have been an error")
+	// Too short a handle
+	res = execute(t, "http://myhost.com/is_ready/"+SIMPLE_HANDLE_STRING[1:]+".png", IsReadyHandler, cfg)
+	gt.AssertEqualM(t, http.StatusBadRequest, res.StatusCode, "Should have been an error")
 
-	// Non-numeric parts in the handle
-	res = execute(t, "http://myhost.com/is_ready/a-1-2-3.png", IsReadyHandler, cfg)
-	gt.AssertEqualM(t, http.StatusInternalServerError, res.StatusCode, "Should have been an error")
+	// Handles aren't written as "<timestamp>-<n1>-<n2>-<n3>" any more
+	res = execute(t, "http://myhost.com/is_ready/100-1-2-3.png", IsReadyHandler, cfg)
+	gt.AssertEqualM(t, http.StatusBadRequest, res.StatusCode, "Should have been an error")
 }
 
 //func TestAuthorization(t *testing.T) {
@@ -116,20 +141,20 @@ func TestAsyncWorker(t *testing.T) {
 	cfg := &Environment{mockRenderEngine: mockEngine}
 
 	s := "lllat=1.0&lllng=2.0&urlat=3.0&urlng=4.0&start=5&end=6"
-	u := "http://myhost.com/drawmap_worker/?state=" + url.QueryEscape(s) + "&access_token=abc&refresh_token=def&expiration_time=1234567890&hStamp=100&h1=1&h2=2&h3=3"
+	u := "http://myhost.com/drawmap_worker/?state=" + url.QueryEscape(s) + "&access_token=abc&refresh_token=def&expiration_time=1234567890&verification_code=vercode&h=" + (&Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}).String()
 
 	res := execute(t, u, DrawMapWorker, cfg)
 
 	if mockEngine.lastRenderRequest == nil {
 		t.Fatal("No render request was made!")
 	}
-	gt.AssertEqualM(t, 1.0, mockEngine.lastRenderRequest.bounds.LowerLeft().Lat, "")
-	gt.AssertEqualM(t, 2.0, mockEngine.lastRenderRequest.bounds.LowerLeft().Lng, "")
-	gt.AssertEqualM(t, 3.0, mockEngine.lastRenderRequest.bounds.UpperRight().Lat, "")
-	gt.AssertEqualM(t, 4.0, mockEngine.lastRenderRequest.bounds.UpperRight().Lng, "")
+	gt.AssertEqualM(t, 1.0, mockEngine.lastRenderRequest.Bounds.LowerLeft().Lat, "")
+	gt.AssertEqualM(t, 2.0, mockEngine.lastRenderRequest.Bounds.LowerLeft().Lng, "")
+	gt.AssertEqualM(t, 3.0, mockEngine.lastRenderRequest.Bounds.UpperRight().Lat, "")
+	gt.AssertEqualM(t, 4.0, mockEngine.lastRenderRequest.Bounds.UpperRight().Lng, "")
 
-	gt.AssertEqualM(t, time.Unix(5, 0).UTC(), mockEngine.lastRenderRequest.start, "")
-	gt.AssertEqualM(t, time.Unix(6, 0).UTC(), mockEngine.lastRenderRequest.end, "")
+	gt.AssertEqualM(t, time.Unix(5, 0).UTC(), mockEngine.lastRenderRequest.Start, "")
+	gt.AssertEqualM(t, time.Unix(6, 0).UTC(), mockEngine.lastRenderRequest.End, "")
 
 	gt.AssertEqualM(t, int64(100), mockEngine.lastHandle.timestamp, "")
 	gt.AssertEqualM(t, int64(1), mockEngine.lastHandle.n1, "")
@@ -137,16 +162,94 @@ func TestAsyncWorker(t *testing.T) {
 	gt.AssertEqualM(t, int64(3), mockEngine.lastHandle.n3, "")
 
 	gt.AssertEqualM(t, http.StatusOK, res.StatusCode, "")
+	gt.AssertEqual(t, "vercode", mockEngine.lastVerificationCode)
+	gt.AssertTrueM(t, mockEngine.lastFinalAttempt, "Not from a task queue, so there's no retrying")
+}
+
+func TestAsyncWorkerFailures(t *testing.T) {
+	h := (&Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}).String()
+	state := "state=" + url.QueryEscape("lllat=1.0&lllng=2.0&urlat=3.0&urlng=4.0&start=5&end=6")
+	status := func(params string, engineErr error) int {
+		mockEngine := &MockRenderEngine{err: engineErr}
+		return execute(t, "http://myhost.com/drawmap_worker/?"+params, DrawMapWorker,
+			&Environment{mockRenderEngine: mockEngine}).StatusCode
+	}
+
+	// Retrying these wouldn't help.
+	gt.AssertEqualM(t, http.StatusUnprocessableEntity, status(state+"&verification_code=v", nil), "No handle")
+	gt.AssertEqualM(t, http.StatusUnprocessableEntity, status("verification_code=v&h="+h, nil), "No request")
+	gt.AssertEqualM(t, http.StatusUnprocessableEntity, status(state+"&h="+h, nil), "No verification code")
+	gt.AssertEqualM(t, http.StatusUnprocessableEntity,
+		status(state+"&verification_code=v&h="+h, permanentJobError(errors.New("bad code"))), "Bad code")
+
+	// But these might.
+	gt.AssertEqual(t, http.StatusInternalServerError,
+		status(state+"&verification_code=v&h="+h, errors.New("network down")))
+	gt.AssertEqual(t, http.StatusOK, status(state+"&verification_code=v&h="+h, ErrJobCancelled))
+}
+
+func TestRenderHandler(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(NewEnvironment(blobStore, nil, nil, nil, nil)))
+
+	h := &Handle{n1: 1, n2: 2, n3: 3, timestamp: 100}
+	created := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := blobStore.Store(h.imageHandle(), &Blob{Data: []byte("<svg/>"), ContentType: "image/svg+xml", Created: created})
+	gt.AssertNil(t, err)
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", "http://myhost.com"+serializeHandleToUrl(h, "svg", "rawimg"), nil)
+		gt.AssertNil(t, err)
+		if header != "" {
+			request.Header.Set(header, value)
+		}
+		response := httptest.NewRecorder()
+		RenderHandler(response, request)
+		return response
+	}
+
+	res := get("", "")
+	gt.AssertEqual(t, http.StatusOK, res.Code)
+	gt.AssertEqual(t, "<svg/>", res.Body.String())
+	gt.AssertEqual(t, "image/svg+xml", res.Header().Get("Content-Type"))
+	gt.AssertEqual(t, "6", res.Header().Get("Content-Length"))
+	gt.AssertEqual(t, "Thu, 02 Jan 2014 03:04:05 GMT", res.Header().Get("Last-Modified"))
+	etag := res.Header().Get("ETag")
+	gt.AssertTrueM(t, etag != "", "Missing ETag")
+
+	gt.AssertEqual(t, http.StatusNotModified, get("If-None-Match", etag).Code)
+	gt.AssertEqual(t, http.StatusNotModified, get("If-Modified-Since", "Thu, 02 Jan 2014 03:04:05 GMT").Code)
+	gt.AssertEqual(t, http.StatusOK, get("If-None-Match", "\"stale\"").Code)
+}
+
+func TestRenderHandlerErrors(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	u := "http://myhost.com" + serializeHandleToUrl(simpleHandle(), "png", "rawimg")
+	res := execute(t, u, RenderHandler, NewEnvironment(blobStore, nil, nil, nil, nil))
+	gt.AssertEqualM(t, http.StatusNotFound, res.StatusCode, "Not rendered (yet)")
+
+	// Links from before handles were base64 don't work any more.
+	res = execute(t, "http://myhost.com/rawimg/0-1-2-3.png", RenderHandler, NewEnvironment(blobStore, nil, nil, nil, nil))
+	gt.AssertEqual(t, http.StatusBadRequest, res.StatusCode)
+
+	for _, kind := range []error{ErrBlobCorrupted, ErrBlobPermission, nil} {
+		store := &brokenBlobStore{err: &BlobError{Op: "fetch", Handle: simpleHandle(), Kind: kind}}
+		res := execute(t, u, RenderHandler, NewEnvironment(store, nil, nil, nil, nil))
+		gt.AssertEqualM(t, http.StatusInternalServerError, res.StatusCode, store.err.Error())
+	}
 }
 
 func TestDisplayPage(t *testing.T) {
 	cfg := &Environment{}
 
-	u := "http://myhost.com/display/100-1-2-3.png"
+	u := "http://myhost.com/display/" + SIMPLE_HANDLE_STRING + ".png"
 	res := execute(t, u, ResultPageHandler, cfg)
 
 	gt.AssertEqualM(t, http.StatusOK, res.StatusCode, "")
-	gt.AssertTrueM(t, strings.Contains(res.Body, "loadImage('100-1-2-3.png'"),
+	gt.AssertTrueM(t, strings.Contains(res.Body, "loadImage('"+SIMPLE_HANDLE_STRING+".png'"),
 		"Missing expected loadImage call in ["+res.Body+"]")
 }
 
@@ -178,12 +281,25 @@ func randomDirectoryName() string {
 	return "test-dir-" + strconv.Itoa(rand.Int())
 }
 
+// A BlobStore which can't do anything.
+type brokenBlobStore struct {
+	err error
+}
+
+func (s *brokenBlobStore) Store(handle *Handle, blob *Blob) error { return s.err }
+func (s *brokenBlobStore) Fetch(handle *Handle) (*Blob, error)    { return nil, s.err }
+func (s *brokenBlobStore) Delete(handle *Handle) error            { return s.err }
+func (s *brokenBlobStore) List() ([]*BlobInfo, error)             { return nil, s.err }
+
 // MockRenderEngine
 type MockRenderEngine struct {
 	lastVerificationCode string
 	lastRenderRequest    *RenderRequest
 	lastHandle           *Handle
 	blobStore            BlobStore
+	lastFinalAttempt     bool
+	// What Execute returns.
+	err error
 }
 
 func (m *MockRenderEngine) GetOAuthUrl(callbackUrl, applicationState string) string {
@@ -194,17 +310,26 @@ func (m *MockRenderEngine) FetchImage(handle *Handle) (*Blob, error) {
 	if m.blobStore == nil {
 		panic("No BlobStore configured!")
 	} else {
-		return m.blobStore.Fetch(handle)
+		return m.blobStore.Fetch(handle.imageHandle())
 	}
 	return nil, nil
 }
 
-func (m *MockRenderEngine) Execute(renderReq *RenderRequest, verificationCode string, callbackUrl string, h *Handle) error {
+func (m *MockRenderEngine) FetchJob(handle *Handle) (*Job, error) {
+	return nil, ErrNoSuchJob
+}
+
+func (m *MockRenderEngine) CancelJob(handle *Handle) (*Job, error) {
+	return nil, ErrNoSuchJob
+}
+
+func (m *MockRenderEngine) Execute(ctx context.Context, renderReq *RenderRequest, verificationCode string, callbackUrl string, h *Handle, finalAttempt bool) error {
 	m.lastRenderRequest = renderReq
 	m.lastHandle = h
 	m.lastVerificationCode = verificationCode
+	m.lastFinalAttempt = finalAttempt
 
-	return nil
+	return m.err
 }
 
 type MockTaskQueue struct {
@@ -0,0 +1,142 @@
+package latvis
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ======================================
+// ============ SHARE LINKS =============
+// ======================================
+
+// How long share links work for, unless asked otherwise, and at most.
+const (
+	SHARE_LINK_DEFAULT_TTL = 7 * 24 * time.Hour
+	SHARE_LINK_MAX_TTL     = 90 * 24 * time.Hour
+)
+
+// Share link keys shorter than this are too easy to guess.
+const SHARE_LINK_MIN_KEY_BYTES = 32
+
+type ShareLink struct {
+	// Relative to the server, e.g. "/shared/<image handle>.png?expires=...".
+	Url     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// Makes a link to an image which anyone can follow, until it expires, in
+// response to a POST to /share/<handle>.json (optionally with a "ttl"
+// parameter, such as "24h").  The link names the image's imageHandle rather
+// than 'handle' itself, so it can't be turned into a link that never expires.
+func ShareHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+	if env.shareLinkKey == nil {
+		http.NotFound(response, request)
+		return
+	}
+	if request.Method != "POST" {
+		http.Error(response, "Sharing needs a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	handle, err := parseHandleFromUrl(request.URL.Path)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := SHARE_LINK_DEFAULT_TTL
+	if rawTtl := request.FormValue("ttl"); rawTtl != "" {
+		ttl, err = time.ParseDuration(rawTtl)
+		if err != nil || ttl <= 0 || ttl > SHARE_LINK_MAX_TTL {
+			http.Error(response, fmt.Sprintf("ttl must be a duration of at most %s", SHARE_LINK_MAX_TTL),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	blob, err := env.RenderEngineForRequest(request).FetchImage(handle)
+	if errors.Is(err, ErrNoSuchBlob) {
+		// Not rendered yet (or ever).
+		http.NotFound(response, request)
+		return
+	}
+	if err != nil {
+		serveErrorWithLabel(response, "ShareHandler/FetchImage error", err)
+		return
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	serveJson(response, &ShareLink{
+		Url:     signShareLink(env.shareLinkKey, handle.imageHandle(), blob.contentType(), expires),
+		Expires: expires,
+	})
+}
+
+// Serves an image from a link made by ShareHandler:
+// /shared/<image handle>.<extension>?expires=<unix time>&sig=<signature>.
+func SharedImageHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+	if env.shareLinkKey == nil {
+		http.NotFound(response, request)
+		return
+	}
+	imageHandle, err := parseHandleFromUrl(request.URL.Path)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	params := request.URL.Query()
+	expires, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil {
+		http.Error(response, "Bad expiry time", http.StatusBadRequest)
+		return
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(params.Get("sig"))
+	if err != nil || !hmac.Equal(signature, shareLinkSignature(env.shareLinkKey, imageHandle, expires)) {
+		http.Error(response, "Bad signature", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(response, "This link has expired", http.StatusGone)
+		return
+	}
+
+	if redirectToBlobURL(response, request, env, imageHandle) {
+		return
+	}
+	blob, err := env.blobStore.Fetch(imageHandle)
+	if errors.Is(err, ErrNoSuchBlob) {
+		// e.g. expired or deleted since the link was made.
+		http.NotFound(response, request)
+		return
+	}
+	if err != nil {
+		serveErrorWithLabel(response, "SharedImageHandler/Fetch error", err)
+		return
+	}
+	serveImage(response, request, blob)
+}
+
+func signShareLink(key []byte, imageHandle *Handle, contentType string, expires time.Time) string {
+	params := url.Values{}
+	params.Add("expires", strconv.FormatInt(expires.Unix(), 10))
+	params.Add("sig", base64.RawURLEncoding.EncodeToString(
+		shareLinkSignature(key, imageHandle, expires.Unix())))
+	return serializeHandleToUrl(imageHandle, extensionForContentType(contentType), "shared") +
+		"?" + params.Encode()
+}
+
+// HMAC-SHA256 of everything the link grants access to.
+func shareLinkSignature(key []byte, imageHandle *Handle, expires int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d", imageHandle, expires)
+	return mac.Sum(nil)
+}
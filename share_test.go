@@ -0,0 +1,125 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var TEST_SHARE_LINK_KEY = []byte(strings.Repeat("k", SHARE_LINK_MIN_KEY_BYTES))
+
+func setUpSharing(t *testing.T) (string, *Environment, *Handle) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	env := NewEnvironment(blobStore, nil, nil, nil, nil)
+	env.EnableShareLinks(TEST_SHARE_LINK_KEY)
+	UseEnvironmentFactory(NewStaticEnvironmentFactory(env))
+
+	h := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 3}
+	gt.AssertNil(t, blobStore.Store(h.imageHandle(), &Blob{Data: []byte("<svg/>"), ContentType: "image/svg+xml"}))
+	return dir, env, h
+}
+
+func share(t *testing.T, method, url string) *httptest.ResponseRecorder {
+	request, err := http.NewRequest(method, url, nil)
+	gt.AssertNil(t, err)
+	response := httptest.NewRecorder()
+	ShareHandler(response, request)
+	return response
+}
+
+func TestShareLinks(t *testing.T) {
+	dir, env, h := setUpSharing(t)
+	defer os.RemoveAll(dir)
+
+	shareUrl := "http://myhost.com" + serializeHandleToUrl(h, "json", "share")
+	gt.AssertEqual(t, http.StatusMethodNotAllowed, share(t, "GET", shareUrl).Code)
+	gt.AssertEqual(t, http.StatusBadRequest, share(t, "POST", "http://myhost.com/share/100-1-2-3.json").Code)
+	gt.AssertEqualM(t, http.StatusNotFound,
+		share(t, "POST", "http://myhost.com"+serializeHandleToUrl(simpleHandle(), "json", "share")).Code,
+		"Not rendered")
+
+	res := share(t, "POST", shareUrl)
+	gt.AssertEqual(t, http.StatusOK, res.Code)
+	link := &ShareLink{}
+	gt.AssertNil(t, json.Unmarshal(res.Body.Bytes(), link))
+	gt.AssertTrueM(t, strings.HasPrefix(link.Url, serializeHandleToUrl(h.imageHandle(), "svg", "shared")+"?"), link.Url)
+	gt.AssertFalseM(t, strings.Contains(link.Url, h.String()), "The link mustn't give away the handle")
+	gt.AssertTrueM(t, link.Expires.Sub(time.Now().Add(SHARE_LINK_DEFAULT_TTL)) < time.Minute, link.Expires.String())
+
+	shared := execute(t, "http://myhost.com"+link.Url, SharedImageHandler, env)
+	gt.AssertEqual(t, http.StatusOK, shared.StatusCode)
+	gt.AssertEqual(t, "<svg/>", shared.Body)
+	gt.AssertEqual(t, "image/svg+xml", shared.Headers.Get("Content-Type"))
+
+	// The image handle can't be used to watch, or fetch, the image directly.
+	res2 := execute(t, "http://myhost.com"+serializeHandleToUrl(h.imageHandle(), "svg", "rawimg"), RenderHandler, env)
+	gt.AssertEqual(t, http.StatusNotFound, res2.StatusCode)
+}
+
+func TestShareLinkTtl(t *testing.T) {
+	dir, _, h := setUpSharing(t)
+	defer os.RemoveAll(dir)
+	shareUrl := "http://myhost.com" + serializeHandleToUrl(h, "json", "share")
+
+	res := share(t, "POST", shareUrl+"?ttl=1h")
+	gt.AssertEqual(t, http.StatusOK, res.Code)
+	link := &ShareLink{}
+	gt.AssertNil(t, json.Unmarshal(res.Body.Bytes(), link))
+	gt.AssertTrueM(t, link.Expires.Before(time.Now().Add(time.Hour+time.Second)), link.Expires.String())
+
+	for _, bad := range []string{"forever", "-1h", "0s", (SHARE_LINK_MAX_TTL + time.Hour).String()} {
+		gt.AssertEqualM(t, http.StatusBadRequest, share(t, "POST", shareUrl+"?ttl="+bad).Code, bad)
+	}
+}
+
+func TestSharedImageRejectsBadLinks(t *testing.T) {
+	dir, env, h := setUpSharing(t)
+	defer os.RemoveAll(dir)
+	image := h.imageHandle()
+	get := func(link string) int {
+		return execute(t, "http://myhost.com"+link, SharedImageHandler, env).StatusCode
+	}
+
+	expires := time.Now().Add(time.Hour)
+	link := signShareLink(TEST_SHARE_LINK_KEY, image, "image/svg+xml", expires)
+	gt.AssertEqual(t, http.StatusOK, get(link))
+
+	otherKey := []byte(strings.Repeat("x", SHARE_LINK_MIN_KEY_BYTES))
+	gt.AssertEqualM(t, http.StatusForbidden,
+		get(signShareLink(otherKey, image, "image/svg+xml", expires)), "Wrong key")
+
+	later := strings.Replace(link, "expires=", "expires=9", 1)
+	gt.AssertEqualM(t, http.StatusForbidden, get(later), "Extended expiry")
+
+	other := &Handle{timestamp: 100, n1: 1, n2: 2, n3: 4}
+	gt.AssertEqualM(t, http.StatusForbidden, get(strings.Replace(link, image.String(), other.String(), 1)),
+		"Someone else's image")
+
+	gt.AssertEqualM(t, http.StatusForbidden, get(link[:strings.Index(link, "&sig=")]), "Unsigned")
+	gt.AssertEqualM(t, http.StatusBadRequest, get(serializeHandleToUrl(image, "svg", "shared")), "No expiry")
+
+	gt.AssertEqualM(t, http.StatusGone,
+		get(signShareLink(TEST_SHARE_LINK_KEY, image, "image/svg+xml", time.Now().Add(-time.Minute))),
+		"Expired")
+
+	gt.AssertEqualM(t, http.StatusNotFound,
+		get(signShareLink(TEST_SHARE_LINK_KEY, other, "image/svg+xml", expires)), "Missing image")
+}
+
+func TestShareLinksDisabled(t *testing.T) {
+	dir, env, h := setUpSharing(t)
+	defer os.RemoveAll(dir)
+	env.EnableShareLinks(nil)
+
+	gt.AssertEqual(t, http.StatusNotFound,
+		share(t, "POST", "http://myhost.com"+serializeHandleToUrl(h, "json", "share")).Code)
+	link := signShareLink(TEST_SHARE_LINK_KEY, h.imageHandle(), "image/svg+xml", time.Now().Add(time.Hour))
+	gt.AssertEqual(t, http.StatusNotFound,
+		execute(t, "http://myhost.com"+link, SharedImageHandler, env).StatusCode)
+}
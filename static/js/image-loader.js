@@ -1,38 +1,143 @@
 var loadImage = function(filename, backoff) {
+  if (window.EventSource) {
+    streamProgress(filename, backoff);
+  } else {
+    pollJob(filename, backoff);
+  }
+};
+
+// Follows the job's progress as Server-Sent Events.
+function streamProgress(filename, backoff) {
+  var source = new EventSource('/progress/' + filename.replace(/\.[^.]*$/, '.events'));
+  source.addEventListener('progress', function(e) {
+    showProgress(describeProgress(JSON.parse(e.data)));
+  });
+  source.addEventListener('done', function(e) {
+    source.close();
+    showImage(filename);
+  });
+  source.addEventListener('error', function(e) {
+    source.close();
+    if (e.data) {
+      showError(JSON.parse(e.data).error);
+    } else {
+      // The connection failed, rather than the job, so fall back to polling.
+      pollJob(filename, backoff);
+    }
+  });
+}
+
+function pollJob(filename, backoff) {
   if (backoff > 60) {
-    document.getElementById('debug').innerHTML = 'Giving up.';    
+    document.getElementById('debug').innerHTML = 'Giving up.';
+    return;
   }
-  doAjax("/is_ready/" + filename, function(result) {
-    if (result == 'ok') {
-      document.getElementById('loading').style.display = 'none';
-      var canvas = document.getElementById('canvas');
-      var map = document.createElement('img');
-      map.setAttribute('class', 'latvis-image');
-      map.setAttribute('src', '/rawimg/' + filename);
-      canvas.appendChild(map);
-      renderMetadata();
-      _gat._getTrackerByName()._trackEvent("latvis-render", "render-complete");
-    } else if (result = 'fail') {
-      setTimeout("loadImage('" + filename + "', " + backoff + " * 1.5)", backoff * 1000);
-      _gat._getTrackerByName()._trackEvent("latvis-render", "timeout-error");
+  var jobUrl = "/jobs/" + filename.replace(/\.[^.]*$/, '.json');
+  doAjax(jobUrl, function(result, status) {
+    var job = null;
+    if (status == 200) {
+      job = JSON.parse(result);
+    }
+    if (job && job.state == 'stored') {
+      showImage(filename);
+    } else if (job && (job.state == 'failed' || job.state == 'cancelled' || job.state == 'expired')) {
+      showError(job.error);
+    } else if (job && job.state == 'retrying') {
+      // Not over yet: the server will try again.
+      showProgress(describeProgress({stage: job.state, error: job.error}));
+      setTimeout("pollJob('" + filename + "', " + backoff + ")", 2000);
+    } else if (job) {
+      // Still on its way, so there's no need to back off.
+      showProgress(job.state + '... (' + job.progress + '%)');
+      setTimeout("pollJob('" + filename + "', " + backoff + ")", 2000);
     } else {
-      alert("Unexpected Result: " + result);
+      // The job hasn't been recorded yet, or the server is having trouble.
+      setTimeout("pollJob('" + filename + "', " + backoff + " * 1.5)", backoff * 1000);
+      _gat._getTrackerByName()._trackEvent("latvis-render", "timeout-error");
     }
   });
-};
+}
+
+function cancelJob(filename) {
+  var cancelUrl = "/cancel/" + filename.replace(/\.[^.]*$/, '.json');
+  doAjax(cancelUrl, function(result, status) {
+    if (status != 200) {
+      // Too late: the job finished (or never started) anyway.
+      return;
+    }
+    showError(JSON.parse(result).error);
+  });
+}
+
+function describeProgress(event) {
+  if (event.stage == 'fetching') {
+    return 'Fetching history... (' + (event.points || 0) + ' points so far)';
+  } else if (event.stage == 'aggregating' && event.total) {
+    return 'Drawing... (' + Math.round(100 * (event.done || 0) / event.total) + '%)';
+  } else if (event.stage == 'encoding') {
+    return 'Encoding image...';
+  } else if (event.stage == 'retrying') {
+    return 'Something went wrong (' + event.error + '), trying again...';
+  }
+  return event.stage + '...';
+}
+
+function showProgress(message) {
+  document.getElementById('debug').innerHTML = escapeHtml(message);
+}
+
+function showImage(filename) {
+  document.getElementById('loading').style.display = 'none';
+  document.getElementById('debug').innerHTML = '';
+  var canvas = document.getElementById('canvas');
+  var map = document.createElement('img');
+  map.setAttribute('class', 'latvis-image');
+  map.setAttribute('src', '/rawimg/' + filename);
+  canvas.appendChild(map);
+  renderMetadata(filename);
+  _gat._getTrackerByName()._trackEvent("latvis-render", "render-complete");
+}
 
-function renderMetadata() {
+function showError(message) {
+  document.getElementById('loading').style.display = 'none';
+  document.getElementById('debug').innerHTML =
+    'Sorry, the map could not be drawn: ' + escapeHtml(message);
+  _gat._getTrackerByName()._trackEvent("latvis-render", "render-error");
+}
+
+function escapeHtml(s) {
+  return String(s).replace(/&/g, '&amp;').replace(/</g, '&lt;').replace(/>/g, '&gt;');
+}
+
+function renderMetadata(filename) {
   var container = document.getElementById('metadata');
   var url = window.location;
 
   container.innerHTML = 
     "<div class='logo'>" +
     "<a href='/'><img src='/img/small_latvis_eeeeee.png'></a></div>" +
-    "<div class='links'><span class='latvis-generate-link'><a href='http://latvis.mrjon.es'>Generate new image</a></span> | <a href='" + url + "'>Link to this page</a> | <a href='https://twitter.com/share'>Tweet</a></div>";
+    "<div class='links'><span class='latvis-generate-link'><a href='http://latvis.mrjon.es'>Generate new image</a></span> | <a href='" + url + "'>Link to this page</a> | <a href='#' onclick=\"shareImage('" + filename + "'); return false;\">Share image</a> | <a href='https://twitter.com/share'>Tweet</a></div>";
 
   container.style.display = 'block';
 }
 
+// Asks for a link which shows just the image, and stops working after a while
+// (unlike the handle in this page's URL).
+function shareImage(filename) {
+  var shareUrl = "/share/" + filename.replace(/\.[^.]*$/, '.json');
+  doAjax(shareUrl, function(result, status) {
+    var debug = document.getElementById('debug');
+    if (status != 200) {
+      debug.innerHTML = 'Sorry, this image cannot be shared.';
+      return;
+    }
+    var link = JSON.parse(result);
+    var absolute = window.location.protocol + '//' + window.location.host + link.url;
+    debug.innerHTML = 'Share this link (it works until ' + escapeHtml(new Date(link.expires).toLocaleString()) +
+      '): <a href="' + escapeHtml(absolute) + '">' + escapeHtml(absolute) + '</a>';
+  });
+}
+
 function doAjax(url, handler) {
 //  document.getElementById('debug').innerHTML = 'Making AJAX call...';
   var xmlHttpReq = false;
@@ -49,7 +154,7 @@ function doAjax(url, handler) {
   self.xmlHttpReq.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
   self.xmlHttpReq.onreadystatechange = function() {
     if (self.xmlHttpReq.readyState == 4) {
-      handler(self.xmlHttpReq.responseText);
+      handler(self.xmlHttpReq.responseText, self.xmlHttpReq.status);
     }
   }
   self.xmlHttpReq.send();
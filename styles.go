@@ -0,0 +1,275 @@
+package latvis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ======================================
+// ======== VISUALIZATION STYLES ========
+// ======================================
+
+const (
+	DEFAULT_STYLE = "bw"
+
+	DEFAULT_IMAGE_SIZE_PX = 512
+	MIN_IMAGE_SIZE_PX     = 16
+	MAX_IMAGE_SIZE_PX     = 4096
+)
+
+// The types of value a VisualizerOption can take.
+const (
+	OPTION_INT   = "int"
+	OPTION_FLOAT = "float"
+	OPTION_BOOL  = "bool"
+
+	// One of the option's Choices.
+	OPTION_CHOICE = "choice"
+
+	// Anything ParsePalette accepts.  Choices lists the built-in palettes.
+	OPTION_PALETTE = "palette"
+)
+
+// Describes one setting of a VisualizerStyle.
+type VisualizerOption struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Default     string `json:"default"`
+
+	// The allowed range (inclusive) of OPTION_INT and OPTION_FLOAT values.
+	Min float64 `json:"min,omitempty"`
+	Max float64 `json:"max,omitempty"`
+
+	Choices []string `json:"choices,omitempty"`
+}
+
+// A way of drawing a history, as chosen by RenderRequest.Style.
+type VisualizerStyle struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	ContentType string             `json:"content_type"`
+	Extension   string             `json:"extension"`
+	Options     []VisualizerOption `json:"options"`
+
+	// Builds the visualizer.  'options' have already been checked against
+	// Options (see ParseOptions), and 'progress' may be nil.
+	New func(options VisualizerOptions, projection Projection, progress ProgressFunc) (Visualizer, error) `json:"-"`
+}
+
+// Option values, by name, as strings (so that they can be passed around in
+// URLs).  Use the accessors to read them once ParseOptions has checked them.
+type VisualizerOptions map[string]string
+
+var visualizerStyles = map[string]*VisualizerStyle{}
+
+// Makes a style available to RenderRequests.  Registering a second style with
+// the same name replaces the first.
+func RegisterVisualizer(style *VisualizerStyle) {
+	visualizerStyles[style.Name] = style
+}
+
+// Returns the names accepted by LookupVisualizerStyle, in sorted order.
+func VisualizerStyleNames() []string {
+	names := []string{}
+	for name, _ := range visualizerStyles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns every registered style, sorted by name.
+func VisualizerStyles() []*VisualizerStyle {
+	styles := []*VisualizerStyle{}
+	for _, name := range VisualizerStyleNames() {
+		styles = append(styles, visualizerStyles[name])
+	}
+	return styles
+}
+
+// Finds the named style.  An empty name gets the DEFAULT_STYLE.
+func LookupVisualizerStyle(name string) (*VisualizerStyle, error) {
+	if name == "" {
+		name = DEFAULT_STYLE
+	}
+	style, ok := visualizerStyles[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown style '%s' (expected one of: %s)",
+			name, strings.Join(VisualizerStyleNames(), ", "))
+	}
+	return style, nil
+}
+
+// Checks 'raw' against the style's Options, and returns a copy with the
+// defaults filled in for anything missing.  Unknown options are an error.
+func (s *VisualizerStyle) ParseOptions(raw map[string]string) (VisualizerOptions, error) {
+	parsed := make(VisualizerOptions)
+	for name, value := range raw {
+		option := s.option(name)
+		if option == nil {
+			return nil, fmt.Errorf("Style '%s' has no option '%s' (expected one of: %s)",
+				s.Name, name, strings.Join(s.optionNames(), ", "))
+		}
+		if err := option.check(value); err != nil {
+			return nil, err
+		}
+		parsed[name] = value
+	}
+	for _, option := range s.Options {
+		if _, ok := parsed[option.Name]; !ok {
+			parsed[option.Name] = option.Default
+		}
+	}
+	return parsed, nil
+}
+
+// Looks up the named style, and checks its options.
+func parseStyle(name string, raw map[string]string) (*VisualizerStyle, VisualizerOptions, error) {
+	style, err := LookupVisualizerStyle(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	options, err := style.ParseOptions(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return style, options, nil
+}
+
+func (s *VisualizerStyle) option(name string) *VisualizerOption {
+	for i := range s.Options {
+		if s.Options[i].Name == name {
+			return &s.Options[i]
+		}
+	}
+	return nil
+}
+
+func (s *VisualizerStyle) optionNames() []string {
+	names := []string{}
+	for _, option := range s.Options {
+		names = append(names, option.Name)
+	}
+	return names
+}
+
+func (o *VisualizerOption) check(value string) error {
+	switch o.Type {
+	case OPTION_INT, OPTION_FLOAT:
+		var number float64
+		var err error
+		if o.Type == OPTION_INT {
+			var i int
+			i, err = strconv.Atoi(value)
+			number = float64(i)
+		} else {
+			number, err = strconv.ParseFloat(value, 64)
+		}
+		if err != nil {
+			return fmt.Errorf("Option '%s' should be a number, got: %s", o.Name, value)
+		}
+		if number < o.Min || number > o.Max {
+			return fmt.Errorf("Option '%s' should be between %s and %s, got: %s",
+				o.Name, formatOptionFloat(o.Min), formatOptionFloat(o.Max), value)
+		}
+	case OPTION_BOOL:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Option '%s' should be true or false, got: %s", o.Name, value)
+		}
+	case OPTION_CHOICE:
+		for _, choice := range o.Choices {
+			if value == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("Option '%s' should be one of: %s, got: %s",
+			o.Name, strings.Join(o.Choices, ", "), value)
+	case OPTION_PALETTE:
+		if _, err := ParsePalette(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o VisualizerOptions) String(name string) string {
+	return o[name]
+}
+
+func (o VisualizerOptions) Int(name string) int {
+	i, _ := strconv.Atoi(o[name])
+	return i
+}
+
+func (o VisualizerOptions) Float(name string) float64 {
+	f, _ := strconv.ParseFloat(o[name], 64)
+	return f
+}
+
+func (o VisualizerOptions) Bool(name string) bool {
+	b, _ := strconv.ParseBool(o[name])
+	return b
+}
+
+func (o VisualizerOptions) Palette(name string) (*Palette, error) {
+	return ParsePalette(o[name])
+}
+
+func formatOptionFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// The options shared by most styles.
+
+var sizeOption = VisualizerOption{
+	Name:        "size",
+	Type:        OPTION_INT,
+	Description: "Maximum width and height of the image, in pixels",
+	Default:     strconv.Itoa(DEFAULT_IMAGE_SIZE_PX),
+	Min:         MIN_IMAGE_SIZE_PX,
+	Max:         MAX_IMAGE_SIZE_PX,
+}
+
+func paletteOption(defaultPalette string) VisualizerOption {
+	return VisualizerOption{
+		Name:        "palette",
+		Type:        OPTION_PALETTE,
+		Description: "Colors, from the emptiest to the busiest areas",
+		Default:     defaultPalette,
+		Choices:     PaletteNames(),
+	}
+}
+
+var transparentOption = VisualizerOption{
+	Name:        "transparent",
+	Type:        OPTION_BOOL,
+	Description: "Leave empty areas transparent, for overlaying on a map",
+	Default:     "false",
+}
+
+// The extension (without the dot) for files of the given content type.  Types
+// which no style produces get "bin".
+func extensionForContentType(contentType string) string {
+	for _, style := range VisualizerStyles() {
+		if style.ContentType == contentType {
+			return style.Extension
+		}
+	}
+	return "bin"
+}
+
+// Lists the available styles, and their options, as JSON.
+func StylesHandler(response http.ResponseWriter, request *http.Request) {
+	data, err := json.Marshal(VisualizerStyles())
+	if err != nil {
+		serveErrorWithLabel(response, "StylesHandler/Marshal error", err)
+		return
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(data)
+}
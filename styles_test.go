@@ -0,0 +1,83 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestLookupVisualizerStyle(t *testing.T) {
+	style, err := LookupVisualizerStyle("")
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, DEFAULT_STYLE, style.Name)
+
+	style, err = LookupVisualizerStyle("svg")
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, "image/svg+xml", style.ContentType)
+	gt.AssertEqual(t, "svg", style.Extension)
+
+	_, err = LookupVisualizerStyle("plaid")
+	gt.AssertNotNil(t, err)
+
+	gt.AssertEqual(t, []string{"bw", "heatmap", "kde", "path", "svg"}, VisualizerStyleNames())
+	for _, style := range VisualizerStyles() {
+		gt.AssertNotNilM(t, style.New, style.Name)
+		gt.AssertTrueM(t, style.option("size") != nil, style.Name+" should have a size")
+		_, err := style.ParseOptions(nil)
+		gt.AssertNilM(t, err, style.Name+" defaults should be valid")
+	}
+}
+
+func TestParseVisualizerOptions(t *testing.T) {
+	style, err := LookupVisualizerStyle("kde")
+	gt.AssertNil(t, err)
+
+	options, err := style.ParseOptions(map[string]string{"bandwidth": "250", "transparent": "true"})
+	gt.AssertNil(t, err)
+	gt.AssertEqual(t, 250.0, options.Float("bandwidth"))
+	gt.AssertTrue(t, options.Bool("transparent"))
+	gt.AssertEqualM(t, DEFAULT_IMAGE_SIZE_PX, options.Int("size"), "Missing options get their defaults")
+	gt.AssertEqual(t, DEFAULT_PALETTE, options.String("palette"))
+
+	bad := [][2]string{
+		{"radius", "3"},
+		{"bandwidth", "wide"},
+		{"bandwidth", "0"},
+		{"size", "1.5"},
+		{"size", "100000"},
+		{"transparent", "maybe"},
+		{"palette", "plaid"},
+	}
+	for _, option := range bad {
+		_, err := style.ParseOptions(map[string]string{option[0]: option[1]})
+		gt.AssertNotNilM(t, err, "Should reject: "+option[0]+"="+option[1])
+	}
+
+	style, err = LookupVisualizerStyle("svg")
+	gt.AssertNil(t, err)
+	_, err = style.ParseOptions(map[string]string{"marker": "square"})
+	gt.AssertNil(t, err)
+	_, err = style.ParseOptions(map[string]string{"marker": "star"})
+	gt.AssertNotNil(t, err)
+}
+
+func TestExtensionForContentType(t *testing.T) {
+	gt.AssertEqual(t, "png", extensionForContentType("image/png"))
+	gt.AssertEqual(t, "svg", extensionForContentType("image/svg+xml"))
+	gt.AssertEqualM(t, "bin", extensionForContentType("image/gif"), "Unknown types")
+}
+
+func TestStylesHandler(t *testing.T) {
+	res := execute(t, "http://myhost.com/styles", StylesHandler, &Environment{})
+	gt.AssertEqual(t, http.StatusOK, res.StatusCode)
+	gt.AssertEqual(t, "application/json", res.Headers.Get("Content-Type"))
+
+	styles := []VisualizerStyle{}
+	gt.AssertNil(t, json.Unmarshal([]byte(res.Body), &styles))
+	gt.AssertEqual(t, len(VisualizerStyleNames()), len(styles))
+	gt.AssertEqual(t, "bw", styles[0].Name)
+	gt.AssertEqual(t, "size", styles[0].Options[0].Name)
+	gt.AssertEqual(t, float64(MAX_IMAGE_SIZE_PX), styles[0].Options[0].Max)
+}
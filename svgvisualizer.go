@@ -0,0 +1,321 @@
+package latvis
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ======================================
+// =========== SVG VISUALIZER ===========
+// ======================================
+
+const (
+	DEFAULT_SVG_CELL_SIZE  = 8.0
+	DEFAULT_SVG_MIN_RADIUS = 1.0
+	DEFAULT_SVG_MAX_RADIUS = 4.0
+)
+
+func init() {
+	RegisterVisualizer(&VisualizerStyle{
+		Name:        "svg",
+		Description: "A vector image, with a marker sized by the number of points in each area",
+		ContentType: "image/svg+xml",
+		Extension:   "svg",
+		Options: []VisualizerOption{
+			sizeOption,
+			{
+				Name:        "marker",
+				Type:        OPTION_CHOICE,
+				Description: "Shape of the markers",
+				Default:     "circle",
+				Choices:     []string{"circle", "square", "diamond"},
+			},
+			{
+				Name:        "radius",
+				Type:        OPTION_FLOAT,
+				Description: "Radius of the markers for the busiest areas, in pixels",
+				Default:     formatOptionFloat(DEFAULT_SVG_MAX_RADIUS),
+				Min:         DEFAULT_SVG_MIN_RADIUS,
+				Max:         50,
+			},
+			{
+				Name:        "paths",
+				Type:        OPTION_BOOL,
+				Description: "Also draw the routes travelled between points",
+				Default:     "false",
+			},
+			{
+				Name:        "legend",
+				Type:        OPTION_BOOL,
+				Description: "Include a legend of marker sizes",
+				Default:     "true",
+			},
+		},
+		New: func(options VisualizerOptions, projection Projection, progress ProgressFunc) (Visualizer, error) {
+			return &SvgVisualizer{
+				MarkerShape:     options.String("marker"),
+				MaxMarkerRadius: options.Float("radius"),
+				DrawPaths:       options.Bool("paths"),
+				HideLegend:      !options.Bool("legend"),
+				Projection:      projection,
+				Progress:        progress,
+			}, nil
+		},
+	})
+}
+
+// Renders the history as an SVG image.
+//
+// The image is divided into square cells of CellSize pixels, and each cell
+// containing points gets a marker whose size grows with the number of points
+// in it.  Optionally, the route between points is drawn too (split up the same
+// way as for the PathVisualizer).
+//
+// The zero value is ready to use.  Output is deterministic, so that it can be
+// compared against golden files.
+type SvgVisualizer struct {
+	// "circle" (the default), "square" or "diamond".
+	MarkerShape string
+
+	// In pixels.
+	CellSize                         float64
+	MinMarkerRadius, MaxMarkerRadius float64
+
+	DrawPaths  bool
+	HideLegend bool
+
+	// Defaults to equirectangular.
+	Projection Projection
+
+	// Told how many points have been counted, and when writing starts.
+	// May be nil.
+	Progress ProgressFunc
+}
+
+func (s *SvgVisualizer) Visualize(ctx context.Context, history *History, bounds *BoundingBox, width int, height int) (*[]byte, error) {
+	cellSize, minRadius, maxRadius := s.CellSize, s.MinMarkerRadius, s.MaxMarkerRadius
+	if cellSize <= 0 {
+		cellSize = DEFAULT_SVG_CELL_SIZE
+	}
+	if minRadius <= 0 {
+		minRadius = DEFAULT_SVG_MIN_RADIUS
+	}
+	if maxRadius <= 0 {
+		maxRadius = DEFAULT_SVG_MAX_RADIUS
+	}
+	if maxRadius < minRadius {
+		return nil, fmt.Errorf("Max marker radius (%f) is smaller than min (%f)", maxRadius, minRadius)
+	}
+	marker, err := svgMarkerFor(s.MarkerShape)
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := newProjectedPixelMapping(bounds, s.Projection, width, height)
+	grid := NewGrid(
+		int(math.Ceil(float64(width)/cellSize)),
+		int(math.Ceil(float64(height)/cellSize)))
+	counter := newProgressCounter(ctx, s.Progress, history.Len())
+	for i := 0; i < history.Len() && counter.inc(); i++ {
+		if bounds.Contains(history.At(i)) {
+			x, y := mapping.bucket(history.At(i))
+			grid.Inc(int(float64(x)/cellSize), int(float64(y)/cellSize))
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.Progress.report(ProgressEvent{Stage: PROGRESS_ENCODING})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s<svg xmlns=\"http://www.w3.org/2000/svg\" version=\"1.1\" "+
+		"width=\"%d\" height=\"%d\" viewBox=\"0 0 %d %d\">\n",
+		xml.Header, width, height, width, height)
+	writeSvgMetadata(&buf, history, bounds)
+
+	if s.DrawPaths {
+		buf.WriteString(" <g id=\"paths\" fill=\"none\" stroke=\"#000000\" stroke-opacity=\"0.5\" stroke-width=\"1\">\n")
+		tracks := splitIntoTracks(history, DEFAULT_PATH_MAX_GAP, DEFAULT_PATH_MAX_SPEED)
+		for _, track := range tracks {
+			writeSvgPolylines(&buf, track, mapping)
+		}
+		buf.WriteString(" </g>\n")
+	}
+
+	maxCount := 0
+	for x := 0; x < grid.Width(); x++ {
+		for y := 0; y < grid.Height(); y++ {
+			if grid.Get(x, y) > maxCount {
+				maxCount = grid.Get(x, y)
+			}
+		}
+	}
+	radius := func(count int) float64 {
+		if maxCount <= 1 {
+			return minRadius
+		}
+		return minRadius + (maxRadius-minRadius)*
+			(scaleHeat(count)-scaleHeat(1))/(scaleHeat(maxCount)-scaleHeat(1))
+	}
+
+	buf.WriteString(" <g id=\"markers\" fill=\"#000000\">\n")
+	for y := 0; y < grid.Height(); y++ {
+		for x := 0; x < grid.Width(); x++ {
+			if count := grid.Get(x, y); count > 0 {
+				buf.WriteString("  ")
+				marker(&buf, (float64(x)+0.5)*cellSize, (float64(y)+0.5)*cellSize, radius(count))
+				buf.WriteString("\n")
+			}
+		}
+	}
+	buf.WriteString(" </g>\n")
+
+	if !s.HideLegend && maxCount > 0 {
+		writeSvgLegend(&buf, marker, maxRadius, maxCount, radius)
+	}
+
+	buf.WriteString("</svg>\n")
+
+	dataBytes := buf.Bytes()
+	return &dataBytes, nil
+}
+
+// Rounds to 2 decimal places (a hundredth of a pixel), without any trailing
+// zeroes.
+func svgNumber(f float64) string {
+	return strconv.FormatFloat(math.Floor(f*100+0.5)/100, 'f', -1, 64)
+}
+
+func svgText(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+type svgMarker func(buf *bytes.Buffer, cx, cy, r float64)
+
+func svgMarkerFor(shape string) (svgMarker, error) {
+	switch shape {
+	case "", "circle":
+		return func(buf *bytes.Buffer, cx, cy, r float64) {
+			fmt.Fprintf(buf, "<circle cx=\"%s\" cy=\"%s\" r=\"%s\"/>",
+				svgNumber(cx), svgNumber(cy), svgNumber(r))
+		}, nil
+	case "square":
+		return func(buf *bytes.Buffer, cx, cy, r float64) {
+			fmt.Fprintf(buf, "<rect x=\"%s\" y=\"%s\" width=\"%s\" height=\"%s\"/>",
+				svgNumber(cx-r), svgNumber(cy-r), svgNumber(2*r), svgNumber(2*r))
+		}, nil
+	case "diamond":
+		return func(buf *bytes.Buffer, cx, cy, r float64) {
+			fmt.Fprintf(buf, "<polygon points=\"%s,%s %s,%s %s,%s %s,%s\"/>",
+				svgNumber(cx), svgNumber(cy-r),
+				svgNumber(cx+r), svgNumber(cy),
+				svgNumber(cx), svgNumber(cy+r),
+				svgNumber(cx-r), svgNumber(cy))
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown marker shape: '%s'", shape)
+}
+
+func writeSvgMetadata(buf *bytes.Buffer, history *History, bounds *BoundingBox) {
+	inBounds := History{}
+	for i := 0; i < history.Len(); i++ {
+		if bounds.Contains(history.At(i)) {
+			inBounds.Add(history.At(i))
+		}
+	}
+	start, end := inBounds.TimeRange()
+
+	ll, ur := bounds.LowerLeft(), bounds.UpperRight()
+	boundsText := fmt.Sprintf("%s,%s to %s,%s",
+		strconv.FormatFloat(ll.Lat, 'f', -1, 64), strconv.FormatFloat(ll.Lng, 'f', -1, 64),
+		strconv.FormatFloat(ur.Lat, 'f', -1, 64), strconv.FormatFloat(ur.Lng, 'f', -1, 64))
+	description := fmt.Sprintf("%d points within %s", inBounds.Len(), boundsText)
+	if !start.IsZero() {
+		description += fmt.Sprintf(", from %s to %s",
+			start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	}
+
+	buf.WriteString(" <title>latvis</title>\n")
+	fmt.Fprintf(buf, " <desc>%s</desc>\n", svgText(description))
+	buf.WriteString(" <metadata>\n")
+	fmt.Fprintf(buf, "  <latvis:render xmlns:latvis=\"http://latvis.mrjon.es/ns/1\" "+
+		"points=\"%d\" lllat=\"%s\" lllng=\"%s\" urlat=\"%s\" urlng=\"%s\"",
+		inBounds.Len(),
+		strconv.FormatFloat(ll.Lat, 'f', -1, 64), strconv.FormatFloat(ll.Lng, 'f', -1, 64),
+		strconv.FormatFloat(ur.Lat, 'f', -1, 64), strconv.FormatFloat(ur.Lng, 'f', -1, 64))
+	if !start.IsZero() {
+		fmt.Fprintf(buf, " start=\"%s\" end=\"%s\"",
+			start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	}
+	buf.WriteString("/>\n")
+	buf.WriteString(" </metadata>\n")
+}
+
+// Writes one polyline per track, breaking it wherever it wraps around the
+// antimeridian.
+func writeSvgPolylines(buf *bytes.Buffer, track History, mapping *pixelMapping) {
+	if len(track) < 2 {
+		return
+	}
+
+	points := []string{}
+	flush := func() {
+		if len(points) > 1 {
+			buf.WriteString("  <polyline points=\"")
+			for i, p := range points {
+				if i > 0 {
+					buf.WriteString(" ")
+				}
+				buf.WriteString(p)
+			}
+			buf.WriteString("\"/>\n")
+		}
+		points = points[:0]
+	}
+
+	for i, c := range track {
+		x, y := mapping.position(c)
+		if i > 0 {
+			if _, wraps := mapping.wrappedDx(track[i-1], c); wraps {
+				flush()
+			}
+		}
+		points = append(points, svgNumber(x)+","+svgNumber(y))
+	}
+	flush()
+}
+
+// Draws a key in the top left corner, showing how big the markers are for a
+// single point, and for the densest cell.
+func writeSvgLegend(buf *bytes.Buffer, marker svgMarker, maxRadius float64, maxCount int, radius func(int) float64) {
+	counts := []int{1}
+	if maxCount > 1 {
+		counts = append(counts, maxCount)
+	}
+
+	rowHeight := math.Max(2*maxRadius+4, 14)
+	buf.WriteString(" <g id=\"legend\" font-family=\"sans-serif\" font-size=\"10\">\n")
+	fmt.Fprintf(buf, "  <rect x=\"2\" y=\"2\" width=\"%s\" height=\"%s\" fill=\"#ffffff\" fill-opacity=\"0.8\"/>\n",
+		svgNumber(2*maxRadius+70), svgNumber(rowHeight*float64(len(counts))+4))
+	for i, count := range counts {
+		cy := 4 + rowHeight*(float64(i)+0.5)
+		buf.WriteString("  ")
+		marker(buf, 6+maxRadius, cy, radius(count))
+		buf.WriteString("\n")
+
+		label := "1 point"
+		if count > 1 {
+			label = fmt.Sprintf("%d points", count)
+		}
+		fmt.Fprintf(buf, "  <text x=\"%s\" y=\"%s\">%s</text>\n",
+			svgNumber(10+2*maxRadius), svgNumber(cy+3.5), label)
+	}
+	buf.WriteString(" </g>\n")
+}
@@ -0,0 +1,107 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"bytes"
+	"context"
+	"encoding/xml"
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update_golden", false, "Rewrite the golden files in testdata/")
+
+func svgTestHistory() *History {
+	h := &History{}
+	for i := 0; i < 20; i++ {
+		// A dense cluster, moving slowly...
+		h.Add(&Coordinate{
+			Lat:       1 + float64(i%4)*0.01,
+			Lng:       1 + float64(i%5)*0.01,
+			Timestamp: time.Unix(1300000000+int64(i)*60, 0),
+		})
+	}
+	// ... and a trip off to the north east.
+	h.Add(&Coordinate{Lat: 2.5, Lng: 3.5, Timestamp: time.Unix(1300002000, 0)})
+	h.Add(&Coordinate{Lat: 3.5, Lng: 3.5, Timestamp: time.Unix(1300004000, 0)})
+	// Out of bounds, so it shouldn't be counted.
+	h.Add(&Coordinate{Lat: 50, Lng: 50, Timestamp: time.Unix(1400000000, 0)})
+	return h
+}
+
+func TestSvgGoldenFiles(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 4, Lng: 5})
+	gt.AssertNil(t, err)
+
+	cases := map[string]*SvgVisualizer{
+		"testdata/svg/default.svg": &SvgVisualizer{},
+		"testdata/svg/diamonds-with-paths.svg": &SvgVisualizer{
+			MarkerShape: "diamond",
+			DrawPaths:   true,
+			CellSize:    10,
+		},
+		"testdata/svg/squares-no-legend.svg": &SvgVisualizer{
+			MarkerShape:     "square",
+			HideLegend:      true,
+			MinMarkerRadius: 2,
+			MaxMarkerRadius: 2,
+		},
+	}
+
+	for filename, visualizer := range cases {
+		actual, err := visualizer.Visualize(context.Background(), svgTestHistory(), bounds, 100, 80)
+		gt.AssertNil(t, err)
+		assertWellFormedXml(t, *actual)
+
+		if *updateGolden {
+			gt.AssertNil(t, ioutil.WriteFile(filename, *actual, 0644))
+		}
+		expected, err := ioutil.ReadFile(filename)
+		gt.AssertNil(t, err)
+		if !bytes.Equal(expected, *actual) {
+			t.Errorf("%s doesn't match (run with -update_golden to accept). Actual:\n%s",
+				filename, string(*actual))
+		}
+	}
+}
+
+func TestSvgVisualizerEmptyHistory(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 4, Lng: 5})
+	gt.AssertNil(t, err)
+
+	actual, err := (&SvgVisualizer{DrawPaths: true}).Visualize(context.Background(), &History{}, bounds, 100, 80)
+	gt.AssertNil(t, err)
+	assertWellFormedXml(t, *actual)
+	gt.AssertFalseM(t, bytes.Contains(*actual, []byte("legend")), "No legend without points")
+}
+
+func TestSvgVisualizerRejectsBadOptions(t *testing.T) {
+	bounds, err := NewBoundingBox(
+		Coordinate{Lat: 0, Lng: 0},
+		Coordinate{Lat: 4, Lng: 5})
+	gt.AssertNil(t, err)
+
+	_, err = (&SvgVisualizer{MarkerShape: "star"}).Visualize(context.Background(), &History{}, bounds, 10, 10)
+	gt.AssertNotNil(t, err)
+
+	_, err = (&SvgVisualizer{MinMarkerRadius: 5, MaxMarkerRadius: 1}).Visualize(context.Background(), &History{}, bounds, 10, 10)
+	gt.AssertNotNil(t, err)
+}
+
+func assertWellFormedXml(t *testing.T, data []byte) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		_, err := decoder.Token()
+		if err != nil {
+			gt.AssertEqualM(t, "EOF", err.Error(), "Malformed SVG")
+			return
+		}
+	}
+}
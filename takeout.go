@@ -0,0 +1,377 @@
+package latvis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ======================================
+// ======= GOOGLE TAKEOUT IMPORTER ======
+// ======================================
+
+// TakeoutSource is a HistorySource which reads the location history in a
+// Google Takeout export.  It understands both the raw "Records.json" file
+// and the per-month "Semantic Location History" files.
+//
+// Files are decoded one record at a time, so only the points which fall inside
+// the requested range are ever held in memory.
+type TakeoutSource struct {
+	paths []string
+}
+
+// Each path may either be a single JSON file, or a directory which will be
+// searched recursively for JSON files (e.g. "Semantic Location History").
+func NewTakeoutSource(paths ...string) *TakeoutSource {
+	return &TakeoutSource{paths: paths}
+}
+
+func (s *TakeoutSource) FetchRange(ctx context.Context, start, end time.Time) (*History, error) {
+	history := &History{}
+
+	for _, path := range s.paths {
+		files, err := takeoutFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if err := readTakeoutFile(ctx, file, start, end, history); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return history, nil
+}
+
+func takeoutFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+
+	files := []string{}
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.ToLower(filepath.Ext(p)) == ".json" {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+func readTakeoutFile(ctx context.Context, filename string, start, end time.Time, out *History) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := readTakeout(ctx, f, start, end, out); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return wrapError("Takeout error / "+filename, err)
+	}
+	return nil
+}
+
+// Streams a single Takeout JSON document, adding every point between start
+// and end to 'out'.  Top-level keys other than "locations" (Records.json)
+// and "timelineObjects" (Semantic Location History) are skipped.  Checks
+// for ctx being cancelled between records.
+func readTakeout(ctx context.Context, r io.Reader, start, end time.Time, out *History) error {
+	decoder := json.NewDecoder(r)
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := token.(string)
+		if !ok {
+			return fmt.Errorf("Expected an object key, got: %v", token)
+		}
+
+		switch key {
+		case "locations":
+			err = forEachElement(decoder, func() error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				var record takeoutRecord
+				if err := decoder.Decode(&record); err != nil {
+					return err
+				}
+				return record.addTo(start, end, out)
+			})
+		case "timelineObjects":
+			err = forEachElement(decoder, func() error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				var object takeoutTimelineObject
+				if err := decoder.Decode(&object); err != nil {
+					return err
+				}
+				return object.addTo(start, end, out)
+			})
+		default:
+			var ignored json.RawMessage
+			err = decoder.Decode(&ignored)
+		}
+		if err != nil {
+			return wrapError("Error reading '"+key+"'", err)
+		}
+	}
+
+	return expectDelim(decoder, '}')
+}
+
+func expectDelim(decoder *json.Decoder, expected json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != expected {
+		return fmt.Errorf("Expected '%s', got: %v", expected, token)
+	}
+	return nil
+}
+
+// Calls 'f' once for each element of the JSON array at the decoder's current
+// position. 'f' is responsible for consuming exactly one value.
+func forEachElement(decoder *json.Decoder, f func() error) error {
+	if err := expectDelim(decoder, '['); err != nil {
+		return err
+	}
+	for decoder.More() {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return expectDelim(decoder, ']')
+}
+
+// Takeout has used both "timestampMs" (a string of milliseconds since the
+// epoch) and "timestamp" (RFC 3339) over the years.
+func parseTakeoutTimestamp(timestampMs, timestamp string) (time.Time, error) {
+	if timestampMs != "" {
+		ms, err := strconv.ParseInt(timestampMs, 10, 64)
+		if err != nil {
+			return time.Time{}, wrapError("Bad timestampMs / "+timestampMs, err)
+		}
+		return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+	}
+	if timestamp != "" {
+		t, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return time.Time{}, wrapError("Bad timestamp / "+timestamp, err)
+		}
+		return t.UTC(), nil
+	}
+	return time.Time{}, nil
+}
+
+func fromE7(e7 int64) float64 {
+	return float64(e7) / 1e7
+}
+
+// ======================================
+// ============ Records.json ============
+// ======================================
+
+type takeoutRecord struct {
+	TimestampMs string
+	Timestamp   string
+	LatitudeE7  int64
+	LongitudeE7 int64
+	Accuracy    float64
+	Altitude    *float64
+	Velocity    *float64
+	Heading     *float64
+	Source      string
+	Activity    []takeoutActivityReport
+}
+
+type takeoutActivityReport struct {
+	Activity []takeoutActivityGuess
+}
+
+type takeoutActivityGuess struct {
+	Type       string
+	Confidence int
+}
+
+func (r *takeoutRecord) addTo(start, end time.Time, out *History) error {
+	ts, err := parseTakeoutTimestamp(r.TimestampMs, r.Timestamp)
+	if err != nil {
+		return err
+	}
+	if !inTimeRange(ts, start, end) {
+		return nil
+	}
+
+	c := &Coordinate{
+		Lat:       fromE7(r.LatitudeE7),
+		Lng:       fromE7(r.LongitudeE7),
+		Timestamp: ts,
+		Accuracy:  r.Accuracy,
+		Source:    strings.ToLower(r.Source),
+		Activity:  r.mostLikelyActivity(),
+	}
+	if c.Source == "" {
+		c.Source = "takeout"
+	}
+	if r.Altitude != nil {
+		c.Altitude = *r.Altitude
+		c.Known |= FIELD_ALTITUDE
+	}
+	if r.Velocity != nil {
+		c.Velocity = *r.Velocity
+		c.Known |= FIELD_VELOCITY
+	}
+	if r.Heading != nil {
+		c.Heading = *r.Heading
+		c.Known |= FIELD_HEADING
+	}
+	out.Add(c)
+	return nil
+}
+
+// Uses the first activity report attached to the record, which is the one
+// closest in time to the location fix.
+func (r *takeoutRecord) mostLikelyActivity() string {
+	if len(r.Activity) == 0 {
+		return ""
+	}
+	best := ""
+	bestConfidence := -1
+	for _, guess := range r.Activity[0].Activity {
+		if guess.Confidence > bestConfidence {
+			best = guess.Type
+			bestConfidence = guess.Confidence
+		}
+	}
+	return best
+}
+
+// ======================================
+// ===== SEMANTIC LOCATION HISTORY ======
+// ======================================
+
+type takeoutTimelineObject struct {
+	PlaceVisit      *takeoutPlaceVisit
+	ActivitySegment *takeoutActivitySegment
+}
+
+type takeoutPlaceVisit struct {
+	Location takeoutLocation
+	Duration takeoutDuration
+}
+
+type takeoutActivitySegment struct {
+	StartLocation     takeoutLocation
+	EndLocation       takeoutLocation
+	Duration          takeoutDuration
+	ActivityType      string
+	SimplifiedRawPath takeoutRawPath
+}
+
+type takeoutLocation struct {
+	// Some visits only reference a place ID, without any coordinates.
+	LatitudeE7  *int64
+	LongitudeE7 *int64
+}
+
+type takeoutDuration struct {
+	StartTimestampMs string
+	StartTimestamp   string
+	EndTimestampMs   string
+	EndTimestamp     string
+}
+
+type takeoutRawPath struct {
+	Points []takeoutRawPoint
+}
+
+type takeoutRawPoint struct {
+	LatE7          int64
+	LngE7          int64
+	AccuracyMeters float64
+	TimestampMs    string
+	Timestamp      string
+}
+
+func (o *takeoutTimelineObject) addTo(start, end time.Time, out *History) error {
+	if o.PlaceVisit != nil {
+		ts, err := parseTakeoutTimestamp(
+			o.PlaceVisit.Duration.StartTimestampMs, o.PlaceVisit.Duration.StartTimestamp)
+		if err != nil {
+			return err
+		}
+		addTakeoutLocation(&o.PlaceVisit.Location, ts, "", start, end, out)
+	}
+
+	if segment := o.ActivitySegment; segment != nil {
+		segmentStart, err := parseTakeoutTimestamp(
+			segment.Duration.StartTimestampMs, segment.Duration.StartTimestamp)
+		if err != nil {
+			return err
+		}
+		segmentEnd, err := parseTakeoutTimestamp(
+			segment.Duration.EndTimestampMs, segment.Duration.EndTimestamp)
+		if err != nil {
+			return err
+		}
+
+		addTakeoutLocation(&segment.StartLocation, segmentStart, segment.ActivityType, start, end, out)
+		for _, p := range segment.SimplifiedRawPath.Points {
+			ts, err := parseTakeoutTimestamp(p.TimestampMs, p.Timestamp)
+			if err != nil {
+				return err
+			}
+			if !inTimeRange(ts, start, end) {
+				continue
+			}
+			out.Add(&Coordinate{
+				Lat:       fromE7(p.LatE7),
+				Lng:       fromE7(p.LngE7),
+				Timestamp: ts,
+				Accuracy:  p.AccuracyMeters,
+				Source:    "semantic",
+				Activity:  segment.ActivityType,
+			})
+		}
+		addTakeoutLocation(&segment.EndLocation, segmentEnd, segment.ActivityType, start, end, out)
+	}
+	return nil
+}
+
+func addTakeoutLocation(l *takeoutLocation, ts time.Time, activity string, start, end time.Time, out *History) {
+	if l.LatitudeE7 == nil || l.LongitudeE7 == nil || !inTimeRange(ts, start, end) {
+		return
+	}
+	out.Add(&Coordinate{
+		Lat:       fromE7(*l.LatitudeE7),
+		Lng:       fromE7(*l.LongitudeE7),
+		Timestamp: ts,
+		Source:    "semantic",
+		Activity:  activity,
+	})
+}
@@ -0,0 +1,158 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const recordsJson = `{
+  "locations": [{
+    "timestampMs": "1400000000000",
+    "latitudeE7": 407500000,
+    "longitudeE7": -739900000,
+    "accuracy": 20,
+    "velocity": 0,
+    "source": "GPS",
+    "activity": [{
+      "timestampMs": "1400000000100",
+      "activity": [{"type": "STILL", "confidence": 30}, {"type": "WALKING", "confidence": 70}]
+    }]
+  }, {
+    "timestamp": "2014-05-13T16:53:20.000Z",
+    "latitudeE7": 407600000,
+    "longitudeE7": -739800000,
+    "altitude": 12,
+    "heading": 180
+  }, {
+    "timestamp": "2014-05-20T00:00:00Z",
+    "latitudeE7": 0,
+    "longitudeE7": 0
+  }],
+  "somethingElse": {"ignored": [1, 2, 3]}
+}`
+
+const semanticJson = `{
+  "timelineObjects": [{
+    "activitySegment": {
+      "startLocation": {"latitudeE7": 515000000, "longitudeE7": -1000000},
+      "endLocation": {"latitudeE7": 515100000, "longitudeE7": -1100000},
+      "duration": {"startTimestamp": "2022-01-01T10:00:00Z", "endTimestamp": "2022-01-01T10:30:00Z"},
+      "activityType": "CYCLING",
+      "simplifiedRawPath": {"points": [
+        {"latE7": 515050000, "lngE7": -1050000, "accuracyMeters": 5, "timestamp": "2022-01-01T10:15:00Z"}
+      ]}
+    }
+  }, {
+    "placeVisit": {
+      "location": {"latitudeE7": 515100000, "longitudeE7": -1100000, "name": "Home"},
+      "duration": {"startTimestampMs": "1641033000000", "endTimestampMs": "1641040000000"}
+    }
+  }, {
+    "placeVisit": {
+      "location": {"placeId": "no-coordinates"},
+      "duration": {"startTimestampMs": "1641033000000", "endTimestampMs": "1641040000000"}
+    }
+  }]
+}`
+
+func TestReadTakeoutRecords(t *testing.T) {
+	h := &History{}
+	err := readTakeout(context.Background(), strings.NewReader(recordsJson), time.Time{}, time.Time{}, h)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, 3, h.Len(), "Should read every record")
+
+	first := h.At(0)
+	gt.AssertEqualM(t, 40.75, first.Lat, "lat")
+	gt.AssertEqualM(t, -73.99, first.Lng, "lng")
+	gt.AssertEqualM(t, time.Unix(1400000000, 0).UTC(), first.Timestamp, "timestampMs")
+	gt.AssertEqualM(t, 20.0, first.Accuracy, "accuracy")
+	gt.AssertTrueM(t, first.Has(FIELD_VELOCITY), "velocity")
+	gt.AssertFalseM(t, first.Has(FIELD_ALTITUDE), "altitude")
+	gt.AssertEqualM(t, "gps", first.Source, "source")
+	gt.AssertEqualM(t, "WALKING", first.Activity, "activity")
+
+	second := h.At(1)
+	gt.AssertEqualM(t, time.Unix(1400000000, 0).UTC(), second.Timestamp, "RFC 3339 timestamp")
+	gt.AssertTrueM(t, second.Has(FIELD_ALTITUDE), "altitude")
+	gt.AssertEqualM(t, 12.0, second.Altitude, "altitude")
+	gt.AssertEqualM(t, 180.0, second.Heading, "heading")
+	gt.AssertEqualM(t, "takeout", second.Source, "default source")
+}
+
+func TestReadTakeoutRecordsHonorsRange(t *testing.T) {
+	h := &History{}
+	err := readTakeout(context.Background(), strings.NewReader(recordsJson),
+		time.Unix(1300000000, 0), time.Unix(1400000000, 0), h)
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, 2, h.Len(), "The last record is out of range")
+}
+
+func TestReadTakeoutSemanticHistory(t *testing.T) {
+	h := &History{}
+	err := readTakeout(context.Background(), strings.NewReader(semanticJson), time.Time{}, time.Time{}, h)
+	gt.AssertNil(t, err)
+
+	// Segment start, raw path point, segment end, and one visit with coordinates.
+	gt.AssertEqualM(t, 4, h.Len(), "Unexpected number of points")
+
+	gt.AssertEqualM(t, 51.5, h.At(0).Lat, "segment start")
+	gt.AssertEqualM(t, "CYCLING", h.At(0).Activity, "segment activity")
+	gt.AssertEqualM(t, 5.0, h.At(1).Accuracy, "raw point accuracy")
+	gt.AssertEqualM(t,
+		time.Date(2022, 1, 1, 10, 15, 0, 0, time.UTC), h.At(1).Timestamp, "raw point time")
+	gt.AssertEqualM(t,
+		time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC), h.At(2).Timestamp, "segment end")
+	gt.AssertEqualM(t, time.Unix(1641033000, 0).UTC(), h.At(3).Timestamp, "visit")
+	gt.AssertEqualM(t, "", h.At(3).Activity, "visits have no activity")
+}
+
+func TestReadTakeoutRejectsMalformedInput(t *testing.T) {
+	err := readTakeout(context.Background(), strings.NewReader(`[1, 2, 3]`), time.Time{}, time.Time{}, &History{})
+	gt.AssertNotNil(t, err)
+
+	err = readTakeout(context.Background(), strings.NewReader(`{"locations": [{"timestampMs": "soon"}]}`),
+		time.Time{}, time.Time{}, &History{})
+	gt.AssertNotNil(t, err)
+
+	err = readTakeout(context.Background(), strings.NewReader(`{"locations": [{"latitudeE7": 1`),
+		time.Time{}, time.Time{}, &History{})
+	gt.AssertNotNil(t, err)
+}
+
+func TestTakeoutSourceReadsDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "latvis-takeout")
+	gt.AssertNil(t, err)
+	defer os.RemoveAll(dir)
+
+	monthDir := filepath.Join(dir, "Semantic Location History", "2022")
+	gt.AssertNil(t, os.MkdirAll(monthDir, 0755))
+	gt.AssertNil(t, ioutil.WriteFile(
+		filepath.Join(monthDir, "2022_JANUARY.json"), []byte(semanticJson), 0644))
+	gt.AssertNil(t, ioutil.WriteFile(
+		filepath.Join(dir, "Records.json"), []byte(recordsJson), 0644))
+	gt.AssertNil(t, ioutil.WriteFile(
+		filepath.Join(dir, "README.txt"), []byte("not json"), 0644))
+
+	source := NewTakeoutSource(dir)
+	h, err := source.FetchRange(context.Background(),
+		time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC))
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, 4, h.Len(), "Only the semantic history is in range")
+
+	h, err = source.FetchRange(context.Background(), time.Time{}, time.Time{})
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, 7, h.Len(), "Everything is in an open range")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = source.FetchRange(ctx, time.Time{}, time.Time{})
+	gt.AssertEqual(t, context.Canceled, err)
+}
@@ -0,0 +1,361 @@
+package latvis
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ======================================
+// ===== IN-PROCESS URL TASK QUEUE ======
+// ======================================
+
+const (
+	DEFAULT_TASK_CONCURRENCY     = 4
+	DEFAULT_TASK_QUEUE_DEPTH     = 100
+	DEFAULT_TASK_TIMEOUT         = 10 * time.Minute
+	DEFAULT_TASK_MAX_ATTEMPTS    = 3
+	DEFAULT_TASK_INITIAL_BACKOFF = time.Second
+	DEFAULT_TASK_MAX_BACKOFF     = time.Minute
+)
+
+var ErrTaskQueueFull = errors.New("Task queue is full")
+
+// Task requests carry which attempt they are (counting from 1), and how many
+// there will be, so that handlers can tell whether a failure is final (see
+// isFinalTaskAttempt).
+const (
+	TASK_ATTEMPT_HEADER      = "X-Latvis-Task-Attempt"
+	TASK_MAX_ATTEMPTS_HEADER = "X-Latvis-Task-Max-Attempts"
+)
+
+// Zero values get the matching DEFAULT_TASK_* setting.
+type TaskQueueOptions struct {
+	// The number of tasks which may run at once.
+	Concurrency int
+
+	// The number of tasks which may be waiting to run.  Once there are this
+	// many, Enqueue fails with ErrTaskQueueFull.
+	MaxQueueDepth int
+
+	// How long each attempt at a task may take.  The task's request is
+	// cancelled after this long, and the attempt counts as a failure.
+	Timeout time.Duration
+
+	// Failed tasks are retried until they've been tried this many times,
+	// waiting InitialBackoff before the first retry, and twice as long before
+	// each one after that (up to MaxBackoff).
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// If set, a DurableUrlTaskQueue encrypts the tasks' params in its log,
+	// since they say where and when someone's history is (and how to fetch
+	// it).  Other queues don't write tasks down, so ignore it.
+	Keyring *BlobKeyring
+}
+
+// InProcessUrlTaskQueue runs tasks on a fixed pool of goroutines, by handing
+// a request for the task's URL straight to the handler registered for it
+// (e.g. DrawMapWorker for "/drawmap_worker"), rather than making a real HTTP
+// request.
+//
+// An attempt at a task fails if the handler responds with a 5xx status,
+// panics, or runs past the timeout.  Handlers which run past the timeout
+// can't be stopped, so should give up once their request's Context is done:
+// the attempt isn't over (so the task isn't retried, and the worker isn't
+// free) until they do.
+type InProcessUrlTaskQueue struct {
+	baseUrl string
+	options TaskQueueOptions
+
+	mutex    sync.Mutex
+	handlers map[string]func(http.ResponseWriter, *http.Request)
+	closed   bool
+
+	tasks chan *queuedTask
+	stop  chan bool
+
+	// Counts every task from being enqueued until it succeeds, or has used
+	// up all of its attempts.
+	pending sync.WaitGroup
+}
+
+type queuedTask struct {
+	url      string
+	params   url.Values
+	attempts int
+}
+
+// baseUrl is where the server can be reached from the outside, e.g.
+// "https://latvis.example.com".  Handlers see it as the request's host and
+// scheme, which matters because they build OAuth callback URLs from them.
+func NewInProcessUrlTaskQueue(baseUrl string, options TaskQueueOptions) *InProcessUrlTaskQueue {
+	options.fillInDefaults()
+
+	q := &InProcessUrlTaskQueue{
+		baseUrl:  strings.TrimSuffix(baseUrl, "/"),
+		options:  options,
+		handlers: make(map[string]func(http.ResponseWriter, *http.Request)),
+		tasks:    make(chan *queuedTask, options.MaxQueueDepth),
+		stop:     make(chan bool),
+	}
+	for i := 0; i < options.Concurrency; i++ {
+		go q.work()
+	}
+	return q
+}
+
+func (options *TaskQueueOptions) fillInDefaults() {
+	if options.Concurrency <= 0 {
+		options.Concurrency = DEFAULT_TASK_CONCURRENCY
+	}
+	if options.MaxQueueDepth <= 0 {
+		options.MaxQueueDepth = DEFAULT_TASK_QUEUE_DEPTH
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_TASK_TIMEOUT
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = DEFAULT_TASK_MAX_ATTEMPTS
+	}
+	if options.InitialBackoff <= 0 {
+		options.InitialBackoff = DEFAULT_TASK_INITIAL_BACKOFF
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DEFAULT_TASK_MAX_BACKOFF
+	}
+}
+
+// Runs tasks for 'path' with the given handler.
+func (q *InProcessUrlTaskQueue) Register(path string, handler func(http.ResponseWriter, *http.Request)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.handlers[path] = handler
+}
+
+func (q *InProcessUrlTaskQueue) Enqueue(path string, params *url.Values) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return errors.New("Task queue is closed")
+	}
+	if _, ok := q.handlers[path]; !ok {
+		return fmt.Errorf("No handler registered for task %s", path)
+	}
+
+	task := &queuedTask{url: path, params: url.Values{}}
+	for key, values := range *params {
+		task.params[key] = append([]string{}, values...)
+	}
+
+	q.pending.Add(1)
+	select {
+	case q.tasks <- task:
+		return nil
+	default:
+		q.pending.Done()
+		return ErrTaskQueueFull
+	}
+}
+
+// Stops accepting new tasks, and waits up to 'timeout' for the queued and
+// running ones (including any waiting to be retried) to finish.
+func (q *InProcessUrlTaskQueue) Close(timeout time.Duration) error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mutex.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		q.pending.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		err = fmt.Errorf("Tasks still pending after %s", timeout)
+	}
+	close(q.stop)
+	return err
+}
+
+func (q *InProcessUrlTaskQueue) work() {
+	for {
+		select {
+		case task := <-q.tasks:
+			q.attempt(task)
+		case <-q.stop:
+			q.discardQueued()
+			return
+		}
+	}
+}
+
+// Drops the tasks left in the queue once it has stopped, since nobody will
+// run them.
+func (q *InProcessUrlTaskQueue) discardQueued() {
+	for {
+		select {
+		case task := <-q.tasks:
+			log.Printf("Task %s dropped: the queue is closed\n", task.url)
+			q.pending.Done()
+		default:
+			return
+		}
+	}
+}
+
+func (q *InProcessUrlTaskQueue) attempt(task *queuedTask) {
+	task.attempts++
+	err := q.run(task)
+	if err == nil {
+		q.pending.Done()
+		return
+	}
+
+	if task.attempts >= q.options.MaxAttempts {
+		log.Printf("Task %s failed for good after %d attempts: %s\n", task.url, task.attempts, err)
+		q.pending.Done()
+		return
+	}
+
+	backoff := q.backoff(task.attempts)
+	log.Printf("Task %s failed (attempt %d), retrying in %s: %s\n", task.url, task.attempts, backoff, err)
+	time.AfterFunc(backoff, func() {
+		select {
+		case q.tasks <- task:
+			// The queue may have stopped (and its workers with it) before the
+			// task got in.
+			select {
+			case <-q.stop:
+				q.discardQueued()
+			default:
+			}
+		case <-q.stop:
+			q.pending.Done()
+		}
+	})
+}
+
+// How long to wait before retrying a task which has failed 'attempts' times.
+func (q *InProcessUrlTaskQueue) backoff(attempts int) time.Duration {
+	return q.options.backoff(attempts)
+}
+
+func (options *TaskQueueOptions) backoff(attempts int) time.Duration {
+	backoff := options.InitialBackoff
+	for i := 1; i < attempts && backoff < options.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > options.MaxBackoff {
+		backoff = options.MaxBackoff
+	}
+	return backoff
+}
+
+func (q *InProcessUrlTaskQueue) run(task *queuedTask) error {
+	q.mutex.Lock()
+	handler := q.handlers[task.url]
+	q.mutex.Unlock()
+
+	return runTask(handler, q.baseUrl, task.url, task.params, task.attempts, &q.options)
+}
+
+// Makes attempt number 'attempt' at a task, by calling its handler directly.
+// Returns an error if the handler responds with a 5xx status, panics, or runs
+// for longer than options.Timeout.  Only returns once the handler has, so
+// that a retry never runs alongside an attempt which timed out.
+func runTask(handler func(http.ResponseWriter, *http.Request),
+	baseUrl, path string, params url.Values, attempt int, options *TaskQueueOptions) error {
+	timeout := options.Timeout
+	request, err := http.NewRequest("POST", baseUrl+path, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set(TASK_ATTEMPT_HEADER, strconv.Itoa(attempt))
+	request.Header.Set(TASK_MAX_ATTEMPTS_HEADER, strconv.Itoa(options.MaxAttempts))
+	if request.URL.Scheme == "https" {
+		// Only checked for being non-nil, by callbackUrlFor.
+		request.TLS = &tls.ConnectionState{}
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), timeout)
+	defer cancel()
+	request = request.WithContext(ctx)
+
+	finished := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				finished <- fmt.Errorf("Panic: %v", r)
+			}
+		}()
+		response := &taskResponseWriter{header: make(http.Header), status: http.StatusOK}
+		handler(response, request)
+		if response.status >= 500 {
+			finished <- fmt.Errorf("Status %d: %s", response.status, response.body.String())
+		} else {
+			finished <- nil
+		}
+	}()
+
+	err = <-finished
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Timed out after %s", timeout)
+	}
+	return err
+}
+
+// Whether a task's handler is making the last attempt at it, i.e. whether the
+// task will be given up on if this attempt fails.  Requests which don't say
+// (e.g. because they didn't come from one of our queues) count as the last.
+func isFinalTaskAttempt(request *http.Request) bool {
+	attempt, err := strconv.Atoi(request.Header.Get(TASK_ATTEMPT_HEADER))
+	if err != nil {
+		return true
+	}
+	maxAttempts, err := strconv.Atoi(request.Header.Get(TASK_MAX_ATTEMPTS_HEADER))
+	if err != nil {
+		return true
+	}
+	return attempt >= maxAttempts
+}
+
+// Keeps the status (and the start of the body, for error messages) of a
+// task's response.
+type taskResponseWriter struct {
+	header http.Header
+	status int
+	body   strings.Builder
+}
+
+func (w *taskResponseWriter) Header() http.Header    { return w.header }
+func (w *taskResponseWriter) WriteHeader(status int) { w.status = status }
+
+func (w *taskResponseWriter) Write(b []byte) (int, error) {
+	if remaining := 200 - w.body.Len(); remaining > 0 {
+		if len(b) > remaining {
+			w.body.Write(b[:remaining])
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return len(b), nil
+}
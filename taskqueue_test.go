@@ -0,0 +1,244 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Retries as quickly as possible.
+func fastTaskQueueOptions() TaskQueueOptions {
+	return TaskQueueOptions{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}
+}
+
+func TestInProcessUrlTaskQueueRunsTasks(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	q := NewInProcessUrlTaskQueue("https://latvis.example.com/", fastTaskQueueOptions())
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		request.ParseForm()
+		requests <- request
+	})
+
+	params := url.Values{"a": []string{"1"}}
+	gt.AssertNil(t, q.Enqueue("/work", &params))
+
+	request := <-requests
+	gt.AssertEqualM(t, "1", request.Form.Get("a"), "Params should be passed along")
+	gt.AssertEqualM(t, "https://latvis.example.com/async_drawmap", callbackUrlFor(request),
+		"Workers should see the server's public URL")
+
+	gt.AssertNotNilM(t, q.Enqueue("/unknown", &params), "Tasks need a handler")
+	gt.AssertNil(t, q.Close(time.Second))
+}
+
+func TestInProcessUrlTaskQueueLimitsConcurrency(t *testing.T) {
+	options := fastTaskQueueOptions()
+	options.Concurrency = 2
+	q := NewInProcessUrlTaskQueue("http://localhost", options)
+
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	})
+
+	for i := 0; i < 10; i++ {
+		gt.AssertNil(t, q.Enqueue("/work", &url.Values{}))
+	}
+	gt.AssertNil(t, q.Close(time.Second))
+	gt.AssertEqualM(t, 2, maxRunning, "Should use exactly the allowed concurrency")
+}
+
+func TestInProcessUrlTaskQueueRejectsWhenFull(t *testing.T) {
+	options := fastTaskQueueOptions()
+	options.Concurrency = 1
+	options.MaxQueueDepth = 1
+	q := NewInProcessUrlTaskQueue("http://localhost", options)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	q.Register("/work", func(response http.ResponseWriter, request *http.Request) {
+		started <- true
+		<-release
+	})
+
+	gt.AssertNil(t, q.Enqueue("/work", &url.Values{}))
+	<-started
+	gt.AssertNil(t, q.Enqueue("/work", &url.Values{}))
+	gt.AssertEqualM(t, ErrTaskQueueFull, q.Enqueue("/work", &url.Values{}), "Queue should be full")
+
+	close(release)
+	<-started
+	gt.AssertNil(t, q.Close(time.Second))
+}
+
+func TestInProcessUrlTaskQueueRetries(t *testing.T) {
+	q := NewInProcessUrlTaskQueue("http://localhost", fastTaskQueueOptions())
+
+	attempts := 0
+	final := []bool{}
+	q.Register("/flaky", func(response http.ResponseWriter, request *http.Request) {
+		attempts++
+		final = append(final, isFinalTaskAttempt(request))
+		if attempts == 1 {
+			response.WriteHeader(http.StatusInternalServerError)
+		} else if attempts == 2 {
+			panic("oops")
+		}
+	})
+
+	gt.AssertNil(t, q.Enqueue("/flaky", &url.Values{}))
+	gt.AssertNil(t, q.Close(time.Second))
+	gt.AssertEqualM(t, 3, attempts, "Should succeed on the third attempt")
+	gt.AssertEqualM(t, []bool{false, false, true}, final, "Handlers should know when they're the last attempt")
+}
+
+func TestIsFinalTaskAttempt(t *testing.T) {
+	request, err := http.NewRequest("POST", "http://localhost/work", nil)
+	gt.AssertNil(t, err)
+	gt.AssertTrueM(t, isFinalTaskAttempt(request), "Requests from elsewhere only get one attempt")
+
+	request.Header.Set(TASK_ATTEMPT_HEADER, "1")
+	request.Header.Set(TASK_MAX_ATTEMPTS_HEADER, "2")
+	gt.AssertFalse(t, isFinalTaskAttempt(request))
+	request.Header.Set(TASK_ATTEMPT_HEADER, "2")
+	gt.AssertTrue(t, isFinalTaskAttempt(request))
+}
+
+func TestInProcessUrlTaskQueueGivesUp(t *testing.T) {
+	options := fastTaskQueueOptions()
+	options.MaxAttempts = 2
+	options.Timeout = 5 * time.Millisecond
+	q := NewInProcessUrlTaskQueue("http://localhost", options)
+
+	var mutex sync.Mutex
+	attempts := 0
+	q.Register("/slow", func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		attempts++
+		mutex.Unlock()
+		<-request.Context().Done()
+	})
+
+	gt.AssertNil(t, q.Enqueue("/slow", &url.Values{}))
+	gt.AssertNil(t, q.Close(time.Second))
+	mutex.Lock()
+	defer mutex.Unlock()
+	gt.AssertEqualM(t, 2, attempts, "Timeouts count as failures")
+}
+
+func TestInProcessUrlTaskQueueWaitsForTimedOutAttempts(t *testing.T) {
+	options := fastTaskQueueOptions()
+	options.MaxAttempts = 2
+	options.Timeout = 5 * time.Millisecond
+	q := NewInProcessUrlTaskQueue("http://localhost", options)
+
+	var mutex sync.Mutex
+	running, maxRunning, attempts := 0, 0, 0
+	q.Register("/slow", func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		running++
+		attempts++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		// Slow to notice the timeout.
+		<-request.Context().Done()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+	})
+
+	gt.AssertNil(t, q.Enqueue("/slow", &url.Values{}))
+	gt.AssertNil(t, q.Close(time.Second))
+	mutex.Lock()
+	defer mutex.Unlock()
+	gt.AssertEqual(t, 2, attempts)
+	gt.AssertEqualM(t, 1, maxRunning, "The retry shouldn't start until the first attempt has given up")
+}
+
+func TestInProcessUrlTaskQueueBackoff(t *testing.T) {
+	q := NewInProcessUrlTaskQueue("http://localhost", TaskQueueOptions{
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	})
+	defer q.Close(0)
+
+	gt.AssertEqualM(t, time.Second, q.backoff(1), "First retry")
+	gt.AssertEqualM(t, 2*time.Second, q.backoff(2), "Second retry")
+	gt.AssertEqualM(t, 4*time.Second, q.backoff(3), "Third retry")
+	gt.AssertEqualM(t, 5*time.Second, q.backoff(4), "Capped")
+}
+
+func TestInProcessUrlTaskQueueDrainsOnClose(t *testing.T) {
+	release := make(chan bool)
+	finished := make(chan bool, 1)
+	q := NewInProcessUrlTaskQueue("http://localhost", fastTaskQueueOptions())
+	q.Register("/slow", func(response http.ResponseWriter, request *http.Request) {
+		<-release
+		finished <- true
+	})
+	gt.AssertNil(t, q.Enqueue("/slow", &url.Values{}))
+
+	closed := make(chan error)
+	go func() { closed <- q.Close(time.Second) }()
+	time.Sleep(5 * time.Millisecond)
+	gt.AssertNotNilM(t, q.Enqueue("/slow", &url.Values{}), "Closed queues reject tasks")
+
+	close(release)
+	gt.AssertNil(t, <-closed)
+	gt.AssertTrueM(t, <-finished, "The task should have finished")
+}
+
+// Retries which come up after the queue has closed are dropped, rather than
+// left queued with nobody to run them.
+func TestInProcessUrlTaskQueueDropsRetriesAfterClose(t *testing.T) {
+	// Whether a retry is sent or dropped is down to chance, so try a few
+	// times.
+	for i := 0; i < 10; i++ {
+		options := fastTaskQueueOptions()
+		options.InitialBackoff = 20 * time.Millisecond
+		options.MaxBackoff = options.InitialBackoff
+		attempts := make(chan bool, 10)
+		q := NewInProcessUrlTaskQueue("http://localhost", options)
+		q.Register("/failing", func(response http.ResponseWriter, request *http.Request) {
+			attempts <- true
+			http.Error(response, "nope", http.StatusInternalServerError)
+		})
+		gt.AssertNil(t, q.Enqueue("/failing", &url.Values{}))
+		<-attempts
+		gt.AssertNotNilM(t, q.Close(time.Millisecond), "The retry is still waiting")
+
+		drained := make(chan bool)
+		go func() {
+			q.pending.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(time.Second):
+			t.Fatal("The retry was never dropped")
+		}
+		gt.AssertEqualM(t, 0, len(attempts), "Nothing should run after Close")
+	}
+}
@@ -0,0 +1,253 @@
+package latvis
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ======================================
+// ============ TILE SERVER =============
+// ======================================
+
+// Serves a history as "slippy map" tiles, which can be shown on top of a
+// basemap in Leaflet, OpenLayers, etc.  Tiles are 256px squares of the Web
+// Mercator projection, addressed as /tiles/{layer}/{z}/{x}/{y}.png following
+// the usual XYZ scheme: at zoom z the world is 2^z tiles across, and (0, 0)
+// is the top left.
+
+const (
+	TILE_SIZE_PX  = 256
+	MAX_TILE_ZOOM = 22
+)
+
+// A history, prepared for rendering as tiles.
+//
+// Each pixel's intensity is relative to the densest pixel at that zoom level
+// anywhere in the world, rather than to the densest pixel in the same tile,
+// so that tiles next to each other match up.
+type TileLayer struct {
+	Name        string
+	Palette     *Palette
+	Transparent bool
+
+	// Distinguishes tiles rendered from this layer from ones cached for
+	// a previous layer with the same name.
+	created time.Time
+
+	// Sorted by x, so that the points in a tile can be found by binary search.
+	points []tilePoint
+
+	mutex     sync.Mutex
+	maxByZoom map[int]int
+}
+
+// A point's position in the Web Mercator world, from 0 to 1 in each
+// direction, with (0, 0) at the top left.
+type tilePoint struct {
+	x, y float64
+}
+
+// Builds a layer from the given history.  Points too close to the poles for
+// Web Mercator to show are dropped.  A nil palette means DEFAULT_PALETTE.
+func NewTileLayer(name string, history *History, palette *Palette) *TileLayer {
+	if palette == nil {
+		// Built-in palettes always parse.
+		palette, _ = ParsePalette(DEFAULT_PALETTE)
+	}
+	mercator := &webMercatorProjection{}
+	points := make([]tilePoint, 0, history.Len())
+	for i := 0; i < history.Len(); i++ {
+		c := history.At(i)
+		if math.Abs(c.Lat) > MAX_MERCATOR_LATITUDE {
+			continue
+		}
+		x, y := mercator.Project(c)
+		points = append(points, tilePoint{
+			x: (x + math.Pi) / (2 * math.Pi),
+			y: (math.Pi - y) / (2 * math.Pi),
+		})
+	}
+	sort.Sort(tilePointsByX(points))
+
+	return &TileLayer{
+		Name:        name,
+		Palette:     palette,
+		Transparent: true,
+		created:     time.Now(),
+		points:      points,
+		maxByZoom:   make(map[int]int),
+	}
+}
+
+type tilePointsByX []tilePoint
+
+func (p tilePointsByX) Len() int           { return len(p) }
+func (p tilePointsByX) Less(i, j int) bool { return p[i].x < p[j].x }
+func (p tilePointsByX) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Returns the pixel (in the whole world, at the given zoom) containing the
+// point.
+func (p tilePoint) pixel(zoom int) (x, y int64) {
+	worldSize := float64(int64(TILE_SIZE_PX) << uint(zoom))
+	x = int64(math.Min(p.x*worldSize, worldSize-1))
+	y = int64(math.Min(p.y*worldSize, worldSize-1))
+	return x, y
+}
+
+// The number of points in the densest pixel at the given zoom.
+func (l *TileLayer) maxCount(zoom int) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if max, ok := l.maxByZoom[zoom]; ok {
+		return max
+	}
+
+	counts := make(map[[2]int64]int)
+	max := 0
+	for _, p := range l.points {
+		x, y := p.pixel(zoom)
+		key := [2]int64{x, y}
+		counts[key]++
+		if counts[key] > max {
+			max = counts[key]
+		}
+	}
+	l.maxByZoom[zoom] = max
+	return max
+}
+
+// Renders the tile as a PNG.
+func (l *TileLayer) Render(zoom, tileX, tileY int) (*[]byte, error) {
+	if zoom < 0 || zoom > MAX_TILE_ZOOM {
+		return nil, fmt.Errorf("Zoom must be between 0 and %d, got: %d", MAX_TILE_ZOOM, zoom)
+	}
+	tiles := 1 << uint(zoom)
+	if tileX < 0 || tileX >= tiles || tileY < 0 || tileY >= tiles {
+		return nil, fmt.Errorf("No tile (%d, %d) at zoom %d", tileX, tileY, zoom)
+	}
+
+	grid := NewGrid(TILE_SIZE_PX, TILE_SIZE_PX)
+	minX, maxX := float64(tileX)/float64(tiles), float64(tileX+1)/float64(tiles)
+	left := int64(tileX) * TILE_SIZE_PX
+	top := int64(tileY) * TILE_SIZE_PX
+
+	start := sort.Search(len(l.points), func(i int) bool { return l.points[i].x >= minX })
+	for i := start; i < len(l.points) && l.points[i].x < maxX; i++ {
+		x, y := l.points[i].pixel(zoom)
+		x, y = x-left, y-top
+		// Points right on the tile's edge can round into the next tile over.
+		if x >= 0 && x < TILE_SIZE_PX && y >= 0 && y < TILE_SIZE_PX {
+			grid.Inc(int(x), int(y))
+		}
+	}
+
+	intensityGrid := formatAsIntensityGridWithMax(grid, l.maxCount(zoom))
+	return imageToPNGBytes(intensityGridToColorImage(intensityGrid, l.Palette, l.Transparent))
+}
+
+// The handle a rendered tile is cached under.
+func (l *TileLayer) tileHandle(zoom, tileX, tileY int) *Handle {
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "tile/%s/%d/%d/%d", l.Name, zoom, tileX, tileY)
+	return &Handle{
+		timestamp: l.created.Unix(),
+		n1:        int64(hash.Sum64() >> 1),
+	}
+}
+
+// Like formatAsIntensityGrid, but relative to the given maximum count rather
+// than the largest one in the grid.
+func formatAsIntensityGridWithMax(grid *Grid, maxCount int) *IntensityGrid {
+	intensityGrid := &IntensityGrid{Points: make([][]float64, grid.Width())}
+	for x := 0; x < grid.Width(); x++ {
+		intensityGrid.Points[x] = make([]float64, grid.Height())
+		if maxCount == 0 {
+			continue
+		}
+		for y := 0; y < grid.Height(); y++ {
+			intensityGrid.Points[x][y] = math.Min(1, scaleHeat(grid.Get(x, y))/scaleHeat(maxCount))
+		}
+	}
+	return intensityGrid
+}
+
+// ======================================
+// ============ TILE HANDLER ============
+// ======================================
+
+// Serves /tiles/{layer}/{z}/{x}/{y}.png, from the layers registered with
+// Environment.AddTileLayer.  Rendered tiles are cached in the BlobStore.
+func TileHandler(response http.ResponseWriter, request *http.Request) {
+	env := envFactory.ForRequest(request)
+
+	layerName, zoom, tileX, tileY, err := parseTileUrl(request.URL.Path)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	layer := env.TileLayer(layerName)
+	if layer == nil {
+		http.NotFound(response, request)
+		return
+	}
+
+	handle := layer.tileHandle(zoom, tileX, tileY)
+	blob, err := env.blobStore.Fetch(handle)
+	if err == nil && len(blob.Data) > 0 {
+		serveTile(response, blob.Data)
+		return
+	}
+	if err != nil && !errors.Is(err, ErrNoSuchBlob) {
+		// The tile can always be drawn again, and stored over the bad one.
+		log.Printf("Couldn't fetch cached tile %s: %s\n", handle, err)
+	}
+
+	data, err := layer.Render(zoom, tileX, tileY)
+	if err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := env.blobStore.Store(handle, &Blob{
+		Data:        *data,
+		ContentType: "image/png",
+		Expires:     time.Now().Add(TILE_CACHE_TTL),
+	}); err != nil {
+		log.Printf("Couldn't cache tile %s: %s\n", request.URL.Path, err)
+	}
+	serveTile(response, *data)
+}
+
+func serveTile(response http.ResponseWriter, data []byte) {
+	response.Header().Set("Content-Type", "image/png")
+	response.Write(data)
+}
+
+// Parses "/tiles/{layer}/{z}/{x}/{y}.png".
+func parseTileUrl(path string) (layer string, zoom, x, y int, err error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "tiles" || parts[2] == "" {
+		return "", 0, 0, 0, errors.New("Invalid tile path: " + path)
+	}
+	if !strings.HasSuffix(parts[5], ".png") {
+		return "", 0, 0, 0, errors.New("Tiles are only available as .png: " + path)
+	}
+
+	numbers := []string{parts[3], parts[4], strings.TrimSuffix(parts[5], ".png")}
+	values := make([]int, len(numbers))
+	for i, number := range numbers {
+		if values[i], err = strconv.Atoi(number); err != nil {
+			return "", 0, 0, 0, fmt.Errorf("Invalid tile path: %s (%s)", path, err)
+		}
+	}
+	return parts[2], values[0], values[1], values[2], nil
+}
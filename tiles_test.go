@@ -0,0 +1,119 @@
+package latvis
+
+import (
+	"github.com/mrjones/gt"
+
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"testing"
+)
+
+func decodeTile(t *testing.T, data []byte) image.Image {
+	img, err := png.Decode(bytes.NewReader(data))
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, image.Rect(0, 0, TILE_SIZE_PX, TILE_SIZE_PX), img.Bounds(), "Tile size")
+	return img
+}
+
+func alphaAt(img image.Image, x, y int) uint32 {
+	_, _, _, a := img.At(x, y).RGBA()
+	return a
+}
+
+func TestParseTileUrl(t *testing.T) {
+	layer, z, x, y, err := parseTileUrl("/tiles/home/3/4/5.png")
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, "home", layer, "Layer")
+	gt.AssertEqualM(t, []int{3, 4, 5}, []int{z, x, y}, "Tile coordinates")
+
+	for _, bad := range []string{
+		"/tiles/home/3/4.png",
+		"/tiles//3/4/5.png",
+		"/tiles/home/3/4/5.jpg",
+		"/tiles/home/3/a/5.png",
+		"/tiles/home/3/4/5/6.png",
+	} {
+		_, _, _, _, err = parseTileUrl(bad)
+		gt.AssertNotNilM(t, err, "Should reject: "+bad)
+	}
+}
+
+func TestTileLayerPlacesPoints(t *testing.T) {
+	h := History{}
+	// Just north-east of Null Island, which is the bottom left corner of tile
+	// (1, 0) at zoom 1.
+	h.Add(&Coordinate{Lat: 0.1, Lng: 0.1})
+	// Too close to the pole for Web Mercator.
+	h.Add(&Coordinate{Lat: 89, Lng: 0.1})
+	layer := NewTileLayer("test", &h, nil)
+	gt.AssertEqualM(t, 1, len(layer.points), "Polar points should be dropped")
+
+	data, err := layer.Render(1, 1, 0)
+	gt.AssertNil(t, err)
+	img := decodeTile(t, *data)
+	gt.AssertEqualM(t, uint32(0), alphaAt(img, 100, 100), "Empty pixels are transparent")
+	gt.AssertEqualM(t, uint32(0xffff), alphaAt(img, 0, TILE_SIZE_PX-1), "Point should be at the bottom left")
+
+	data, err = layer.Render(1, 0, 0)
+	gt.AssertNil(t, err)
+	img = decodeTile(t, *data)
+	gt.AssertEqualM(t, uint32(0), alphaAt(img, TILE_SIZE_PX-1, TILE_SIZE_PX-1), "Point shouldn't spill over")
+
+	_, err = layer.Render(1, 2, 0)
+	gt.AssertNotNil(t, err)
+	_, err = layer.Render(MAX_TILE_ZOOM+1, 0, 0)
+	gt.AssertNotNil(t, err)
+}
+
+func TestTileLayerNormalizesPerZoom(t *testing.T) {
+	h := History{}
+	// Four points in one place in the west, and one in the east.
+	for i := 0; i < 4; i++ {
+		h.Add(&Coordinate{Lat: 10, Lng: -100})
+	}
+	h.Add(&Coordinate{Lat: 10, Lng: 100})
+	layer := NewTileLayer("test", &h, nil)
+
+	gt.AssertEqualM(t, 4, layer.maxCount(1), "Densest pixel at zoom 1")
+	gt.AssertEqualM(t, 4, layer.maxCount(1), "Should be cached")
+
+	// On its own tile, the lone eastern point isn't the brightest point
+	// around, so it shouldn't be drawn at full intensity.
+	grid := NewGrid(1, 1)
+	grid.Inc(0, 0)
+	intensity := formatAsIntensityGridWithMax(grid, layer.maxCount(1))
+	assertClose(t, scaleHeat(1)/scaleHeat(4), intensity.Points[0][0], "Intensity relative to the whole zoom level")
+}
+
+func TestTileHandlerCachesTiles(t *testing.T) {
+	dir, blobStore := setUpFakeBlobStore(t)
+	defer os.RemoveAll(dir)
+
+	h := History{}
+	h.Add(&Coordinate{Lat: 0.1, Lng: 0.1})
+	env := NewEnvironment(blobStore, nil, nil, nil, nil)
+	layer := NewTileLayer("home", &h, nil)
+	env.AddTileLayer(layer)
+
+	res := execute(t, "http://myhost.com/tiles/home/1/1/0.png", TileHandler, env)
+	gt.AssertEqualM(t, 200, res.StatusCode, "Should have rendered a tile")
+	gt.AssertEqualM(t, "image/png", res.Headers.Get("Content-Type"), "Content type")
+	decodeTile(t, []byte(res.Body))
+
+	cached, err := blobStore.Fetch(layer.tileHandle(1, 1, 0))
+	gt.AssertNil(t, err)
+	gt.AssertEqualM(t, res.Body, string(cached.Data), "Tile should be cached")
+
+	// Serve the cached copy, even if the layer would now render differently.
+	layer.points = nil
+	res = execute(t, "http://myhost.com/tiles/home/1/1/0.png", TileHandler, env)
+	gt.AssertEqualM(t, string(cached.Data), res.Body, "Should serve the cached tile")
+
+	res = execute(t, "http://myhost.com/tiles/work/1/1/0.png", TileHandler, env)
+	gt.AssertEqualM(t, 404, res.StatusCode, "Unknown layer")
+
+	res = execute(t, "http://myhost.com/tiles/home/1/5/1.png", TileHandler, env)
+	gt.AssertEqualM(t, 400, res.StatusCode, "Tile out of range")
+}
@@ -2,7 +2,7 @@ package latvis
 
 import (
 	"bytes"
-	"fmt"
+	"context"
 	"image"
 	"image/color"
 	"image/png"
@@ -18,13 +18,16 @@ import (
 // - bounds:    The borders of the image in latitude/longitude
 // - width/height:  The width & height of the final image in pixels
 //
+// Visualizers give up, returning ctx.Err(), if ctx is cancelled.
+//
 // returns
 // - a []byte representing a PNG image
 //
 // TODO(mrjones): return a ContentType along with []bytes
 // TODO(mrjones): do width & height make sense for non-PNG return types?
 type Visualizer interface {
-	Visualize(history *History,
+	Visualize(ctx context.Context,
+		history *History,
 		bounds *BoundingBox,
 		imageWidth,
 		imageHeight int) (*[]byte, error)
@@ -43,21 +46,91 @@ type IntensityGrid struct {
 	Points [][]float64
 }
 
-type BwPngVisualizer struct{}
+func init() {
+	RegisterVisualizer(&VisualizerStyle{
+		Name:        "bw",
+		Description: "Black and white, with every pixel containing a point drawn black",
+		ContentType: "image/png",
+		Extension:   "png",
+		Options:     []VisualizerOption{sizeOption},
+		New: func(options VisualizerOptions, projection Projection, progress ProgressFunc) (Visualizer, error) {
+			return &BwPngVisualizer{Projection: projection, Progress: progress}, nil
+		},
+	})
+}
+
+type BwPngVisualizer struct {
+	// Defaults to equirectangular.
+	Projection Projection
 
-func (r *BwPngVisualizer) Visualize(history *History, bounds *BoundingBox, width int, height int) (*[]byte, error) {
-	return imageToPNGBytes(r.makeImage(history, bounds, width, height))
+	// Told how many points have been drawn, and when encoding starts.  May
+	// be nil.
+	Progress ProgressFunc
+}
+
+func (r *BwPngVisualizer) Visualize(ctx context.Context, history *History, bounds *BoundingBox, width int, height int) (*[]byte, error) {
+	img := r.makeImage(ctx, history, bounds, width, height)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.Progress.report(ProgressEvent{Stage: PROGRESS_ENCODING})
+	return imageToPNGBytes(img)
 }
 
 // Seam for testing
-func (r *BwPngVisualizer) makeImage(history *History, bounds *BoundingBox, width int, height int) image.Image {
-	grid := aggregateHistory(history, bounds, width, height)
+func (r *BwPngVisualizer) makeImage(ctx context.Context, history *History, bounds *BoundingBox, width int, height int) image.Image {
+	grid := aggregateProjectedHistory(history, newProjectedPixelMapping(bounds, r.Projection, width, height),
+		newProgressCounter(ctx, r.Progress, history.Len()))
 	intensityGrid := formatAsIntensityGrid(grid, width, height)
 	return intensityGridToBWImage(intensityGrid)
 }
 
 func aggregateHistory(history *History, bounds *BoundingBox, gridWidth int, gridHeight int) *Grid {
-	grid := NewGrid(gridWidth, gridHeight)
+	return aggregateProjectedHistory(history, newPixelMapping(bounds, gridWidth, gridHeight), nil)
+}
+
+// Counts the points in each pixel of the mapping.  Stops early if the
+// counter says so.
+func aggregateProjectedHistory(history *History, mapping *pixelMapping, counter *progressCounter) *Grid {
+	grid := NewGrid(mapping.width, mapping.height)
+
+	for i := 0; i < history.Len() && counter.inc(); i++ {
+		if mapping.bounds.Contains(history.At(i)) {
+			grid.Inc(mapping.bucket(history.At(i)))
+		}
+	}
+
+	return grid
+}
+
+// ======================================
+// === PIXEL MAPPING (HELPER CLASS) =====
+// ======================================
+
+// Maps coordinates within a BoundingBox onto the pixels of an image, by way of
+// a Projection.
+type pixelMapping struct {
+	bounds     *BoundingBox
+	projection Projection
+
+	// The projected extent of the bounds.
+	minX, minY   float64
+	spanX, spanY float64
+
+	width, height  int
+	xScale, yScale float64
+}
+
+func newPixelMapping(bounds *BoundingBox, width, height int) *pixelMapping {
+	return newProjectedPixelMapping(bounds, nil, width, height)
+}
+
+// A nil projection means equirectangular.
+func newProjectedPixelMapping(bounds *BoundingBox, projection Projection, width, height int) *pixelMapping {
+	if projection == nil {
+		projection = &equirectangularProjection{reversed: bounds.isReversed()}
+	}
+	minX, minY, maxX, maxY := projectedExtent(projection, bounds)
 
 	// For now, we always generate a square output image
 	// but the selected box probably isn't exactly square.
@@ -66,8 +139,8 @@ func aggregateHistory(history *History, bounds *BoundingBox, gridWidth int, grid
 	// Figure out which dimension to constrict, and how much
 	// to construct it by.
 
-	inputSkew := bounds.Width() / bounds.Height()
-	outputSkew := float64(gridWidth) / float64(gridHeight)
+	inputSkew := (maxX - minX) / (maxY - minY)
+	outputSkew := float64(width) / float64(height)
 	xScale := 1.0
 	yScale := 1.0
 
@@ -77,19 +150,128 @@ func aggregateHistory(history *History, bounds *BoundingBox, gridWidth int, grid
 		xScale = inputSkew / outputSkew
 	}
 
-	for i := 0; i < history.Len(); i++ {
-		if bounds.Contains(history.At(i)) {
-			xBucket := int(bounds.WidthFraction(history.At(i)) * xScale * float64(gridWidth))
-			yBucket := int(bounds.HeightFraction(history.At(i)) * yScale * float64(gridHeight))
-			// TODO(mrjones): explain this
-			yBucket = gridHeight - yBucket - 1
-			grid.Inc(xBucket, yBucket)
+	return &pixelMapping{
+		bounds:     bounds,
+		projection: projection,
+		minX:       minX,
+		minY:       minY,
+		spanX:      maxX - minX,
+		spanY:      maxY - minY,
+		width:      width,
+		height:     height,
+		xScale:     xScale,
+		yScale:     yScale,
+	}
+}
+
+// Number of points sampled along each edge of a box, to find its projected
+// extent.
+const EXTENT_SAMPLES_PER_EDGE = 32
+
+// Returns the smallest rectangle (in projected coordinates) containing the
+// whole box.  The corners are projected exactly, which is all that's needed
+// for the cylindrical projections, but the edges of a box can bulge outwards
+// in the others, so points along them are sampled too.
+func projectedExtent(projection Projection, bounds *BoundingBox) (minX, minY, maxX, maxY float64) {
+	ll, ur := bounds.LowerLeft(), bounds.UpperRight()
+	minX, minY = projection.Project(&ll)
+	maxX, maxY = projection.Project(&ur)
+	if minX > maxX {
+		minX, maxX = maxX, minX
+	}
+	if minY > maxY {
+		minY, maxY = maxY, minY
+	}
+
+	include := func(lat, lng float64) {
+		if lng > 180 {
+			lng -= 360
 		}
+		x, y := projection.Project(&Coordinate{Lat: lat, Lng: lng})
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	include(ll.Lat, ur.Lng)
+	include(ur.Lat, ll.Lng)
+	for i := 1; i < EXTENT_SAMPLES_PER_EDGE; i++ {
+		t := float64(i) / EXTENT_SAMPLES_PER_EDGE
+		lat := ll.Lat + t*bounds.Height()
+		lng := ll.Lng + t*bounds.Width()
+		include(lat, ll.Lng)
+		include(lat, ur.Lng)
+		include(ll.Lat, lng)
+		include(ur.Lat, lng)
 	}
+	return minX, minY, maxX, maxY
+}
 
-	return grid
+// The fraction of the way across and up the image that 'c' lies, with (0, 0)
+// at the bottom left.
+func (m *pixelMapping) fractions(c *Coordinate) (fx, fy float64) {
+	x, y := m.projection.Project(c)
+	return (x - m.minX) / m.spanX, (y - m.minY) / m.spanY
+}
+
+// Returns the pixel containing 'c'.  (0, 0) is the top left of the image.
+func (m *pixelMapping) bucket(c *Coordinate) (x, y int) {
+	fx, fy := m.fractions(c)
+	x = int(fx * m.xScale * float64(m.width))
+	y = int(fy * m.yScale * float64(m.height))
+	// Image rows count down from the top, but latitude counts up from the bottom.
+	return x, m.height - y - 1
+}
+
+// Like bucket, but without rounding to whole pixels (nor clamping to the
+// image).  Pixel (i, j) covers [i, i+1) x [j, j+1).
+func (m *pixelMapping) position(c *Coordinate) (x, y float64) {
+	fx, fy := m.fractions(c)
+	x = fx * m.xScale * float64(m.width)
+	y = fy * m.yScale * float64(m.height)
+	return x, float64(m.height) - y
+}
+
+// For projections which wrap around (see Projection.Period), how many pixels
+// wide one full trip around the globe is.  0 otherwise.
+func (m *pixelMapping) periodPixels() float64 {
+	return m.projection.Period() / m.spanX * m.xScale * float64(m.width)
+}
+
+// Returns the horizontal distance, in pixels, between two points if you take
+// the short way around the globe, and whether that differs from the distance
+// between their positions on the map (i.e. the map itself wraps somewhere in
+// between them).
+func (m *pixelMapping) wrappedDx(from, to *Coordinate) (dx float64, wraps bool) {
+	x1, _ := m.position(from)
+	x2, _ := m.position(to)
+	period := m.periodPixels()
+	if period == 0 {
+		return x2 - x1, false
+	}
+	dx = math.Remainder(to.Lng-from.Lng, 360) / 360 * period
+	return dx, math.Abs((x2-x1)-dx) > period/2
+}
+
+// Approximate ground distance covered by one pixel, in meters, measured
+// horizontally and vertically at the middle of the box.
+func (m *pixelMapping) metersPerPixel() (x, y float64) {
+	center := boxCenter(m.bounds)
+	east := &Coordinate{Lat: center.Lat, Lng: center.Lng + m.bounds.Width()/1000}
+	if east.Lng > 180 {
+		east.Lng -= 360
+	}
+	north := &Coordinate{Lat: center.Lat + m.bounds.Height()/1000, Lng: center.Lng}
+
+	cx, cy := m.position(center)
+	ex, ey := m.position(east)
+	nx, ny := m.position(north)
+	x = center.DistanceTo(east) / math.Hypot(ex-cx, ey-cy)
+	y = center.DistanceTo(north) / math.Hypot(nx-cx, ny-cy)
+	return x, y
 }
 
+// Meters per degree of latitude (and of longitude, at the equator).
+const METERS_PER_DEGREE = 111320.0
+
 func scaleHeat(input int) float64 {
 	return float64(math.Sqrt(math.Sqrt(float64(input))))
 }
@@ -138,6 +320,85 @@ func intensityGridToBWImage(intensityGrid *IntensityGrid) image.Image {
 	return img
 }
 
+// ======================================
+// ======== COLOR PNG VISUALIZER ========
+// ======================================
+
+// Renders a heatmap, mapping each pixel's intensity through a Palette.
+//
+// If Transparent is set, pixels without any points are left fully transparent
+// (rather than taking the palette's lowest color), so that the image can be
+// overlaid on a basemap.
+type ColorPngVisualizer struct {
+	Palette     *Palette
+	Transparent bool
+
+	// Defaults to equirectangular.
+	Projection Projection
+
+	// Told how many points have been drawn, and when encoding starts.  May
+	// be nil.
+	Progress ProgressFunc
+}
+
+func init() {
+	RegisterVisualizer(&VisualizerStyle{
+		Name:        "heatmap",
+		Description: "Colors each pixel by how many points it contains",
+		ContentType: "image/png",
+		Extension:   "png",
+		Options:     []VisualizerOption{sizeOption, paletteOption(DEFAULT_PALETTE), transparentOption},
+		New: func(options VisualizerOptions, projection Projection, progress ProgressFunc) (Visualizer, error) {
+			palette, err := options.Palette("palette")
+			if err != nil {
+				return nil, err
+			}
+			return &ColorPngVisualizer{
+				Palette:     palette,
+				Transparent: options.Bool("transparent"),
+				Projection:  projection,
+				Progress:    progress,
+			}, nil
+		},
+	})
+}
+
+func (r *ColorPngVisualizer) Visualize(ctx context.Context, history *History, bounds *BoundingBox, width int, height int) (*[]byte, error) {
+	img := r.makeImage(ctx, history, bounds, width, height)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.Progress.report(ProgressEvent{Stage: PROGRESS_ENCODING})
+	return imageToPNGBytes(img)
+}
+
+// Seam for testing
+func (r *ColorPngVisualizer) makeImage(ctx context.Context, history *History, bounds *BoundingBox, width int, height int) image.Image {
+	grid := aggregateProjectedHistory(history, newProjectedPixelMapping(bounds, r.Projection, width, height),
+		newProgressCounter(ctx, r.Progress, history.Len()))
+	intensityGrid := formatAsIntensityGrid(grid, width, height)
+	return intensityGridToColorImage(intensityGrid, r.Palette, r.Transparent)
+}
+
+func intensityGridToColorImage(intensityGrid *IntensityGrid, palette *Palette, transparent bool) image.Image {
+	width := len(intensityGrid.Points)
+	height := len(intensityGrid.Points[0])
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for i := 0; i < width; i++ {
+		for j := 0; j < height; j++ {
+			val := intensityGrid.Points[i][j]
+			if transparent && !(val > 0) {
+				img.SetNRGBA(i, j, color.NRGBA{})
+			} else {
+				img.SetNRGBA(i, j, palette.At(val))
+			}
+		}
+	}
+
+	return img
+}
+
 func imageToPNGBytes(img image.Image) (*[]byte, error) {
 	buffer := bytes.NewBuffer(make([]byte, 0))
 
@@ -188,82 +449,3 @@ func (g *Grid) Width() int {
 func (g *Grid) Height() int {
 	return g.height
 }
-
-// ======================================
-// =========== SVG VISUALIZER ===========
-// ======================================
-
-type SvgVisualizer struct{}
-
-func histogram(grid *Grid, resolution int64) {
-	max := int64(0)
-	sum := int64(0)
-	count := int64(0)
-	for x := 0 ; x < grid.Width(); x++ {
-		for y := 0 ; y < grid.Height(); y++ {
-			d := int64(grid.Get(x,y))
-			if d > max {
-				max = d
-			}
-			if d > 0 {
-				count++
-			}
-			sum += d
-		}
-	}
-
-	fmt.Printf("Max: %d\n", max)
-	fmt.Printf("Sum: %d\n", sum)
-
-	numBuckets := (max / resolution) + 1
-	buckets := make([]int64, numBuckets)
-	fmt.Printf("NumBuckets: %d\n", numBuckets)
-	for x := 0 ; x < grid.Width(); x++ {
-		for y := 0 ; y < grid.Height(); y++ {
-			d := int64(grid.Get(x,y))
-			if d > 0 {
-//				fmt.Printf("%d -> %d\n", d, d/resolution)
-				buckets[d / resolution]++
-			}
-		}
-	}
-
-
-	acc := int64(0)
-	for i := int64(0) ; i < numBuckets; i++ {
-		acc += buckets[i]
-		if buckets[i] > 0 {
-			fmt.Printf("%4d - %4d: %4d (%2.2f)\n", i * resolution, (i + 1) * resolution - 1, buckets[i], 100.0 * float64(acc) / float64(count))
-		}
-	}
-}
-
-func (s *SvgVisualizer) Visualize(history *History, bounds *BoundingBox, width int, height int) (*[]byte, error) {
-	grid := aggregateHistory(history, bounds, width, height)
-	histogram(grid, 5)
-
-	var buf bytes.Buffer
-
-	buf.WriteString("<svg xmlns=\"http://www.w3.org/2000/svg\" version=\"1.1\">")
-	for x := 0 ; x < grid.Width(); x++ {
-		for y := 0 ; y < grid.Height(); y++ {
-			if grid.Get(x,y) > 0 {
-//				r := (float64(grid.Get(x,y)) / 10) + 3
-//				if (r < 3) { r = 3 }
-//				if (r > 5) { r = 5 }
-
-				cnt := grid.Get(x,y)
-				r := 5 / (1 + math.Pow(math.E, -(float64(cnt)/10.0)))
-				
-				buf.WriteString(fmt.Sprintf(
-					"<circle cx=\"%d\" cy=\"%d\" r=\"%.1f\" style=\"fill:rgb(0,0,0);\"/>", x * 10 , y * 10, r));
-//				buf.WriteString(fmt.Sprintf(
-//				"<rect x=\"%d\" y=\"%d\" width=\"3\" height=\"3\" style=\"fill:rgb(99,99,99);stroke-width:1;stroke:rgb(0,0,0)\" />", x * 3 , y * 3));
-			}
-		}
-	}
-	buf.WriteString("</svg>")
-
-	dataBytes := buf.Bytes();
-	return &dataBytes, nil
-}